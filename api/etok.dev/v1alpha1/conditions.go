@@ -5,6 +5,15 @@ const (
 	RunCompleteCondition    = "Complete"
 	WorkspaceReadyCondition = "Ready"
 
+	// TerraformInstalled reports whether the workspace's version of terraform
+	// is installed on its cache
+	WorkspaceTerraformInstalledCondition = "TerraformInstalled"
+	// CacheReady reports whether the workspace's cache matches its spec
+	WorkspaceCacheReadyCondition = "CacheReady"
+	// CredentialsReady reports whether the workspace's credential secrets
+	// exist
+	WorkspaceCredentialsReadyCondition = "CredentialsReady"
+
 	PodCreatedReason        = "PodCreated"
 	PodPendingReason        = "PodPending"
 	PodUnknownReason        = "PodUnknown"
@@ -17,6 +26,26 @@ const (
 	QueueTimeoutReason      = "QueueTimeout"
 	RunPendingTimeoutReason = "PodPendingTimeout"
 	WorkspaceNotFoundReason = "WorkspaceNotFound"
+	RunCancelledReason      = "Cancelled"
+	PodRetryingReason       = "PodRetrying"
+	PodEvictedReason        = "PodEvicted"
+	ImagePullFailedReason   = "ImagePullFailed"
+	// A container's configuration could not be created, e.g. a secret it
+	// references is missing
+	ContainerConfigFailedReason = "ContainerConfigFailed"
+
+	InstallingReason             = "Installing"
+	InstalledReason              = "Installed"
+	ReinstallPendingReason       = "ReinstallPending"
+	CacheProvisioningReason      = "Provisioning"
+	CacheBoundReason             = "Bound"
+	CacheResizingReason          = "Resizing"
+	CacheResizeUnsupportedReason = "ResizeUnsupported"
+	CacheMigratingReason         = "Migrating"
+	CacheMigrationPendingReason  = "MigrationPending"
+	CacheMigrationFailedReason   = "MigrationFailed"
+	SecretsFoundReason           = "SecretsFound"
+	SecretNotFoundReason         = "SecretNotFound"
 
 	// Pending means whatever is being observed is reported to be progressing
 	// towards a non-failure state.
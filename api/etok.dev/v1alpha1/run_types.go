@@ -1,12 +1,14 @@
 package v1alpha1
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
@@ -70,10 +72,71 @@ type RunSpec struct {
 	// Logging verbosity.
 	Verbosity int `json:"verbosity,omitempty"`
 
+	// Paths to files on the pod to be returned to the client once the command
+	// has completed successfully. Relative paths are relative to the root
+	// module.
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// +kubebuilder:validation:Enum={"interrupt","kill"}
+
+	// Request cancellation of the run. If the command is running, interrupt
+	// sends it an interrupt signal, permitting it to exit gracefully, whereas
+	// kill terminates it immediately. A run that is yet to start is cancelled
+	// regardless.
+	Cancel RunCancelMode `json:"cancel,omitempty"`
+
+	// Policy for retrying the run's pod upon infrastructure failures
+	RetryPolicy RetryPolicy `json:"retryPolicy,omitempty"`
+
 	// AttachSpec defines behaviour for clients attaching to the pod's TTY
 	AttachSpec `json:",inline"`
 }
 
+// A RunCancelMode determines how a running command is cancelled
+type RunCancelMode string
+
+const (
+	// Interrupt: send the command an interrupt signal
+	RunCancelInterrupt RunCancelMode = "interrupt"
+	// Kill: send the command a kill signal
+	RunCancelKill RunCancelMode = "kill"
+)
+
+// IsCancelled checks if cancellation of the run has been requested
+func (r *Run) IsCancelled() bool {
+	return r.Cancel != ""
+}
+
+// RetryPolicy determines whether a run's pod is re-created upon infrastructure
+// failures, such as eviction or failing to pull its image. Only failures that
+// occur before the pod's runner container has started are retried: once it has
+// started the command may have altered state.
+type RetryPolicy struct {
+	// +kubebuilder:validation:Minimum=0
+
+	// Maximum number of times the pod is retried. Defaults to none.
+	Limit int `json:"limit,omitempty"`
+
+	// Retry the pod if it remains pending for longer than this duration, or,
+	// without retries, fail the run. Defaults to ten minutes.
+	PendingTimeout string `json:"pendingTimeout,omitempty"`
+}
+
+// RunRetry records a failed attempt at running a run's pod, which was retried
+type RunRetry struct {
+	// UID of the failed attempt's pod
+	PodUID types.UID `json:"podUID"`
+
+	// Reason the attempt failed
+	Reason string `json:"reason"`
+
+	// Details of the failure
+	Message string `json:"message,omitempty"`
+
+	// Time at which the failure was observed
+	Time metav1.Time `json:"time"`
+}
+
 // AttachSpec defines behaviour for clients attaching to the pod's TTY
 type AttachSpec struct {
 	// Enable TTY on pod and await handshake string from client
@@ -92,7 +155,26 @@ func (r *Run) ApprovedAnnotationKey() string {
 	return ApprovedAnnotationKey(r.Name)
 }
 
-const ApprovedAnnotationKeyPrefix = "approvals.etok.dev"
+const (
+	ApprovedAnnotationKeyPrefix = "approvals.etok.dev"
+
+	// GitCommitAnnotationKey is the key of the run annotation recording the
+	// SHA of the git commit checked out on the client
+	GitCommitAnnotationKey = "etok.dev/git-commit"
+	// GitDirtyAnnotationKey is the key of the run annotation recording whether
+	// the client's git repository had uncommitted changes
+	GitDirtyAnnotationKey = "etok.dev/git-dirty"
+
+	// VCSRepositoryAnnotationKey is the key of the annotation recording the
+	// repository of a run triggered by a VCS webhook
+	VCSRepositoryAnnotationKey = "etok.dev/vcs-repository"
+	// VCSPullRequestAnnotationKey is the key of the annotation recording the
+	// number of the pull request that triggered a run
+	VCSPullRequestAnnotationKey = "etok.dev/vcs-pull-request"
+	// VCSStatusAnnotationKey is the key of the annotation recording the last
+	// commit status reported for a run triggered by a VCS webhook
+	VCSStatusAnnotationKey = "etok.dev/vcs-status"
+)
 
 func ApprovedAnnotationKey(runName string) string {
 	return fmt.Sprintf("%s/%s", ApprovedAnnotationKeyPrefix, runName)
@@ -105,12 +187,35 @@ func GetRunFromApprovalAnnotationKey(key string) string {
 // Run's pod shares its name
 func (r *Run) PodName() string { return r.Name }
 
-func (r *Run) LockFileConfigMapName() string {
-	return RunLockFileConfigMapName(r.Name)
+func (r *Run) ArtifactsConfigMapName() string {
+	return RunArtifactsConfigMapName(r.Name)
+}
+
+// RunArtifactsConfigMapName returns the name of the config map in which the
+// artifacts of the named run are stored.
+func RunArtifactsConfigMapName(name string) string {
+	return name + "-artifacts"
 }
 
-func RunLockFileConfigMapName(name string) string {
-	return name + "-lockfile"
+// ArtifactKey returns the config map key under which the artifact with the
+// given path is stored. Config map keys cannot contain slashes, so the path is
+// encoded.
+func ArtifactKey(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+// ArchiveConfigMapName returns the name of the config map storing a
+// workspace's archive with the given content hash. Runs with identical config
+// share the same archive.
+func ArchiveConfigMapName(workspace, hash string) string {
+	return fmt.Sprintf("archive-%s-%s", workspace, hash)
+}
+
+// BatchArchiveConfigMapName returns the name of the config map storing an
+// archive shared by a batch of runs across workspaces, with the given content
+// hash.
+func BatchArchiveConfigMapName(hash string) string {
+	return fmt.Sprintf("archive-%s", hash)
 }
 
 // RunStatus defines the observed state of Run
@@ -122,6 +227,20 @@ type RunStatus struct {
 
 	// Exit code of run pod's runner container
 	ExitCode *int `json:"exitCode,omitempty"`
+
+	// Failed attempts at running the run's pod that were retried, in order
+	Retries []RunRetry `json:"retries,omitempty"`
+}
+
+// IsRetriedPod checks if the pod with the given UID is a failed attempt that
+// has been retried
+func (r *Run) IsRetriedPod(uid types.UID) bool {
+	for _, retry := range r.Retries {
+		if retry.PodUID == uid {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Run) IsReconciled() bool {
@@ -158,6 +277,9 @@ const (
 	RunPhaseCompleted RunPhase = "completed"
 	// Failed: a fatal error occurred and the run will not be completed
 	RunPhaseFailed RunPhase = "failed"
+	// Cancelled: run was cancelled, either before its pod was created, or
+	// while its command was running
+	RunPhaseCancelled RunPhase = "cancelled"
 
 	RunDefaultConfigMapKey = "config.tar.gz"
 )
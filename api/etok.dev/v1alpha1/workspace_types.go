@@ -2,6 +2,7 @@ package v1alpha1
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/leg100/etok/pkg/util/slice"
 	corev1 "k8s.io/api/core/v1"
@@ -9,6 +10,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// Any change to the default terraform version must also be made to the
+	// default marker on WorkspaceSpec.TerraformVersion
+	DefaultTerraformVersion = "0.14.3"
+	DefaultCacheSize        = "1Gi"
+)
+
 func init() {
 	SchemeBuilder.Register(&Workspace{}, &WorkspaceList{})
 }
@@ -66,6 +74,10 @@ type WorkspaceSpec struct {
 	// Required version of Terraform on workspace pod
 	TerraformVersion string `json:"terraformVersion,omitempty"`
 
+	// URL of mirror from which to download terraform. Defaults to the
+	// operator's mirror.
+	TerraformMirror string `json:"terraformMirror,omitempty"`
+
 	// Variables as inputs to module
 	Variables []*Variable `json:"variables,omitempty"`
 
@@ -73,10 +85,134 @@ type WorkspaceSpec struct {
 
 	// GCS bucket to which to backup state file
 	BackupBucket string `json:"backupBucket,omitempty"`
+
+	// Only upload files tracked by git when running commands on the
+	// workspace. Clients may override this setting.
+	GitTrackedOnly bool `json:"gitTrackedOnly,omitempty"`
+
+	// Name of the service account with which the workspace's runs are run.
+	// Defaults to the namespace's etok service account. The operator creates
+	// the service account if it does not exist, and grants it the permissions
+	// necessary for runs.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Annotations to set on the workspace's service account, e.g. to bind it
+	// to a cloud identity. Only applies to a service account created by the
+	// operator for the workspace.
+	ServiceAccountAnnotations map[string]string `json:"serviceAccountAnnotations,omitempty"`
+
+	// Secrets containing credentials to provide to the workspace's runs,
+	// either as environment variables or as files. If none are specified then
+	// the namespace's etok secret, if it exists, is provided as environment
+	// variables.
+	CredentialSecrets []CredentialSecret `json:"credentialSecrets,omitempty"`
+
+	// +kubebuilder:validation:Enum={"kubernetes","http"}
+	// +kubebuilder:default="kubernetes"
+
+	// Terraform backend in which state is stored. Kubernetes uses terraform's
+	// kubernetes backend, storing state in a secret. HTTP uses the operator's
+	// state server, storing versions of state in secrets. Changing the backend
+	// from kubernetes to http migrates the state.
+	StateBackend StateBackend `json:"stateBackend,omitempty"`
+
+	// +kubebuilder:validation:Enum={"share","wait","isolate"}
+	// +kubebuilder:default="wait"
+
+	// How runs with read-only commands, such as plan, are scheduled alongside
+	// runs with queueable commands, such as apply. Wait enqueues read-only
+	// runs too: they run concurrently with one another, but never alongside an
+	// active queueable run. Isolate runs them straight away, each with its own
+	// copy of the .terraform directory. Share runs them straight away, sharing
+	// the .terraform directory with other runs, which is unsafe: an init may
+	// alter it from under them. Share is retained for backwards compatibility.
+	ReaderPolicy ReaderPolicy `json:"readerPolicy,omitempty"`
+
+	// Repository in a version control system to which the workspace is
+	// connected. The operator plans pull requests against the repository, and
+	// optionally applies changes merged to its default branch. Requires the
+	// operator's VCS webhook receiver to be enabled.
+	VCS *VCSSpec `json:"vcs,omitempty"`
+}
+
+// VCSSpec connects a workspace to a repository in a version control system
+type VCSSpec struct {
+	// Repository, in the form owner/name. GitLab repositories may include
+	// subgroups, e.g. group/subgroup/name.
+	Repository string `json:"repository"`
+
+	// Path to the root module relative to the root of the repository.
+	// Defaults to the root of the repository.
+	Path string `json:"path,omitempty"`
+
+	// Apply changes merged to the repository's default branch.
+	ApplyOnMerge bool `json:"applyOnMerge,omitempty"`
+
+	// Plan pull requests from forks of the repository. Their code is run
+	// with the workspace's credentials, so only enable this if forks are
+	// trusted.
+	AllowForks bool `json:"allowForks,omitempty"`
+}
+
+// StateBackend determines where a workspace's state is stored
+type StateBackend string
+
+const (
+	StateBackendKubernetes StateBackend = "kubernetes"
+	StateBackendHTTP       StateBackend = "http"
+)
+
+// ReaderPolicy determines how runs with read-only commands are scheduled
+type ReaderPolicy string
+
+const (
+	// ReaderPolicyShare is unsafe, and retained for backwards compatibility
+	ReaderPolicyShare   ReaderPolicy = "share"
+	ReaderPolicyWait    ReaderPolicy = "wait"
+	ReaderPolicyIsolate ReaderPolicy = "isolate"
+)
+
+// CredentialSecret references a secret in the workspace's namespace to provide
+// to the workspace's runs
+type CredentialSecret struct {
+	// Name of the secret
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:Enum={"env","file"}
+	// +kubebuilder:default="env"
+
+	// How the secret is provided. Env provides each key as an environment
+	// variable. File mounts each key as a file.
+	Type CredentialSecretType `json:"type,omitempty"`
+
+	// Directory on which to mount the secret's files. Defaults to
+	// /credentials/<name>. Only applies to the file type.
+	MountPath string `json:"mountPath,omitempty"`
+
+	// Map keys to paths relative to the mount path. If specified, only the
+	// listed keys are mounted. Only applies to the file type.
+	Items []corev1.KeyToPath `json:"items,omitempty"`
 }
 
+// CredentialSecretType determines how a credential secret is provided to runs
+type CredentialSecretType string
+
+const (
+	CredentialSecretTypeEnv  CredentialSecretType = "env"
+	CredentialSecretTypeFile CredentialSecretType = "file"
+)
+
 // WorkspaceSpec defines the desired state of Workspace's cache storage
 type WorkspaceCacheSpec struct {
+	// +kubebuilder:validation:Enum={"pinned","shared","ephemeral"}
+	// +kubebuilder:default="pinned"
+
+	// How the cache is provisioned. Pinned uses a ReadWriteOnce persistent
+	// volume that is kept attached to a node by the workspace pod. Shared uses
+	// a ReadWriteMany persistent volume. Ephemeral provisions an empty cache
+	// for each run.
+	Mode CacheMode `json:"mode,omitempty"`
+
 	// Storage class for the cache's persistent volume claim. This is a pointer
 	// to distinguish between explicit empty string and nil (which triggers
 	// different behaviour for dynamic provisioning of persistent volumes).
@@ -86,8 +222,26 @@ type WorkspaceCacheSpec struct {
 
 	// Size of cache's persistent volume claim.
 	Size string `json:"size,omitempty"`
+
+	// Share a provider plugin cache with other workspaces in the namespace.
+	// Only takes effect if the operator has enabled the shared plugin cache.
+	SharedPlugins bool `json:"sharedPlugins,omitempty"`
+
+	// Delete the workspace pod once the workspace has had no runs for this
+	// duration (e.g. 30m), and re-create it on the next run. Only applies to
+	// the pinned mode. Empty means the pod is never deleted.
+	IdleTimeout string `json:"idleTimeout,omitempty"`
 }
 
+// CacheMode determines how a workspace's cache is provisioned
+type CacheMode string
+
+const (
+	CacheModePinned    CacheMode = "pinned"
+	CacheModeShared    CacheMode = "shared"
+	CacheModeEphemeral CacheMode = "ephemeral"
+)
+
 // WorkspaceStatus defines the observed state of Workspace
 type WorkspaceStatus struct {
 	// Queue of runs. Only runs with queueable commands (sh, apply, etc) are
@@ -96,6 +250,10 @@ type WorkspaceStatus struct {
 
 	Active string `json:"active,omitempty"`
 
+	// Runs with read-only commands that are permitted to run concurrently with
+	// one another. Empty whenever there is an active run.
+	Readers []string `json:"readers,omitempty"`
+
 	// Lifecycle phase of workspace.
 	Phase WorkspacePhase `json:"phase,omitempty"`
 
@@ -110,6 +268,36 @@ type WorkspaceStatus struct {
 	BackupSerial *int `json:"backupSerial,omitempty"`
 
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The generation of the workspace spec last reconciled by the operator.
+	// Only recorded once the workspace is ready, i.e. once any reconfiguration
+	// the spec calls for has completed.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The state backend in use. Differs from the spec until the state has been
+	// migrated.
+	StateBackend StateBackend `json:"stateBackend,omitempty"`
+
+	// Lock held on the state. Nil means the state is unlocked.
+	Lock *WorkspaceLock `json:"lock,omitempty"`
+}
+
+// WorkspaceLock describes a lock held by terraform on the workspace's state
+type WorkspaceLock struct {
+	// Lock ID
+	ID string `json:"id"`
+
+	// Run holding the lock. Empty if the lock is not held by a run.
+	Run string `json:"run,omitempty"`
+
+	// Who is holding the lock, in the form user@host
+	Who string `json:"who,omitempty"`
+
+	// Terraform operation for which the lock is held
+	Operation string `json:"operation,omitempty"`
+
+	// When the lock was acquired
+	Since *metav1.Time `json:"since,omitempty"`
 }
 
 // Variable denotes an input to the module
@@ -149,10 +337,45 @@ func (ws *Workspace) PodName() string {
 	return WorkspacePodName(ws.Name)
 }
 
+// CacheMode returns the workspace's cache mode, defaulting to the pinned mode
+func (ws *Workspace) CacheMode() CacheMode {
+	if ws.Spec.Cache.Mode == "" {
+		return CacheModePinned
+	}
+	return ws.Spec.Cache.Mode
+}
+
+// ReaderPolicy returns the workspace's reader policy, defaulting to the wait
+// policy
+func (ws *Workspace) ReaderPolicy() ReaderPolicy {
+	if ws.Spec.ReaderPolicy == "" {
+		return ReaderPolicyWait
+	}
+	return ws.Spec.ReaderPolicy
+}
+
+// ActiveRuns returns the runs that are permitted to run: either the active run
+// or the active readers
+func (ws *Workspace) ActiveRuns() []string {
+	if ws.Status.Active != "" {
+		return []string{ws.Status.Active}
+	}
+	return ws.Status.Readers
+}
+
 func (ws *Workspace) PVCName() string {
 	return ws.Name
 }
 
+// StateBackend returns the state backend in use, defaulting to the kubernetes
+// backend
+func (ws *Workspace) StateBackend() StateBackend {
+	if ws.Status.StateBackend == "" {
+		return StateBackendKubernetes
+	}
+	return ws.Status.StateBackend
+}
+
 // StateSecretName retrieves the name of the secret containing the terraform
 // state for this workspace.
 func (ws *Workspace) StateSecretName() string {
@@ -165,6 +388,12 @@ func (ws *Workspace) BackupObjectName() string {
 	return fmt.Sprintf("%s/%s.yaml", ws.Namespace, ws.Name)
 }
 
+// StateFileBackupObjectName returns the object name to be used for the backup
+// of the workspace's state file when using the HTTP backend.
+func (ws *Workspace) StateFileBackupObjectName() string {
+	return fmt.Sprintf("%s/%s.tfstate", ws.Namespace, ws.Name)
+}
+
 func (ws *Workspace) BuiltinsConfigMapName() string {
 	return WorkspaceBuiltinsConfigMapName(ws.Name)
 }
@@ -200,3 +429,22 @@ const (
 	WorkspacePhaseUnknown      WorkspacePhase = "unknown"
 	WorkspacePhaseDeleting     WorkspacePhase = "deleting"
 )
+
+// UnlockAnnotationKey is the key to be set on a workspace's annotations to
+// request the operator release the lock on the workspace's state. Its value is
+// the ID of the lock to be released.
+const UnlockAnnotationKey = "etok.dev/unlock"
+
+// QueueOrderAnnotationKey is the key to be set on a workspace's annotations to
+// request the operator re-order the workspace's queue. Its value is a
+// comma-separated list of run names in the requested order.
+const QueueOrderAnnotationKey = "etok.dev/queue-order"
+
+// QueueOrder returns the requested order of the workspace's queue, or nil if no
+// order has been requested
+func (ws *Workspace) QueueOrder() []string {
+	if order, ok := ws.Annotations[QueueOrderAnnotationKey]; ok && order != "" {
+		return strings.Split(order, ",")
+	}
+	return nil
+}
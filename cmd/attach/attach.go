@@ -0,0 +1,188 @@
+package attach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/globals"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/k8s"
+	"github.com/leg100/etok/pkg/logstreamer"
+	"github.com/leg100/etok/pkg/monitors"
+	"github.com/spf13/cobra"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/kubectl/pkg/util/term"
+)
+
+const (
+	defaultNamespace = "default"
+
+	// Long enough for the runner's readiness probe, run every second, to
+	// report a handshake it has already received
+	defaultHandshakeGrace = 2 * time.Second
+
+	handshakePollInterval = 200 * time.Millisecond
+)
+
+var errRunNotFound = errors.New("run not found")
+
+type attachOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	runName string
+
+	// Disable TTY detection
+	disableTTY bool
+	// Timeout for run's pod to be running
+	podTimeout time.Duration
+	// Time to wait for the runner to report it has received the handshake
+	// before concluding it is still awaiting one
+	handshakeGrace time.Duration
+}
+
+func AttachCmd(f *cmdutil.Factory) (*cobra.Command, *attachOptions) {
+	o := &attachOptions{
+		Factory:        f,
+		namespace:      defaultNamespace,
+		handshakeGrace: defaultHandshakeGrace,
+	}
+	cmd := &cobra.Command{
+		Use:   "attach <run>",
+		Short: "Attach to a run",
+		Long: `Re-connect to a run, e.g. one launched with --detach, or one whose client was interrupted. If the
+run was launched with a TTY and a TTY is detected, the client is attached to the run's TTY, permitting
+input, and sends the handshake the run awaits if the client that launched it exited beforehand. Otherwise the run's logs are streamed. Once the run completes, its exit code is returned.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.runName = args[0]
+
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, nil)
+			if err != nil {
+				return err
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().BoolVar(&o.disableTTY, "no-tty", false, "disable tty")
+	cmd.Flags().DurationVar(&o.podTimeout, "pod-timeout", time.Hour, "timeout for pod to be ready and running")
+
+	return cmd, o
+}
+
+func (o *attachOptions) run(ctx context.Context) error {
+	if _, err := o.RunsClient(o.namespace).Get(ctx, o.runName, metav1.GetOptions{}); err != nil {
+		if kerrors.IsNotFound(err) {
+			return fmt.Errorf("%w: %s/%s", errRunNotFound, o.namespace, o.runName)
+		}
+		return err
+	}
+
+	// Wait for the run's pod to be running, or to have already completed
+	run, err := o.waitForPod(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Watch the run for the container's exit code. Non-blocking.
+	exit := monitors.RunExitMonitor(ctx, o.EtokClient, o.namespace, o.runName)
+
+	// Only a running pod with a TTY can be attached to
+	if !o.disableTTY && run.Handshake && !run.IsDone() && term.IsTerminal(o.In) {
+		// Only send the handshake if the runner is still awaiting one, i.e.
+		// the client that launched the run exited before sending it
+		var handshake string
+		awaiting, err := o.awaitingHandshake(ctx, run)
+		if err != nil {
+			return err
+		}
+		if awaiting {
+			handshake = cmdutil.HandshakeString
+		}
+		if err := o.AttachFunc(o.Out, *o.Config, o.namespace, o.runName, o.In.(*os.File), handshake, globals.RunnerContainerName); err != nil {
+			return err
+		}
+	} else {
+		if err := logstreamer.Stream(ctx, o.GetLogsFunc, o.Out, o.PodsClient(o.namespace), o.runName, globals.RunnerContainerName); err != nil {
+			return err
+		}
+	}
+
+	// Await container's exit code
+	select {
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timed out waiting for exit code")
+	case code := <-exit:
+		return code
+	}
+}
+
+// awaitingHandshake determines whether the runner is still awaiting the
+// handshake. The runner container only becomes ready once it has received it.
+func (o *attachOptions) awaitingHandshake(ctx context.Context, run *v1alpha1.Run) (bool, error) {
+	err := wait.PollImmediate(handshakePollInterval, o.handshakeGrace, func() (bool, error) {
+		pod, err := o.PodsClient(o.namespace).Get(ctx, run.PodName(), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if status := k8s.ContainerStatusByName(pod, globals.RunnerContainerName); status != nil {
+			return status.Ready, nil
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return true, nil
+	}
+	return false, err
+}
+
+// waitForPod waits until the run's pod is running or has completed, returning
+// the run at that point
+func (o *attachOptions) waitForPod(ctx context.Context) (*v1alpha1.Run, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.podTimeout)
+	defer cancel()
+
+	lw := &k8s.RunListWatcher{Client: o.EtokClient, Name: o.runName, Namespace: o.namespace}
+	event, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Run{}, nil, handlers.RunConnectable(o.runName, false))
+	if err != nil {
+		return nil, err
+	}
+	return event.Object.(*v1alpha1.Run), nil
+}
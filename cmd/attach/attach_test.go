@@ -0,0 +1,175 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+)
+
+// withRunStatus mocks the run controller, setting the run's pod as running or
+// completed, along with the exit code of the runner container
+func withRunStatus(reason string, code int) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		status := metav1.ConditionFalse
+		if reason != v1alpha1.PodRunningReason {
+			status = metav1.ConditionTrue
+		}
+		run.Conditions = []metav1.Condition{{Type: v1alpha1.RunCompleteCondition, Status: status, Reason: reason}}
+		run.ExitCode = &code
+	}
+}
+
+func withHandshake(run *v1alpha1.Run) {
+	run.Handshake = true
+}
+
+// withRunnerReady sets the runner container as ready, i.e. the runner has
+// received the handshake
+func withRunnerReady(pod *corev1.Pod) {
+	pod.Status.ContainerStatuses[0].Ready = true
+}
+
+func TestAttach(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		objs []runtime.Object
+		// Provide a TTY
+		tty bool
+		err error
+		// Expected output
+		out string
+	}{
+		{
+			name: "stream logs",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", withRunStatus(v1alpha1.PodRunningReason, 0))},
+			out:  "fake logs",
+		},
+		{
+			name: "attach to tty",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{
+				testobj.Run("default", "run-12345", "apply", withHandshake, withRunStatus(v1alpha1.PodRunningReason, 0)),
+				testobj.RunPod("default", "run-12345", withRunnerReady),
+			},
+			tty: true,
+			out: "fake attach without handshake",
+		},
+		{
+			name: "attach to tty awaiting handshake",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{
+				testobj.Run("default", "run-12345", "apply", withHandshake, withRunStatus(v1alpha1.PodRunningReason, 0)),
+				testobj.RunPod("default", "run-12345"),
+			},
+			tty: true,
+			out: "fake attach with handshake",
+		},
+		{
+			name: "disable tty",
+			args: []string{"run-12345", "--no-tty"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", withHandshake, withRunStatus(v1alpha1.PodRunningReason, 0))},
+			tty:  true,
+			out:  "fake logs",
+		},
+		{
+			name: "run without tty",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", withRunStatus(v1alpha1.PodRunningReason, 0))},
+			tty:  true,
+			out:  "fake logs",
+		},
+		{
+			name: "completed run with tty",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", withHandshake, withRunStatus(v1alpha1.PodSucceededReason, 0))},
+			tty:  true,
+			out:  "fake logs",
+		},
+		{
+			name: "non-zero exit code",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", withRunStatus(v1alpha1.PodFailedReason, 2))},
+			out:  "fake logs",
+			err:  etokerrors.NewExitError(2),
+		},
+		{
+			name: "specific namespace",
+			args: []string{"run-12345", "--namespace", "dev"},
+			objs: []runtime.Object{testobj.Run("dev", "run-12345", "apply", withRunStatus(v1alpha1.PodRunningReason, 0))},
+			out:  "fake logs",
+		},
+		{
+			name: "run failed",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunFailedCondition))},
+			err:  handlers.ErrRunFailed,
+		},
+		{
+			name: "run not found",
+			args: []string{"run-12345"},
+			err:  errRunNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// Ensure project file isn't read from the current directory
+			t.NewTempDir().Chdir()
+
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			// Record whether a handshake is sent
+			f.AttachFunc = func(out io.Writer, cfg rest.Config, namespace, name string, in *os.File, handshake, containerName string) error {
+				if handshake == "" {
+					out.Write([]byte("fake attach without handshake"))
+				} else {
+					out.Write([]byte("fake attach with handshake"))
+				}
+				return nil
+			}
+
+			if tt.tty {
+				var err error
+				_, f.In, err = pty.Open()
+				require.NoError(t, err)
+			}
+
+			cmd, opts := AttachCmd(f)
+			opts.handshakeGrace = 10 * time.Millisecond
+			cmd.SetOut(out)
+			cmd.SetArgs(tt.args)
+
+			err := cmd.ExecuteContext(context.Background())
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if tt.out != "" {
+				assert.Contains(t, out.String(), tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package cancel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/spf13/cobra"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const defaultNamespace = "default"
+
+var errRunNotFound = errors.New("run not found")
+
+type cancelOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	runName string
+
+	// Kill the command rather than interrupt it
+	force bool
+}
+
+func CancelCmd(f *cmdutil.Factory) (*cobra.Command, *cancelOptions) {
+	o := &cancelOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+	}
+	cmd := &cobra.Command{
+		Use:   "cancel <run>",
+		Short: "Cancel a run",
+		Long: `Cancel a run. If the run's command is running it is sent an interrupt signal, permitting terraform to
+exit gracefully, releasing any state lock. Cancelling the run again, or passing --force, kills the
+command instead. A run that is yet to start is cancelled straight away.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.runName = args[0]
+
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, nil)
+			if err != nil {
+				return err
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().BoolVar(&o.force, "force", false, "kill the command rather than interrupt it")
+
+	return cmd, o
+}
+
+func (o *cancelOptions) run(ctx context.Context) error {
+	mode, err := o.CancelRun(ctx, o.namespace, o.runName, o.force)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return fmt.Errorf("%w: %s/%s", errRunNotFound, o.namespace, o.runName)
+		}
+		return err
+	}
+
+	switch mode {
+	case v1alpha1.RunCancelInterrupt:
+		fmt.Fprintf(o.Out, "Interrupting run %s (cancel again to kill it)\n", o.runName)
+	case v1alpha1.RunCancelKill:
+		fmt.Fprintf(o.Out, "Killing run %s\n", o.runName)
+	}
+	return nil
+}
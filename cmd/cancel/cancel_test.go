@@ -0,0 +1,96 @@
+package cancel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		objs []runtime.Object
+		err  error
+		out  string
+		// Expected cancellation mode
+		mode v1alpha1.RunCancelMode
+	}{
+		{
+			name: "interrupt",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithRunPhase(v1alpha1.RunPhaseRunning))},
+			out:  "Interrupting run run-12345 (cancel again to kill it)\n",
+			mode: v1alpha1.RunCancelInterrupt,
+		},
+		{
+			name: "kill upon second cancel",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCancel(v1alpha1.RunCancelInterrupt))},
+			out:  "Killing run run-12345\n",
+			mode: v1alpha1.RunCancelKill,
+		},
+		{
+			name: "force",
+			args: []string{"run-12345", "--force"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply")},
+			out:  "Killing run run-12345\n",
+			mode: v1alpha1.RunCancelKill,
+		},
+		{
+			name: "specific namespace",
+			args: []string{"run-12345", "--namespace", "dev"},
+			objs: []runtime.Object{testobj.Run("dev", "run-12345", "apply")},
+			out:  "Interrupting run run-12345 (cancel again to kill it)\n",
+			mode: v1alpha1.RunCancelInterrupt,
+		},
+		{
+			name: "completed run",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition))},
+			err:  client.ErrRunDone,
+		},
+		{
+			name: "run not found",
+			args: []string{"run-12345"},
+			err:  errRunNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// Ensure project file isn't read from the current directory
+			t.NewTempDir().Chdir()
+
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			cmd, o := CancelCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs(tt.args)
+
+			err := cmd.ExecuteContext(context.Background())
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out.String())
+
+			run, err := o.RunsClient(o.namespace).Get(context.Background(), "run-12345", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.mode, run.Cancel)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/util/slice"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+var (
+	errNotQueued = errors.New("run is not waiting in the queue")
+)
+
+// approve approves a run by annotating its workspace
+func approve(ctx context.Context, c *client.Client, run *v1alpha1.Run) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ws, err := c.WorkspacesClient(run.Namespace).Get(ctx, run.Workspace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ws.Annotations == nil {
+			ws.Annotations = make(map[string]string)
+		}
+		ws.Annotations[run.ApprovedAnnotationKey()] = "approved"
+
+		_, err = c.WorkspacesClient(run.Namespace).Update(ctx, ws, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// cancelRun requests cancellation of a run. A run that is yet to start is
+// cancelled straight away, whereas a running command is interrupted, and killed
+// if the run is cancelled again.
+func cancelRun(ctx context.Context, c *client.Client, run *v1alpha1.Run) (v1alpha1.RunCancelMode, error) {
+	return c.CancelRun(ctx, run.Namespace, run.Name, false)
+}
+
+// move moves a run up or down its workspace's queue. The queue is maintained by
+// the workspace controller, so the new order is requested by annotating the
+// workspace, which the controller then applies to the queue.
+func move(ctx context.Context, c *client.Client, run *v1alpha1.Run, delta int) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ws, err := c.WorkspacesClient(run.Namespace).Get(ctx, run.Workspace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		queue := append([]string{}, ws.Status.Queue...)
+		i := slice.StringIndex(queue, run.Name)
+		if i == -1 {
+			return fmt.Errorf("%w: %s", errNotQueued, run.Name)
+		}
+
+		j := i + delta
+		if j < 0 || j >= len(queue) {
+			// Already at front or back of queue
+			return nil
+		}
+		queue[i], queue[j] = queue[j], queue[i]
+
+		if ws.Annotations == nil {
+			ws.Annotations = make(map[string]string)
+		}
+		ws.Annotations[v1alpha1.QueueOrderAnnotationKey] = strings.Join(queue, ",")
+
+		_, err = c.WorkspacesClient(run.Namespace).Update(ctx, ws, metav1.UpdateOptions{})
+		return err
+	})
+}
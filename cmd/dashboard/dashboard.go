@@ -0,0 +1,267 @@
+package dashboard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/globals"
+	"github.com/leg100/etok/pkg/k8s"
+	"github.com/leg100/etok/pkg/logstreamer"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/kubectl/pkg/util/term"
+)
+
+const (
+	defaultNamespace = "default"
+
+	// Switch to and from the terminal's alternate screen, hiding the cursor
+	enterAltScreen = "\x1b[?1049h\x1b[?25l"
+	exitAltScreen  = "\x1b[?25h\x1b[?1049l"
+)
+
+type dashboardOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+}
+
+// Events received by the dashboard's event loop
+type (
+	keyEvent   string
+	errorEvent struct{ err error }
+	logsEvent  struct {
+		run  string
+		data []byte
+		err  error
+	}
+)
+
+func DashboardCmd(f *cmdutil.Factory) (*cobra.Command, *dashboardOptions) {
+	o := &dashboardOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+	}
+	cmd := &cobra.Command{
+		Use:   "dashboard",
+		Short: "Interactive dashboard of workspaces and runs",
+		Long: `Open an interactive dashboard showing the workspaces in a namespace, along with their live runs. The
+dashboard is updated in real time.
+
+Select a run with the arrow keys (or j/k) and then:
+
+  enter  view the run's logs (esc to return)
+  a      approve the run, if its command is privileged
+  c      cancel the run (again to kill its command)
+  K/J    move the run up or down its workspace's queue
+  q      quit`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, nil)
+			if err != nil {
+				return err
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	return cmd, o
+}
+
+func (o *dashboardOptions) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := newModel(o.namespace)
+
+	// Put terminal into raw mode so that key presses are received immediately
+	if term.IsTerminal(o.In) {
+		fd := int(o.In.(*os.File).Fd())
+		oldState, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(fd, oldState)
+
+		if _, height, err := terminal.GetSize(fd); err == nil {
+			m.height = height
+		}
+
+		fmt.Fprint(o.Out, enterAltScreen)
+		defer fmt.Fprint(o.Out, exitAltScreen)
+	}
+
+	events := make(chan interface{})
+
+	go o.watch(ctx, &k8s.WorkspaceListWatcher{Client: o.EtokClient, Namespace: o.namespace}, &v1alpha1.Workspace{}, events)
+	go o.watch(ctx, &k8s.RunListWatcher{Client: o.EtokClient, Namespace: o.namespace}, &v1alpha1.Run{}, events)
+	go readKeys(ctx, o.In, events)
+
+	// Cancels the current logs stream
+	stopLogs := func() {}
+	defer func() { stopLogs() }()
+
+	for {
+		fmt.Fprint(o.Out, m.render())
+
+		var ev interface{}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev = <-events:
+		}
+
+		switch ev := ev.(type) {
+		case watch.Event:
+			m.update(ev)
+		case logsEvent:
+			if ev.err != nil && ev.run == m.logsRun {
+				m.message = fmt.Sprintf("Unable to stream logs: %s", ev.err.Error())
+				continue
+			}
+			m.appendLogs(ev.run, ev.data)
+		case errorEvent:
+			return ev.err
+		case keyEvent:
+			a := m.handleKey(string(ev))
+			switch a.kind {
+			case actionQuit:
+				return nil
+			case actionLogs:
+				// Stop streaming the logs of any previously selected run
+				stopLogs()
+				stopLogs = o.streamLogs(ctx, a.run.Name, events)
+			case actionStopLogs:
+				stopLogs()
+			case actionApprove:
+				if err := approve(ctx, o.Client, a.run); err != nil {
+					m.message = err.Error()
+				} else {
+					m.message = fmt.Sprintf("Approved run %s", a.run.Name)
+				}
+			case actionCancel:
+				if mode, err := cancelRun(ctx, o.Client, a.run); err != nil {
+					m.message = err.Error()
+				} else if mode == v1alpha1.RunCancelKill {
+					m.message = fmt.Sprintf("Killing run %s", a.run.Name)
+				} else {
+					m.message = fmt.Sprintf("Cancelling run %s (cancel again to kill it)", a.run.Name)
+				}
+			case actionMove:
+				if err := move(ctx, o.Client, a.run, a.delta); err != nil {
+					m.message = err.Error()
+				}
+			}
+		}
+	}
+}
+
+// watch sends events for the resources listed and watched by the list watcher
+// until the context is cancelled
+func (o *dashboardOptions) watch(ctx context.Context, lw cache.ListerWatcher, obj runtime.Object, events chan<- interface{}) {
+	_, err := watchtools.UntilWithSync(ctx, lw, obj, nil, func(event watch.Event) (bool, error) {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+		return false, nil
+	})
+	if ctx.Err() != nil {
+		// Dashboard has closed
+		return
+	}
+	select {
+	case events <- errorEvent{err: err}:
+	case <-ctx.Done():
+	}
+}
+
+// streamLogs starts sending the logs of a run, returning a func to stop
+// sending them
+func (o *dashboardOptions) streamLogs(ctx context.Context, run string, events chan<- interface{}) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		w := &logsWriter{ctx: ctx, run: run, events: events}
+		err := logstreamer.Stream(ctx, o.GetLogsFunc, w, o.PodsClient(o.namespace), run, globals.RunnerContainerName)
+		if err != nil && ctx.Err() == nil {
+			select {
+			case events <- logsEvent{run: run, err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// logsWriter sends the logs written to it as events
+type logsWriter struct {
+	ctx    context.Context
+	run    string
+	events chan<- interface{}
+}
+
+func (w *logsWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	select {
+	case w.events <- logsEvent{run: w.run, data: data}:
+		return len(p), nil
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
+}
+
+// readKeys sends key presses read from the terminal
+func readKeys(ctx context.Context, in io.Reader, events chan<- interface{}) {
+	buf := make([]byte, 32)
+	for {
+		n, err := in.Read(buf)
+		for _, key := range parseKeys(buf[:n]) {
+			select {
+			case events <- keyEvent(key):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// safeBuffer is a buffer that is safe for concurrent use
+type safeBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDashboard(t *testing.T) {
+	out := new(safeBuffer)
+
+	f := cmdutil.NewFakeFactory(out,
+		testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1")),
+		testobj.Run("default", "run-1", "apply", testobj.WithWorkspace("workspace-1"), testobj.WithRunPhase(v1alpha1.RunPhaseRunning)),
+		testobj.Workspace("dev", "workspace-2"),
+	)
+
+	in, keys := io.Pipe()
+	f.In = in
+
+	cmd, _ := DashboardCmd(f)
+	cmd.SetArgs([]string{})
+
+	errch := make(chan error)
+	go func() {
+		errch <- cmd.ExecuteContext(context.Background())
+	}()
+
+	// Dashboard is populated by watches
+	assert.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "workspace-1") &&
+			strings.Contains(out.String(), "run-1")
+	}, time.Second, 10*time.Millisecond)
+
+	// View logs
+	_, err := keys.Write([]byte("\r"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "fake logs")
+	}, time.Second, 10*time.Millisecond)
+
+	// Return and quit
+	_, err = keys.Write([]byte("\x1bq"))
+	require.NoError(t, err)
+
+	select {
+	case err := <-errch:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("dashboard did not quit")
+	}
+
+	// Other namespaces are not shown
+	assert.NotContains(t, out.String(), "workspace-2")
+}
+
+func TestDashboardActions(t *testing.T) {
+	queued := func(name string) *v1alpha1.Run {
+		return testobj.Run("default", name, "apply", testobj.WithWorkspace("workspace-1"))
+	}
+
+	tests := []struct {
+		name       string
+		runs       []*v1alpha1.Run
+		workspace  *v1alpha1.Workspace
+		act        func(context.Context, *client.Client) error
+		err        error
+		assertions func(*testutil.T, *client.Client)
+	}{
+		{
+			name:      "approve",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithPrivilegedCommands("apply")),
+			act: func(ctx context.Context, c *client.Client) error {
+				return approve(ctx, c, queued("run-1"))
+			},
+			assertions: func(t *testutil.T, c *client.Client) {
+				ws, err := c.WorkspacesClient("default").Get(context.Background(), "workspace-1", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.True(t, ws.IsRunApproved(queued("run-1")))
+			},
+		},
+		{
+			name:      "cancel",
+			runs:      []*v1alpha1.Run{queued("run-1")},
+			workspace: testobj.Workspace("default", "workspace-1"),
+			act: func(ctx context.Context, c *client.Client) error {
+				_, err := cancelRun(ctx, c, queued("run-1"))
+				return err
+			},
+			assertions: func(t *testutil.T, c *client.Client) {
+				run, err := c.RunsClient("default").Get(context.Background(), "run-1", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, v1alpha1.RunCancelInterrupt, run.Cancel)
+			},
+		},
+		{
+			name:      "move up",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1", "run-2", "run-3")),
+			act: func(ctx context.Context, c *client.Client) error {
+				return move(ctx, c, queued("run-3"), -1)
+			},
+			assertions: func(t *testutil.T, c *client.Client) {
+				ws, err := c.WorkspacesClient("default").Get(context.Background(), "workspace-1", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"run-3", "run-2"}, ws.QueueOrder())
+				// Queue itself is left to the controller to re-order
+				assert.Equal(t, []string{"run-2", "run-3"}, ws.Status.Queue)
+			},
+		},
+		{
+			name:      "move down from back of queue",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1", "run-2", "run-3")),
+			act: func(ctx context.Context, c *client.Client) error {
+				return move(ctx, c, queued("run-3"), 1)
+			},
+			assertions: func(t *testutil.T, c *client.Client) {
+				ws, err := c.WorkspacesClient("default").Get(context.Background(), "workspace-1", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Nil(t, ws.QueueOrder())
+			},
+		},
+		{
+			name:      "move active run",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1", "run-2")),
+			act: func(ctx context.Context, c *client.Client) error {
+				return move(ctx, c, queued("run-1"), 1)
+			},
+			err: errNotQueued,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			f := cmdutil.NewFakeFactory(new(bytes.Buffer), tt.workspace)
+			c, err := f.Create("")
+			require.NoError(t, err)
+
+			for _, run := range tt.runs {
+				_, err := c.RunsClient("default").Create(context.Background(), run, metav1.CreateOptions{})
+				require.NoError(t, err)
+			}
+
+			err = tt.act(context.Background(), c)
+			if !assert.True(t, errors.Is(err, tt.err)) || err != nil {
+				return
+			}
+
+			if tt.assertions != nil {
+				tt.assertions(t, c)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package dashboard
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/util/slice"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Keys, other than printable characters, recognised by the dashboard
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyEnter = "enter"
+	keyEsc   = "esc"
+	keyCtrlC = "ctrl-c"
+)
+
+// ANSI escape sequences
+const (
+	clearScreen  = "\x1b[H\x1b[2J"
+	reverseVideo = "\x1b[7m"
+	bold         = "\x1b[1m"
+	resetStyle   = "\x1b[0m"
+)
+
+const helpLine = "j/k: move  enter: logs  a: approve  c: cancel  J/K: reorder queue  q: quit"
+
+type view int
+
+const (
+	listView view = iota
+	logsView
+)
+
+type actionKind int
+
+const (
+	actionNone actionKind = iota
+	actionQuit
+	actionLogs
+	actionStopLogs
+	actionApprove
+	actionCancel
+	actionMove
+)
+
+// action is something the dashboard is asked to do in response to a key press
+type action struct {
+	kind actionKind
+	run  *v1alpha1.Run
+
+	// Number of places to move run in queue; negative moves it towards the
+	// front
+	delta int
+}
+
+// model maintains the state of the dashboard. It performs no I/O: it is
+// updated with watch events and key presses, and it renders frames.
+type model struct {
+	namespace string
+
+	workspaces map[string]*v1alpha1.Workspace
+	runs       map[string]*v1alpha1.Run
+
+	// Phases each run has passed through whilst the dashboard has been open
+	transitions map[string][]v1alpha1.RunPhase
+
+	// Name of selected run. The selection follows the run as the runs are
+	// re-ordered.
+	cursor string
+
+	view view
+
+	// Run whose logs are shown, and its logs
+	logsRun string
+	logs    []byte
+
+	// Run awaiting confirmation of cancellation
+	confirm string
+
+	// Message shown on status line
+	message string
+
+	// Terminal height; zero if unknown
+	height int
+}
+
+func newModel(namespace string) *model {
+	return &model{
+		namespace:   namespace,
+		workspaces:  make(map[string]*v1alpha1.Workspace),
+		runs:        make(map[string]*v1alpha1.Run),
+		transitions: make(map[string][]v1alpha1.RunPhase),
+	}
+}
+
+// update updates the model with a workspace or run watch event
+func (m *model) update(event watch.Event) {
+	switch obj := event.Object.(type) {
+	case *v1alpha1.Workspace:
+		if event.Type == watch.Deleted {
+			delete(m.workspaces, obj.Name)
+			return
+		}
+		m.workspaces[obj.Name] = obj
+	case *v1alpha1.Run:
+		if event.Type == watch.Deleted {
+			delete(m.runs, obj.Name)
+			delete(m.transitions, obj.Name)
+			return
+		}
+		m.runs[obj.Name] = obj
+
+		// Record phase transition
+		phases := m.transitions[obj.Name]
+		if obj.Phase != "" && (len(phases) == 0 || phases[len(phases)-1] != obj.Phase) {
+			m.transitions[obj.Name] = append(phases, obj.Phase)
+		}
+	}
+}
+
+// appendLogs appends logs for the named run, ignoring them if they're not the
+// logs currently being viewed
+func (m *model) appendLogs(run string, data []byte) {
+	if m.view == logsView && run == m.logsRun {
+		m.logs = append(m.logs, data...)
+	}
+}
+
+// sortedWorkspaces returns workspaces sorted by name
+func (m *model) sortedWorkspaces() []*v1alpha1.Workspace {
+	var workspaces []*v1alpha1.Workspace
+	for _, ws := range m.workspaces {
+		workspaces = append(workspaces, ws)
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+	return workspaces
+}
+
+// visibleRuns returns the runs that are live, along with those that have
+// finished since the dashboard was opened. They're grouped by workspace and
+// ordered by their position in the workspace queue, followed by the newest.
+func (m *model) visibleRuns() []*v1alpha1.Run {
+	var runs []*v1alpha1.Run
+	for _, run := range m.runs {
+		if !run.IsDone() || len(m.transitions[run.Name]) > 1 {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Workspace != runs[j].Workspace {
+			return runs[i].Workspace < runs[j].Workspace
+		}
+		if pi, pj := m.queuePosition(runs[i]), m.queuePosition(runs[j]); pi != pj {
+			// Runs not in queue (-1) go last
+			return pj == -1 || (pi != -1 && pi < pj)
+		}
+		if !runs[i].CreationTimestamp.Equal(&runs[j].CreationTimestamp) {
+			return runs[j].CreationTimestamp.Before(&runs[i].CreationTimestamp)
+		}
+		return runs[i].Name < runs[j].Name
+	})
+	return runs
+}
+
+// queuePosition returns a run's position in its workspace's combined queue,
+// where 0 is an active run, or -1 if it is not queued
+func (m *model) queuePosition(run *v1alpha1.Run) int {
+	ws, ok := m.workspaces[run.Workspace]
+	if !ok {
+		return -1
+	}
+	if slice.ContainsString(ws.ActiveRuns(), run.Name) {
+		return 0
+	}
+	if i := slice.StringIndex(ws.Status.Queue, run.Name); i != -1 {
+		return i + 1
+	}
+	return -1
+}
+
+// needsApproval determines whether a run is awaiting approval
+func (m *model) needsApproval(run *v1alpha1.Run) bool {
+	ws, ok := m.workspaces[run.Workspace]
+	if !ok || run.IsDone() {
+		return false
+	}
+	return slice.ContainsString(ws.Spec.PrivilegedCommands, run.Command) && !ws.IsRunApproved(run)
+}
+
+// selected returns the index of the selected run amongst the given runs,
+// defaulting to the first run if the selected run is no longer visible
+func (m *model) selected(runs []*v1alpha1.Run) int {
+	for i, run := range runs {
+		if run.Name == m.cursor {
+			return i
+		}
+	}
+	return 0
+}
+
+// moveCursor moves the selection up or down the list of runs
+func (m *model) moveCursor(delta int) {
+	runs := m.visibleRuns()
+	if len(runs) == 0 {
+		return
+	}
+	i := m.selected(runs) + delta
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(runs) {
+		i = len(runs) - 1
+	}
+	m.cursor = runs[i].Name
+}
+
+// handleKey updates the model in response to a key press, and returns the
+// action to be taken
+func (m *model) handleKey(key string) action {
+	if key == keyCtrlC {
+		return action{kind: actionQuit}
+	}
+
+	// Confirm cancellation
+	if m.confirm != "" {
+		run, ok := m.runs[m.confirm]
+		m.confirm = ""
+		if (key == "y" || key == "Y") && ok {
+			return action{kind: actionCancel, run: run}
+		}
+		m.message = "Run not cancelled"
+		return action{}
+	}
+
+	if m.view == logsView {
+		switch key {
+		case keyEsc, "q", "h":
+			m.view = listView
+			m.logsRun, m.logs = "", nil
+			return action{kind: actionStopLogs}
+		}
+		return action{}
+	}
+
+	m.message = ""
+
+	switch key {
+	case "q":
+		return action{kind: actionQuit}
+	case keyUp, "k":
+		m.moveCursor(-1)
+		return action{}
+	case keyDown, "j":
+		m.moveCursor(1)
+		return action{}
+	}
+
+	runs := m.visibleRuns()
+	if len(runs) == 0 {
+		return action{}
+	}
+	run := runs[m.selected(runs)]
+
+	switch key {
+	case keyEnter, "l":
+		m.view = logsView
+		m.logsRun, m.logs = run.Name, nil
+		return action{kind: actionLogs, run: run}
+	case "a":
+		if !m.needsApproval(run) {
+			m.message = fmt.Sprintf("Run %s does not need approval", run.Name)
+			return action{}
+		}
+		return action{kind: actionApprove, run: run}
+	case "c":
+		if run.IsDone() {
+			m.message = fmt.Sprintf("Run %s has already finished", run.Name)
+			return action{}
+		}
+		m.confirm = run.Name
+		return action{}
+	case "K", "J":
+		if m.queuePosition(run) < 1 {
+			m.message = fmt.Sprintf("Run %s is not waiting in the queue", run.Name)
+			return action{}
+		}
+		delta := 1
+		if key == "K" {
+			delta = -1
+		}
+		return action{kind: actionMove, run: run, delta: delta}
+	}
+	return action{}
+}
+
+// render returns a frame depicting the current state of the dashboard
+func (m *model) render() string {
+	var lines []string
+	if m.view == logsView {
+		lines = m.renderLogs()
+	} else {
+		lines = m.renderList()
+	}
+
+	// Status line
+	switch {
+	case m.confirm != "":
+		lines = append(lines, "", fmt.Sprintf("Cancel run %s? [y/N]", m.confirm))
+	case m.message != "":
+		lines = append(lines, "", m.message)
+	}
+
+	return clearScreen + strings.Join(lines, "\r\n")
+}
+
+func (m *model) renderList() []string {
+	lines := []string{bold + fmt.Sprintf("Namespace: %s", m.namespace) + resetStyle, ""}
+
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "WORKSPACE\tPHASE\tACTIVE\tQUEUE")
+	for _, ws := range m.sortedWorkspaces() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", ws.Name, cmdutil.OrNone(string(ws.Status.Phase)), cmdutil.OrNone(strings.Join(ws.ActiveRuns(), ",")), len(ws.Status.Queue))
+	}
+	tw.Flush()
+	lines = append(lines, splitLines(buf.String())...)
+	lines = append(lines, "")
+
+	runs := m.visibleRuns()
+
+	buf.Reset()
+	tw = tabwriter.NewWriter(buf, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tWORKSPACE\tCOMMAND\tQUEUE\tAGE\tSTATUS")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", run.Name, run.Workspace, run.Command, m.queueSummary(run), cmdutil.Age(run.CreationTimestamp.Time), m.statusSummary(run))
+	}
+	tw.Flush()
+	cursor := m.selected(runs)
+	for i, line := range splitLines(buf.String()) {
+		// First line is the header; highlight selected run
+		if len(runs) > 0 && i-1 == cursor {
+			line = reverseVideo + line + resetStyle
+		}
+		lines = append(lines, line)
+	}
+	if len(runs) == 0 {
+		lines = append(lines, "No live runs")
+	}
+
+	return append(lines, "", helpLine)
+}
+
+func (m *model) renderLogs() []string {
+	lines := []string{bold + fmt.Sprintf("Logs: %s (esc to return)", m.logsRun) + resetStyle, ""}
+
+	logs := splitLines(strings.ReplaceAll(string(m.logs), "\r\n", "\n"))
+	if m.height > 0 {
+		// Leave room for header and status line
+		if max := m.height - 4; max > 0 && len(logs) > max {
+			logs = logs[len(logs)-max:]
+		}
+	}
+	return append(lines, logs...)
+}
+
+func (m *model) queueSummary(run *v1alpha1.Run) string {
+	switch pos := m.queuePosition(run); pos {
+	case -1:
+		return "-"
+	case 0:
+		return "active"
+	default:
+		return strconv.Itoa(pos)
+	}
+}
+
+// statusSummary summarises the phases a run has transitioned through
+func (m *model) statusSummary(run *v1alpha1.Run) string {
+	var phases []string
+	for _, phase := range m.transitions[run.Name] {
+		phases = append(phases, string(phase))
+	}
+	summary := cmdutil.OrNone(strings.Join(phases, " → "))
+	if run.ExitCode != nil {
+		summary += fmt.Sprintf(" (exit %d)", *run.ExitCode)
+	}
+	if m.needsApproval(run) {
+		summary += " [needs approval]"
+	}
+	return summary
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// parseKeys parses key presses from terminal input
+func parseKeys(input []byte) (keys []string) {
+	for i := 0; i < len(input); i++ {
+		switch b := input[i]; b {
+		case 0x1b:
+			// Arrow keys are sent as an escape sequence
+			if i+2 < len(input) && input[i+1] == '[' {
+				switch input[i+2] {
+				case 'A':
+					keys = append(keys, keyUp)
+				case 'B':
+					keys = append(keys, keyDown)
+				}
+				// Ignore other sequences
+				i += 2
+				continue
+			}
+			keys = append(keys, keyEsc)
+		case 0x03:
+			keys = append(keys, keyCtrlC)
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		default:
+			keys = append(keys, string(b))
+		}
+	}
+	return keys
+}
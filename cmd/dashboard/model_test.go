@@ -0,0 +1,230 @@
+package dashboard
+
+import (
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestModel(t *testing.T) {
+	added := func(obj runtime.Object) watch.Event { return watch.Event{Type: watch.Added, Object: obj} }
+	modified := func(obj runtime.Object) watch.Event { return watch.Event{Type: watch.Modified, Object: obj} }
+	deleted := func(obj runtime.Object) watch.Event { return watch.Event{Type: watch.Deleted, Object: obj} }
+
+	run := func(name, command string, phase v1alpha1.RunPhase, opts ...func(*v1alpha1.Run)) *v1alpha1.Run {
+		opts = append(opts, testobj.WithWorkspace("workspace-1"), testobj.WithRunPhase(phase))
+		return testobj.Run("default", name, command, opts...)
+	}
+
+	workspace := testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1", "run-2", "run-3"))
+	privileged := testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("run-1"), testobj.WithPrivilegedCommands("apply"))
+
+	tests := []struct {
+		name     string
+		events   []watch.Event
+		keys     []string
+		action   actionKind
+		run      string
+		delta    int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "workspaces with queue depth",
+			events:   []watch.Event{added(workspace), added(testobj.Workspace("default", "workspace-2"))},
+			contains: []string{"Namespace: default", "workspace-1   <none>   run-1    2", "workspace-2   <none>   <none>   0", "No live runs"},
+		},
+		{
+			name: "run transitions",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseQueued)),
+				modified(run("run-1", "apply", v1alpha1.RunPhaseProvisioning)),
+				modified(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			contains: []string{"queued → provisioning → running"},
+		},
+		{
+			name: "run completed whilst open is shown",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+				modified(run("run-1", "apply", v1alpha1.RunPhaseCompleted, testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0))),
+			},
+			contains: []string{"running → completed (exit 0)"},
+		},
+		{
+			name: "run completed before open is not shown",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseCompleted, testobj.WithCondition(v1alpha1.RunCompleteCondition))),
+			},
+			excludes: []string{"run-1"},
+		},
+		{
+			name: "deleted run is not shown",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+				deleted(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			excludes: []string{"run-1"},
+		},
+		{
+			name:   "quit",
+			keys:   []string{"q"},
+			action: actionQuit,
+		},
+		{
+			name: "select next run and view logs",
+			events: []watch.Event{
+				added(workspace),
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+				added(run("run-2", "apply", v1alpha1.RunPhaseQueued)),
+			},
+			keys:     []string{keyDown, keyEnter},
+			action:   actionLogs,
+			run:      "run-2",
+			contains: []string{"Logs: run-2"},
+		},
+		{
+			name: "return from logs",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:     []string{keyEnter, keyEsc},
+			action:   actionStopLogs,
+			contains: []string{"RUN", "run-1"},
+		},
+		{
+			name: "approve",
+			events: []watch.Event{
+				added(privileged),
+				added(run("run-1", "apply", v1alpha1.RunPhaseWaiting)),
+			},
+			keys:     []string{"a"},
+			action:   actionApprove,
+			run:      "run-1",
+			contains: []string{"waiting [needs approval]"},
+		},
+		{
+			name: "approve unprivileged run",
+			events: []watch.Event{
+				added(workspace),
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:     []string{"a"},
+			contains: []string{"Run run-1 does not need approval"},
+		},
+		{
+			name: "cancel",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:   []string{"c", "y"},
+			action: actionCancel,
+			run:    "run-1",
+		},
+		{
+			name: "cancel declined",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:     []string{"c", "n"},
+			contains: []string{"Run not cancelled"},
+		},
+		{
+			name: "cancel awaiting confirmation",
+			events: []watch.Event{
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:     []string{"c"},
+			contains: []string{"Cancel run run-1? [y/N]"},
+		},
+		{
+			name: "move run up queue",
+			events: []watch.Event{
+				added(workspace),
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+				added(run("run-2", "apply", v1alpha1.RunPhaseQueued)),
+				added(run("run-3", "apply", v1alpha1.RunPhaseQueued)),
+			},
+			keys:   []string{"j", "j", "K"},
+			action: actionMove,
+			run:    "run-3",
+			delta:  -1,
+		},
+		{
+			name: "move active run",
+			events: []watch.Event{
+				added(workspace),
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:     []string{"J"},
+			contains: []string{"Run run-1 is not waiting in the queue"},
+		},
+		{
+			name: "runs ordered by queue position",
+			events: []watch.Event{
+				added(workspace),
+				added(run("run-3", "apply", v1alpha1.RunPhaseQueued)),
+				added(run("run-2", "apply", v1alpha1.RunPhaseQueued)),
+				added(run("run-1", "apply", v1alpha1.RunPhaseRunning)),
+			},
+			keys:   []string{"j", keyEnter},
+			action: actionLogs,
+			run:    "run-2",
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			m := newModel("default")
+			for _, ev := range tt.events {
+				m.update(ev)
+			}
+
+			var a action
+			for _, k := range tt.keys {
+				a = m.handleKey(k)
+			}
+
+			assert.Equal(t, tt.action, a.kind)
+			if tt.run != "" {
+				assert.Equal(t, tt.run, a.run.Name)
+			}
+			assert.Equal(t, tt.delta, a.delta)
+
+			frame := m.render()
+			for _, s := range tt.contains {
+				assert.Contains(t, frame, s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, frame, s)
+			}
+		})
+	}
+}
+
+func TestModelLogs(t *testing.T) {
+	m := newModel("default")
+	m.height = 6
+	m.update(watch.Event{Type: watch.Added, Object: testobj.Run("default", "run-1", "plan")})
+
+	m.handleKey(keyEnter)
+	m.appendLogs("run-1", []byte("line 1\r\nline 2\nline 3\n"))
+	m.appendLogs("run-2", []byte("other run's logs\n"))
+
+	frame := m.render()
+	assert.Contains(t, frame, "line 2\r\nline 3")
+	// Logs are truncated to fit terminal
+	assert.NotContains(t, frame, "line 1")
+	assert.NotContains(t, frame, "other run's logs")
+}
+
+func TestParseKeys(t *testing.T) {
+	assert.Equal(t,
+		[]string{keyUp, keyDown, keyEnter, keyEsc, keyCtrlC, "j", "K"},
+		parseKeys([]byte("\x1b[A\x1b[B\r\x1b\x03\x1b[Cj\x1b[DK")))
+}
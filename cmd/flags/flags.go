@@ -23,3 +23,7 @@ func AddKubeContextFlag(cmd *cobra.Command, kubeContext *string) {
 func AddDisableResourceCleanupFlag(cmd *cobra.Command, disable *bool) {
 	cmd.Flags().BoolVar(disable, "no-cleanup", false, "Do not delete kubernetes resources upon error")
 }
+
+func AddIgnoreClusterMismatchFlag(cmd *cobra.Command, ignore *bool) {
+	cmd.Flags().BoolVar(ignore, "ignore-cluster-mismatch", false, "Proceed even if the cluster differs from that on which the workspace was selected")
+}
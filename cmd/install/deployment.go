@@ -1,6 +1,8 @@
 package install
 
 import (
+	"fmt"
+	"path/filepath"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -9,7 +11,25 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/leg100/etok/pkg/backend"
 	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/vcs"
+	"github.com/leg100/etok/pkg/web"
+	"github.com/leg100/etok/pkg/webhooks"
+)
+
+const (
+	// Path on which the secret containing the state encryption key is mounted
+	stateEncryptionKeyMountPath = "/etc/etok/state-encryption-key"
+	// Key in the secret containing the state encryption key
+	stateEncryptionKeyKey = "key"
+
+	// Path on which the secret containing the VCS credentials is mounted
+	vcsSecretMountPath = "/etc/etok/vcs"
+	// Key in the VCS secret containing the API token
+	vcsTokenKey = "token"
+	// Key in the VCS secret containing the webhook secret
+	vcsWebhookSecretKey = "webhook-secret"
 )
 
 type podTemplateOption func(*podTemplateConfig)
@@ -19,6 +39,17 @@ type podTemplateConfig struct {
 	envVars     []corev1.EnvVar
 	annotations map[string]string
 	withSecret  bool
+	webhooks    bool
+	stateServer bool
+	// Name of secret containing the state encryption key
+	stateEncryptionKeySecret string
+	webServer                bool
+	// VCS provider from which to receive webhooks
+	vcsProvider string
+	// Base URL of the VCS provider's API
+	vcsAPIURL string
+	// Name of secret containing the VCS credentials
+	vcsSecret string
 }
 
 func WithImage(image string) podTemplateOption {
@@ -56,6 +87,46 @@ func WithSecret(secretPresent bool) podTemplateOption {
 	}
 }
 
+// WithWebhooks configures the operator to serve admission webhooks
+func WithWebhooks(enabled bool) podTemplateOption {
+	return func(c *podTemplateConfig) {
+		c.webhooks = enabled
+	}
+}
+
+// WithStateServer configures the operator to serve the HTTP state backend
+func WithStateServer(enabled bool) podTemplateOption {
+	return func(c *podTemplateConfig) {
+		c.stateServer = enabled
+	}
+}
+
+// WithWebServer configures the operator to serve the read-only HTTP API and
+// web UI
+func WithWebServer(enabled bool) podTemplateOption {
+	return func(c *podTemplateConfig) {
+		c.webServer = enabled
+	}
+}
+
+// WithVCS configures the operator to receive webhooks from a VCS provider,
+// with credentials from the given secret
+func WithVCS(provider, apiURL, secret string) podTemplateOption {
+	return func(c *podTemplateConfig) {
+		c.vcsProvider = provider
+		c.vcsAPIURL = apiURL
+		c.vcsSecret = secret
+	}
+}
+
+// WithStateEncryptionKeySecret configures the operator to encrypt state using
+// the key in the given secret
+func WithStateEncryptionKeySecret(name string) podTemplateOption {
+	return func(c *podTemplateConfig) {
+		c.stateEncryptionKeySecret = name
+	}
+}
+
 func deployment(namespace string, opts ...podTemplateOption) *appsv1.Deployment {
 	c := &podTemplateConfig{
 		image: version.Image,
@@ -124,6 +195,86 @@ func deployment(namespace string, opts ...podTemplateOption) *appsv1.Deployment
 	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: selector}
 	deployment.Spec.Template.Labels = selector
 
+	if c.webhooks {
+		deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--enable-webhooks", "--webhook-namespace", namespace)
+
+		deployment.Spec.Template.Spec.Containers[0].Ports = append(deployment.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "webhook",
+			ContainerPort: webhooks.Port,
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+
+	if c.stateServer {
+		deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--state-server-url", fmt.Sprintf("https://%s.%s.svc", backend.ServiceName, namespace), "--state-server-namespace", namespace)
+
+		deployment.Spec.Template.Spec.Containers[0].Ports = append(deployment.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "state",
+			ContainerPort: backend.Port,
+			Protocol:      corev1.ProtocolTCP,
+		})
+
+		if c.stateEncryptionKeySecret != "" {
+			deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+				Name: "state-encryption-key",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: c.stateEncryptionKeySecret,
+					},
+				},
+			})
+
+			deployment.Spec.Template.Spec.Containers[0].VolumeMounts = append(deployment.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+				Name:      "state-encryption-key",
+				MountPath: stateEncryptionKeyMountPath,
+				ReadOnly:  true,
+			})
+
+			deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--state-encryption-key-file", filepath.Join(stateEncryptionKeyMountPath, stateEncryptionKeyKey))
+		}
+	}
+
+	if c.webServer {
+		deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--enable-web", "--web-namespace", namespace)
+
+		deployment.Spec.Template.Spec.Containers[0].Ports = append(deployment.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "web",
+			ContainerPort: web.Port,
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+
+	if c.vcsProvider != "" {
+		deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args,
+			"--vcs-provider", c.vcsProvider,
+			"--vcs-token-file", filepath.Join(vcsSecretMountPath, vcsTokenKey),
+			"--vcs-webhook-secret-file", filepath.Join(vcsSecretMountPath, vcsWebhookSecretKey))
+		if c.vcsAPIURL != "" {
+			deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--vcs-api-url", c.vcsAPIURL)
+		}
+
+		deployment.Spec.Template.Spec.Containers[0].Ports = append(deployment.Spec.Template.Spec.Containers[0].Ports, corev1.ContainerPort{
+			Name:          "vcs",
+			ContainerPort: vcs.Port,
+			Protocol:      corev1.ProtocolTCP,
+		})
+
+		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: "vcs",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: c.vcsSecret,
+				},
+			},
+		})
+
+		deployment.Spec.Template.Spec.Containers[0].VolumeMounts = append(deployment.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "vcs",
+			MountPath: vcsSecretMountPath,
+			ReadOnly:  true,
+		})
+	}
+
 	if c.withSecret {
 		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
 			Name: "secrets",
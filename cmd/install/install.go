@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
@@ -22,7 +23,9 @@ import (
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/vcs"
 	"github.com/leg100/etok/pkg/version"
+	"github.com/leg100/etok/pkg/webhooks"
 	"github.com/spf13/cobra"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/yaml"
@@ -70,6 +73,23 @@ type installOptions struct {
 	// Annotations to add to the service account resource
 	serviceAccountAnnotations map[string]string
 
+	// Toggle installing admission webhooks
+	webhooks bool
+
+	// Toggle serving the HTTP state backend
+	stateServer bool
+	// Toggle serving the read-only HTTP API and web UI
+	webServer bool
+	// Name of existing secret containing the state encryption key
+	stateEncryptionKeySecret string
+
+	// VCS provider from which to receive webhooks
+	vcsProvider string
+	// Base URL of the VCS provider's API
+	vcsAPIURL string
+	// Name of existing secret containing the VCS credentials
+	vcsSecret string
+
 	// Toggle only installing CRDs
 	crdsOnly bool
 
@@ -117,6 +137,13 @@ func InstallCmd(f *cmdutil.Factory) (*cobra.Command, *installOptions) {
 
 	cmd.Flags().StringVar(&o.secretFile, "secret-file", "", "Path on local filesystem to key file")
 	cmd.Flags().StringToStringVar(&o.serviceAccountAnnotations, "sa-annotations", map[string]string{}, "Annotations to add to the etok ServiceAccount. Add iam.gke.io/gcp-service-account=[GSA_NAME]@[PROJECT_NAME].iam.gserviceaccount.com for workload identity")
+	cmd.Flags().BoolVar(&o.webhooks, "webhooks", true, "Install admission webhooks for validating and defaulting workspaces and runs")
+	cmd.Flags().BoolVar(&o.stateServer, "state-server", true, "Serve the HTTP state backend for workspaces")
+	cmd.Flags().StringVar(&o.stateEncryptionKeySecret, "state-encryption-key-secret", "", "Name of an existing secret in the install namespace, with the key 'key', from which to derive a key with which to encrypt state stored by the HTTP state backend")
+	cmd.Flags().BoolVar(&o.webServer, "web", false, "Serve a read-only HTTP API and web UI for workspaces and runs")
+	cmd.Flags().StringVar(&o.vcsProvider, "vcs-provider", "", "VCS provider (github or gitlab) from which to receive webhooks that trigger runs. Leave empty to disable.")
+	cmd.Flags().StringVar(&o.vcsAPIURL, "vcs-api-url", "", "Base URL of the VCS provider's API. Defaults to the public API of the provider.")
+	cmd.Flags().StringVar(&o.vcsSecret, "vcs-secret", "", "Name of an existing secret in the install namespace, with the keys 'token' and 'webhook-secret', containing the VCS provider's API token and webhook secret")
 	cmd.Flags().BoolVar(&o.crdsOnly, "crds-only", o.crdsOnly, "Only generate CRD resources. Useful for updating CRDs for an existing Etok install.")
 
 	return cmd, o
@@ -126,6 +153,15 @@ func (o *installOptions) install(ctx context.Context) error {
 	var deploy *appsv1.Deployment
 	var resources []runtimeclient.Object
 
+	if o.vcsProvider != "" {
+		if o.vcsProvider != vcs.GitHub && o.vcsProvider != vcs.GitLab {
+			return fmt.Errorf("%w: %s", vcs.ErrUnknownProvider, o.vcsProvider)
+		}
+		if o.vcsSecret == "" {
+			return fmt.Errorf("--vcs-secret is required with --vcs-provider")
+		}
+	}
+
 	for _, path := range crdPaths {
 		res, err := o.crd(path)
 		if err != nil {
@@ -150,9 +186,27 @@ func (o *installOptions) install(ctx context.Context) error {
 		resources = append(resources, serviceAccount(o.namespace, o.serviceAccountAnnotations))
 
 		secretPresent := o.secretFile != ""
-		deploy = deployment(o.namespace, WithSecret(secretPresent), WithImage(o.image))
+		deploy = deployment(o.namespace, WithSecret(secretPresent), WithImage(o.image), WithWebhooks(o.webhooks), WithStateServer(o.stateServer), WithStateEncryptionKeySecret(o.stateEncryptionKeySecret), WithWebServer(o.webServer), WithVCS(o.vcsProvider, o.vcsAPIURL, o.vcsSecret))
 		resources = append(resources, deploy)
 
+		if o.stateServer {
+			resources = append(resources, stateService(o.namespace))
+		}
+
+		if o.webServer {
+			resources = append(resources, webService(o.namespace))
+		}
+
+		if o.vcsProvider != "" {
+			resources = append(resources, vcsService(o.namespace))
+		}
+
+		if o.webhooks {
+			resources = append(resources, webhookService(o.namespace))
+			resources = append(resources, webhooks.MutatingWebhookConfiguration(o.namespace))
+			resources = append(resources, webhooks.ValidatingWebhookConfiguration(o.namespace))
+		}
+
 		if o.secretFile != "" {
 			key, err := ioutil.ReadFile(o.secretFile)
 			if err != nil {
@@ -224,6 +278,24 @@ func (o *installOptions) createOrUpdate(ctx context.Context, resources []runtime
 				updatedBinding.Subjects = existingBinding.Subjects
 			}
 
+			// Preserve CA bundle injected by the operator
+			switch updated := res.(type) {
+			case *admissionregistrationv1.MutatingWebhookConfiguration:
+				existingCfg := existing.(*admissionregistrationv1.MutatingWebhookConfiguration)
+				for i := range updated.Webhooks {
+					if i < len(existingCfg.Webhooks) {
+						updated.Webhooks[i].ClientConfig.CABundle = existingCfg.Webhooks[i].ClientConfig.CABundle
+					}
+				}
+			case *admissionregistrationv1.ValidatingWebhookConfiguration:
+				existingCfg := existing.(*admissionregistrationv1.ValidatingWebhookConfiguration)
+				for i := range updated.Webhooks {
+					if i < len(existingCfg.Webhooks) {
+						updated.Webhooks[i].ClientConfig.CABundle = existingCfg.Webhooks[i].ClientConfig.CABundle
+					}
+				}
+			}
+
 			res.SetResourceVersion(existing.GetResourceVersion())
 
 			fmt.Fprintf(o.Out, "Updating resource %s %s\n", kind, klog.KObj(res))
@@ -15,8 +15,10 @@ import (
 
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -25,6 +27,7 @@ import (
 	etokclient "github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/scheme"
 	"github.com/leg100/etok/pkg/testutil"
+	"github.com/leg100/etok/pkg/webhooks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
@@ -67,6 +70,98 @@ func TestInstall(t *testing.T) {
 				assert.Equal(t, map[string]string{"foo": "bar", "baz": "haj"}, sa.GetAnnotations())
 			},
 		},
+		{
+			name: "fresh install configures operator to serve webhooks",
+			args: []string{"install", "--wait=false"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator", "--enable-webhooks", "--webhook-namespace", "etok", "--state-server-url", "https://etok-state.etok.svc", "--state-server-namespace", "etok"}, d.Spec.Template.Spec.Containers[0].Args)
+
+				var cfg admissionregistrationv1.ValidatingWebhookConfiguration
+				client.Get(context.Background(), types.NamespacedName{Name: "etok"}, &cfg)
+				if assert.Equal(t, 2, len(cfg.Webhooks)) {
+					assert.Equal(t, "etok", cfg.Webhooks[0].ClientConfig.Service.Namespace)
+					assert.Equal(t, "etok-webhook", cfg.Webhooks[0].ClientConfig.Service.Name)
+				}
+			},
+		},
+		{
+			name: "upgrade preserves injected CA bundle",
+			args: []string{"install", "--wait=false"},
+			objs: append(wantedCRDs(), withCABundle(webhooks.MutatingWebhookConfiguration("etok"), []byte("ca"))),
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var cfg admissionregistrationv1.MutatingWebhookConfiguration
+				client.Get(context.Background(), types.NamespacedName{Name: "etok"}, &cfg)
+				for _, wh := range cfg.Webhooks {
+					assert.Equal(t, []byte("ca"), wh.ClientConfig.CABundle)
+				}
+			},
+		},
+		{
+			name: "fresh install without webhooks",
+			args: []string{"install", "--wait=false", "--webhooks=false"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator", "--state-server-url", "https://etok-state.etok.svc", "--state-server-namespace", "etok"}, d.Spec.Template.Spec.Containers[0].Args)
+
+				var cfg admissionregistrationv1.ValidatingWebhookConfiguration
+				assert.True(t, kerrors.IsNotFound(client.Get(context.Background(), types.NamespacedName{Name: "etok"}, &cfg)))
+			},
+		},
+		{
+			name: "fresh install without state server",
+			args: []string{"install", "--wait=false", "--webhooks=false", "--state-server=false"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator"}, d.Spec.Template.Spec.Containers[0].Args)
+
+				var svc corev1.Service
+				assert.True(t, kerrors.IsNotFound(client.Get(context.Background(), types.NamespacedName{Namespace: "etok", Name: "etok-state"}, &svc)))
+			},
+		},
+		{
+			name: "fresh install with web server",
+			args: []string{"install", "--wait=false", "--webhooks=false", "--state-server=false", "--web"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator", "--enable-web", "--web-namespace", "etok"}, d.Spec.Template.Spec.Containers[0].Args)
+
+				var svc corev1.Service
+				assert.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "etok", Name: "etok-web"}, &svc))
+				assert.Equal(t, int32(443), svc.Spec.Ports[0].Port)
+			},
+		},
+		{
+			name: "fresh install with vcs provider",
+			args: []string{"install", "--wait=false", "--webhooks=false", "--state-server=false", "--vcs-provider", "gitlab", "--vcs-api-url", "https://gitlab.example.com/api/v4", "--vcs-secret", "vcs-creds"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator", "--vcs-provider", "gitlab", "--vcs-token-file", "/etc/etok/vcs/token", "--vcs-webhook-secret-file", "/etc/etok/vcs/webhook-secret", "--vcs-api-url", "https://gitlab.example.com/api/v4"}, d.Spec.Template.Spec.Containers[0].Args)
+				assert.Equal(t, "vcs-creds", d.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+
+				var svc corev1.Service
+				assert.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "etok", Name: "etok-vcs"}, &svc))
+			},
+		},
+		{
+			name: "fresh install with state encryption key",
+			args: []string{"install", "--wait=false", "--webhooks=false", "--state-encryption-key-secret", "state-key"},
+			assertions: func(t *testutil.T, client runtimeclient.Client) {
+				var d = deploy()
+				client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(d), d)
+				assert.Equal(t, []string{"operator", "--state-server-url", "https://etok-state.etok.svc", "--state-server-namespace", "etok", "--state-encryption-key-file", "/etc/etok/state-encryption-key/key"}, d.Spec.Template.Spec.Containers[0].Args)
+				assert.Equal(t, "state-key", d.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+
+				var svc corev1.Service
+				assert.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "etok", Name: "etok-state"}, &svc))
+				assert.Equal(t, int32(443), svc.Spec.Ports[0].Port)
+			},
+		},
 		{
 			name: "fresh install with custom image",
 			args: []string{"install", "--wait=false", "--image", "bugsbunny:v123"},
@@ -115,7 +210,7 @@ func TestInstall(t *testing.T) {
 
 			// assert non-CRD resources are present unless only CRDs are
 			// requested
-			if !opts.crdsOnly {
+			if !opts.crdsOnly && opts.webhooks {
 				for _, res := range wantedResources() {
 					assert.NoError(t, client.Get(context.Background(), runtimeclient.ObjectKeyFromObject(res), res))
 				}
@@ -177,13 +272,15 @@ func TestInstallDryRun(t *testing.T) {
 			Factory: &cmdutil.Factory{
 				IOStreams: cmdutil.IOStreams{Out: out},
 			},
-			dryRun: true,
-			local:  true,
+			dryRun:      true,
+			local:       true,
+			webhooks:    true,
+			stateServer: true,
 		}
 		require.NoError(t, opts.install(context.Background()))
 
 		docs := strings.Split(out.String(), "---\n")
-		assert.Equal(t, 11, len(docs))
+		assert.Equal(t, 15, len(docs))
 	})
 }
 
@@ -213,9 +310,20 @@ func wantedResources() (resources []runtimeclient.Object) {
 	resources = append(resources, &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "etok-user"}})
 	resources = append(resources, &rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "etok-admin"}})
 	resources = append(resources, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "etok", Name: "etok"}})
+	resources = append(resources, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "etok", Name: "etok-webhook"}})
+	resources = append(resources, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "etok", Name: "etok-state"}})
+	resources = append(resources, &admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "etok"}})
+	resources = append(resources, &admissionregistrationv1.ValidatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "etok"}})
 	return
 }
 
+func withCABundle(cfg *admissionregistrationv1.MutatingWebhookConfiguration, ca []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	for i := range cfg.Webhooks {
+		cfg.Webhooks[i].ClientConfig.CABundle = ca
+	}
+	return cfg
+}
+
 func deploy() *appsv1.Deployment {
 	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
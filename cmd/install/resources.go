@@ -1,9 +1,15 @@
 package install
 
 import (
+	"github.com/leg100/etok/pkg/backend"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/vcs"
+	"github.com/leg100/etok/pkg/web"
+	"github.com/leg100/etok/pkg/webhooks"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func namespace(namespace string) *corev1.Namespace {
@@ -107,3 +113,111 @@ func secret(namespace string, key []byte) *corev1.Secret {
 
 	return secret
 }
+
+// webhookService fronts the operator's webhook server
+func webhookService(namespace string) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: corev1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      webhooks.ServiceName,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels.MakeLabels(
+				labels.App,
+				labels.OperatorComponent,
+			),
+			Ports: []corev1.ServicePort{
+				{
+					Port:       443,
+					TargetPort: intstr.FromInt(webhooks.Port),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// stateService fronts the operator's state server
+func stateService(namespace string) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: corev1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backend.ServiceName,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels.MakeLabels(
+				labels.App,
+				labels.OperatorComponent,
+			),
+			Ports: []corev1.ServicePort{
+				{
+					Port:       443,
+					TargetPort: intstr.FromInt(backend.Port),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// webService fronts the operator's web server
+func webService(namespace string) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: corev1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      web.ServiceName,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels.MakeLabels(
+				labels.App,
+				labels.OperatorComponent,
+			),
+			Ports: []corev1.ServicePort{
+				{
+					Port:       443,
+					TargetPort: intstr.FromInt(web.Port),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// vcsService fronts the operator's VCS webhook receiver
+func vcsService(namespace string) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Service",
+			APIVersion: corev1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vcs.ServiceName,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels.MakeLabels(
+				labels.App,
+				labels.OperatorComponent,
+			),
+			Ports: []corev1.ServicePort{
+				{
+					Port:       80,
+					TargetPort: intstr.FromInt(vcs.Port),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
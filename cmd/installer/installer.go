@@ -0,0 +1,348 @@
+package installer
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultMirror is the default URL from which terraform is downloaded
+	DefaultMirror = "https://releases.hashicorp.com/terraform"
+
+	// HashicorpFingerprint is the fingerprint of HashiCorp's release signing
+	// key. The public key is only trusted if its fingerprint matches.
+	HashicorpFingerprint = "C874011F0AB405110D02105534365D9472D7468F"
+
+	// versionsDir is the directory within the bin directory in which each
+	// version of terraform is cached
+	versionsDir = "versions"
+)
+
+// hashicorpKey is HashiCorp's armored public key, with which the signature of
+// the checksums file is verified unless another key is specified. Refresh it
+// with `make hashicorp-key`.
+//
+//go:embed hashicorp.asc
+var hashicorpKey []byte
+
+var (
+	errNoKey               = errors.New("no public key embedded in binary")
+	errChecksumMismatch    = errors.New("checksum mismatch")
+	errChecksumNotFound    = errors.New("checksum not found")
+	errFingerprintMismatch = errors.New("public key fingerprint mismatch")
+	errBinaryNotFound      = errors.New("terraform binary not found in zip archive")
+)
+
+// InstallerOptions installs a version of terraform into a bin directory, on
+// the PATH of both the workspace and run pods. Each version is cached in its
+// own directory, and the bin directory's terraform symlink points to the
+// requested version.
+type InstallerOptions struct {
+	*cmdutil.Factory
+
+	version string
+	mirror  string
+	binDir  string
+	os      string
+	arch    string
+
+	// Path to armored public key with which to verify the checksums file.
+	// Empty string means use HashiCorp's embedded public key.
+	keyPath string
+	// Fingerprint that the public key is expected to possess. Empty string
+	// disables the check.
+	fingerprint string
+
+	client *http.Client
+}
+
+func InstallerCmd(f *cmdutil.Factory) (*cobra.Command, *InstallerOptions) {
+	o := &InstallerOptions{
+		Factory: f,
+		client:  http.DefaultClient,
+	}
+
+	cmd := &cobra.Command{
+		Use:    "install-terraform",
+		Short:  "Install terraform",
+		Long:   "Install terraform downloads the requested version of terraform from a mirror, verifying the signature of its checksums file and its checksum, and then extracts the binary into a version-specific directory within the bin directory. If the version has already been downloaded then it is not downloaded again. A symlink named terraform in the bin directory is updated to point to the requested version.",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.version == "" {
+				return errors.New("--version cannot be empty")
+			}
+			return o.Install(cmd.Context())
+		},
+	}
+
+	cmd.Flags().StringVar(&o.version, "version", "", "Terraform version to install")
+	cmd.Flags().StringVar(&o.mirror, "mirror", DefaultMirror, "URL of mirror from which to download terraform")
+	cmd.Flags().StringVar(&o.binDir, "bin-dir", "/terraform-bins", "Directory in which to install terraform")
+	cmd.Flags().StringVar(&o.os, "os", runtime.GOOS, "Operating system of terraform binary")
+	cmd.Flags().StringVar(&o.arch, "arch", runtime.GOARCH, "Architecture of terraform binary")
+	cmd.Flags().StringVar(&o.keyPath, "gpg-key", "", "Path to armored public key with which to verify checksums (defaults to HashiCorp's embedded key)")
+	cmd.Flags().StringVar(&o.fingerprint, "gpg-fingerprint", HashicorpFingerprint, "Expected fingerprint of public key (empty string disables check)")
+
+	return cmd, o
+}
+
+// Install the requested version of terraform.
+func (o *InstallerOptions) Install(ctx context.Context) error {
+	fmt.Fprintf(o.Out, "Requested terraform version is %s\n", o.version)
+
+	dst := filepath.Join(o.binDir, versionsDir, o.version, "terraform")
+
+	if _, err := os.Stat(dst); err == nil {
+		fmt.Fprintf(o.Out, "Terraform %s found in cache\n", o.version)
+		return o.link()
+	}
+
+	if o.builtinVersion() == o.version {
+		// The container image's terraform binary is found on the PATH after
+		// the bin directory, so remove the symlink to ensure the builtin
+		// binary is used.
+		fmt.Fprintf(o.Out, "Terraform %s is already installed, skipping installation\n", o.version)
+		return o.unlink()
+	}
+
+	keyring, err := o.readKeyring()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Downloading terraform %s checksums...\n", o.version)
+	sums, err := o.download(ctx, fmt.Sprintf("terraform_%s_SHA256SUMS", o.version))
+	if err != nil {
+		return err
+	}
+	sig, err := o.download(ctx, fmt.Sprintf("terraform_%s_SHA256SUMS.sig", o.version))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(o.Out, "Verifying checksums signature...")
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(sums), bytes.NewReader(sig))
+	if err != nil {
+		return fmt.Errorf("unable to verify checksums signature: %w", err)
+	}
+	klog.V(1).Infof("checksums signed by key %X", signer.PrimaryKey.Fingerprint)
+
+	zipName := fmt.Sprintf("terraform_%s_%s_%s.zip", o.version, o.os, o.arch)
+	want, err := findChecksum(sums, zipName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Downloading %s...\n", zipName)
+	zipFile, err := o.download(ctx, zipName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(o.Out, "Verifying checksum...")
+	got := sha256.Sum256(zipFile)
+	if hex.EncodeToString(got[:]) != want {
+		return fmt.Errorf("%w: %s", errChecksumMismatch, zipName)
+	}
+
+	fmt.Fprintf(o.Out, "Extracting terraform %s...\n", o.version)
+	if err := extract(zipFile, dst); err != nil {
+		return err
+	}
+
+	return o.link()
+}
+
+// readKeyring reads the armored public key, and checks its fingerprint
+func (o *InstallerOptions) readKeyring() (openpgp.EntityList, error) {
+	key := hashicorpKey
+	if o.keyPath != "" {
+		var err error
+		key, err = ioutil.ReadFile(o.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open public key: %w", err)
+		}
+	} else if len(bytes.TrimSpace(key)) == 0 {
+		return nil, errNoKey
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+
+	if o.fingerprint == "" {
+		return keyring, nil
+	}
+
+	// Only trust the key with the expected fingerprint
+	for _, entity := range keyring {
+		if strings.EqualFold(fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint), o.fingerprint) {
+			return openpgp.EntityList{entity}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: expected %s", errFingerprintMismatch, o.fingerprint)
+}
+
+// download retrieves the named file for the requested version from the mirror
+func (o *InstallerOptions) download(ctx context.Context, filename string) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(o.mirror, "/"), o.version, filename)
+	klog.V(1).Infof("downloading %s", url)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// builtinVersion returns the version of the terraform binary found on the PATH,
+// excluding the bin directory, or an empty string if it cannot be determined.
+func (o *InstallerOptions) builtinVersion() string {
+	var bin string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(dir) == filepath.Clean(o.binDir) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(dir, "terraform")); err == nil && !info.IsDir() {
+			bin = filepath.Join(dir, "terraform")
+			break
+		}
+	}
+	if bin == "" {
+		return ""
+	}
+
+	// Older versions of terraform do not support the -json flag, in which
+	// case the version is not determined and terraform is downloaded
+	out, err := exec.Command(bin, "version", "-json").Output()
+	if err != nil {
+		return ""
+	}
+
+	var version struct {
+		Version string `json:"terraform_version"`
+	}
+	if err := json.Unmarshal(out, &version); err != nil {
+		return ""
+	}
+	return version.Version
+}
+
+// link points the terraform symlink in the bin directory to the requested
+// version
+func (o *InstallerOptions) link() error {
+	if err := o.unlink(); err != nil {
+		return err
+	}
+
+	target := filepath.Join(versionsDir, o.version, "terraform")
+	if err := os.Symlink(target, filepath.Join(o.binDir, "terraform")); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Terraform %s installed\n", o.version)
+	return nil
+}
+
+// unlink removes the terraform symlink in the bin directory, if it exists
+func (o *InstallerOptions) unlink() error {
+	if err := os.Remove(filepath.Join(o.binDir, "terraform")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// findChecksum finds the checksum for filename in the contents of a checksums
+// file
+func findChecksum(sums []byte, filename string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == filename {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w: %s", errChecksumNotFound, filename)
+}
+
+// extract the terraform binary from the zip file to dst. The binary is first
+// written to a temporary file and then renamed, to ensure an incomplete binary
+// is never cached.
+func extract(zipFile []byte, dst string) error {
+	zr, err := zip.NewReader(bytes.NewReader(zipFile), int64(len(zipFile)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.Name != "terraform" {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		tmp, err := ioutil.TempFile(filepath.Dir(dst), ".terraform-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		if _, err := io.Copy(tmp, src); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp.Name(), 0755); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), dst)
+	}
+
+	return errBinaryNotFound
+}
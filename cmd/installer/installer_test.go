@@ -0,0 +1,247 @@
+package installer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+func TestInstaller(t *testing.T) {
+	signer := newEntity(t)
+	imposter := newEntity(t)
+
+	zipFile := newZip(t, "terraform", "#!/bin/sh\necho fake terraform\n")
+	sums := []byte(fmt.Sprintf("%s  terraform_0.14.3_linux_amd64.zip\n", sha256Hex(zipFile)))
+
+	tests := []struct {
+		name string
+		args []string
+		// Files served by mirror
+		files map[string][]byte
+		// Entity to sign checksums file
+		signer *openpgp.Entity
+		// Setup bin dir and path prior to running installer
+		setup      func(t *testutil.T, binDir, pathDir string)
+		err        error
+		assertions func(t *testutil.T, binDir string, out string)
+	}{
+		{
+			name: "install",
+			files: map[string][]byte{
+				"terraform_0.14.3_SHA256SUMS":      sums,
+				"terraform_0.14.3_linux_amd64.zip": zipFile,
+			},
+			signer: signer,
+			assertions: func(t *testutil.T, binDir string, out string) {
+				target, err := os.Readlink(filepath.Join(binDir, "terraform"))
+				require.NoError(t, err)
+				assert.Equal(t, "versions/0.14.3/terraform", target)
+
+				info, err := os.Stat(filepath.Join(binDir, "versions/0.14.3/terraform"))
+				require.NoError(t, err)
+				assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+				assert.Contains(t, out, "Terraform 0.14.3 installed")
+			},
+		},
+		{
+			name:   "cached",
+			signer: signer,
+			setup: func(t *testutil.T, binDir, pathDir string) {
+				require.NoError(t, os.MkdirAll(filepath.Join(binDir, "versions/0.14.3"), 0755))
+				require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "versions/0.14.3/terraform"), []byte("cached"), 0755))
+				// Symlink to different version
+				require.NoError(t, os.Symlink("versions/0.13.5/terraform", filepath.Join(binDir, "terraform")))
+			},
+			assertions: func(t *testutil.T, binDir string, out string) {
+				target, err := os.Readlink(filepath.Join(binDir, "terraform"))
+				require.NoError(t, err)
+				assert.Equal(t, "versions/0.14.3/terraform", target)
+
+				assert.Contains(t, out, "Terraform 0.14.3 found in cache")
+			},
+		},
+		{
+			name:   "builtin version",
+			signer: signer,
+			setup: func(t *testutil.T, binDir, pathDir string) {
+				script := "#!/bin/sh\necho '{\"terraform_version\":\"0.14.3\"}'\n"
+				require.NoError(t, ioutil.WriteFile(filepath.Join(pathDir, "terraform"), []byte(script), 0755))
+				require.NoError(t, os.Symlink("versions/0.13.5/terraform", filepath.Join(binDir, "terraform")))
+			},
+			assertions: func(t *testutil.T, binDir string, out string) {
+				_, err := os.Lstat(filepath.Join(binDir, "terraform"))
+				assert.True(t, os.IsNotExist(err))
+
+				assert.Contains(t, out, "Terraform 0.14.3 is already installed")
+			},
+		},
+		{
+			name: "checksum mismatch",
+			files: map[string][]byte{
+				"terraform_0.14.3_SHA256SUMS":      sums,
+				"terraform_0.14.3_linux_amd64.zip": newZip(t, "terraform", "#!/bin/sh\necho malicious\n"),
+			},
+			signer: signer,
+			err:    errChecksumMismatch,
+		},
+		{
+			name: "checksum not found",
+			args: []string{"--arch", "arm64"},
+			files: map[string][]byte{
+				"terraform_0.14.3_SHA256SUMS":      sums,
+				"terraform_0.14.3_linux_amd64.zip": zipFile,
+			},
+			signer: signer,
+			err:    errChecksumNotFound,
+		},
+		{
+			name: "signed by unknown key",
+			files: map[string][]byte{
+				"terraform_0.14.3_SHA256SUMS":      sums,
+				"terraform_0.14.3_linux_amd64.zip": zipFile,
+			},
+			signer: imposter,
+			err:    pgperrors.ErrUnknownIssuer,
+		},
+		{
+			name:   "fingerprint mismatch",
+			args:   []string{"--gpg-fingerprint", "C874011F0AB405110D02105534365D9472D7468F"},
+			signer: signer,
+			err:    errFingerprintMismatch,
+		},
+		{
+			name: "binary not in zip",
+			files: map[string][]byte{
+				"terraform_0.14.3_SHA256SUMS":      []byte(fmt.Sprintf("%s  terraform_0.14.3_linux_amd64.zip\n", sha256Hex(newZip(t, "README", "")))),
+				"terraform_0.14.3_linux_amd64.zip": newZip(t, "README", ""),
+			},
+			signer: signer,
+			err:    errBinaryNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// Serve files from mirror, along with a signature of the checksums
+			// file
+			files := make(map[string][]byte)
+			for k, v := range tt.files {
+				files["/0.14.3/"+k] = v
+			}
+			if sums, ok := tt.files["terraform_0.14.3_SHA256SUMS"]; ok {
+				sig := new(bytes.Buffer)
+				require.NoError(t, openpgp.DetachSign(sig, tt.signer, bytes.NewReader(sums), nil))
+				files["/0.14.3/terraform_0.14.3_SHA256SUMS.sig"] = sig.Bytes()
+			}
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				content, ok := files[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(content)
+			}))
+			defer mirror.Close()
+
+			binDir := t.NewTempDir().Root()
+			pathDir := t.NewTempDir().Root()
+			keyPath := filepath.Join(t.NewTempDir().Root(), "key.asc")
+			writeArmoredKey(t, keyPath, signer)
+
+			// Ensure a terraform binary is only found on the PATH if the test
+			// puts one there
+			t.SetEnvs(map[string]string{"PATH": pathDir})
+
+			if tt.setup != nil {
+				tt.setup(t, binDir, pathDir)
+			}
+
+			out := new(bytes.Buffer)
+			cmd, _ := InstallerCmd(cmdutil.NewFakeFactory(out))
+			cmd.SetOut(out)
+			cmd.SetArgs(append([]string{
+				"--version", "0.14.3",
+				"--mirror", mirror.URL,
+				"--bin-dir", binDir,
+				"--os", "linux",
+				"--arch", "amd64",
+				"--gpg-key", keyPath,
+				"--gpg-fingerprint", fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint),
+			}, tt.args...))
+
+			err := cmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.err)) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if tt.assertions != nil {
+				tt.assertions(t, binDir, out.String())
+			}
+		})
+	}
+}
+
+func newEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("etok", "test", "etok@example.com", nil)
+	require.NoError(t, err)
+	return entity
+}
+
+func writeArmoredKey(t *testutil.T, path string, entity *openpgp.Entity) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+}
+
+func newZip(t *testing.T, name, content string) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create(name)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestEmbeddedKey(t *testing.T) {
+	// Without the embedded key every install other than the builtin version
+	// fails
+	require.NotEmpty(t, bytes.TrimSpace(hashicorpKey), "hashicorp.asc is empty: run make hashicorp-key")
+
+	// Embedded key must be HashiCorp's key
+	o := &InstallerOptions{fingerprint: HashicorpFingerprint}
+	keyring, err := o.readKeyring()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(keyring))
+	assert.Equal(t, HashicorpFingerprint, fmt.Sprintf("%X", keyring[0].PrimaryKey.Fingerprint))
+}
@@ -0,0 +1,97 @@
+package launcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/globals"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// artifact is a file to be returned from the run's pod to the client
+type artifact struct {
+	// Path to file on pod, relative to the root module
+	remote string
+	// Path to which the file is written on the client
+	local string
+	// Optional artifacts are skipped if not found
+	optional bool
+}
+
+// parseArtifacts parses the artifact flags, each of which is of the form
+// <remote>:<local>, or <remote> in which case the local path is the same as
+// the remote path. Commands that update the lock file implicitly request it as
+// an optional artifact, to be written to the root module.
+func (o *launcherOptions) parseArtifacts() error {
+	for _, f := range o.artifactFlags {
+		parts := strings.SplitN(f, ":", 2)
+
+		a := artifact{remote: parts[0], local: parts[0]}
+		if len(parts) == 2 {
+			a.local = parts[1]
+		}
+		if a.remote == "" || a.local == "" {
+			return fmt.Errorf("%w: %s: expected <remote>:<local>", errInvalidArtifact, f)
+		}
+		o.artifacts = append(o.artifacts, a)
+	}
+
+	if UpdatesLockFile(o.command) {
+		// Some commands (e.g. terraform init) update the lock file,
+		// .terraform.lock.hcl, and it's recommended that this be committed to
+		// version control.
+		o.artifacts = append(o.artifacts, artifact{
+			remote:   globals.LockFile,
+			local:    filepath.Join(o.path, globals.LockFile),
+			optional: true,
+		})
+	}
+
+	return nil
+}
+
+// downloadArtifacts retrieves the config map containing the run's artifacts,
+// written by the runner, and writes the artifacts to the local filesystem.
+func (o *launcherOptions) downloadArtifacts(ctx context.Context, run *v1alpha1.Run) error {
+	var data map[string][]byte
+
+	configMap, err := o.ConfigMapsClient(o.namespace).Get(ctx, run.ArtifactsConfigMapName(), metav1.GetOptions{})
+	if err != nil {
+		// The runner skips creating the config map if none of the artifacts
+		// were found
+		if !kerrors.IsNotFound(err) {
+			return err
+		}
+	} else {
+		data = configMap.BinaryData
+	}
+
+	for _, a := range o.artifacts {
+		contents, ok := data[v1alpha1.ArtifactKey(a.remote)]
+		if !ok {
+			if a.optional {
+				klog.V(1).Infof("artifact %s not found", a.remote)
+				continue
+			}
+			return fmt.Errorf("%w: %s", errArtifactNotFound, a.remote)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(a.local), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(a.local, contents, 0644); err != nil {
+			return err
+		}
+
+		klog.V(1).Infof("Written %s", a.local)
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	errBatchIncompatible    = errors.New("incompatible with --selector")
+	errInvalidConcurrency   = errors.New("--concurrency must be at least 1")
+	errNoWorkspacesSelected = errors.New("no workspaces match selector")
+	errBatchFailed          = errors.New("runs failed to complete")
+)
+
+// batchResult is the outcome of running the command on a workspace in a batch
+type batchResult struct {
+	workspace string
+	// Name of run, empty if the run was not created
+	run string
+	err error
+}
+
+// runBatch runs the command on each workspace matching the label selector. The
+// runs share a single archive, and up to the maximum concurrency run at any one
+// time. Their output is prefixed with the name of their workspace, unless only
+// a summary is requested.
+func (o *launcherOptions) runBatch(ctx context.Context) error {
+	if o.detach {
+		return fmt.Errorf("--detach is %w", errBatchIncompatible)
+	}
+	if len(o.artifacts) > 0 {
+		return fmt.Errorf("--artifact is %w", errBatchIncompatible)
+	}
+	if o.concurrency < 1 {
+		return errInvalidConcurrency
+	}
+
+	workspaces, err := o.selectWorkspaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	tarball, root, hash, err := o.pack(o.batchGitTrackedOnly(workspaces))
+	if err != nil {
+		return err
+	}
+
+	configMapName := v1alpha1.BatchArchiveConfigMapName(hash)
+	if err := o.ensureConfigMap(ctx, tarball, configMapName, v1alpha1.RunDefaultConfigMapKey); err != nil {
+		return err
+	}
+
+	out := &syncWriter{w: o.Out}
+	results := make([]batchResult, len(workspaces))
+	sem := make(chan struct{}, o.concurrency)
+
+	var wg sync.WaitGroup
+	for i := range workspaces {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = batchResult{workspace: workspaces[i].Name, err: ctx.Err()}
+				return
+			}
+
+			results[i] = o.runBatchMember(ctx, &workspaces[i], tarball, configMapName, root, out)
+		}(i)
+	}
+	wg.Wait()
+
+	o.printSummary(results)
+
+	if o.createdArchive && !o.disableResourceCleanup && !anyRunCreated(results) {
+		o.cleanup()
+	}
+
+	return batchError(results)
+}
+
+// selectWorkspaces lists the workspaces matching the label selector, sorted by
+// name
+func (o *launcherOptions) selectWorkspaces(ctx context.Context) ([]v1alpha1.Workspace, error) {
+	list, err := o.WorkspacesClient(o.namespace).List(ctx, metav1.ListOptions{LabelSelector: o.selector})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("%w: %s", errNoWorkspacesSelected, o.selector)
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	return list.Items, nil
+}
+
+// batchGitTrackedOnly determines whether only files tracked by git should be
+// archived for a batch. The flag takes precedence, otherwise all the selected
+// workspaces must have enabled the setting.
+func (o *launcherOptions) batchGitTrackedOnly(workspaces []v1alpha1.Workspace) bool {
+	if o.gitTrackedOnlyPassed {
+		return o.gitTrackedOnly
+	}
+	for _, ws := range workspaces {
+		if !ws.Spec.GitTrackedOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// runBatchMember runs the command on a workspace in a batch, using the batch's
+// archive
+func (o *launcherOptions) runBatchMember(ctx context.Context, ws *v1alpha1.Workspace, tarball []byte, configMapName, root string, out io.Writer) batchResult {
+	var w io.Writer = ioutil.Discard
+	if !o.summary {
+		pw := newPrefixWriter(out, fmt.Sprintf("[%s] ", ws.Name))
+		defer pw.Flush()
+		w = pw
+	}
+
+	member := o.batchMember(ws.Name, w)
+	result := batchResult{workspace: ws.Name}
+
+	run, err := member.createRun(ctx, member.runName, configMapName, false, root)
+	if err == nil {
+		result.run = run.Name
+		err = member.ownArchive(ctx, run, tarball, configMapName, v1alpha1.RunDefaultConfigMapKey)
+	}
+	if err == nil {
+		err = member.follow(ctx, run, false)
+	}
+
+	var exit etokerrors.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		fmt.Fprintf(w, "Error: %s\n", err.Error())
+		if !o.disableResourceCleanup {
+			member.cleanup()
+		}
+	}
+
+	result.err = err
+	return result
+}
+
+// batchMember constructs options for running the command on a workspace in a
+// batch, writing output to the given writer
+func (o *launcherOptions) batchMember(workspace string, out io.Writer) *launcherOptions {
+	f := *o.Factory
+	f.Out = out
+
+	member := *o
+	member.Factory = &f
+	member.workspace = workspace
+	member.runName = fmt.Sprintf("run-%s", util.GenerateRandomString(5))
+	member.batch = true
+	member.createdRun = false
+	member.createdArchive = false
+
+	return &member
+}
+
+// printSummary prints a table summarising the outcome of each run in a batch
+func (o *launcherOptions) printSummary(results []batchResult) {
+	tw := tabwriter.NewWriter(o.Out, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "WORKSPACE\tRUN\tRESULT")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.workspace, cmdutil.OrNone(r.run), r.describe())
+	}
+	if err := tw.Flush(); err != nil {
+		klog.Errorf("unable to print summary: %s", err.Error())
+	}
+}
+
+func (r batchResult) describe() string {
+	var exit etokerrors.ExitError
+	switch {
+	case r.err == nil:
+		return "exit code 0"
+	case errors.As(r.err, &exit):
+		return fmt.Sprintf("exit code %d", exit.ExitCode())
+	default:
+		return fmt.Sprintf("error: %s", r.err.Error())
+	}
+}
+
+func anyRunCreated(results []batchResult) bool {
+	for _, r := range results {
+		if r.run != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// batchError aggregates the outcomes of a batch's runs. If any run failed to
+// complete an error is returned, otherwise the highest exit code of the runs
+// is returned.
+func batchError(results []batchResult) error {
+	var failed, code int
+	for _, r := range results {
+		var exit etokerrors.ExitError
+		switch {
+		case r.err == nil:
+		case errors.As(r.err, &exit):
+			if exit.ExitCode() > code {
+				code = exit.ExitCode()
+			}
+		default:
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errBatchFailed, failed, len(results))
+	}
+	if code > 0 {
+		return etokerrors.NewExitError(code)
+	}
+	return nil
+}
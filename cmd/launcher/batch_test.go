@@ -0,0 +1,169 @@
+package launcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestLauncherBatch(t *testing.T) {
+	prod := testobj.WithLabels(map[string]string{"env": "prod"})
+
+	tests := []struct {
+		name       string
+		args       []string
+		objs       []runtime.Object
+		code       int
+		err        error
+		assertions func(*testutil.T, *launcherOptions, string)
+	}{
+		{
+			name: "fan out across selected workspaces",
+			args: []string{"-l", "env=prod"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "eu-west", prod),
+				testobj.Workspace("default", "us-east", prod),
+				testobj.Workspace("default", "dev"),
+			},
+			assertions: func(t *testutil.T, o *launcherOptions, out string) {
+				runs, err := o.RunsClient("default").List(context.Background(), metav1.ListOptions{})
+				require.NoError(t, err)
+				if assert.Equal(t, 2, len(runs.Items)) {
+					// Runs share a single archive
+					assert.Equal(t, runs.Items[0].ConfigMap, runs.Items[1].ConfigMap)
+
+					var workspaces []string
+					for _, run := range runs.Items {
+						workspaces = append(workspaces, run.Workspace)
+					}
+					assert.ElementsMatch(t, []string{"eu-west", "us-east"}, workspaces)
+				}
+
+				configMaps, err := o.ConfigMapsClient("default").List(context.Background(), metav1.ListOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, 1, len(configMaps.Items))
+
+				assert.Contains(t, out, "[eu-west] fake logs\n")
+				assert.Contains(t, out, "[us-east] fake logs\n")
+				assert.Regexp(t, `eu-west\s+run-\w{5}\s+exit code 0`, out)
+				assert.Regexp(t, `us-east\s+run-\w{5}\s+exit code 0`, out)
+			},
+		},
+		{
+			name: "summary only",
+			args: []string{"-l", "env=prod", "--summary"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "eu-west", prod),
+			},
+			assertions: func(t *testutil.T, o *launcherOptions, out string) {
+				assert.NotContains(t, out, "fake logs")
+				assert.Regexp(t, `eu-west\s+run-\w{5}\s+exit code 0`, out)
+			},
+		},
+		{
+			name: "aggregate exit code",
+			args: []string{"-l", "env=prod"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "eu-west", prod),
+				testobj.Workspace("default", "us-east", prod),
+			},
+			code: 2,
+			err:  etokerrors.NewExitError(2),
+		},
+		{
+			name: "no matching workspaces",
+			args: []string{"-l", "env=prod"},
+			objs: []runtime.Object{testobj.Workspace("default", "dev")},
+			err:  errNoWorkspacesSelected,
+		},
+		{
+			name: "incompatible with detach",
+			args: []string{"-l", "env=prod", "--detach"},
+			err:  errBatchIncompatible,
+		},
+		{
+			name: "invalid concurrency",
+			args: []string{"-l", "env=prod", "--concurrency", "0"},
+			err:  errInvalidConcurrency,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			t.NewTempDir().Chdir().Write("main.tf", []byte("# empty"))
+
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			opts := &launcherOptions{command: "plan"}
+
+			// Mock the run controller by setting status up front
+			code := tt.code
+			opts.status = &v1alpha1.RunStatus{
+				Conditions: []metav1.Condition{
+					{
+						Type:   v1alpha1.RunCompleteCondition,
+						Status: metav1.ConditionFalse,
+						Reason: v1alpha1.PodRunningReason,
+					},
+				},
+				Phase:    v1alpha1.RunPhaseRunning,
+				ExitCode: &code,
+			}
+
+			cmd := launcherCommand(f, opts)
+			cmd.SetOut(out)
+			cmd.SetArgs(tt.args)
+
+			err := cmd.ExecuteContext(context.Background())
+			assert.True(t, errors.Is(err, tt.err), err)
+
+			if tt.assertions != nil {
+				tt.assertions(t, opts, out.String())
+			}
+		})
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		results []batchResult
+		err     error
+	}{
+		{
+			name:    "all succeeded",
+			results: []batchResult{{}, {}},
+		},
+		{
+			name:    "highest exit code",
+			results: []batchResult{{err: etokerrors.NewExitError(1)}, {err: etokerrors.NewExitError(2)}, {}},
+			err:     etokerrors.NewExitError(2),
+		},
+		{
+			name:    "failure takes precedence over exit code",
+			results: []batchResult{{err: etokerrors.NewExitError(2)}, {err: failed}},
+			err:     errBatchFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			err := batchError(tt.results)
+			assert.True(t, errors.Is(err, tt.err), err)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package launcher
+
+import "github.com/leg100/etok/pkg/util/slice"
+
+// Commands that can be run on a workspace.
+var commands = []string{
+	"apply",
+	"console",
+	"destroy",
+	"force-unlock",
+	"get",
+	"graph",
+	"import",
+	"init",
+	"output",
+	"plan",
+	"providers",
+	"providers lock",
+	"refresh",
+	"show",
+	"state list",
+	"state mv",
+	"state pull",
+	"state push",
+	"state replace-provider",
+	"state rm",
+	"state show",
+	"taint",
+	"untaint",
+	"validate",
+	"sh",
+}
+
+func IsCommand(cmd string) bool {
+	return slice.ContainsString(commands, cmd)
+}
@@ -3,12 +3,14 @@ package launcher
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
@@ -25,6 +27,7 @@ import (
 	"github.com/leg100/etok/pkg/logstreamer"
 	"github.com/leg100/etok/pkg/monitors"
 	"github.com/leg100/etok/pkg/util"
+	"github.com/leg100/etok/pkg/util/git"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 
@@ -32,6 +35,7 @@ import (
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	watchtools "k8s.io/client-go/tools/watch"
 	"k8s.io/klog/v2"
@@ -41,6 +45,10 @@ import (
 const (
 	defaultWorkspace        = "default"
 	defaultReconcileTimeout = 10 * time.Second
+	defaultConcurrency      = 10
+
+	// interval between checks for the deletion of an archive
+	archiveDeletionInterval = 500 * time.Millisecond
 
 	// default namespace runs are created in
 	defaultNamespace = "default"
@@ -51,6 +59,9 @@ var (
 	errWorkspaceNotFound = errors.New("workspace not found")
 	errWorkspaceNotReady = errors.New("workspace not ready")
 	errReconcileTimeout  = errors.New("timed out waiting for run to be reconciled")
+	errInvalidArtifact   = errors.New("invalid artifact")
+	errArtifactNotFound  = errors.New("artifact not found")
+	errDetachArtifacts   = errors.New("artifacts cannot be downloaded from a detached run")
 )
 
 // launcherOptions deploys a new Run. It monitors not only its progress, but
@@ -93,10 +104,46 @@ type launcherOptions struct {
 	// Disable TTY detection
 	disableTTY bool
 
+	// Maximum number of times to retry the run's pod upon infrastructure
+	// failures
+	retries int
+	// Retry the run's pod if it is pending for longer than this
+	pendingTimeout time.Duration
+
+	// Create the run and exit without waiting for it to complete
+	detach bool
+
+	// Label selector for workspaces on which to run the command, in a batch
+	selector string
+	// Maximum number of runs in a batch that run concurrently
+	concurrency int
+	// Print only a summary table of a batch's runs, rather than their output
+	summary bool
+	// Run is one of a batch of runs
+	batch bool
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Run regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// Artifacts to be downloaded from the run, specified as <remote>:<local>
+	artifactFlags []string
+	artifacts     []artifact
+
+	// Only archive files tracked by git. Defaults to the workspace's setting
+	// unless the flag is explicitly set.
+	gitTrackedOnly       bool
+	gitTrackedOnlyPassed bool
+
 	// Recall if resources are created so that if error occurs they can be cleaned up
 	createdRun     bool
 	createdArchive bool
 
+	// Name of archive config map, set once it has been created or found to
+	// already exist
+	archiveName string
+
 	// For testing purposes set run status
 	status *v1alpha1.RunStatus
 }
@@ -116,15 +163,29 @@ func launcherCommand(f *cmdutil.Factory, o *launcherOptions) *cobra.Command {
 				o.runName = fmt.Sprintf("run-%s", util.GenerateRandomString(5))
 			}
 
+			if err := o.lookupEnvFile(cmd); err != nil {
+				return err
+			}
+
 			o.Client, err = f.Create(o.kubeContext)
 			if err != nil {
 				return err
 			}
 
-			if err := o.lookupEnvFile(cmd); err != nil {
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
 				return err
 			}
 
+			o.gitTrackedOnlyPassed = flags.IsFlagPassed(cmd.Flags(), "git-tracked-only")
+
+			if err := o.parseArtifacts(); err != nil {
+				return err
+			}
+
+			if o.selector != "" {
+				return o.runBatch(cmd.Context())
+			}
+
 			err = o.run(cmd.Context())
 			if err != nil {
 				// Cleanup resources upon error. An exit code error means the
@@ -149,7 +210,16 @@ func launcherCommand(f *cmdutil.Factory, o *launcherOptions) *cobra.Command {
 	flags.AddDisableResourceCleanupFlag(cmd, &o.disableResourceCleanup)
 
 	cmd.Flags().BoolVar(&o.disableTTY, "no-tty", false, "disable tty")
+	cmd.Flags().BoolVar(&o.detach, "detach", false, "create the run and print its name without waiting for it to complete (see attach and wait)")
+	cmd.Flags().StringVarP(&o.selector, "selector", "l", "", "run on each workspace matching this label selector, e.g. env=prod, instead of the current workspace")
+	cmd.Flags().IntVar(&o.concurrency, "concurrency", defaultConcurrency, "maximum number of runs to run concurrently when selecting workspaces by label")
+	cmd.Flags().BoolVar(&o.summary, "summary", false, "only print a summary of each run when selecting workspaces by label, instead of their output")
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+	cmd.Flags().BoolVar(&o.gitTrackedOnly, "git-tracked-only", false, "only upload files tracked by git (defaults to workspace setting)")
+	cmd.Flags().StringArrayVar(&o.artifactFlags, "artifact", nil, "download file from pod once command has completed, specified as <remote>:<local> (remote is relative to the root module; local defaults to remote)")
 	cmd.Flags().DurationVar(&o.podTimeout, "pod-timeout", time.Hour, "timeout for pod to be ready and running")
+	cmd.Flags().IntVar(&o.retries, "retries", 0, "retry the run's pod up to this many times upon infrastructure failures, such as eviction, that occur before the command has started; ignored with a TTY")
+	cmd.Flags().DurationVar(&o.pendingTimeout, "pending-timeout", 0, "retry the run's pod, or without --retries fail the run, if its pod is pending for longer than this (default 10m)")
 	cmd.Flags().DurationVar(&o.handshakeTimeout, "handshake-timeout", v1alpha1.DefaultHandshakeTimeout, "timeout waiting for handshake")
 
 	cmd.Flags().DurationVar(&o.reconcileTimeout, "reconcile-timeout", defaultReconcileTimeout, "timeout for resource to be reconciled")
@@ -157,26 +227,34 @@ func launcherCommand(f *cmdutil.Factory, o *launcherOptions) *cobra.Command {
 	return cmd
 }
 
-func (o *launcherOptions) lookupEnvFile(cmd *cobra.Command) error {
-	etokenv, err := env.Read(o.path)
-	if err != nil {
-		// It's ok for envfile to not exist
-		if !os.IsNotExist(err) {
-			return err
+func (o *launcherOptions) lookupEnvFile(cmd *cobra.Command) (err error) {
+	o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+	if err != nil || o.etokenv == nil {
+		return err
+	}
+
+	// Override default timeouts with those in the project file
+	if timeouts := o.etokenv.Timeouts; timeouts != nil {
+		if timeouts.Pod != nil && !flags.IsFlagPassed(cmd.Flags(), "pod-timeout") {
+			o.podTimeout = timeouts.Pod.Duration
 		}
-	} else {
-		if !flags.IsFlagPassed(cmd.Flags(), "namespace") {
-			o.namespace = etokenv.Namespace
+		if timeouts.Handshake != nil && !flags.IsFlagPassed(cmd.Flags(), "handshake-timeout") {
+			o.handshakeTimeout = timeouts.Handshake.Duration
 		}
-		if !flags.IsFlagPassed(cmd.Flags(), "workspace") {
-			o.workspace = etokenv.Workspace
+		if timeouts.Reconcile != nil && !flags.IsFlagPassed(cmd.Flags(), "reconcile-timeout") {
+			o.reconcileTimeout = timeouts.Reconcile.Duration
 		}
 	}
 	return nil
 }
 
 func (o *launcherOptions) run(ctx context.Context) error {
-	isTTY := !o.disableTTY && term.IsTerminal(o.In)
+	if o.detach && len(o.artifacts) > 0 {
+		return errDetachArtifacts
+	}
+
+	// Nobody remains attached to a detached run's TTY
+	isTTY := !o.disableTTY && !o.detach && term.IsTerminal(o.In)
 
 	// Tar up local config and deploy k8s resources
 	run, err := o.deploy(ctx, isTTY)
@@ -184,8 +262,19 @@ func (o *launcherOptions) run(ctx context.Context) error {
 		return err
 	}
 
-	if IsQueueable(o.command) {
-		// Watch and log queue updates
+	if o.detach {
+		return o.detachRun(ctx, run)
+	}
+
+	return o.follow(ctx, run, isTTY)
+}
+
+// follow waits for the run's pod to be ready, before connecting to it and
+// awaiting the exit code of its command
+func (o *launcherOptions) follow(ctx context.Context, run *v1alpha1.Run, isTTY bool) error {
+	if !o.batch {
+		// Watch and log queue updates. Runs with read-only commands are
+		// queued too unless the workspace isolates them.
 		o.watchQueue(ctx, run)
 	}
 
@@ -214,6 +303,15 @@ func (o *launcherOptions) run(ctx context.Context) error {
 		return err
 	}
 
+	if !isTTY {
+		// Without a TTY, an interrupt cannot be relayed to the command via
+		// the TTY. Instead, an interrupt cancels the run, and its logs are
+		// streamed until it completes.
+		var stop context.CancelFunc
+		ctx, stop = o.cancelOnInterrupt(ctx, run)
+		defer stop()
+	}
+
 	// Watch the run for the container's exit code. Non-blocking.
 	exit := monitors.RunExitMonitor(ctx, o.EtokClient, o.namespace, o.runName)
 
@@ -238,28 +336,84 @@ func (o *launcherOptions) run(ctx context.Context) error {
 		}
 	}
 
-	if UpdatesLockFile(o.command) {
-		// Some commands (e.g. terraform init) update the lock file,
-		// .terraform.lock.hcl, and it's recommended that this be committed to
-		// version control. So the runner copies it to a config map, and it is
-		// here that that config map is retrieved.
-		lock, err := o.ConfigMapsClient(o.namespace).Get(ctx, v1alpha1.RunLockFileConfigMapName(run.Name), metav1.GetOptions{})
-		if err != nil {
+	// Download artifacts from run
+	if len(o.artifacts) > 0 {
+		if err := o.downloadArtifacts(ctx, run); err != nil {
 			return err
 		}
+	}
 
-		// Write lock file to user's disk
-		lockFilePath := filepath.Join(o.path, globals.LockFile)
-		if err := ioutil.WriteFile(lockFilePath, lock.BinaryData[globals.LockFile], 0644); err != nil {
-			return err
-		}
+	return nil
+}
+
+// detachRun waits for the run to be reconciled and, if necessary, approved,
+// before printing its name and returning
+func (o *launcherOptions) detachRun(ctx context.Context, run *v1alpha1.Run) error {
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return o.waitForReconcile(gctx, run)
+	})
 
-		klog.V(1).Infof("Written %s", lockFilePath)
+	if err := o.checkWorkspace(ctx, run); err != nil {
+		return err
 	}
 
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(o.Out, run.Name)
 	return nil
 }
 
+// cancelOnInterrupt returns a context that, unlike the given context, is not
+// cancelled when the client is interrupted. Instead the interrupt cancels the
+// run, which interrupts its command. A second interrupt kills the command, and
+// a third cancels the returned context, abandoning the run.
+func (o *launcherOptions) cancelOnInterrupt(ctx context.Context, run *v1alpha1.Run) (context.Context, context.CancelFunc) {
+	cctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-cctx.Done():
+			return
+		}
+
+		// Catch subsequent interrupts
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupts)
+
+		fmt.Fprintf(o.Out, "Cancelling run %s; interrupt again to kill it\n", run.Name)
+		o.cancelRun(cctx, run, false)
+
+		select {
+		case <-interrupts:
+		case <-cctx.Done():
+			return
+		}
+
+		fmt.Fprintf(o.Out, "Killing run %s; interrupt again to stop waiting for it\n", run.Name)
+		o.cancelRun(cctx, run, true)
+
+		select {
+		case <-interrupts:
+			cancel()
+		case <-cctx.Done():
+		}
+	}()
+
+	return cctx, cancel
+}
+
+func (o *launcherOptions) cancelRun(ctx context.Context, run *v1alpha1.Run, force bool) {
+	if _, err := o.CancelRun(ctx, run.Namespace, run.Name, force); err != nil {
+		klog.Errorf("unable to cancel run %s: %s", klog.KObj(run), err.Error())
+	}
+}
+
 func (o *launcherOptions) watchRun(ctx context.Context, run *v1alpha1.Run, isTTY bool) error {
 	lw := &k8s.RunListWatcher{Client: o.EtokClient, Name: run.Name, Namespace: run.Namespace}
 	_, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Run{}, nil, handlers.RunConnectable(run.Name, isTTY))
@@ -306,46 +460,108 @@ func (o *launcherOptions) checkWorkspace(ctx context.Context, run *v1alpha1.Run)
 
 // Deploy configmap and run resources in parallel
 func (o *launcherOptions) deploy(ctx context.Context, isTTY bool) (run *v1alpha1.Run, err error) {
-	g, ctx := errgroup.WithContext(ctx)
+	tarball, root, hash, err := o.pack(o.useGitTrackedOnly(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	configMapName := v1alpha1.ArchiveConfigMapName(o.workspace, hash)
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Embed tarball in configmap and deploy, unless an identical archive
+	// already exists for the workspace
+	g.Go(func() error {
+		return o.ensureConfigMap(gctx, tarball, configMapName, v1alpha1.RunDefaultConfigMapKey)
+	})
+
+	// Construct and deploy command resource
+	g.Go(func() error {
+		run, err = o.createRun(gctx, o.runName, configMapName, isTTY, root)
+		return err
+	})
+
+	if err := g.Wait(); err != nil {
+		return run, err
+	}
+
+	return run, o.ownArchive(ctx, run, tarball, configMapName, v1alpha1.RunDefaultConfigMapKey)
+}
 
+// pack compiles a tarball of local terraform modules, returning the tarball,
+// the relative path to the root module within it, and its hash. Archives are
+// named after their hash so the tarball needs to be packed before resources are
+// deployed.
+func (o *launcherOptions) pack(gitTrackedOnly bool) (tarball []byte, root, hash string, err error) {
 	// Construct new archive
-	arc, err := archive.NewArchive(o.path)
+	arc, err := archive.NewArchive(o.path, archive.GitTrackedOnly(gitTrackedOnly))
 	if err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
 
 	// Add local module references to archive
 	if err := arc.Walk(); err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
 
 	// Get relative path to root module within archive
-	root, err := arc.RootPath()
+	root, err = arc.RootPath()
 	if err != nil {
-		return nil, err
+		return nil, "", "", err
 	}
 
-	// Compile tarball of local terraform modules, embed in configmap and deploy
-	g.Go(func() error {
-		w := new(bytes.Buffer)
-		meta, err := arc.Pack(w)
-		if err != nil {
-			return err
-		}
+	w := new(bytes.Buffer)
+	meta, err := arc.Pack(w)
+	if err != nil {
+		return nil, "", "", err
+	}
 
-		klog.V(1).Infof("slug created: %d files; %d (%d) bytes (compressed)\n", len(meta.Files), meta.Size, meta.CompressedSize)
+	klog.V(1).Infof("slug created: %d files; %d (%d) bytes (compressed); hash: %s\n", len(meta.Files), meta.Size, meta.CompressedSize, meta.Hash)
 
-		// Construct and deploy ConfigMap resource
-		return o.createConfigMap(ctx, w.Bytes(), o.runName, v1alpha1.RunDefaultConfigMapKey)
-	})
+	return w.Bytes(), root, meta.Hash, nil
+}
 
-	// Construct and deploy command resource
-	g.Go(func() error {
-		run, err = o.createRun(ctx, o.runName, o.runName, isTTY, root)
-		return err
-	})
+// useGitTrackedOnly determines whether only files tracked by git should be
+// archived. The flag takes precedence over the workspace's setting.
+func (o *launcherOptions) useGitTrackedOnly(ctx context.Context) bool {
+	if o.gitTrackedOnlyPassed {
+		return o.gitTrackedOnly
+	}
 
-	return run, g.Wait()
+	// Errors, including the workspace not being found, are reported later on
+	// when the workspace is checked.
+	ws, err := o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	return ws.Spec.GitTrackedOnly
+}
+
+// setGitAnnotations records the git commit and whether there are uncommitted
+// changes on the run, if the config is within a git repository.
+func (o *launcherOptions) setGitAnnotations(run *v1alpha1.Run) {
+	if _, err := git.GetRepoRoot(o.path); err != nil {
+		return
+	}
+
+	sha, err := git.Head(o.path)
+	if err != nil {
+		klog.V(1).Infof("unable to determine git commit: %s", err.Error())
+		return
+	}
+	dirty, err := git.IsDirty(o.path)
+	if err != nil {
+		klog.V(1).Infof("unable to determine git status: %s", err.Error())
+		return
+	}
+
+	annotations := run.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[v1alpha1.GitCommitAnnotationKey] = sha
+	annotations[v1alpha1.GitDirtyAnnotationKey] = strconv.FormatBool(dirty)
+	run.SetAnnotations(annotations)
 }
 
 func (o *launcherOptions) cleanup() {
@@ -353,7 +569,34 @@ func (o *launcherOptions) cleanup() {
 		o.RunsClient(o.namespace).Delete(context.Background(), o.runName, metav1.DeleteOptions{})
 	}
 	if o.createdArchive {
-		o.ConfigMapsClient(o.namespace).Delete(context.Background(), o.runName, metav1.DeleteOptions{})
+		o.deleteArchive(context.Background())
+	}
+}
+
+// deleteArchive deletes the archive created by the launcher, unless another run
+// has since reused it, in which case it is left to be garbage collected along
+// with its runs.
+func (o *launcherOptions) deleteArchive(ctx context.Context) {
+	archive, err := o.ConfigMapsClient(o.namespace).Get(ctx, o.archiveName, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+	for _, ref := range archive.OwnerReferences {
+		if ref.Kind == "Run" && ref.Name != o.runName {
+			klog.V(1).Infof("archive %s is used by run %s, not deleting\n", klog.KObj(archive), ref.Name)
+			return
+		}
+	}
+
+	// Guard against another run having become an owner in the meantime
+	err = o.ConfigMapsClient(o.namespace).Delete(ctx, o.archiveName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &archive.UID,
+			ResourceVersion: &archive.ResourceVersion,
+		},
+	})
+	if err != nil && !kerrors.IsNotFound(err) {
+		klog.V(1).Infof("unable to delete archive %s: %s\n", klog.KObj(archive), err.Error())
 	}
 }
 
@@ -393,6 +636,9 @@ func (o *launcherOptions) createRun(ctx context.Context, name, configMapName str
 	// Permit filtering etok resources by component
 	labels.SetLabel(run, labels.RunComponent)
 
+	// Record git commit of config
+	o.setGitAnnotations(run)
+
 	run.Workspace = o.workspace
 
 	run.Command = o.command
@@ -403,6 +649,19 @@ func (o *launcherOptions) createRun(ctx context.Context, name, configMapName str
 
 	run.Verbosity = o.Verbosity
 
+	for _, a := range o.artifacts {
+		run.Artifacts = append(run.Artifacts, a.remote)
+	}
+
+	if !isTTY {
+		// A run with a TTY cannot be retried, because the client cannot
+		// attach to the replacement pod
+		run.RetryPolicy.Limit = o.retries
+		if o.pendingTimeout > 0 {
+			run.RetryPolicy.PendingTimeout = o.pendingTimeout.String()
+		}
+	}
+
 	if o.status != nil {
 		// For testing purposes seed status
 		run.RunStatus = *o.status
@@ -424,11 +683,96 @@ func (o *launcherOptions) createRun(ctx context.Context, name, configMapName str
 	return run, nil
 }
 
-func (o *launcherOptions) createConfigMap(ctx context.Context, tarball []byte, name, keyName string) error {
+// ensureConfigMap deploys a config map containing the tarball, unless a config
+// map with the same name already exists. The name is derived from the hash of
+// the tarball, in which case an existing config map is guaranteed to contain an
+// identical tarball, and it is reused instead. Each run that uses the config
+// map is made an owner of it (by the run controller), so it is garbage
+// collected once all its runs are deleted.
+func (o *launcherOptions) ensureConfigMap(ctx context.Context, tarball []byte, name, keyName string) error {
+	_, err := o.ConfigMapsClient(o.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		o.archiveName = name
+		klog.V(1).Infof("archive unchanged, reused config map %s/%s\n", o.namespace, name)
+		return nil
+	}
+	if !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	if err := o.createConfigMap(ctx, tarball, name, keyName); err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			// Another client created an identical archive in the meantime
+			o.archiveName = name
+			klog.V(1).Infof("archive unchanged, reused config map %s/%s\n", o.namespace, name)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// ownArchive makes the run an owner of its archive. A reused archive may be
+// owned only by runs that are being deleted, in which case it would be garbage
+// collected from under the run. Once the run is an owner the archive is checked
+// again, and should it have been deleted in the meantime, it is re-created.
+func (o *launcherOptions) ownArchive(ctx context.Context, run *v1alpha1.Run, tarball []byte, name, keyName string) error {
+	owner := metav1.OwnerReference{
+		APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		Kind:       "Run",
+		Name:       run.Name,
+		UID:        run.UID,
+	}
+
+	// A strategic merge patch adds the owner to any existing owners
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{owner},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = o.ConfigMapsClient(o.namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	archive, err := o.ConfigMapsClient(o.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil && archive.DeletionTimestamp == nil {
+		return nil
+	}
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	klog.V(1).Infof("archive %s/%s was deleted, re-creating it\n", o.namespace, name)
+	if err := o.awaitArchiveDeletion(ctx, name); err != nil {
+		return err
+	}
+	return o.createConfigMap(ctx, tarball, name, keyName, owner)
+}
+
+// awaitArchiveDeletion waits for the archive to be deleted
+func (o *launcherOptions) awaitArchiveDeletion(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, o.reconcileTimeout)
+	defer cancel()
+
+	return wait.PollImmediateUntil(archiveDeletionInterval, func() (bool, error) {
+		_, err := o.ConfigMapsClient(o.namespace).Get(ctx, name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}, ctx.Done())
+}
+
+func (o *launcherOptions) createConfigMap(ctx context.Context, tarball []byte, name, keyName string, owners ...metav1.OwnerReference) error {
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: o.namespace,
+			Name:            name,
+			Namespace:       o.namespace,
+			OwnerReferences: owners,
 		},
 		BinaryData: map[string][]byte{
 			keyName: tarball,
@@ -437,10 +781,11 @@ func (o *launcherOptions) createConfigMap(ctx context.Context, tarball []byte, n
 
 	// Set etok's common labels
 	labels.SetCommonLabels(configMap)
-	// Permit filtering archives by command
-	labels.SetLabel(configMap, labels.Command(o.command))
-	// Permit filtering archives by workspace
-	labels.SetLabel(configMap, labels.Workspace(o.workspace))
+	if o.selector == "" {
+		// Permit filtering archives by workspace (a batch's archive is
+		// shared by several workspaces)
+		labels.SetLabel(configMap, labels.Workspace(o.workspace))
+	}
 	// Permit filtering etok resources by component
 	labels.SetLabel(configMap, labels.RunComponent)
 
@@ -450,6 +795,7 @@ func (o *launcherOptions) createConfigMap(ctx context.Context, tarball []byte, n
 	}
 
 	o.createdArchive = true
+	o.archiveName = name
 	klog.V(1).Infof("created config map %s\n", klog.KObj(configMap))
 
 	return nil
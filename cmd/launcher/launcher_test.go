@@ -1,27 +1,38 @@
 package launcher
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/archive"
+	"github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/env"
 	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/globals"
 	"github.com/leg100/etok/pkg/handlers"
 	"github.com/leg100/etok/pkg/logstreamer"
 	"github.com/leg100/etok/pkg/testobj"
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestLauncher(t *testing.T) {
@@ -37,8 +48,12 @@ func TestLauncher(t *testing.T) {
 		cmd string
 		// Size of content to be archived
 		size int
+		// Initialise a git repo, committing the content to be archived
+		gitRepo bool
 		// Mock exit code of runner container
 		code int32
+		// Simulate the client being interrupted whilst streaming logs
+		interrupt bool
 		// Override run status
 		overrideStatus   func(*v1alpha1.RunStatus)
 		factoryOverrides func(*cmdutil.Factory)
@@ -101,6 +116,17 @@ func TestLauncher(t *testing.T) {
 				assert.Equal(t, []string{"-input", "false"}, o.args)
 			},
 		},
+		{
+			name: "retry policy",
+			args: []string{"--retries", "2", "--pending-timeout", "5m"},
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			env:  &env.Env{Namespace: "default", Workspace: "default"},
+			assertions: func(o *launcherOptions) {
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, v1alpha1.RetryPolicy{Limit: 2, PendingTimeout: "5m0s"}, run.RetryPolicy)
+			},
+		},
 		{
 			name: "context flag",
 			args: []string{"--context", "oz-cluster"},
@@ -110,6 +136,53 @@ func TestLauncher(t *testing.T) {
 				assert.Equal(t, "oz-cluster", o.kubeContext)
 			},
 		},
+		{
+			name: "context mismatch",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env:  &env.Env{Namespace: "default", Workspace: "default", Context: "kind"},
+			err:  cmdutil.ErrClusterMismatch,
+		},
+		{
+			name: "context flag overrides project file",
+			args: []string{"--context", "oz-cluster"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env:  &env.Env{Namespace: "default", Workspace: "default", Context: "kind"},
+			assertions: func(o *launcherOptions) {
+				assert.Equal(t, "oz-cluster", o.kubeContext)
+			},
+		},
+		{
+			name: "cluster mismatch",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env:  &env.Env{Namespace: "default", Workspace: "default", Cluster: "https://prod.example.com"},
+			err:  cmdutil.ErrClusterMismatch,
+		},
+		{
+			name: "context flag skips cluster check",
+			args: []string{"--context", "oz-cluster"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env:  &env.Env{Namespace: "default", Workspace: "default", Cluster: "https://prod.example.com"},
+		},
+		{
+			name: "ignore cluster mismatch",
+			args: []string{"--ignore-cluster-mismatch"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env:  &env.Env{Namespace: "default", Workspace: "default", Cluster: "https://prod.example.com"},
+		},
+		{
+			name: "timeouts from project file",
+			args: []string{"--handshake-timeout", "1m"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			env: &env.Env{Namespace: "default", Workspace: "default", Timeouts: &env.Timeouts{
+				Pod:       &metav1.Duration{Duration: 5 * time.Minute},
+				Handshake: &metav1.Duration{Duration: 30 * time.Second},
+			}},
+			assertions: func(o *launcherOptions) {
+				assert.Equal(t, 5*time.Minute, o.podTimeout)
+				// Flag overrides project file
+				assert.Equal(t, time.Minute, o.handshakeTimeout)
+			},
+		},
 		{
 			name: "approved",
 			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"), testobj.WithPrivilegedCommands("plan"))},
@@ -149,7 +222,7 @@ func TestLauncher(t *testing.T) {
 				_, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
 				assert.True(t, kerrors.IsNotFound(err))
 
-				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.archiveName, metav1.GetOptions{})
 				assert.True(t, kerrors.IsNotFound(err))
 			},
 		},
@@ -167,7 +240,7 @@ func TestLauncher(t *testing.T) {
 				_, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
 				assert.NoError(t, err)
 
-				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.archiveName, metav1.GetOptions{})
 				assert.NoError(t, err)
 			},
 		},
@@ -186,10 +259,128 @@ func TestLauncher(t *testing.T) {
 				_, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
 				assert.NoError(t, err)
 
-				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), o.archiveName, metav1.GetOptions{})
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "archive named after workspace and hash",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			assertions: func(o *launcherOptions) {
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Regexp(t, "^archive-default-[0-9a-f]{64}$", run.ConfigMap)
+
+				_, err = o.ConfigMapsClient(o.namespace).Get(context.Background(), run.ConfigMap, metav1.GetOptions{})
 				assert.NoError(t, err)
 			},
 		},
+		{
+			name:    "git annotations",
+			objs:    []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			gitRepo: true,
+			assertions: func(o *launcherOptions) {
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Regexp(t, "^[0-9a-f]{40}$", run.Annotations[v1alpha1.GitCommitAnnotationKey])
+				assert.Equal(t, "false", run.Annotations[v1alpha1.GitDirtyAnnotationKey])
+			},
+		},
+		{
+			name: "no git annotations outside git repo",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			assertions: func(o *launcherOptions) {
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.NotContains(t, run.Annotations, v1alpha1.GitCommitAnnotationKey)
+			},
+		},
+		{
+			name:    "git tracked only",
+			args:    []string{"--git-tracked-only"},
+			objs:    []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			gitRepo: true,
+			assertions: func(o *launcherOptions) {
+				assert.Equal(t, []string{"test.bin"}, archivedFiles(t, o))
+			},
+		},
+		{
+			name:    "git tracked only set on workspace",
+			objs:    []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"), testobj.WithGitTrackedOnly())},
+			gitRepo: true,
+			assertions: func(o *launcherOptions) {
+				assert.Equal(t, []string{"test.bin"}, archivedFiles(t, o))
+			},
+		},
+		{
+			name:    "flag overrides git tracked only set on workspace",
+			args:    []string{"--git-tracked-only=false"},
+			objs:    []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"), testobj.WithGitTrackedOnly())},
+			gitRepo: true,
+			assertions: func(o *launcherOptions) {
+				assert.Equal(t, []string{"test.bin", "untracked.tf"}, archivedFiles(t, o))
+			},
+		},
+		{
+			name: "artifacts",
+			args: []string{"--artifact", "plan.out:plans/local.out", "--artifact", "graph.dot", "--", "-out", "plan.out"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345")),
+				testobj.ConfigMap("default", "run-12345-artifacts", testobj.WithBinaryData(map[string][]byte{
+					v1alpha1.ArtifactKey("plan.out"):  []byte("plan"),
+					v1alpha1.ArtifactKey("graph.dot"): []byte("graph"),
+				})),
+			},
+			assertions: func(o *launcherOptions) {
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"plan.out", "graph.dot"}, run.Artifacts)
+
+				plan, err := ioutil.ReadFile("plans/local.out")
+				require.NoError(t, err)
+				assert.Equal(t, "plan", string(plan))
+
+				graph, err := ioutil.ReadFile("graph.dot")
+				require.NoError(t, err)
+				assert.Equal(t, "graph", string(graph))
+			},
+		},
+		{
+			name: "artifact not found",
+			args: []string{"--artifact", "plan.out"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			err:  errArtifactNotFound,
+		},
+		{
+			name: "invalid artifact",
+			args: []string{"--artifact", ":plan.out"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			err:  errInvalidArtifact,
+		},
+		{
+			name: "lock file",
+			cmd:  "init",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345")),
+				testobj.ConfigMap("default", "run-12345-artifacts", testobj.WithBinaryData(map[string][]byte{
+					v1alpha1.ArtifactKey(globals.LockFile): []byte("plugin hashes"),
+				})),
+			},
+			assertions: func(o *launcherOptions) {
+				lock, err := ioutil.ReadFile(globals.LockFile)
+				require.NoError(t, err)
+				assert.Equal(t, "plugin hashes", string(lock))
+			},
+		},
+		{
+			name: "lock file not found",
+			cmd:  "init",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
+			assertions: func(o *launcherOptions) {
+				_, err := ioutil.ReadFile(globals.LockFile)
+				assert.True(t, os.IsNotExist(err))
+			},
+		},
 		{
 			name: "with tty",
 			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
@@ -230,6 +421,54 @@ func TestLauncher(t *testing.T) {
 				assert.False(t, run.Handshake)
 			},
 		},
+		{
+			name:      "interrupt cancels run",
+			env:       &env.Env{Namespace: "default", Workspace: "default"},
+			objs:      []runtime.Object{testobj.Workspace("default", "default")},
+			interrupt: true,
+			overrideStatus: func(status *v1alpha1.RunStatus) {
+				status.ExitCode = nil
+			},
+			err: etokerrors.NewExitError(130),
+			assertions: func(o *launcherOptions) {
+				// Run is not deleted
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, v1alpha1.RunCancelInterrupt, run.Cancel)
+
+				assert.Contains(t, o.Out.(*bytes.Buffer).String(), "Cancelling run run-12345")
+			},
+		},
+		{
+			name: "detach",
+			args: []string{"--detach"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithPrivilegedCommands("plan"))},
+			factoryOverrides: func(f *cmdutil.Factory) {
+				// A tty is ignored when detaching
+				var err error
+				_, f.In, err = pty.Open()
+				require.NoError(t, err)
+			},
+			assertions: func(o *launcherOptions) {
+				// Neither attaches nor streams logs
+				assert.Equal(t, "run-12345\n", o.Out.(*bytes.Buffer).String())
+
+				run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.False(t, run.Handshake)
+
+				// Detached run is still approved
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.True(t, ws.IsRunApproved(run))
+			},
+		},
+		{
+			name: "detach with artifacts",
+			args: []string{"--detach", "--artifact", "plan.out"},
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			err:  errDetachArtifacts,
+		},
 		{
 			name: "pod completed with no tty",
 			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithCombinedQueue("run-12345"))},
@@ -295,7 +534,13 @@ func TestLauncher(t *testing.T) {
 		testutil.Run(t, tt.name, func(t *testutil.T) {
 			path := t.NewTempDir().Chdir().WriteRandomFile("test.bin", tt.size).Root()
 
-			// Write .terraform/environment
+			if tt.gitRepo {
+				initGitRepo(t, path, "test.bin")
+				// Write a file that is not tracked by git
+				require.NoError(t, ioutil.WriteFile(filepath.Join(path, "untracked.tf"), []byte("# untracked"), 0644))
+			}
+
+			// Write project file
 			if tt.env != nil {
 				require.NoError(t, tt.env.Write(path))
 			}
@@ -335,14 +580,39 @@ func TestLauncher(t *testing.T) {
 			}
 			opts.status = &status
 
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if tt.interrupt {
+				f.GetLogsFunc = func(ctx context.Context, lopts logstreamer.Options) (io.ReadCloser, error) {
+					cancel()
+
+					// Mock the runner exiting upon the run being cancelled
+					require.Eventually(t, func() bool {
+						run, err := opts.RunsClient(opts.namespace).Get(ctx, opts.runName, metav1.GetOptions{})
+						require.NoError(t, err)
+						if !run.IsCancelled() {
+							return false
+						}
+						code := 130
+						run.ExitCode = &code
+						_, err = opts.RunsClient(opts.namespace).Update(ctx, run, metav1.UpdateOptions{})
+						require.NoError(t, err)
+						return true
+					}, time.Second, 10*time.Millisecond)
+
+					return logstreamer.FakeGetLogs(ctx, lopts)
+				}
+			}
+
 			// create cobra command
 			cmd := launcherCommand(f, opts)
 			cmd.SetOut(out)
 			cmd.SetArgs(tt.args)
 
-			err := cmd.ExecuteContext(context.Background())
+			err := cmd.ExecuteContext(ctx)
 			if !assert.True(t, errors.Is(err, tt.err)) {
-				t.Errorf("unexpected error: %w", err)
+				t.Errorf("unexpected error: %v", err)
 			}
 
 			if tt.assertions != nil {
@@ -351,3 +621,191 @@ func TestLauncher(t *testing.T) {
 		})
 	}
 }
+
+// initGitRepo initialises a git repo at path and commits the given files
+func initGitRepo(t *testutil.T, path string, files ...string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		append([]string{"add"}, files...),
+		{"-c", "user.name=etok", "-c", "user.email=etok@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", path}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+// archivedFiles returns the files in the archive referenced by the run
+func archivedFiles(t *testing.T, o *launcherOptions) []string {
+	run, err := o.RunsClient(o.namespace).Get(context.Background(), o.runName, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	configMap, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), run.ConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	gr, err := gzip.NewReader(bytes.NewReader(configMap.BinaryData[v1alpha1.RunDefaultConfigMapKey]))
+	require.NoError(t, err)
+
+	var files []string
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		files = append(files, hdr.Name)
+	}
+	return files
+}
+
+func TestLauncherReusesArchive(t *testing.T) {
+	tests := []struct {
+		name string
+		// Simulate the existing archive being garbage collected after it is
+		// found to exist but before the run becomes an owner
+		collected  bool
+		assertions func(*testutil.T, *launcherOptions, string)
+	}{
+		{
+			name: "reuse archive",
+			assertions: func(t *testutil.T, o *launcherOptions, name string) {
+				// Existing archive should not have been replaced
+				assert.False(t, o.createdArchive)
+
+				// Run should have been made an owner of the existing archive
+				archive, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), name, metav1.GetOptions{})
+				require.NoError(t, err)
+				var owners []string
+				for _, ref := range archive.OwnerReferences {
+					owners = append(owners, ref.Name)
+				}
+				assert.ElementsMatch(t, []string{"run-previous", "run-12345"}, owners)
+			},
+		},
+		{
+			name:      "re-create archive collected in the meantime",
+			collected: true,
+			assertions: func(t *testutil.T, o *launcherOptions, name string) {
+				assert.True(t, o.createdArchive)
+
+				archive, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), name, metav1.GetOptions{})
+				require.NoError(t, err)
+				if assert.Equal(t, 1, len(archive.OwnerReferences)) {
+					assert.Equal(t, "run-12345", archive.OwnerReferences[0].Name)
+				}
+				assert.NotEmpty(t, archive.BinaryData[v1alpha1.RunDefaultConfigMapKey])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			path := t.NewTempDir().Chdir().Write("main.tf", []byte("# empty")).Root()
+
+			// Determine hash of archive that launcher is expected to create
+			arc, err := archive.NewArchive(path)
+			require.NoError(t, err)
+			require.NoError(t, arc.Walk())
+			meta, err := arc.Pack(new(bytes.Buffer))
+			require.NoError(t, err)
+			name := v1alpha1.ArchiveConfigMapName("default", meta.Hash)
+
+			// Existing archive, owned by a previous run
+			existing := testobj.ConfigMap("default", name, testobj.WithOwnerRuns("run-previous"))
+
+			objs := []runtime.Object{testobj.Workspace("default", "default")}
+			if !tt.collected {
+				objs = append(objs, existing)
+			}
+
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, objs...)
+
+			if tt.collected {
+				// Report the archive as existing only when the launcher first
+				// checks for it
+				var checked bool
+				f.ClientCreator.(*client.FakeClientCreator).PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					if checked {
+						return false, nil, nil
+					}
+					checked = true
+					return true, existing, nil
+				})
+			}
+
+			var code int
+			opts := &launcherOptions{command: "plan", runName: "run-12345"}
+			opts.status = &v1alpha1.RunStatus{
+				Conditions: []metav1.Condition{
+					{
+						Type:   v1alpha1.RunCompleteCondition,
+						Status: metav1.ConditionFalse,
+						Reason: v1alpha1.PodRunningReason,
+					},
+				},
+				Phase:    v1alpha1.RunPhaseRunning,
+				ExitCode: &code,
+			}
+
+			cmd := launcherCommand(f, opts)
+			cmd.SetOut(out)
+			cmd.SetArgs([]string{})
+			require.NoError(t, cmd.ExecuteContext(context.Background()))
+
+			// Run should reference existing archive
+			run, err := opts.RunsClient(opts.namespace).Get(context.Background(), opts.runName, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, name, run.ConfigMap)
+
+			tt.assertions(t, opts, name)
+		})
+	}
+}
+
+func TestLauncherDeleteArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive *corev1.ConfigMap
+		deleted bool
+	}{
+		{
+			name:    "sole owner",
+			archive: testobj.ConfigMap("default", "archive-default-abc", testobj.WithOwnerRuns("run-12345")),
+			deleted: true,
+		},
+		{
+			name:    "not yet owned",
+			archive: testobj.ConfigMap("default", "archive-default-abc"),
+			deleted: true,
+		},
+		{
+			name:    "reused by another run",
+			archive: testobj.ConfigMap("default", "archive-default-abc", testobj.WithOwnerRuns("run-12345", "run-67890")),
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			f := cmdutil.NewFakeFactory(new(bytes.Buffer), tt.archive)
+			c, err := f.Create("")
+			require.NoError(t, err)
+
+			o := &launcherOptions{
+				Client:         c,
+				namespace:      "default",
+				runName:        "run-12345",
+				archiveName:    "archive-default-abc",
+				createdArchive: true,
+			}
+			o.cleanup()
+
+			_, err = o.ConfigMapsClient("default").Get(context.Background(), "archive-default-abc", metav1.GetOptions{})
+			assert.Equal(t, tt.deleted, kerrors.IsNotFound(err))
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package launcher
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// syncWriter serializes writes to an underlying writer
+type syncWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// prefixWriter prefixes each line written to it. Only whole lines are written
+// to the underlying writer, so that lines from several prefixWriters sharing a
+// syncWriter are not interleaved.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    bytes.Buffer
+	mu     sync.Mutex
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf.Write(b)
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+		if err := p.writeLine(p.buf.Next(i + 1)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any remaining partial line, terminating it with a newline
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	line := append(p.buf.Bytes(), '\n')
+	p.buf.Reset()
+	return p.writeLine(line)
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
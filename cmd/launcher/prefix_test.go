@@ -0,0 +1,27 @@
+package launcher
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	out := new(bytes.Buffer)
+	sw := &syncWriter{w: out}
+	foo := newPrefixWriter(sw, "[foo] ")
+	bar := newPrefixWriter(sw, "[bar] ")
+
+	fmt.Fprint(foo, "first ")
+	fmt.Fprint(bar, "one\ntwo\nthr")
+	fmt.Fprint(foo, "line\nsecond line\n")
+	fmt.Fprint(bar, "ee")
+
+	require.NoError(t, foo.Flush())
+	require.NoError(t, bar.Flush())
+
+	assert.Equal(t, "[bar] one\n[bar] two\n[foo] first line\n[foo] second line\n[bar] three\n", out.String())
+}
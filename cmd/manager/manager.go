@@ -3,18 +3,30 @@ package manager
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 
 	"k8s.io/klog/v2"
 
 	"github.com/leg100/etok/cmd/flags"
+	"github.com/leg100/etok/cmd/installer"
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/backend"
 	"github.com/leg100/etok/pkg/controllers"
+	"github.com/leg100/etok/pkg/pki"
 	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/vcs"
 	"github.com/leg100/etok/pkg/version"
+	"github.com/leg100/etok/pkg/web"
+	"github.com/leg100/etok/pkg/webhooks"
 	"github.com/spf13/cobra"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
@@ -32,6 +44,61 @@ type ManagerOptions struct {
 	// Docker image used for both the operator and the runner
 	Image string
 
+	// URL of mirror from which terraform is downloaded
+	TerraformMirror string
+
+	// Storage class for the shared plugin cache PVC. Empty disables the
+	// shared plugin cache.
+	PluginCacheStorageClass string
+	// Size of the shared plugin cache PVC
+	PluginCacheSize string
+	// Namespace in which to create the shared plugin cache PVC
+	PluginCacheNamespace string
+	// Only install providers from the shared plugin cache
+	PluginCacheOffline bool
+
+	// Toggle serving admission webhooks
+	EnableWebhooks bool
+	// Namespace of the webhook service
+	WebhookNamespace string
+	// Directory to which webhook serving certificate is written
+	WebhookCertDir string
+
+	// URL at which runs reach the operator's state server. Empty disables the
+	// HTTP state backend.
+	StateServerURL string
+	// Namespace of the state server's service, in which its certificate is
+	// persisted
+	StateServerNamespace string
+	// File containing secret from which the state encryption key is derived.
+	// Empty disables encryption.
+	StateEncryptionKeyFile string
+	// Number of versions of state to retain
+	StateVersions int
+	// Release locks on state held by runs whose pods are gone
+	ReleaseStaleLocks bool
+
+	// Toggle serving the read-only HTTP API and web UI
+	EnableWeb bool
+	// Namespace of the web server's service, in which its generated
+	// certificate is persisted
+	WebNamespace string
+	// Files containing the web server's certificate and key. Empty uses a
+	// certificate generated by the operator.
+	WebTLSCertFile string
+	WebTLSKeyFile  string
+
+	// VCS provider from which webhooks are received. Empty disables the VCS
+	// webhook receiver.
+	VCSProvider string
+	// Base URL of the VCS provider's API
+	VCSAPIURL string
+	// File containing the token with which to authenticate to the VCS
+	// provider's API
+	VCSTokenFile string
+	// File containing the secret with which webhooks are validated
+	VCSWebhookSecretFile string
+
 	// Operator metrics bind endpoint
 	MetricsAddress string
 	// Toggle operator leader election
@@ -59,7 +126,8 @@ func ManagerCmd(f *cmdutil.Factory) *cobra.Command {
 			mgr, err := ctrl.NewManager(client.Config, ctrl.Options{
 				Scheme:             scheme.Scheme,
 				MetricsBindAddress: o.MetricsAddress,
-				Port:               9443,
+				Port:               webhooks.Port,
+				CertDir:            o.WebhookCertDir,
 				LeaderElection:     o.EnableLeaderElection,
 				LeaderElectionID:   "688c905b.dev",
 			})
@@ -70,19 +138,127 @@ func ManagerCmd(f *cmdutil.Factory) *cobra.Command {
 			klog.V(0).Info("Runner image: " + o.Image)
 
 			// Setup workspace ctrl with mgr
-			workspaceReconciler := controllers.NewWorkspaceReconciler(
-				mgr.GetClient(),
-				o.Image,
-				controllers.WithEventRecorder(mgr.GetEventRecorderFor("workspace-controller")))
+			opts := []controllers.WorkspaceReconcilerOption{
+				controllers.WithEventRecorder(mgr.GetEventRecorderFor("workspace-controller")),
+				controllers.WithTerraformMirror(o.TerraformMirror),
+			}
+			if o.PluginCacheStorageClass != "" {
+				size, err := resource.ParseQuantity(o.PluginCacheSize)
+				if err != nil {
+					return fmt.Errorf("invalid plugin cache size: %w", err)
+				}
+				klog.V(0).Info("Shared plugin cache storage class: " + o.PluginCacheStorageClass)
+				opts = append(opts, controllers.WithSharedPluginCache(o.PluginCacheNamespace, o.PluginCacheStorageClass, size))
+			}
+			if o.PluginCacheOffline {
+				opts = append(opts, controllers.WithPluginCacheOffline())
+			}
+			if o.StateServerURL != "" {
+				store, err := o.stateStore(mgr)
+				if err != nil {
+					return err
+				}
+				klog.V(0).Info("State server URL: " + o.StateServerURL)
+
+				// Serve TLS if runs are to connect with https, lest state
+				// and credentials are sent in the clear
+				var serverOpts []backend.ServerOption
+				var ca []byte
+				if strings.HasPrefix(o.StateServerURL, "https://") {
+					certs, err := pki.LoadOrGenerate(cmd.Context(), client.KubeClient, backend.CertsSecretName, backend.ServiceName, o.StateServerNamespace)
+					if err != nil {
+						return fmt.Errorf("unable to load state server certificate: %w", err)
+					}
+					serverOpts = append(serverOpts, backend.WithTLS(certs.Cert, certs.Key))
+					ca = certs.CACert
+				} else {
+					klog.Warning("State server is not serving TLS: state and credentials are sent in the clear")
+				}
+				opts = append(opts, controllers.WithStateBackend(store, o.StateServerURL, ca))
+
+				server, err := backend.NewServer(fmt.Sprintf(":%d", backend.Port), store, serverOpts...)
+				if err != nil {
+					return err
+				}
+				if err := mgr.Add(server); err != nil {
+					return fmt.Errorf("unable to add state server: %w", err)
+				}
+			}
+			if o.ReleaseStaleLocks {
+				opts = append(opts, controllers.WithStaleLockRelease())
+			}
+			workspaceReconciler := controllers.NewWorkspaceReconciler(mgr.GetClient(), o.Image, opts...)
 			if err := workspaceReconciler.SetupWithManager(mgr); err != nil {
 				return fmt.Errorf("unable to create workspace controller: %w", err)
 			}
 
 			// Setup run ctrl with mgr
-			if err := controllers.NewRunReconciler(mgr.GetClient(), o.Image).SetupWithManager(mgr); err != nil {
+			if err := controllers.NewRunReconciler(mgr.GetClient(), o.Image, controllers.WithRunTerraformMirror(o.TerraformMirror)).SetupWithManager(mgr); err != nil {
 				return fmt.Errorf("unable to create run controller: %w", err)
 			}
 
+			if o.EnableWeb {
+				// Always serve TLS, lest bearer tokens are sent in the clear.
+				// Use the certificate provided, or else one generated by the
+				// operator.
+				var cert, key []byte
+				if o.WebTLSCertFile != "" || o.WebTLSKeyFile != "" {
+					if cert, err = ioutil.ReadFile(o.WebTLSCertFile); err != nil {
+						return fmt.Errorf("unable to read web server certificate: %w", err)
+					}
+					if key, err = ioutil.ReadFile(o.WebTLSKeyFile); err != nil {
+						return fmt.Errorf("unable to read web server key: %w", err)
+					}
+				} else {
+					certs, err := pki.LoadOrGenerate(cmd.Context(), client.KubeClient, web.CertsSecretName, web.ServiceName, o.WebNamespace)
+					if err != nil {
+						return fmt.Errorf("unable to load web server certificate: %w", err)
+					}
+					cert, key = certs.Cert, certs.Key
+				}
+
+				server, err := web.NewServer(fmt.Sprintf(":%d", web.Port), mgr.GetClient(), client.KubeClient, web.WithTLS(cert, key))
+				if err != nil {
+					return err
+				}
+				if err := mgr.Add(server); err != nil {
+					return fmt.Errorf("unable to add web server: %w", err)
+				}
+			}
+
+			if o.VCSProvider != "" {
+				provider, err := o.vcsProvider()
+				if err != nil {
+					return err
+				}
+				klog.V(0).Info("VCS provider: " + o.VCSProvider)
+
+				if err := vcs.NewReporter(mgr.GetClient(), client.KubeClient, provider).SetupWithManager(mgr); err != nil {
+					return fmt.Errorf("unable to create VCS reporter: %w", err)
+				}
+				if err := mgr.Add(vcs.NewServer(fmt.Sprintf(":%d", vcs.Port), mgr.GetClient(), provider)); err != nil {
+					return fmt.Errorf("unable to add VCS webhook receiver: %w", err)
+				}
+			}
+
+			if o.EnableWebhooks {
+				// Reuse the certificate persisted by a previous run of the
+				// operator, generating one if necessary, and instruct the API
+				// server to trust it
+				certs, err := pki.LoadOrGenerate(cmd.Context(), client.KubeClient, webhooks.CertsSecretName, webhooks.ServiceName, o.WebhookNamespace)
+				if err != nil {
+					return fmt.Errorf("unable to load webhook certificate: %w", err)
+				}
+				if err := certs.Write(o.WebhookCertDir); err != nil {
+					return fmt.Errorf("unable to write webhook certificate: %w", err)
+				}
+				if err := webhooks.InjectCABundle(cmd.Context(), client.KubeClient, certs.CACert); err != nil {
+					return err
+				}
+
+				webhooks.Register(mgr.GetWebhookServer(), mgr.GetClient())
+			}
+
 			klog.V(0).Info("starting manager")
 			if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 				return fmt.Errorf("problem running manager: %w", err)
@@ -101,6 +277,71 @@ func ManagerCmd(f *cmdutil.Factory) *cobra.Command {
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	cmd.Flags().StringVar(&o.Image, "image", version.Image, "Docker image used for both the operator and the runner")
+	cmd.Flags().StringVar(&o.TerraformMirror, "terraform-mirror", installer.DefaultMirror, "URL of mirror from which to download terraform (workspaces can override)")
+
+	cmd.Flags().StringVar(&o.PluginCacheStorageClass, "plugin-cache-storage-class", "", "Storage class for the provider plugin cache shared by workspaces across the cluster (must support ReadWriteMany). Leave empty to disable.")
+	cmd.Flags().StringVar(&o.PluginCacheSize, "plugin-cache-size", controllers.DefaultSharedPluginCacheSize, "Size of the shared provider plugin cache")
+	cmd.Flags().StringVar(&o.PluginCacheNamespace, "plugin-cache-namespace", controllers.DefaultSharedPluginCacheNamespace, "Namespace in which to create the shared provider plugin cache")
+	cmd.Flags().BoolVar(&o.PluginCacheOffline, "plugin-cache-offline", false, "Only install providers from the shared plugin cache")
+
+	cmd.Flags().StringVar(&o.StateServerURL, "state-server-url", "", "URL at which runs reach the operator's state server. The server serves TLS if the URL is https. Leave empty to disable the HTTP state backend.")
+	cmd.Flags().StringVar(&o.StateServerNamespace, "state-server-namespace", "etok", "Namespace of the state server's service")
+	cmd.Flags().StringVar(&o.StateEncryptionKeyFile, "state-encryption-key-file", "", "File containing a secret with which to encrypt state stored by the HTTP state backend. Leave empty to disable encryption.")
+	cmd.Flags().IntVar(&o.StateVersions, "state-versions", backend.DefaultVersions, "Number of versions of state to retain in the HTTP state backend")
+	cmd.Flags().BoolVar(&o.ReleaseStaleLocks, "release-stale-locks", true, "Release locks on state held by runs whose pods are gone")
+
+	cmd.Flags().BoolVar(&o.EnableWeb, "enable-web", false, fmt.Sprintf("Serve a read-only HTTP API and web UI for workspaces and runs over HTTPS on port %d", web.Port))
+	cmd.Flags().StringVar(&o.WebNamespace, "web-namespace", "etok", "Namespace of the web server's service")
+	cmd.Flags().StringVar(&o.WebTLSCertFile, "web-tls-cert-file", "", "File containing the web server's certificate. Leave empty to use a certificate generated by the operator.")
+	cmd.Flags().StringVar(&o.WebTLSKeyFile, "web-tls-key-file", "", "File containing the web server's key")
+
+	cmd.Flags().StringVar(&o.VCSProvider, "vcs-provider", "", fmt.Sprintf("VCS provider (github or gitlab) from which to receive webhooks on port %d. Leave empty to disable.", vcs.Port))
+	cmd.Flags().StringVar(&o.VCSAPIURL, "vcs-api-url", "", "Base URL of the VCS provider's API. Defaults to the public API of the provider.")
+	cmd.Flags().StringVar(&o.VCSTokenFile, "vcs-token-file", "", "File containing the token with which to authenticate to the VCS provider's API")
+	cmd.Flags().StringVar(&o.VCSWebhookSecretFile, "vcs-webhook-secret-file", "", "File containing the secret with which VCS webhooks are validated")
+
+	cmd.Flags().BoolVar(&o.EnableWebhooks, "enable-webhooks", false, "Serve admission webhooks for validating and defaulting workspaces and runs")
+	cmd.Flags().StringVar(&o.WebhookNamespace, "webhook-namespace", "etok", "Namespace of the webhook service")
+	cmd.Flags().StringVar(&o.WebhookCertDir, "webhook-cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"), "Directory to which the webhook serving certificate is written")
 
 	return cmd
 }
+
+// stateStore constructs the store for the HTTP state backend. It uses a client
+// that bypasses the manager's cache, to ensure state is read consistently.
+func (o *ManagerOptions) stateStore(mgr ctrl.Manager) (*backend.Store, error) {
+	if o.StateVersions < 1 {
+		return nil, fmt.Errorf("invalid number of state versions: %d", o.StateVersions)
+	}
+	opts := []backend.StoreOption{backend.WithVersions(o.StateVersions)}
+
+	if o.StateEncryptionKeyFile != "" {
+		key, err := ioutil.ReadFile(o.StateEncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read state encryption key: %w", err)
+		}
+		opts = append(opts, backend.WithEncryptionKey(key))
+	}
+
+	c, err := client.New(mgr.GetConfig(), client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		return nil, err
+	}
+	return backend.NewStore(c, opts...), nil
+}
+
+// vcsProvider constructs the VCS provider, reading its credentials from file
+func (o *ManagerOptions) vcsProvider() (vcs.Provider, error) {
+	if o.VCSTokenFile == "" || o.VCSWebhookSecretFile == "" {
+		return nil, fmt.Errorf("a VCS token file and webhook secret file are required")
+	}
+	token, err := ioutil.ReadFile(o.VCSTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read VCS token: %w", err)
+	}
+	secret, err := ioutil.ReadFile(o.VCSWebhookSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read VCS webhook secret: %w", err)
+	}
+	return vcs.NewProvider(o.VCSProvider, o.VCSAPIURL, strings.TrimSpace(string(token)), strings.TrimSpace(string(secret)))
+}
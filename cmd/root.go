@@ -4,11 +4,16 @@ import (
 	"flag"
 	"strconv"
 
+	"github.com/leg100/etok/cmd/attach"
+	"github.com/leg100/etok/cmd/cancel"
+	"github.com/leg100/etok/cmd/dashboard"
 	"github.com/leg100/etok/cmd/install"
+	"github.com/leg100/etok/cmd/installer"
 	"github.com/leg100/etok/cmd/launcher"
 	"github.com/leg100/etok/cmd/manager"
 	"github.com/leg100/etok/cmd/runner"
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/cmd/wait"
 	"github.com/leg100/etok/cmd/workspace"
 	"github.com/leg100/etok/pkg/executor"
 	"github.com/spf13/cobra"
@@ -40,11 +45,27 @@ func RootCmd(f *cmdutil.Factory) *cobra.Command {
 	runnerCmd, _ := runner.RunnerCmd(f)
 	cmd.AddCommand(runnerCmd)
 
+	dashboardCmd, _ := dashboard.DashboardCmd(f)
+	cmd.AddCommand(dashboardCmd)
+
 	installCmd, _ := install.InstallCmd(f)
 	cmd.AddCommand(installCmd)
 
+	installerCmd, _ := installer.InstallerCmd(f)
+	cmd.AddCommand(installerCmd)
+
 	// Terraform commands (and shell command)
 	launcher.AddToRoot(cmd, f)
+
+	// Re-connect to and await runs
+	attachCmd, _ := attach.AttachCmd(f)
+	cmd.AddCommand(attachCmd)
+	waitCmd, _ := wait.WaitCmd(f)
+	cmd.AddCommand(waitCmd)
+
+	// Cancel runs
+	cancelCmd, _ := cancel.CancelCmd(f)
+	cmd.AddCommand(cancelCmd)
 	// terraform fmt
 	cmd.AddCommand(launcher.FmtCmd(&executor.Exec{IOStreams: f.IOStreams}))
 
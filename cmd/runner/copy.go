@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/leg100/etok/pkg/globals"
+)
+
+// copyDotTerraform takes a private copy of the .terraform directory src at
+// dst. Provider binaries are large and only ever executed, so rather than
+// copying them they are hard linked, which leaves the copy intact should an
+// init replace them in the source. The lock file guarding the directory is
+// not copied.
+func copyDotTerraform(src, dst string) error {
+	if err := copyDir(src, dst, copyFile, "providers", globals.DotTerraformLockFile); err != nil {
+		return err
+	}
+
+	providers := filepath.Join(src, "providers")
+	if _, err := os.Stat(providers); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return copyDir(providers, filepath.Join(dst, "providers"), linkFile)
+}
+
+// copyDir recursively copies the directory src to dst, preserving symlinks,
+// and skipping the given paths relative to src. Regular files are copied with
+// the given func. Terraform symlinks providers from the plugin cache into the
+// .terraform directory, and the links are copied rather than their targets.
+func copyDir(src, dst string, copyFn func(src, dst string, mode os.FileMode) error, skip ...string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		for _, s := range skip {
+			if rel == s {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFn(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+// linkFile hard links dst to src, falling back to copying src should the
+// filesystem not permit the link
+func linkFile(src, dst string, mode os.FileMode) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, mode)
+}
+
+// copyFile copies src to dst, with the given mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
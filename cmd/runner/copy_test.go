@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyDir(t *testing.T) {
+	src := testutil.NewTempDir(t).
+		Write("modules/modules.json", []byte("{}")).
+		Write("terraform.tfstate", []byte("state")).
+		Symlink("terraform.tfstate", "link")
+	require.NoError(t, os.Chmod(src.Path("terraform.tfstate"), 0600))
+
+	dst := filepath.Join(testutil.NewTempDir(t).Root(), ".terraform")
+	require.NoError(t, copyDir(src.Root(), dst, copyFile))
+
+	contents, err := ioutil.ReadFile(filepath.Join(dst, "modules", "modules.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(contents))
+
+	info, err := os.Stat(filepath.Join(dst, "terraform.tfstate"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, src.Path("terraform.tfstate"), link)
+}
+
+func TestCopyDotTerraform(t *testing.T) {
+	src := testutil.NewTempDir(t).
+		Write("modules/modules.json", []byte("{}")).
+		Write("providers/registry.terraform.io/hashicorp/random/3.0.0/linux_amd64/terraform-provider-random", []byte("binary")).
+		Write(".etok.lock", []byte{})
+
+	dst := filepath.Join(testutil.NewTempDir(t).Root(), ".terraform")
+	require.NoError(t, copyDotTerraform(src.Root(), dst))
+
+	assert.FileExists(t, filepath.Join(dst, "modules", "modules.json"))
+
+	// Providers are hard linked rather than copied
+	binary := "providers/registry.terraform.io/hashicorp/random/3.0.0/linux_amd64/terraform-provider-random"
+	srcInfo, err := os.Stat(src.Path(binary))
+	require.NoError(t, err)
+	dstInfo, err := os.Lstat(filepath.Join(dst, binary))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+	// Providers directory is a private copy, unaffected by an init replacing
+	// the source's providers
+	require.NoError(t, os.RemoveAll(src.Path("providers")))
+	contents, err := ioutil.ReadFile(filepath.Join(dst, binary))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(contents))
+
+	// Lock file is not copied
+	_, err = os.Stat(filepath.Join(dst, ".etok.lock"))
+	assert.True(t, os.IsNotExist(err))
+}
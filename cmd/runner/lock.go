@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Interval between attempts to acquire a lock
+var lockInterval = time.Second
+
+// lockFile takes an exclusive lock on the file at the given path, creating it
+// if it doesn't exist, and blocking until the lock is acquired or the context
+// is cancelled. The returned func releases the lock.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return flock(ctx, f, syscall.LOCK_EX)
+}
+
+// sharedLockFile takes a shared lock on the file at the given path, blocking
+// until the lock is acquired or the context is cancelled. The file is opened
+// read-only, permitting it to reside on a read-only volume. If it doesn't
+// exist then no lock is taken. The returned func releases the lock.
+func sharedLockFile(ctx context.Context, path string) (func(), error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return flock(ctx, f, syscall.LOCK_SH)
+}
+
+func flock(ctx context.Context, f *os.File, how int) (func(), error) {
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %w", f.Name(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockInterval):
+		}
+	}
+
+	return func() {
+		// Closing the file releases the lock
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	lockInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// Whether the lock is already held
+		held bool
+		// Whether the lock is released before the context is cancelled
+		release bool
+		wantErr error
+	}{
+		{
+			name: "acquire free lock",
+		},
+		{
+			name:    "await held lock",
+			held:    true,
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:    "acquire released lock",
+			held:    true,
+			release: true,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			path := filepath.Join(t.NewTempDir().Root(), ".lock")
+
+			if tt.held {
+				unlock, err := lockFile(context.Background(), path)
+				require.NoError(t, err)
+				if tt.release {
+					time.AfterFunc(50*time.Millisecond, unlock)
+				} else {
+					defer unlock()
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			unlock, err := lockFile(ctx, path)
+			assert.Equal(t, tt.wantErr, err)
+			if err == nil {
+				unlock()
+			}
+		})
+	}
+}
+
+func TestSharedLockFile(t *testing.T) {
+	lockInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// Whether the lock file exists
+		exists bool
+		// Whether an exclusive lock is already held
+		exclusive bool
+		// Whether a shared lock is already held
+		shared  bool
+		wantErr error
+	}{
+		{
+			name:   "acquire free lock",
+			exists: true,
+		},
+		{
+			name: "lock file does not exist",
+		},
+		{
+			name:   "share held lock",
+			exists: true,
+			shared: true,
+		},
+		{
+			name:      "await exclusive lock",
+			exists:    true,
+			exclusive: true,
+			wantErr:   context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			path := filepath.Join(t.NewTempDir().Root(), ".lock")
+
+			if tt.exists {
+				unlock, err := lockFile(context.Background(), path)
+				require.NoError(t, err)
+				if tt.exclusive {
+					defer unlock()
+				} else {
+					unlock()
+				}
+			}
+
+			if tt.shared {
+				unlock, err := sharedLockFile(context.Background(), path)
+				require.NoError(t, err)
+				defer unlock()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			unlock, err := sharedLockFile(ctx, path)
+			assert.Equal(t, tt.wantErr, err)
+			if err == nil {
+				unlock()
+			}
+		})
+	}
+}
@@ -2,21 +2,23 @@ package runner
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/cmd/flags"
-	"github.com/leg100/etok/cmd/launcher"
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/archive"
 	"github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/executor"
 	"github.com/leg100/etok/pkg/globals"
+	"github.com/leg100/etok/pkg/k8s"
 	"github.com/leg100/etok/pkg/labels"
 	"github.com/leg100/etok/pkg/scheme"
 	"github.com/spf13/cobra"
@@ -24,6 +26,8 @@ import (
 	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	watchtools "k8s.io/client-go/tools/watch"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
@@ -46,18 +50,52 @@ type RunnerOptions struct {
 
 	runName string
 
+	// Directory from which to copy the .terraform directory into the working
+	// directory, rather than using a .terraform directory shared with other
+	// runs
+	dotTerraformSource string
+
+	// Path to a lock file held whilst the command modifies a .terraform
+	// directory shared with other runs, preventing runs from copying it
+	// whilst it is modified
+	dotTerraformLock string
+
+	// Path to a lock file with which to serialise installs into a plugin cache
+	// shared with other runs. Terraform doesn't synchronise concurrent writes
+	// to its plugin cache.
+	pluginCacheLock string
+
+	// Run terraform init before the command, because the command is run on
+	// an empty cache
+	init bool
+
 	exec executor.Executor
 
+	// Signals to be forwarded to the command upon the run being cancelled
+	signals chan os.Signal
+
 	handshake        bool
 	handshakeTimeout time.Duration
+	// File created once the handshake is received
+	handshakeMarker string
+
+	// Paths to files to be persisted to a config map once the command has
+	// completed, encoded as a JSON array
+	artifactsJSON string
+	artifacts     []string
 
 	args []string
 }
 
 func RunnerCmd(opts *cmdutil.Factory) (*cobra.Command, *RunnerOptions) {
+	// Buffered so that cancellation requests received before the command
+	// starts are forwarded once it has started
+	signals := make(chan os.Signal, 2)
+
 	o := &RunnerOptions{
 		Factory: opts,
-		exec:    &executor.Exec{IOStreams: opts.IOStreams},
+		exec:    &executor.Exec{IOStreams: opts.IOStreams, Signals: signals, ProcessGroup: true},
+		signals: signals,
 	}
 
 	cmd := &cobra.Command{
@@ -88,8 +126,14 @@ func RunnerCmd(opts *cmdutil.Factory) (*cobra.Command, *RunnerOptions) {
 	cmd.Flags().StringVar(&o.tarball, "tarball", o.tarball, "Tarball filename")
 	cmd.Flags().BoolVar(&o.handshake, "handshake", false, "Await handshake string on stdin")
 	cmd.Flags().DurationVar(&o.handshakeTimeout, "handshake-timeout", v1alpha1.DefaultHandshakeTimeout, "Timeout waiting for handshake")
+	cmd.Flags().StringVar(&o.handshakeMarker, "handshake-marker", globals.HandshakeMarker, "File to create once the handshake is received")
 	cmd.Flags().StringVar(&o.runName, "run-name", "", "Name of run resource")
 	cmd.Flags().StringVar(&o.command, "command", "", "Etok command to run")
+	cmd.Flags().StringVar(&o.dotTerraformSource, "dot-terraform-source", "", "Directory from which to copy the .terraform directory")
+	cmd.Flags().BoolVar(&o.init, "init", false, "Run terraform init before the command")
+	cmd.Flags().StringVar(&o.dotTerraformLock, "dot-terraform-lock", "", "Lock file to hold whilst modifying a shared .terraform directory")
+	cmd.Flags().StringVar(&o.pluginCacheLock, "plugin-cache-lock", "", "Lock file with which to serialise provider installs into a shared plugin cache")
+	cmd.Flags().StringVar(&o.artifactsJSON, "artifacts", "", "Paths to files to return to the client, as a JSON array")
 
 	return cmd, o
 }
@@ -110,9 +154,17 @@ func (o *RunnerOptions) validate() error {
 		return errors.New("--command cannot be empty")
 	}
 
-	if launcher.UpdatesLockFile(o.command) {
+	if o.artifactsJSON != "" {
+		// Paths are JSON-encoded because they may contain any character,
+		// including commas
+		if err := json.Unmarshal([]byte(o.artifactsJSON), &o.artifacts); err != nil {
+			return fmt.Errorf("--artifacts must be a JSON array of paths: %w", err)
+		}
+	}
+
+	if len(o.artifacts) > 0 {
 		if o.runName == "" {
-			return fmt.Errorf("%s updates lock file; --run-name cannot be empty", o.command)
+			return errors.New("artifacts requested; --run-name cannot be empty")
 		}
 	}
 
@@ -151,35 +203,141 @@ func (o *RunnerOptions) Run(ctx context.Context) error {
 		return err
 	}
 
+	if o.dotTerraformSource != "" {
+		// Take a private copy of the .terraform directory, awaiting any run
+		// modifying it
+		klog.V(1).Infof("[runner] awaiting lock on .terraform directory\r\n")
+		unlock, err := sharedLockFile(ctx, filepath.Join(o.dotTerraformSource, globals.DotTerraformLockFile))
+		if err != nil {
+			return fmt.Errorf("failed to lock .terraform directory: %w", err)
+		}
+		err = copyDotTerraform(o.dotTerraformSource, ".terraform")
+		unlock()
+		if err != nil {
+			return fmt.Errorf("failed to copy .terraform directory: %w", err)
+		}
+	}
+
+	if o.runName != "" {
+		// Forward cancellation requests to the command until it exits
+		cctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go o.watchCancel(cctx)
+	}
+
+	if o.init && o.command != "init" {
+		// Install providers and modules before running the command
+		if err := o.execute(ctx, "init", "-input=false"); err != nil {
+			return err
+		}
+	}
+
 	// Execute requested command
-	if err := o.exec.Execute(ctx, prepareArgs(o.command, o.args...)); err != nil {
+	if err := o.execute(ctx, o.command, o.args...); err != nil {
 		return err
 	}
 
-	if launcher.UpdatesLockFile(o.command) {
-		// This is a command that updates the lock file (such as terraform init)
-		// so persist it to a configmap
-		if err := o.persistLockFile(ctx); err != nil {
-			return fmt.Errorf("failed to persist lock file to config map: %w", err)
+	if len(o.artifacts) > 0 {
+		// Return requested files to the client via a config map
+		if err := o.persistArtifacts(ctx); err != nil {
+			return fmt.Errorf("failed to persist artifacts to config map: %w", err)
 		}
 	}
 
 	return nil
 }
 
-// persistLockFile persists the lock file .terraform.lock.hcl to a config map.
-// If the lock file does not exist then it exits early without error.
-func (o *RunnerOptions) persistLockFile(ctx context.Context) error {
-	// Check if file exists
-	lockFileContents, err := ioutil.ReadFile(globals.LockFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			klog.V(1).Infof("%s not found", globals.LockFile)
-			return nil
+// execute executes the command, holding the plugin cache lock if the command
+// installs providers, and the .terraform lock if it modifies a shared .terraform
+// directory
+func (o *RunnerOptions) execute(ctx context.Context, command string, args ...string) error {
+	if o.pluginCacheLock != "" && command == "init" {
+		klog.V(1).Infof("[runner] awaiting lock on plugin cache\r\n")
+		unlock, err := lockFile(ctx, o.pluginCacheLock)
+		if err != nil {
+			return fmt.Errorf("failed to lock plugin cache: %w", err)
 		}
+		defer unlock()
 	}
 
-	// File exists so continue...
+	if o.dotTerraformLock != "" && modifiesDotTerraform(command) {
+		klog.V(1).Infof("[runner] awaiting lock on .terraform directory\r\n")
+		unlock, err := lockFile(ctx, o.dotTerraformLock)
+		if err != nil {
+			return fmt.Errorf("failed to lock .terraform directory: %w", err)
+		}
+		defer unlock()
+	}
+
+	return o.exec.Execute(ctx, prepareArgs(command, args...))
+}
+
+// modifiesDotTerraform determines whether the command modifies the .terraform
+// directory, installing providers or modules
+func modifiesDotTerraform(command string) bool {
+	return command == "init" || command == "get"
+}
+
+// watchCancel watches the run for cancellation requests, sending the command an
+// interrupt signal upon the first request, and a kill signal upon a request to
+// kill it.
+func (o *RunnerOptions) watchCancel(ctx context.Context) {
+	var interrupted bool
+
+	lw := &k8s.RunListWatcher{Client: o.EtokClient, Name: o.runName, Namespace: o.namespace}
+	_, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Run{}, nil, func(event watch.Event) (bool, error) {
+		run, ok := event.Object.(*v1alpha1.Run)
+		if !ok || run.Name != o.runName {
+			return false, nil
+		}
+
+		switch run.Cancel {
+		case v1alpha1.RunCancelInterrupt:
+			if !interrupted {
+				klog.V(1).Infof("[runner] run cancelled, interrupting command\r\n")
+				o.signals <- os.Interrupt
+				interrupted = true
+			}
+		case v1alpha1.RunCancelKill:
+			klog.V(1).Infof("[runner] run cancelled, killing command\r\n")
+			o.signals <- os.Kill
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil && ctx.Err() == nil {
+		klog.Errorf("[runner] unable to watch run for cancellation requests: %s\r\n", err.Error())
+	}
+}
+
+// persistArtifacts persists the requested artifacts to a config map, owned by
+// the run. Artifacts that do not exist are skipped; it is up to the client to
+// determine whether this is an error.
+func (o *RunnerOptions) persistArtifacts(ctx context.Context) error {
+	data := make(map[string][]byte)
+	var size int
+	for _, path := range o.artifacts {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				klog.V(1).Infof("artifact %s not found", path)
+				continue
+			}
+			return err
+		}
+		key := v1alpha1.ArtifactKey(path)
+		data[key] = contents
+		size += len(key) + len(contents)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	// Fail with a clear error rather than an obscure one from the API server
+	if size > archive.MaxConfigSize {
+		return fmt.Errorf("%w: %d bytes exceeds the maximum size of a config map (%d bytes)", errArtifactsTooLarge, size, archive.MaxConfigSize)
+	}
 
 	// Get run resource so that it can be set as owner of config map
 	run, err := o.RunsClient(o.namespace).Get(ctx, o.runName, metav1.GetOptions{})
@@ -191,15 +349,13 @@ func (o *RunnerOptions) persistLockFile(ctx context.Context) error {
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: o.namespace,
-			Name:      v1alpha1.RunLockFileConfigMapName(o.runName),
-		},
-		BinaryData: map[string][]byte{
-			globals.LockFile: lockFileContents,
+			Name:      v1alpha1.RunArtifactsConfigMapName(o.runName),
 		},
+		BinaryData: data,
 	}
 	// Set etok's common labels
 	labels.SetCommonLabels(configMap)
-	// Permit filtering archives by command
+	// Permit filtering artifacts by command
 	labels.SetLabel(configMap, labels.Command(o.command))
 	// Permit filtering etok resources by component
 	labels.SetLabel(configMap, labels.RunComponent)
@@ -278,10 +434,17 @@ func (o *RunnerOptions) receiveHandshake(ctx context.Context) error {
 		}
 	}
 	klog.V(1).Infof("[runner] handshake completed\r\n")
+
+	// Signal the handshake is complete, so that a client attaching later
+	// does not send it again
+	if err := ioutil.WriteFile(o.handshakeMarker, nil, 0644); err != nil {
+		return fmt.Errorf("handshake: unable to create marker: %w", err)
+	}
 	return nil
 }
 
 var (
 	errIncorrectHandshake = errors.New("incorrect handshake received")
 	errHandshakeTimeout   = errors.New("timed out awaiting handshake")
+	errArtifactsTooLarge  = errors.New("artifacts too large")
 )
@@ -19,8 +19,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/creack/pty"
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/cmd/envvars"
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/archive"
 	"github.com/leg100/etok/pkg/executor"
 	"github.com/leg100/etok/pkg/globals"
 	"github.com/leg100/etok/pkg/testobj"
@@ -85,6 +87,46 @@ func TestRunnerCommand(t *testing.T) {
 		assert.Equal(t, want, strings.TrimSpace(out.String()))
 	})
 
+	testutil.Run(t, "terraform plan with init", func(t *testutil.T) {
+		out, cmd, opts := setupRunnerCmd(t, "--", "-out", "plan.out")
+
+		// Set flag via env var since that's how runner is invoked on a pod
+		t.SetEnvs(map[string]string{
+			"ETOK_COMMAND":   "plan",
+			"ETOK_NAMESPACE": "foo",
+			"ETOK_INIT":      "true",
+		})
+		envvars.SetFlagsFromEnvVariables(cmd)
+
+		// Override executor with one that prints out cmd+args
+		opts.exec = &executor.FakeExecutorEchoArgs{Out: out}
+
+		require.NoError(t, cmd.ExecuteContext(context.Background()))
+
+		want := "[terraform init -input=false][terraform plan -out plan.out]"
+		assert.Equal(t, want, strings.TrimSpace(out.String()))
+	})
+
+	testutil.Run(t, "terraform init with init", func(t *testutil.T) {
+		out, cmd, opts := setupRunnerCmd(t)
+
+		// Set flag via env var since that's how runner is invoked on a pod
+		t.SetEnvs(map[string]string{
+			"ETOK_COMMAND":   "init",
+			"ETOK_NAMESPACE": "foo",
+			"ETOK_INIT":      "true",
+		})
+		envvars.SetFlagsFromEnvVariables(cmd)
+
+		// Override executor with one that prints out cmd+args
+		opts.exec = &executor.FakeExecutorEchoArgs{Out: out}
+
+		require.NoError(t, cmd.ExecuteContext(context.Background()))
+
+		// Init is only run once
+		assert.Equal(t, "[terraform init]", strings.TrimSpace(out.String()))
+	})
+
 	testutil.Run(t, "terraform plan with custom namespace", func(t *testutil.T) {
 		out, cmd, opts := setupRunnerCmd(t, "--", "-out", "plan.out")
 
@@ -146,31 +188,165 @@ func TestRunnerCommand(t *testing.T) {
 	})
 }
 
-func TestRunnerLockFile(t *testing.T) {
-	testutil.Run(t, "with lock file", func(t *testutil.T) {
+func TestRunnerCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		mode v1alpha1.RunCancelMode
+	}{
+		{
+			name: "interrupt",
+			mode: v1alpha1.RunCancelInterrupt,
+		},
+		{
+			name: "kill",
+			mode: v1alpha1.RunCancelKill,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, testobj.Run("dev", "run-12345", "sh", testobj.WithCancel(tt.mode)))
+			cmd, _ := RunnerCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs([]string{"--", "exec sleep 10"})
+
+			t.NewTempDir().Chdir()
+
+			// Set flag via env var since that's how runner is invoked on a pod
+			t.SetEnvs(map[string]string{
+				"ETOK_NAMESPACE": "dev",
+				"ETOK_COMMAND":   "sh",
+				"ETOK_RUN_NAME":  "run-12345",
+			})
+			envvars.SetFlagsFromEnvVariables(cmd)
+
+			start := time.Now()
+
+			// Command is signalled and exits prematurely
+			var exiterr *exec.ExitError
+			assert.True(t, errors.As(cmd.ExecuteContext(context.Background()), &exiterr))
+			assert.True(t, time.Since(start) < 10*time.Second)
+		})
+	}
+}
+
+func TestRunnerDotTerraformLock(t *testing.T) {
+	lockInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		command string
+		// Copy .terraform from a source directory, as a reader does
+		copy bool
+		// Whether the lock is already held exclusively
+		held bool
+		err  error
+	}{
+		{
+			name:    "init acquires free lock",
+			command: "init",
+		},
+		{
+			name:    "init awaits held lock",
+			command: "init",
+			held:    true,
+			err:     context.DeadlineExceeded,
+		},
+		{
+			name:    "plan ignores held lock",
+			command: "plan",
+			held:    true,
+		},
+		{
+			name:    "copy acquires free lock",
+			command: "plan",
+			copy:    true,
+		},
+		{
+			name:    "copy awaits held lock",
+			command: "plan",
+			copy:    true,
+			held:    true,
+			err:     context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			src := t.NewTempDir().Write("modules/modules.json", []byte("{}"))
+			lock := src.Path(globals.DotTerraformLockFile)
+
+			args := []string{"--namespace", "dev", "--command", tt.command}
+			if tt.copy {
+				args = append(args, "--dot-terraform-source", src.Root())
+			} else {
+				args = append(args, "--dot-terraform-lock", lock)
+			}
+
+			_, cmd, opts := setupRunnerCmd(t, args...)
+			opts.exec = &executor.FakeExecutor{}
+
+			unlock, err := lockFile(context.Background(), lock)
+			require.NoError(t, err)
+			if tt.held {
+				defer unlock()
+			} else {
+				unlock()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err = cmd.ExecuteContext(ctx)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.copy {
+				assert.FileExists(t, filepath.Join(".terraform", "modules", "modules.json"))
+			}
+		})
+	}
+}
+
+func TestRunnerArtifacts(t *testing.T) {
+	testutil.Run(t, "with artifacts", func(t *testutil.T) {
 		out := new(bytes.Buffer)
-		f := cmdutil.NewFakeFactory(out, testobj.Run("dev", "run-12345", "init"))
+		f := cmdutil.NewFakeFactory(out, testobj.Run("dev", "run-12345", "sh"))
 		cmd, o := RunnerCmd(f)
 		cmd.SetOut(out)
 		cmd.SetArgs([]string{"--", "true"})
 
-		t.NewTempDir().Chdir().Write(globals.LockFile, []byte("plugin hashes"))
+		t.NewTempDir().Chdir().
+			Write(globals.LockFile, []byte("plugin hashes")).
+			Write("plans/plan.out", []byte("plan")).
+			Write("plans/a,b.out", []byte("comma"))
 
 		// Set flag via env var since that's how runner is invoked on a pod
 		t.SetEnvs(map[string]string{
 			"ETOK_NAMESPACE": "dev",
-			"ETOK_COMMAND":   "init",
+			"ETOK_COMMAND":   "sh",
 			"ETOK_RUN_NAME":  "run-12345",
+			"ETOK_ARTIFACTS": `["` + globals.LockFile + `","plans/plan.out","plans/a,b.out","missing.txt"]`,
 		})
 		envvars.SetFlagsFromEnvVariables(cmd)
 
 		assert.NoError(t, cmd.ExecuteContext(context.Background()))
 
-		_, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), "run-12345-lockfile", metav1.GetOptions{})
-		assert.NoError(t, err)
+		artifacts, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), "run-12345-artifacts", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]byte{
+			v1alpha1.ArtifactKey(globals.LockFile): []byte("plugin hashes"),
+			v1alpha1.ArtifactKey("plans/plan.out"): []byte("plan"),
+			v1alpha1.ArtifactKey("plans/a,b.out"):  []byte("comma"),
+		}, artifacts.BinaryData)
+		assert.Equal(t, "run-12345", artifacts.OwnerReferences[0].Name)
 	})
 
-	testutil.Run(t, "without lock file", func(t *testutil.T) {
+	testutil.Run(t, "without artifacts", func(t *testutil.T) {
 		_, cmd, o := setupRunnerCmd(t, "--", "true")
 
 		// Set flag via env var since that's how runner is invoked on a pod
@@ -183,9 +359,59 @@ func TestRunnerLockFile(t *testing.T) {
 
 		assert.NoError(t, cmd.ExecuteContext(context.Background()))
 
-		_, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), "run-12345-lockfile", metav1.GetOptions{})
+		_, err := o.ConfigMapsClient(o.namespace).Get(context.Background(), "run-12345-artifacts", metav1.GetOptions{})
 		assert.True(t, kerrors.IsNotFound(err))
 	})
+
+	testutil.Run(t, "artifacts require run name", func(t *testutil.T) {
+		_, cmd, _ := setupRunnerCmd(t, "--", "true")
+
+		// Set flag via env var since that's how runner is invoked on a pod
+		t.SetEnvs(map[string]string{
+			"ETOK_NAMESPACE": "dev",
+			"ETOK_COMMAND":   "sh",
+			"ETOK_ARTIFACTS": `["plan.out"]`,
+		})
+		envvars.SetFlagsFromEnvVariables(cmd)
+
+		assert.Error(t, cmd.ExecuteContext(context.Background()))
+	})
+
+	testutil.Run(t, "artifacts too large", func(t *testutil.T) {
+		out := new(bytes.Buffer)
+		f := cmdutil.NewFakeFactory(out, testobj.Run("dev", "run-12345", "sh"))
+		cmd, _ := RunnerCmd(f)
+		cmd.SetOut(out)
+		cmd.SetArgs([]string{"--", "true"})
+
+		t.NewTempDir().Chdir().WriteRandomFile("plan.out", archive.MaxConfigSize+1)
+
+		// Set flag via env var since that's how runner is invoked on a pod
+		t.SetEnvs(map[string]string{
+			"ETOK_NAMESPACE": "dev",
+			"ETOK_COMMAND":   "sh",
+			"ETOK_RUN_NAME":  "run-12345",
+			"ETOK_ARTIFACTS": `["plan.out"]`,
+		})
+		envvars.SetFlagsFromEnvVariables(cmd)
+
+		assert.True(t, errors.Is(cmd.ExecuteContext(context.Background()), errArtifactsTooLarge))
+	})
+
+	testutil.Run(t, "artifacts must be a json array", func(t *testutil.T) {
+		_, cmd, _ := setupRunnerCmd(t, "--", "true")
+
+		// Set flag via env var since that's how runner is invoked on a pod
+		t.SetEnvs(map[string]string{
+			"ETOK_NAMESPACE": "dev",
+			"ETOK_COMMAND":   "sh",
+			"ETOK_RUN_NAME":  "run-12345",
+			"ETOK_ARTIFACTS": "plan.out,graph.dot",
+		})
+		envvars.SetFlagsFromEnvVariables(cmd)
+
+		assert.Error(t, cmd.ExecuteContext(context.Background()))
+	})
 }
 
 func TestRunnerHandshake(t *testing.T) {
@@ -235,6 +461,10 @@ func TestRunnerHandshake(t *testing.T) {
 			t.SetEnvs(tt.envs)
 			envvars.SetFlagsFromEnvVariables(cmd)
 
+			// Create the marker in a temp dir rather than /tmp
+			marker := filepath.Join(t.NewTempDir().Root(), "handshake-completed")
+			opts.handshakeMarker = marker
+
 			// Override executor with one that does a noop
 			opts.exec = &executor.FakeExecutor{}
 
@@ -254,6 +484,10 @@ func TestRunnerHandshake(t *testing.T) {
 
 			// Look for wanted error in returned error chain
 			assert.True(t, errors.Is(cmd.ExecuteContext(context.Background()), tt.err))
+
+			// The marker is only created upon a successful handshake
+			_, err = os.Stat(marker)
+			assert.Equal(t, tt.err == nil, err == nil)
 		})
 	}
 }
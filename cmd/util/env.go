@@ -0,0 +1,61 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/leg100/etok/cmd/flags"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/spf13/cobra"
+)
+
+var ErrClusterMismatch = errors.New("cluster does not match that on which the workspace was selected")
+
+// LookupEnv reads the env for the path from the project file, setting the
+// namespace and workspace unless their flags were passed. A nil workspace is
+// left unset. Nil is returned if there is no project file.
+func LookupEnv(cmd *cobra.Command, path string, namespace, workspace *string) (*env.Env, error) {
+	etokenv, err := env.Read(path)
+	if err != nil {
+		// It's ok for envfile to not exist
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !flags.IsFlagPassed(cmd.Flags(), "namespace") {
+		*namespace = etokenv.Namespace
+	}
+	if workspace != nil && !flags.IsFlagPassed(cmd.Flags(), "workspace") {
+		*workspace = etokenv.Workspace
+	}
+	return etokenv, nil
+}
+
+// CheckCluster checks the client is configured for the cluster on which the
+// workspace was selected, guarding against operating on the wrong cluster after
+// switching kube contexts. The check is skipped if there is no project file,
+// or the user either sets the kube context explicitly or chooses to ignore a
+// mismatch.
+func CheckCluster(cmd *cobra.Command, etokenv *env.Env, c *client.Client, ignoreMismatch bool) error {
+	if etokenv == nil || ignoreMismatch || flags.IsFlagPassed(cmd.Flags(), "context") {
+		return nil
+	}
+
+	switch {
+	case etokenv.Cluster != "":
+		if c.Config.Host != etokenv.Cluster {
+			return fmt.Errorf("%w: workspace was selected on cluster %s but context %q is configured for cluster %s; pass --context or --ignore-cluster-mismatch to proceed", ErrClusterMismatch, etokenv.Cluster, c.Context, c.Config.Host)
+		}
+	case etokenv.Context != "":
+		// Project files written by older versions of etok record only the
+		// context
+		if c.Context != etokenv.Context {
+			return fmt.Errorf("%w: workspace was selected with context %q but the current context is %q; pass --context or --ignore-cluster-mismatch to proceed", ErrClusterMismatch, etokenv.Context, c.Context)
+		}
+	}
+	return nil
+}
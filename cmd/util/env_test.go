@@ -0,0 +1,116 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/cmd/flags"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func TestLookupEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           *env.Env
+		args          []string
+		wantNamespace string
+		wantWorkspace string
+	}{
+		{
+			name:          "no project file",
+			wantNamespace: "default",
+			wantWorkspace: "default",
+		},
+		{
+			name:          "project file",
+			env:           &env.Env{Namespace: "dev", Workspace: "networking"},
+			wantNamespace: "dev",
+			wantWorkspace: "networking",
+		},
+		{
+			name:          "flags override project file",
+			env:           &env.Env{Namespace: "dev", Workspace: "networking"},
+			args:          []string{"--namespace", "prod", "--workspace", "dns"},
+			wantNamespace: "prod",
+			wantWorkspace: "dns",
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			path := t.NewTempDir().Mkdir(".git").Root()
+			if tt.env != nil {
+				require.NoError(t, tt.env.Write(path))
+			}
+
+			namespace := "default"
+			var workspace string
+			cmd := &cobra.Command{RunE: func(*cobra.Command, []string) error { return nil }}
+			flags.AddNamespaceFlag(cmd, &namespace)
+			flags.AddWorkspaceFlag(cmd, &workspace)
+			require.NoError(t, cmd.ParseFlags(tt.args))
+
+			etokenv, err := LookupEnv(cmd, path, &namespace, &workspace)
+			require.NoError(t, err)
+			assert.Equal(t, tt.env == nil, etokenv == nil)
+			assert.Equal(t, tt.wantNamespace, namespace)
+			assert.Equal(t, tt.wantWorkspace, workspace)
+		})
+	}
+}
+
+func TestCheckCluster(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    *env.Env
+		args   []string
+		ignore bool
+		err    error
+	}{
+		{
+			name: "no project file",
+		},
+		{
+			name: "same cluster",
+			env:  &env.Env{Cluster: "https://dev.example.com"},
+		},
+		{
+			name: "different cluster",
+			env:  &env.Env{Cluster: "https://prod.example.com"},
+			err:  ErrClusterMismatch,
+		},
+		{
+			name: "different context",
+			env:  &env.Env{Context: "prod"},
+			err:  ErrClusterMismatch,
+		},
+		{
+			name: "context flag",
+			env:  &env.Env{Cluster: "https://prod.example.com"},
+			args: []string{"--context", "dev"},
+		},
+		{
+			name:   "ignore mismatch",
+			env:    &env.Env{Cluster: "https://prod.example.com"},
+			ignore: true,
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			var kubeContext string
+			cmd := &cobra.Command{RunE: func(*cobra.Command, []string) error { return nil }}
+			flags.AddKubeContextFlag(cmd, &kubeContext)
+			require.NoError(t, cmd.ParseFlags(tt.args))
+
+			c := &client.Client{Config: &rest.Config{Host: "https://dev.example.com"}, Context: "dev"}
+
+			err := CheckCluster(cmd, tt.env, c, tt.ignore)
+			assert.True(t, errors.Is(err, tt.err), err)
+		})
+	}
+}
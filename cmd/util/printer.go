@@ -0,0 +1,263 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	ErrInvalidOutputFormat = errors.New("invalid output format")
+)
+
+// OutputFormats are the output formats supported by NewPrinter
+const OutputFormats = "table|wide|json|yaml|name|go-template=...|jsonpath=..."
+
+// AddOutputFlag adds the output flag for selecting a printer
+func AddOutputFlag(cmd *cobra.Command, output *string, usage string) {
+	cmd.Flags().StringVarP(output, "output", "o", *output, fmt.Sprintf("%s. One of: %s", usage, OutputFormats))
+}
+
+// Printer prints an object, or a list of objects
+type Printer interface {
+	PrintObj(obj runtime.Object, w io.Writer) error
+}
+
+// Table describes how to print objects of a particular resource as a table,
+// and as names
+type Table struct {
+	// Resource name, used for name output
+	Resource string
+
+	Columns []Column
+}
+
+// Column is a table column
+type Column struct {
+	Header string
+
+	// Only shown with wide output
+	Wide bool
+
+	// Value retrieves the column value from an object
+	Value func(obj runtime.Object) string
+}
+
+// NewPrinter constructs a printer for the given output format. The table is
+// used for the table, wide and name output formats.
+func NewPrinter(output string, table *Table) (Printer, error) {
+	switch {
+	case output == "" || output == "table":
+		return &tablePrinter{table: table}, nil
+	case output == "wide":
+		return &tablePrinter{table: table, wide: true}, nil
+	case output == "json":
+		return &jsonPrinter{}, nil
+	case output == "yaml":
+		return &yamlPrinter{}, nil
+	case output == "name":
+		return &namePrinter{resource: table.Resource}, nil
+	case strings.HasPrefix(output, "go-template="):
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(output, "go-template="))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOutputFormat, err.Error())
+		}
+		return &templatePrinter{tmpl: tmpl}, nil
+	case strings.HasPrefix(output, "jsonpath="):
+		jp := jsonpath.New("output").AllowMissingKeys(true)
+		if err := jp.Parse(strings.TrimPrefix(output, "jsonpath=")); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOutputFormat, err.Error())
+		}
+		return &jsonpathPrinter{jp: jp}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s: must be one of: %s", ErrInvalidOutputFormat, output, OutputFormats)
+	}
+}
+
+// items returns the items of a list object, or the object itself if it is not
+// a list
+func items(obj runtime.Object) ([]runtime.Object, error) {
+	if meta.IsListType(obj) {
+		return meta.ExtractList(obj)
+	}
+	return []runtime.Object{obj}, nil
+}
+
+// withKind sets the kind of an object (and of its items if it is a list),
+// which typed clients leave empty
+func withKind(obj runtime.Object) (runtime.Object, error) {
+	obj = obj.DeepCopyObject()
+
+	if meta.IsListType(obj) {
+		objs, err := meta.ExtractList(obj)
+		if err != nil {
+			return nil, err
+		}
+		for i := range objs {
+			if objs[i], err = withKind(objs[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := meta.SetList(obj, objs); err != nil {
+			return nil, err
+		}
+	}
+
+	if obj.GetObjectKind().GroupVersionKind().Empty() {
+		gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	return obj, nil
+}
+
+// toUnstructured converts an object into the structure of its JSON encoding,
+// for use with templates
+func toUnstructured(obj runtime.Object) (map[string]interface{}, error) {
+	obj, err := withKind(obj)
+	if err != nil {
+		return nil, err
+	}
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+}
+
+type tablePrinter struct {
+	table *Table
+	wide  bool
+}
+
+func (p *tablePrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	objs, err := items(obj)
+	if err != nil {
+		return err
+	}
+
+	var columns []Column
+	for _, col := range p.table.Columns {
+		if !col.Wide || p.wide {
+			columns = append(columns, col)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+
+	headers := make([]string, len(columns))
+	for i, col := range columns {
+		headers[i] = col.Header
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+
+	for _, obj := range objs {
+		values := make([]string, len(columns))
+		for i, col := range columns {
+			values[i] = col.Value(obj)
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+type jsonPrinter struct{}
+
+func (p *jsonPrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	obj, err := withKind(obj)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+type yamlPrinter struct{}
+
+func (p *yamlPrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	obj, err := withKind(obj)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+type namePrinter struct {
+	resource string
+}
+
+func (p *namePrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	objs, err := items(obj)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s/%s\n", p.resource, accessor.GetName())
+	}
+	return nil
+}
+
+type templatePrinter struct {
+	tmpl *template.Template
+}
+
+func (p *templatePrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	data, err := toUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	return p.tmpl.Execute(w, data)
+}
+
+type jsonpathPrinter struct {
+	jp *jsonpath.JSONPath
+}
+
+func (p *jsonpathPrinter) PrintObj(obj runtime.Object, w io.Writer) error {
+	data, err := toUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	return p.jp.Execute(w, data)
+}
+
+// OrNone returns the string, or "<none>" if it is empty
+func OrNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// Age returns the human readable duration since the given time
+func Age(t time.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(t))
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPrinter(t *testing.T) {
+	table := &Table{
+		Resource: "workspace",
+		Columns: []Column{
+			{
+				Header: "NAME",
+				Value:  func(obj runtime.Object) string { return obj.(*v1alpha1.Workspace).Name },
+			},
+			{
+				Header: "VERSION",
+				Wide:   true,
+				Value:  func(obj runtime.Object) string { return obj.(*v1alpha1.Workspace).Spec.TerraformVersion },
+			},
+		},
+	}
+
+	list := &v1alpha1.WorkspaceList{
+		Items: []v1alpha1.Workspace{
+			*testobj.Workspace("default", "networking", testobj.WithTerraformVersion("0.14.3")),
+			*testobj.Workspace("default", "vpc", testobj.WithTerraformVersion("0.13.5")),
+		},
+	}
+
+	tests := []struct {
+		name   string
+		output string
+		obj    runtime.Object
+		err    error
+		want   string
+	}{
+		{
+			name: "default table",
+			obj:  list,
+			want: "NAME\nnetworking\nvpc\n",
+		},
+		{
+			name:   "wide table",
+			output: "wide",
+			obj:    list,
+			want:   "NAME         VERSION\nnetworking   0.14.3\nvpc          0.13.5\n",
+		},
+		{
+			name:   "single object table",
+			output: "table",
+			obj:    &list.Items[0],
+			want:   "NAME\nnetworking\n",
+		},
+		{
+			name:   "name",
+			output: "name",
+			obj:    list,
+			want:   "workspace/networking\nworkspace/vpc\n",
+		},
+		{
+			name:   "go-template",
+			output: "go-template={{range .items}}{{.metadata.name}}={{.spec.terraformVersion}} {{end}}",
+			obj:    list,
+			want:   "networking=0.14.3 vpc=0.13.5 ",
+		},
+		{
+			name:   "jsonpath",
+			output: "jsonpath={.kind}/{.metadata.name}",
+			obj:    &list.Items[0],
+			want:   "Workspace/networking",
+		},
+		{
+			name:   "invalid output format",
+			output: "xml",
+			err:    ErrInvalidOutputFormat,
+		},
+		{
+			name:   "invalid go-template",
+			output: "go-template={{.metadata.name",
+			err:    ErrInvalidOutputFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			printer, err := NewPrinter(tt.output, table)
+			if !assert.True(t, errors.Is(err, tt.err)) || err != nil {
+				return
+			}
+
+			out := new(bytes.Buffer)
+			require.NoError(t, printer.PrintObj(tt.obj, out))
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
+
+func TestPrinterJSONAndYAML(t *testing.T) {
+	ws := testobj.Workspace("default", "networking")
+
+	t.Run("json", func(t *testing.T) {
+		printer, err := NewPrinter("json", &Table{})
+		require.NoError(t, err)
+
+		out := new(bytes.Buffer)
+		require.NoError(t, printer.PrintObj(ws, out))
+		assert.Contains(t, out.String(), `"kind": "Workspace"`)
+		assert.Contains(t, out.String(), `"apiVersion": "etok.dev/v1alpha1"`)
+		assert.Contains(t, out.String(), `"name": "networking"`)
+
+		// Original object is not modified
+		assert.Empty(t, ws.Kind)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		printer, err := NewPrinter("yaml", &Table{})
+		require.NoError(t, err)
+
+		out := new(bytes.Buffer)
+		require.NoError(t, printer.PrintObj(&v1alpha1.WorkspaceList{Items: []v1alpha1.Workspace{*ws}}, out))
+		assert.Contains(t, out.String(), "kind: WorkspaceList")
+		assert.Contains(t, out.String(), "kind: Workspace\n")
+		assert.Contains(t, out.String(), "name: networking")
+	})
+}
@@ -0,0 +1,181 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/monitors"
+	"github.com/spf13/cobra"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const defaultNamespace = "default"
+
+var (
+	errRunNotFound = errors.New("run not found")
+	errTimeout     = errors.New("timed out waiting for run to complete")
+)
+
+type waitOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	runName string
+
+	// Timeout for run to complete. Zero means no timeout.
+	timeout time.Duration
+
+	// Output format for printing the run once it completes. Empty means the
+	// run is not printed.
+	output string
+}
+
+func WaitCmd(f *cmdutil.Factory) (*cobra.Command, *waitOptions) {
+	o := &waitOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+	}
+	cmd := &cobra.Command{
+		Use:   "wait <run>",
+		Short: "Wait for a run to complete",
+		Long: `Wait for a run to complete, exiting with the exit code of its terraform command. Pass --output to print the
+run once it completes.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.runName = args[0]
+
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, nil)
+			if err != nil {
+				return err
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().DurationVar(&o.timeout, "timeout", 0, "timeout for run to complete (0 waits indefinitely)")
+	cmdutil.AddOutputFlag(cmd, &o.output, "Print the run in the output format once it completes")
+
+	return cmd, o
+}
+
+func (o *waitOptions) run(ctx context.Context) error {
+	var printer cmdutil.Printer
+	if o.output != "" {
+		var err error
+		printer, err = cmdutil.NewPrinter(o.output, runTable())
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := o.RunsClient(o.namespace).Get(ctx, o.runName, metav1.GetOptions{}); err != nil {
+		if kerrors.IsNotFound(err) {
+			return fmt.Errorf("%w: %s/%s", errRunNotFound, o.namespace, o.runName)
+		}
+		return err
+	}
+
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	err := <-monitors.RunExitMonitor(ctx, o.EtokClient, o.namespace, o.runName)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s/%s", errTimeout, o.namespace, o.runName)
+	}
+
+	if printer != nil {
+		run, getErr := o.RunsClient(o.namespace).Get(ctx, o.runName, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if printErr := printer.PrintObj(run, o.Out); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+// runTable describes how to print runs as a table
+func runTable() *cmdutil.Table {
+	run := func(obj runtime.Object) *v1alpha1.Run {
+		return obj.(*v1alpha1.Run)
+	}
+	return &cmdutil.Table{
+		Resource: "run",
+		Columns: []cmdutil.Column{
+			{
+				Header: "NAME",
+				Value:  func(obj runtime.Object) string { return run(obj).Name },
+			},
+			{
+				Header: "WORKSPACE",
+				Value:  func(obj runtime.Object) string { return run(obj).Workspace },
+			},
+			{
+				Header: "COMMAND",
+				Value:  func(obj runtime.Object) string { return run(obj).Command },
+			},
+			{
+				Header: "PHASE",
+				Value:  func(obj runtime.Object) string { return cmdutil.OrNone(string(run(obj).Phase)) },
+			},
+			{
+				Header: "EXIT CODE",
+				Value: func(obj runtime.Object) string {
+					if code := run(obj).ExitCode; code != nil {
+						return strconv.Itoa(*code)
+					}
+					return "-"
+				},
+			},
+			{
+				Header: "ARGS",
+				Wide:   true,
+				Value:  func(obj runtime.Object) string { return strings.Join(run(obj).Args, " ") },
+			},
+			{
+				Header: "AGE",
+				Value:  func(obj runtime.Object) string { return cmdutil.Age(run(obj).CreationTimestamp.Time) },
+			},
+		},
+	}
+}
@@ -0,0 +1,103 @@
+package wait
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		objs []runtime.Object
+		err  error
+		out  string
+	}{
+		{
+			name: "successful run",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0))},
+		},
+		{
+			name: "non-zero exit code",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(2))},
+			err:  etokerrors.NewExitError(2),
+		},
+		{
+			name: "specific namespace",
+			args: []string{"run-12345", "--namespace", "dev"},
+			objs: []runtime.Object{testobj.Run("dev", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0))},
+		},
+		{
+			name: "run failed without exit code",
+			args: []string{"run-12345"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunFailedCondition))},
+			err:  handlers.ErrRunFailed,
+		},
+		{
+			name: "timeout",
+			args: []string{"run-12345", "--timeout", "10ms"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithRunPhase(v1alpha1.RunPhaseRunning))},
+			err:  errTimeout,
+		},
+		{
+			name: "print run",
+			args: []string{"run-12345", "-o", "name"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0))},
+			out:  "run/run-12345\n",
+		},
+		{
+			name: "print run with non-zero exit code",
+			args: []string{"run-12345", "-o", "jsonpath={.status.exitCode}"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(2))},
+			err:  etokerrors.NewExitError(2),
+			out:  "2",
+		},
+		{
+			name: "invalid output format",
+			args: []string{"run-12345", "-o", "xml"},
+			objs: []runtime.Object{testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0))},
+			err:  cmdutil.ErrInvalidOutputFormat,
+		},
+		{
+			name: "run not found",
+			args: []string{"run-12345"},
+			err:  errRunNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// Ensure project file isn't read from the current directory
+			t.NewTempDir().Chdir()
+
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			cmd, _ := WaitCmd(f)
+			cmd.SetOut(new(bytes.Buffer))
+			cmd.SetErr(new(bytes.Buffer))
+			cmd.SetArgs(tt.args)
+
+			err := cmd.ExecuteContext(context.Background())
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.out, out.String())
+		})
+	}
+}
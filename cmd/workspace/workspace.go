@@ -6,11 +6,11 @@ import (
 )
 
 const (
-	// default namespace workspaces are created in or if .terraform/environment
+	// default namespace workspaces are created in or if the project file
 	// is not found
 	defaultNamespace = "default"
 
-	// default workspace if .terraform/environment is not found
+	// default workspace if the project file is not found
 	defaultWorkspace = "default"
 )
 
@@ -23,11 +23,29 @@ func WorkspaceCmd(f *cmdutil.Factory) *cobra.Command {
 	nc, _ := newCmd(f)
 	cmd.AddCommand(nc)
 
+	sc, _ := setCmd(f)
+	cmd.AddCommand(sc)
+
+	lc, _ := listCmd(f)
+	cmd.AddCommand(lc)
+
+	shc, _ := showCmd(f)
+	cmd.AddCommand(shc)
+
+	uc, _ := unlockCmd(f)
+	cmd.AddCommand(uc)
+
+	ec, _ := exportCmd(f)
+	cmd.AddCommand(ec)
+
+	ic, _ := importCmd(f)
+	cmd.AddCommand(ic)
+
 	cmd.AddCommand(
-		listCmd(f),
 		deleteCmd(f),
-		showCmd(f),
+		currentCmd(f),
 		selectCmd(f),
+		stateCmd(f),
 	)
 
 	return cmd
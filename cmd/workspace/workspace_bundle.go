@@ -0,0 +1,434 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/backend"
+	"github.com/leg100/etok/pkg/bundle"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	errStateExists   = errors.New("state already exists")
+	errStateMismatch = errors.New("bundled state does not match manifest")
+)
+
+// readPassphrase reads a passphrase from a file, trimming any trailing newline.
+// An empty path returns a nil passphrase.
+func readPassphrase(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+type exportOptions struct {
+	stateOptions
+
+	// Path to which to write bundle
+	dest string
+
+	// Path to file containing passphrase with which to encrypt sensitive
+	// variables
+	passphraseFile string
+
+	// Do not bundle state
+	noState bool
+
+	// Path to file containing the key with which the operator encrypts state
+	// stored by the HTTP state backend
+	stateEncryptionKeyFile string
+}
+
+func exportCmd(f *cmdutil.Factory) (*cobra.Command, *exportOptions) {
+	o := &exportOptions{
+		stateOptions: stateOptions{
+			Factory:   f,
+			namespace: defaultNamespace,
+			workspace: defaultWorkspace,
+		},
+	}
+	cmd := &cobra.Command{
+		Use:   "export [workspace]",
+		Short: "Export a workspace to a bundle",
+		Long: `Export a workspace to a bundle, for importing into another namespace or cluster. Defaults to the
+current workspace.
+
+The bundle contains the workspace's spec, including its variables and references to credential secrets,
+its outputs, and its state. State stored by the http state backend is read directly from the
+operator's secrets; if the operator encrypts state then the encryption key must be provided. The values of variables sourced from secrets are only included if a
+passphrase is provided, with which they are encrypted. Otherwise only the references to the secrets
+are included, and the secrets must exist wherever the bundle is imported.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				o.workspace = args[0]
+			}
+
+			if o.dest == "" {
+				o.dest = o.workspace + ".tgz"
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().StringVarP(&o.dest, "output", "o", "", "Path to which to write bundle (default <workspace>.tgz)")
+	cmd.Flags().StringVar(&o.passphraseFile, "passphrase-file", "", "Path to file containing passphrase with which to encrypt the values of variables sourced from secrets")
+	cmd.Flags().BoolVar(&o.noState, "no-state", false, "Do not include state in bundle")
+	cmd.Flags().StringVar(&o.stateEncryptionKeyFile, "state-encryption-key-file", "", "Path to file containing the key with which the operator encrypts state stored by the http state backend")
+
+	return cmd, o
+}
+
+func (o *exportOptions) run(ctx context.Context) error {
+	passphrase, err := readPassphrase(o.passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	ws, err := o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	b := &bundle.Bundle{Workspace: portableWorkspace(ws)}
+
+	if !o.noState {
+		var state []byte
+		if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+			state, err = o.getHTTPState(ctx, ws)
+		} else {
+			_, state, err = o.getState(ctx, ws)
+		}
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			parsed, err := parseStateFile(state)
+			if err != nil {
+				return fmt.Errorf("unable to parse state: %w", err)
+			}
+			b.State = state
+			b.Serial = &parsed.Serial
+			b.Lineage = parsed.Lineage
+		}
+	}
+
+	if passphrase != nil {
+		b.Secrets, err = o.getVariableSecrets(ctx, ws)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(o.dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := bundle.Write(f, b, passphrase); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Exported workspace %s/%s to %s\n", o.namespace, o.workspace, o.dest)
+	if b.Serial != nil {
+		fmt.Fprintf(o.Out, "State serial: %d\n", *b.Serial)
+	}
+	return nil
+}
+
+// getHTTPState retrieves state stored by the HTTP state backend, reading the
+// secrets in which the operator stores it
+func (o *exportOptions) getHTTPState(ctx context.Context, ws *v1alpha1.Workspace) ([]byte, error) {
+	var opts []backend.StoreOption
+	if o.stateEncryptionKeyFile != "" {
+		key, err := ioutil.ReadFile(o.stateEncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read state encryption key: %w", err)
+		}
+		opts = append(opts, backend.WithEncryptionKey(key))
+	}
+
+	rc, err := o.CreateRuntimeClient(o.kubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := backend.NewStore(rc.RuntimeClient, opts...).Get(ctx, ws)
+	if errors.Is(err, backend.ErrNoKey) {
+		return nil, fmt.Errorf("%w: pass --state-encryption-key-file", err)
+	}
+	return state, err
+}
+
+// getVariableSecrets retrieves the values of variables sourced from secrets,
+// keyed by secret name and then by secret key
+func (o *exportOptions) getVariableSecrets(ctx context.Context, ws *v1alpha1.Workspace) (map[string]map[string][]byte, error) {
+	secrets := make(map[string]map[string][]byte)
+	for _, v := range ws.Spec.Variables {
+		if v == nil || v.ValueFrom == nil || v.ValueFrom.SecretKeyRef == nil {
+			continue
+		}
+		ref := v.ValueFrom.SecretKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+
+		secret, err := o.SecretsClient(o.namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) && optional {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to retrieve secret for variable %s: %w", v.Key, err)
+		}
+
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("secret %s for variable %s has no key %s", ref.Name, v.Key, ref.Key)
+		}
+
+		if _, ok := secrets[ref.Name]; !ok {
+			secrets[ref.Name] = make(map[string][]byte)
+		}
+		secrets[ref.Name][ref.Key] = value
+	}
+	return secrets, nil
+}
+
+// portableWorkspace copies the parts of a workspace that are portable between
+// namespaces and clusters
+func portableWorkspace(ws *v1alpha1.Workspace) *v1alpha1.Workspace {
+	return &v1alpha1.Workspace{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       "Workspace",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ws.Name,
+			Namespace: ws.Namespace,
+			Labels:    ws.Labels,
+		},
+		Spec: *ws.Spec.DeepCopy(),
+		Status: v1alpha1.WorkspaceStatus{
+			Outputs: ws.Status.Outputs,
+			Serial:  ws.Status.Serial,
+		},
+	}
+}
+
+type importOptions struct {
+	stateOptions
+
+	// Path to bundle
+	src string
+
+	// Name to give imported workspace. Defaults to the bundled workspace's
+	// name.
+	name string
+
+	// Path to file containing passphrase with which to decrypt sensitive
+	// variables
+	passphraseFile string
+
+	// Wait for the operator to read the imported state
+	wait    bool
+	timeout time.Duration
+}
+
+func importCmd(f *cmdutil.Factory) (*cobra.Command, *importOptions) {
+	o := &importOptions{
+		stateOptions: stateOptions{
+			Factory:   f,
+			namespace: defaultNamespace,
+		},
+	}
+	cmd := &cobra.Command{
+		Use:   "import <bundle>",
+		Short: "Import a workspace from a bundle",
+		Long: `Import a workspace from a bundle created with 'etok workspace export'.
+
+The workspace is created in the namespace from which it was exported unless --namespace is passed, and
+with the same name unless --name is passed. Secrets for variables included in the bundle are created or
+updated, and the bundled state is imported. The command waits for the workspace to report the imported
+state's serial.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.src = args[0]
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context(), flags.IsFlagPassed(cmd.Flags(), "namespace"))
+		},
+	}
+
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+
+	cmd.Flags().StringVar(&o.name, "name", "", "Name to give imported workspace (default bundled workspace's name)")
+	cmd.Flags().StringVar(&o.passphraseFile, "passphrase-file", "", "Path to file containing passphrase with which to decrypt the values of variables sourced from secrets")
+	cmd.Flags().BoolVar(&o.wait, "wait", true, "Wait for the workspace to read the imported state")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", defaultStateImportTimeout, "Timeout for the workspace to read the imported state")
+
+	return cmd, o
+}
+
+func (o *importOptions) run(ctx context.Context, namespaceOverride bool) error {
+	passphrase, err := readPassphrase(o.passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(o.src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := bundle.Read(f, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if b.State != nil {
+		parsed, err := parseStateFile(b.State)
+		if err != nil {
+			return err
+		}
+		if parsed.Serial != *b.Serial {
+			return fmt.Errorf("%w: state has serial %d but manifest has serial %d", errStateMismatch, parsed.Serial, *b.Serial)
+		}
+		if parsed.Lineage != b.Lineage {
+			return fmt.Errorf("%w: state has lineage %s but manifest has lineage %s", errStateMismatch, parsed.Lineage, b.Lineage)
+		}
+	}
+
+	ws := b.Workspace.DeepCopy()
+	ws.Status = v1alpha1.WorkspaceStatus{}
+	if !namespaceOverride {
+		o.namespace = ws.Namespace
+	}
+	ws.Namespace = o.namespace
+	if o.name != "" {
+		ws.Name = o.name
+	}
+	o.workspace = ws.Name
+
+	// Refuse to import over existing state
+	if b.State != nil {
+		_, existing, err := o.getState(ctx, ws)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: secret %s/%s", errStateExists, ws.Namespace, ws.StateSecretName())
+		}
+	}
+
+	if err := o.applySecrets(ctx, b.Secrets); err != nil {
+		return err
+	}
+
+	ws, err = o.WorkspacesClient(o.namespace).Create(ctx, ws, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(o.Out, "Created workspace %s/%s\n", ws.Namespace, ws.Name)
+
+	if b.State == nil {
+		return nil
+	}
+
+	compressed, err := compress(b.State)
+	if err != nil {
+		return err
+	}
+	if _, err := o.SecretsClient(o.namespace).Create(ctx, newStateSecret(ws, compressed), metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(o.Out, "Imported state with serial %d\n", *b.Serial)
+
+	if !o.wait {
+		return nil
+	}
+
+	// Verify the workspace reports the imported state
+	importOpts := &stateImportOptions{stateOptions: o.stateOptions, timeout: o.timeout}
+	return importOpts.waitForState(ctx, ws, *b.Serial)
+}
+
+// applySecrets creates the bundled secrets, or updates the bundled keys of
+// secrets that already exist
+func (o *importOptions) applySecrets(ctx context.Context, secrets map[string]map[string][]byte) error {
+	for name, data := range secrets {
+		secret, err := o.SecretsClient(o.namespace).Get(ctx, name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: o.namespace,
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: data,
+			}
+			if _, err := o.SecretsClient(o.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+			fmt.Fprintf(o.Out, "Created secret %s/%s\n", o.namespace, name)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		for k, v := range data {
+			secret.Data[k] = v
+		}
+		if _, err := o.SecretsClient(o.namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		fmt.Fprintf(o.Out, "Updated secret %s/%s\n", o.namespace, name)
+	}
+	return nil
+}
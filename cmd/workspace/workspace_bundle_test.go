@@ -0,0 +1,265 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/backend"
+	"github.com/leg100/etok/pkg/bundle"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestExportImport(t *testing.T) {
+	withSecretVariable := func(ws *v1alpha1.Workspace) {
+		ws.Spec.Variables = append(ws.Spec.Variables, &v1alpha1.Variable{
+			Key: "password",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "creds"},
+					Key:                  "password",
+				},
+			},
+		})
+	}
+
+	tests := []struct {
+		name string
+		// Objects in the cluster from which the workspace is exported
+		exportObjs []runtime.Object
+		exportArgs []string
+		exportErr  error
+		// Objects in the cluster into which the workspace is imported
+		importObjs []runtime.Object
+		importArgs []string
+		importErr  error
+		// Passphrase file contents. Empty means no passphrase file.
+		passphrase string
+		assertions func(*testutil.T, *importOptions)
+	}{
+		{
+			name:       "workspace with state",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithVariables("foo", "bar")), stateSecret(t, stateSerial5)},
+			importArgs: []string{"--wait=false"},
+			assertions: func(t *testutil.T, o *importOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "foo", ws.Spec.Variables[0].Key)
+
+				_, data, err := o.getState(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, stateSerial5, string(data))
+			},
+		},
+		{
+			name:       "rename and move workspace",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			importArgs: []string{"--wait=false", "--namespace", "prod", "--name", "networking"},
+			assertions: func(t *testutil.T, o *importOptions) {
+				ws, err := o.WorkspacesClient("prod").Get(context.Background(), "networking", metav1.GetOptions{})
+				require.NoError(t, err)
+
+				secret, data, err := o.getState(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, stateSerial5, string(data))
+				assert.Equal(t, "tfstate-default-networking", secret.Name)
+				assert.Equal(t, "networking", secret.Labels["tfstateSecretSuffix"])
+			},
+		},
+		{
+			name:       "workspace without state",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default")},
+			assertions: func(t *testutil.T, o *importOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+
+				secret, _, err := o.getState(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Nil(t, secret)
+			},
+		},
+		{
+			name:       "secret variables encrypted with passphrase",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default", withSecretVariable), testobj.Secret("default", "creds", testobj.WithData("password", "opensesame"))},
+			passphrase: "letmein\n",
+			assertions: func(t *testutil.T, o *importOptions) {
+				secret, err := o.SecretsClient("default").Get(context.Background(), "creds", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "opensesame", string(secret.Data["password"]))
+			},
+		},
+		{
+			name:       "secret variables without passphrase",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default", withSecretVariable), testobj.Secret("default", "creds", testobj.WithData("password", "opensesame"))},
+			assertions: func(t *testutil.T, o *importOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "creds", ws.Spec.Variables[0].ValueFrom.SecretKeyRef.Name)
+
+				_, err = o.SecretsClient("default").Get(context.Background(), "creds", metav1.GetOptions{})
+				assert.Error(t, err)
+			},
+		},
+		{
+			name:       "http state backend",
+			exportObjs: append(httpStateSecrets(t, stateSerial5), testobj.Workspace("default", "default", testobj.WithStateBackend(v1alpha1.StateBackendHTTP), testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP))),
+			importArgs: []string{"--wait=false"},
+			assertions: func(t *testutil.T, o *importOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, v1alpha1.StateBackendHTTP, ws.Spec.StateBackend)
+
+				// Imported into the kubernetes backend's secret, from which
+				// the operator migrates it
+				_, data, err := o.getState(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, stateSerial5, string(data))
+			},
+		},
+		{
+			name:       "encrypted http state backend without key",
+			exportObjs: append(httpStateSecrets(t, stateSerial5, backend.WithEncryptionKey([]byte("secret"))), testobj.Workspace("default", "default", testobj.WithStateBackend(v1alpha1.StateBackendHTTP), testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP))),
+			exportErr:  backend.ErrNoKey,
+		},
+		{
+			name:       "http state backend without state",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithStateBackend(v1alpha1.StateBackendHTTP))},
+			exportArgs: []string{"--no-state"},
+		},
+		{
+			name:       "state already exists on target",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			importObjs: []runtime.Object{stateSecret(t, stateSerial3)},
+			importErr:  errStateExists,
+		},
+		{
+			name:       "timeout waiting for workspace to read state",
+			exportObjs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			importArgs: []string{"--timeout", "10ms"},
+			importErr:  errStateImportTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			dir := t.NewTempDir()
+			bundlePath := dir.Path("bundle.tgz")
+
+			var passphraseArgs []string
+			if tt.passphrase != "" {
+				dir.Write("passphrase", []byte(tt.passphrase))
+				passphraseArgs = []string{"--passphrase-file", dir.Path("passphrase")}
+			}
+
+			out := new(bytes.Buffer)
+			ef := cmdutil.NewFakeFactory(out, tt.exportObjs...)
+
+			ecmd, eopts := exportCmd(ef)
+			ecmd.SetOut(out)
+			ecmd.SetArgs(append(append([]string{"default", "-o", bundlePath}, tt.exportArgs...), passphraseArgs...))
+
+			// Override path
+			eopts.path = t.NewTempDir().Root()
+
+			err := ecmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.exportErr)) || err != nil {
+				return
+			}
+
+			f := cmdutil.NewFakeFactory(out, tt.importObjs...)
+
+			icmd, iopts := importCmd(f)
+			icmd.SetOut(out)
+			icmd.SetArgs(append(append([]string{bundlePath}, tt.importArgs...), passphraseArgs...))
+
+			err = icmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.importErr)) {
+				return
+			}
+
+			if tt.assertions != nil {
+				tt.assertions(t, iopts)
+			}
+		})
+	}
+}
+
+func TestImportEncryptedBundleWithoutPassphrase(t *testing.T) {
+	dir := testutil.NewTempDir(t)
+	dir.Write("passphrase", []byte("letmein"))
+
+	out := new(bytes.Buffer)
+	ef := cmdutil.NewFakeFactory(out,
+		testobj.Workspace("default", "default", testobj.WithVariables("foo", "bar"), func(ws *v1alpha1.Workspace) {
+			ws.Spec.Variables[0].ValueFrom = &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "creds"},
+					Key:                  "password",
+				},
+			}
+		}),
+		testobj.Secret("default", "creds", testobj.WithData("password", "opensesame")))
+
+	ecmd, eopts := exportCmd(ef)
+	ecmd.SetOut(out)
+	ecmd.SetArgs([]string{"default", "-o", dir.Path("bundle.tgz"), "--passphrase-file", dir.Path("passphrase")})
+	eopts.path = dir.Root()
+	require.NoError(t, ecmd.ExecuteContext(context.Background()))
+
+	icmd, _ := importCmd(cmdutil.NewFakeFactory(out))
+	icmd.SetOut(out)
+	icmd.SetArgs([]string{dir.Path("bundle.tgz")})
+	err := icmd.ExecuteContext(context.Background())
+	assert.True(t, errors.Is(err, bundle.ErrPassphraseRequired))
+}
+
+func TestImportMismatchedState(t *testing.T) {
+	dir := testutil.NewTempDir(t)
+
+	serial := 5
+	buf := new(bytes.Buffer)
+	require.NoError(t, bundle.Write(buf, &bundle.Bundle{
+		Manifest:  bundle.Manifest{Serial: &serial, Lineage: "xyz"},
+		Workspace: testobj.Workspace("default", "default"),
+		State:     []byte(stateSerial5),
+	}, nil))
+	dir.Write("bundle.tgz", buf.Bytes())
+
+	out := new(bytes.Buffer)
+	icmd, _ := importCmd(cmdutil.NewFakeFactory(out))
+	icmd.SetOut(out)
+	icmd.SetArgs([]string{dir.Path("bundle.tgz")})
+	err := icmd.ExecuteContext(context.Background())
+	assert.True(t, errors.Is(err, errStateMismatch))
+	assert.Contains(t, err.Error(), "lineage abc but manifest has lineage xyz")
+}
+
+// httpStateSecrets returns the secrets in which the http state backend stores
+// the state
+func httpStateSecrets(t *testing.T, state string, opts ...backend.StoreOption) []runtime.Object {
+	ws := testobj.Workspace("default", "default")
+	client := fake.NewFakeClientWithScheme(scheme.Scheme, ws)
+	require.NoError(t, backend.NewStore(client, opts...).Put(context.Background(), ws, []byte(state), ""))
+
+	var secrets corev1.SecretList
+	require.NoError(t, client.List(context.Background(), &secrets))
+
+	var objs []runtime.Object
+	for i := range secrets.Items {
+		secret := secrets.Items[i]
+		secret.ResourceVersion = ""
+		objs = append(objs, &secret)
+	}
+	return objs
+}
@@ -0,0 +1,44 @@
+package workspace
+
+import (
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+)
+
+// credentialSecrets constructs credential secrets from the names of secrets to
+// provide as environment variables and the names of secrets to provide as
+// files. The latter may specify a mount path, i.e. <name>=<path>.
+func credentialSecrets(envSecrets, fileSecrets []string) (secrets []v1alpha1.CredentialSecret) {
+	for _, name := range envSecrets {
+		secrets = append(secrets, v1alpha1.CredentialSecret{
+			Name: name,
+			Type: v1alpha1.CredentialSecretTypeEnv,
+		})
+	}
+	for _, s := range fileSecrets {
+		parts := strings.SplitN(s, "=", 2)
+		cs := v1alpha1.CredentialSecret{
+			Name: parts[0],
+			Type: v1alpha1.CredentialSecretTypeFile,
+		}
+		if len(parts) == 2 {
+			cs.MountPath = parts[1]
+		}
+		secrets = append(secrets, cs)
+	}
+	return secrets
+}
+
+// replaceCredentialSecrets replaces the existing credential secrets of the given
+// type with replacements, leaving those of the other type untouched.
+func replaceCredentialSecrets(existing []v1alpha1.CredentialSecret, typ v1alpha1.CredentialSecretType, replacements []v1alpha1.CredentialSecret) (secrets []v1alpha1.CredentialSecret) {
+	for _, cs := range existing {
+		// An empty type is the env type
+		if cs.Type == typ || (cs.Type == "" && typ == v1alpha1.CredentialSecretTypeEnv) {
+			continue
+		}
+		secrets = append(secrets, cs)
+	}
+	return append(secrets, replacements...)
+}
@@ -1,63 +1,190 @@
 package workspace
 
 import (
-	"fmt"
-	"os"
+	"strings"
 
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/cmd/flags"
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/env"
 	"github.com/spf13/cobra"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
-func listCmd(f *cmdutil.Factory) *cobra.Command {
-	var path, kubeContext string
-	var namespace = defaultNamespace
-	var workspace = defaultWorkspace
+type listOptions struct {
+	*cmdutil.Factory
 
+	*client.Client
+
+	path        string
+	namespace   string
+	workspace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// List workspaces across all namespaces
+	allNamespaces bool
+
+	// Label selector
+	selector string
+
+	// Output format
+	output string
+	// Show values of outputs rather than masking them
+	revealOutputs bool
+}
+
+func listCmd(f *cmdutil.Factory) (*cobra.Command, *listOptions) {
+	o := &listOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+		workspace: defaultWorkspace,
+	}
 	cmd := &cobra.Command{
 		Use:   "list",
-		Short: "List all workspaces",
+		Short: "List workspaces",
+		Long: `List workspaces in the current namespace, or across all namespaces with --all-namespaces. The current
+workspace is marked with an asterisk.`,
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			client, err := f.Create(kubeContext)
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
 			if err != nil {
 				return err
 			}
 
-			etokenv, err := env.Read(path)
+			o.Client, err = f.Create(o.kubeContext)
 			if err != nil {
-				if !os.IsNotExist(err) {
-					return err
-				}
-			} else {
-				// Override defaults
-				namespace = etokenv.Namespace
-				workspace = etokenv.Workspace
+				return err
 			}
 
-			// List across all namespaces
-			workspaces, err := client.WorkspacesClient("").List(cmd.Context(), metav1.ListOptions{})
-			if err != nil {
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
 				return err
 			}
 
-			var prefix string
-			for _, ws := range workspaces.Items {
-				if ws.Namespace == namespace && ws.Name == workspace {
-					prefix = "*"
-				} else {
-					prefix = ""
-				}
-				fmt.Fprintf(f.Out, "%s\t%s\n", prefix, &env.Env{Namespace: ws.Namespace, Workspace: ws.Name})
-			}
+			return o.run(cmd)
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+	cmdutil.AddOutputFlag(cmd, &o.output, "Output format")
+	cmd.Flags().BoolVar(&o.revealOutputs, "reveal-outputs", false, "Show the values of outputs, which are otherwise masked")
 
-			return nil
+	cmd.Flags().BoolVarP(&o.allNamespaces, "all-namespaces", "A", false, "List workspaces across all namespaces")
+	cmd.Flags().StringVarP(&o.selector, "selector", "l", "", "Label selector to filter workspaces, e.g. -l team=platform")
+
+	return cmd, o
+}
+
+func (o *listOptions) run(cmd *cobra.Command) error {
+	printer, err := cmdutil.NewPrinter(o.output, o.table())
+	if err != nil {
+		return err
+	}
+
+	namespace := o.namespace
+	if o.allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+
+	workspaces, err := o.WorkspacesClient(namespace).List(cmd.Context(), metav1.ListOptions{LabelSelector: o.selector})
+	if err != nil {
+		return err
+	}
+
+	if !o.revealOutputs {
+		for i := range workspaces.Items {
+			workspaces.Items[i] = *maskOutputs(&workspaces.Items[i])
+		}
+	}
+
+	return printer.PrintObj(workspaces, o.Out)
+}
+
+// table constructs the table for listing workspaces, marking the current
+// workspace
+func (o *listOptions) table() *cmdutil.Table {
+	table := workspaceTable()
+
+	current := cmdutil.Column{
+		Header: "CURRENT",
+		Value: func(obj runtime.Object) string {
+			ws := obj.(*v1alpha1.Workspace)
+			if ws.Namespace == o.namespace && ws.Name == o.workspace {
+				return "*"
+			}
+			return ""
 		},
 	}
+	columns := []cmdutil.Column{current}
+
+	if o.allNamespaces {
+		columns = append(columns, cmdutil.Column{
+			Header: "NAMESPACE",
+			Value: func(obj runtime.Object) string {
+				return obj.(*v1alpha1.Workspace).Namespace
+			},
+		})
+	}
 
-	flags.AddPathFlag(cmd, &path)
-	flags.AddKubeContextFlag(cmd, &kubeContext)
+	table.Columns = append(columns, table.Columns...)
+	return table
+}
 
-	return cmd
+// workspaceTable describes how to print workspaces as a table
+func workspaceTable() *cmdutil.Table {
+	ws := func(obj runtime.Object) *v1alpha1.Workspace {
+		return obj.(*v1alpha1.Workspace)
+	}
+	return &cmdutil.Table{
+		Resource: "workspace",
+		Columns: []cmdutil.Column{
+			{
+				Header: "NAME",
+				Value:  func(obj runtime.Object) string { return ws(obj).Name },
+			},
+			{
+				Header: "PHASE",
+				Value:  func(obj runtime.Object) string { return cmdutil.OrNone(string(ws(obj).Status.Phase)) },
+			},
+			{
+				Header: "VERSION",
+				Value:  func(obj runtime.Object) string { return cmdutil.OrNone(ws(obj).Spec.TerraformVersion) },
+			},
+			{
+				Header: "SERIAL",
+				Value:  func(obj runtime.Object) string { return serial(ws(obj).Status.Serial) },
+			},
+			{
+				Header: "ACTIVE",
+				Value:  func(obj runtime.Object) string { return cmdutil.OrNone(strings.Join(ws(obj).ActiveRuns(), ",")) },
+			},
+			{
+				Header: "QUEUE",
+				Wide:   true,
+				Value:  func(obj runtime.Object) string { return cmdutil.OrNone(strings.Join(ws(obj).Status.Queue, ",")) },
+			},
+			{
+				Header: "CACHE",
+				Wide:   true,
+				Value:  func(obj runtime.Object) string { return string(ws(obj).CacheMode()) },
+			},
+			{
+				Header: "BACKEND",
+				Wide:   true,
+				Value:  func(obj runtime.Object) string { return string(ws(obj).StateBackend()) },
+			},
+			{
+				Header: "AGE",
+				Value:  func(obj runtime.Object) string { return cmdutil.Age(ws(obj).CreationTimestamp.Time) },
+			},
+		},
+	}
 }
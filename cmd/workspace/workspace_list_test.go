@@ -5,6 +5,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/env"
 	"github.com/leg100/etok/pkg/testobj"
@@ -15,6 +16,18 @@ import (
 )
 
 func TestListWorkspaces(t *testing.T) {
+	withLabels := func(labels map[string]string) func(*v1alpha1.Workspace) {
+		return func(ws *v1alpha1.Workspace) {
+			ws.Labels = labels
+		}
+	}
+
+	objs := []runtime.Object{
+		testobj.Workspace("default", "workspace-1", withLabels(map[string]string{"team": "platform"})),
+		testobj.Workspace("default", "workspace-3"),
+		testobj.Workspace("dev", "workspace-2"),
+	}
+
 	tests := []struct {
 		name string
 		objs []runtime.Object
@@ -25,29 +38,84 @@ func TestListWorkspaces(t *testing.T) {
 	}{
 		{
 			name: "WithEnvironmentFile",
-			objs: []runtime.Object{
-				testobj.Workspace("default", "workspace-1"),
-				testobj.Workspace("dev", "workspace-2"),
-			},
-			args: []string{},
+			objs: objs,
+			args: []string{"-o", "name"},
 			env:  &env.Env{Namespace: "default", Workspace: "workspace-1"},
-			out:  "*\tdefault/workspace-1\n\tdev/workspace-2\n",
+			out:  "workspace/workspace-1\nworkspace/workspace-3\n",
 		},
 		{
 			name: "WithoutEnvironmentFile",
-			objs: []runtime.Object{
-				testobj.Workspace("default", "workspace-1"),
-				testobj.Workspace("dev", "workspace-2"),
-			},
-			args: []string{},
-			out:  "\tdefault/workspace-1\n\tdev/workspace-2\n",
+			objs: objs,
+			args: []string{"-o", "name"},
+			out:  "workspace/workspace-1\nworkspace/workspace-3\n",
+		},
+		{
+			name: "namespace from environment file",
+			objs: objs,
+			args: []string{"-o", "name"},
+			env:  &env.Env{Namespace: "dev", Workspace: "workspace-2"},
+			out:  "workspace/workspace-2\n",
+		},
+		{
+			name: "namespace flag",
+			objs: objs,
+			args: []string{"-o", "name", "-n", "dev"},
+			out:  "workspace/workspace-2\n",
+		},
+		{
+			name: "all namespaces",
+			objs: objs,
+			args: []string{"-o", "name", "-A"},
+			out:  "workspace/workspace-1\nworkspace/workspace-3\nworkspace/workspace-2\n",
+		},
+		{
+			name: "label selector",
+			objs: objs,
+			args: []string{"-o", "name", "-A", "-l", "team=platform"},
+			out:  "workspace/workspace-1\n",
+		},
+		{
+			name: "table marks current workspace",
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1"), testobj.Workspace("default", "workspace-3")},
+			env:  &env.Env{Namespace: "default", Workspace: "workspace-1"},
+			out: "CURRENT   NAME          PHASE    VERSION   SERIAL   ACTIVE   AGE\n" +
+				"*         workspace-1   <none>   <none>    <none>   <none>   <unknown>\n" +
+				"          workspace-3   <none>   <none>    <none>   <none>   <unknown>\n",
+		},
+		{
+			name: "table across all namespaces",
+			objs: []runtime.Object{testobj.Workspace("dev", "workspace-2")},
+			args: []string{"-A"},
+			out: "CURRENT   NAMESPACE   NAME          PHASE    VERSION   SERIAL   ACTIVE   AGE\n" +
+				"          dev         workspace-2   <none>   <none>    <none>   <none>   <unknown>\n",
+		},
+		{
+			name: "json output masks outputs",
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", func(ws *v1alpha1.Workspace) {
+				ws.Status.Outputs = []*v1alpha1.Output{{Key: "password", Value: "opensesame"}}
+			})},
+			args: []string{"-o", "jsonpath={.items[0].status.outputs[0].value}"},
+			out:  maskedOutput,
+		},
+		{
+			name: "reveal outputs",
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", func(ws *v1alpha1.Workspace) {
+				ws.Status.Outputs = []*v1alpha1.Output{{Key: "password", Value: "opensesame"}}
+			})},
+			args: []string{"-o", "jsonpath={.items[0].status.outputs[0].value}", "--reveal-outputs"},
+			out:  "opensesame",
+		},
+		{
+			name: "invalid output format",
+			args: []string{"-o", "xml"},
+			err:  true,
 		},
 	}
 	for _, tt := range tests {
 		testutil.Run(t, tt.name, func(t *testutil.T) {
 			path := t.NewTempDir().Chdir().Root()
 
-			// Write .terraform/environment
+			// Write project file
 			if tt.env != nil {
 				require.NoError(t, tt.env.Write(path))
 			}
@@ -56,13 +124,15 @@ func TestListWorkspaces(t *testing.T) {
 
 			f := cmdutil.NewFakeFactory(out, tt.objs...)
 
-			cmd := listCmd(f)
+			cmd, _ := listCmd(f)
 			cmd.SetArgs(tt.args)
 			cmd.SetOut(f.Out)
 
 			t.CheckError(tt.err, cmd.ExecuteContext(context.Background()))
 
-			assert.Equal(t, tt.out, out.String())
+			if !tt.err {
+				assert.Equal(t, tt.out, out.String())
+			}
 		})
 	}
 }
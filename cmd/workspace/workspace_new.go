@@ -35,10 +35,13 @@ const (
 )
 
 var (
-	errPodTimeout       = errors.New("timed out waiting for pod to be ready")
-	errReconcileTimeout = errors.New("timed out waiting for workspace to be reconciled")
-	errReadyTimeout     = errors.New("timed out waiting for workspace to be ready")
-	errWorkspaceNameArg = errors.New("expected single argument providing the workspace name")
+	errPodTimeout          = errors.New("timed out waiting for pod to be ready")
+	errReconcileTimeout    = errors.New("timed out waiting for workspace to be reconciled")
+	errReadyTimeout        = errors.New("timed out waiting for workspace to be ready")
+	errWorkspaceNameArg    = errors.New("expected single argument providing the workspace name")
+	errInvalidCacheMode    = errors.New("invalid cache mode")
+	errInvalidStateBackend = errors.New("invalid state backend")
+	errInvalidReaderPolicy = errors.New("invalid reader policy")
 )
 
 type newOptions struct {
@@ -77,9 +80,17 @@ type newOptions struct {
 	variables            map[string]string
 	environmentVariables map[string]string
 
+	// Names of secrets to provide to runs as environment variables and as
+	// files
+	envSecrets  []string
+	fileSecrets []string
+
 	// backupBucket is the bucket to which the state file will backed up to
 	backupBucket string
 
+	// Delete workspace pod after workspace is idle for this duration
+	idleTimeout time.Duration
+
 	etokenv *env.Env
 }
 
@@ -103,6 +114,30 @@ func newCmd(f *cmdutil.Factory) (*cobra.Command, *newOptions) {
 				return err
 			}
 
+			switch o.workspaceSpec.Cache.Mode {
+			case v1alpha1.CacheModePinned, v1alpha1.CacheModeShared, v1alpha1.CacheModeEphemeral:
+			default:
+				return fmt.Errorf("%w: %s", errInvalidCacheMode, o.workspaceSpec.Cache.Mode)
+			}
+
+			switch o.workspaceSpec.ReaderPolicy {
+			case v1alpha1.ReaderPolicyShare, v1alpha1.ReaderPolicyWait, v1alpha1.ReaderPolicyIsolate:
+			default:
+				return fmt.Errorf("%w: %s", errInvalidReaderPolicy, o.workspaceSpec.ReaderPolicy)
+			}
+
+			switch o.workspaceSpec.StateBackend {
+			case v1alpha1.StateBackendKubernetes, v1alpha1.StateBackendHTTP:
+			default:
+				return fmt.Errorf("%w: %s", errInvalidStateBackend, o.workspaceSpec.StateBackend)
+			}
+
+			if o.idleTimeout > 0 {
+				o.workspaceSpec.Cache.IdleTimeout = o.idleTimeout.String()
+			}
+
+			o.workspaceSpec.CredentialSecrets = credentialSecrets(o.envSecrets, o.fileSecrets)
+
 			// Storage class default is nil not empty string (pflags doesn't
 			// permit default of nil)
 			if !flags.IsFlagPassed(cmd.Flags(), "storage-class") {
@@ -114,6 +149,10 @@ func newCmd(f *cmdutil.Factory) (*cobra.Command, *newOptions) {
 				return err
 			}
 
+			// Record the context and cluster on which the workspace is created
+			o.etokenv.Context = o.Client.Context
+			o.etokenv.Cluster = o.Config.Host
+
 			err = o.run(cmd.Context())
 			if err != nil {
 				if !o.disableResourceCleanup {
@@ -131,7 +170,16 @@ func newCmd(f *cmdutil.Factory) (*cobra.Command, *newOptions) {
 
 	cmd.Flags().StringVar(&o.workspaceSpec.Cache.Size, "size", defaultCacheSize, "Size of PersistentVolume for cache")
 	cmd.Flags().StringVar(&o.workspaceSpec.TerraformVersion, "terraform-version", "", "Override terraform version")
+	cmd.Flags().StringVar(&o.workspaceSpec.TerraformMirror, "terraform-mirror", "", "Override URL of mirror from which to download terraform")
 	cmd.Flags().StringVar(&o.workspaceSpec.BackupBucket, "backup-bucket", "", "Backup state to GCS bucket")
+	cmd.Flags().StringVar((*string)(&o.workspaceSpec.StateBackend), "state-backend", string(v1alpha1.StateBackendKubernetes), "State backend: kubernetes, or http (served by the operator)")
+	cmd.Flags().StringVar((*string)(&o.workspaceSpec.Cache.Mode), "cache-mode", string(v1alpha1.CacheModePinned), "Cache mode: pinned, shared (requires ReadWriteMany storage class), or ephemeral")
+	cmd.Flags().StringVar((*string)(&o.workspaceSpec.ReaderPolicy), "reader-policy", string(v1alpha1.ReaderPolicyWait), "Scheduling of read-only commands such as plan: wait (behind queued commands), isolate (run immediately with own copy of .terraform), or share (run immediately with shared .terraform; unsafe)")
+	cmd.Flags().DurationVar(&o.idleTimeout, "idle-timeout", 0, "Delete workspace pod after workspace has had no runs for this duration (pinned cache mode only)")
+	cmd.Flags().BoolVar(&o.workspaceSpec.Cache.SharedPlugins, "shared-plugins", false, "Use provider plugin cache shared with other workspaces in the namespace")
+	cmd.Flags().BoolVar(&o.workspaceSpec.GitTrackedOnly, "git-tracked-only", false, "Only upload files tracked by git when running commands")
+	cmd.Flags().StringVar(&o.workspaceSpec.ServiceAccountName, "service-account", "", "Run commands with this service account, which is created if it does not exist (default: the namespace's etok service account)")
+	cmd.Flags().StringToStringVar(&o.workspaceSpec.ServiceAccountAnnotations, "sa-annotations", map[string]string{}, "Annotations to add to the workspace's service account, e.g. iam.gke.io/gcp-service-account=[GSA_NAME]@[PROJECT_NAME].iam.gserviceaccount.com for workload identity")
 
 	// We want nil to be the default but it doesn't seem like pflags supports
 	// that so use empty string and override later (see above)
@@ -146,6 +194,9 @@ func newCmd(f *cmdutil.Factory) (*cobra.Command, *newOptions) {
 	cmd.Flags().StringToStringVar(&o.variables, "variables", map[string]string{}, "Set terraform variables")
 	cmd.Flags().StringToStringVar(&o.environmentVariables, "environment-variables", map[string]string{}, "Set environment variables")
 
+	cmd.Flags().StringSliceVar(&o.envSecrets, "env-secrets", []string{}, "Provide keys of these secrets to runs as environment variables (default: the namespace's etok secret)")
+	cmd.Flags().StringSliceVar(&o.fileSecrets, "file-secrets", []string{}, "Mount keys of these secrets as files in runs, optionally specifying a mount path, e.g. ssh=/root/.ssh (default mount path: /credentials/<name>)")
+
 	return cmd, o
 }
 
@@ -170,6 +221,14 @@ func (o *newOptions) run(ctx context.Context) error {
 		return o.waitForReady(gctx, ws)
 	})
 
+	if ws.CacheMode() == v1alpha1.CacheModeEphemeral {
+		// There is no workspace pod; runs install terraform themselves
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		return o.etokenv.Write(o.path)
+	}
+
 	// Monitor exit code; non-blocking
 	exit := monitors.ExitMonitor(ctx, o.KubeClient, ws.PodName(), ws.Namespace, controllers.InstallerContainerName)
 
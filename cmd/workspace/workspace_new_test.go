@@ -131,6 +131,100 @@ func TestNewWorkspace(t *testing.T) {
 				assert.Equal(t, "lumpen-proletariat", *ws.Spec.Cache.StorageClass)
 			},
 		},
+		{
+			name: "ephemeral cache does not wait for pod",
+			args: []string{"foo", "--cache-mode", "ephemeral"},
+			// Deliberately omit pod
+			objs: []runtime.Object{},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.Equal(t, v1alpha1.CacheModeEphemeral, ws.Spec.Cache.Mode)
+			},
+		},
+		{
+			name: "invalid cache mode",
+			args: []string{"foo", "--cache-mode", "sticky"},
+			err:  errInvalidCacheMode,
+		},
+		{
+			name: "invalid reader policy",
+			args: []string{"foo", "--reader-policy", "ignore"},
+			err:  errInvalidReaderPolicy,
+		},
+		{
+			name: "http state backend",
+			args: []string{"foo", "--state-backend", "http"},
+			objs: []runtime.Object{testobj.WorkspacePod("default", "foo")},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.Equal(t, v1alpha1.StateBackendHTTP, ws.Spec.StateBackend)
+			},
+		},
+		{
+			name: "invalid state backend",
+			args: []string{"foo", "--state-backend", "s3"},
+			err:  errInvalidStateBackend,
+		},
+		{
+			name: "with idle timeout",
+			args: []string{"foo", "--idle-timeout", "30m"},
+			objs: []runtime.Object{testobj.WorkspacePod("default", "foo")},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.Equal(t, v1alpha1.CacheModePinned, ws.Spec.Cache.Mode)
+				assert.Equal(t, "30m0s", ws.Spec.Cache.IdleTimeout)
+			},
+		},
+		{
+			name: "with dedicated service account",
+			args: []string{"foo", "--service-account", "terraform", "--sa-annotations", "iam.gke.io/gcp-service-account=prod@my-project.iam.gserviceaccount.com"},
+			objs: []runtime.Object{testobj.WorkspacePod("default", "foo")},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.Equal(t, "terraform", ws.Spec.ServiceAccountName)
+				assert.Equal(t, map[string]string{"iam.gke.io/gcp-service-account": "prod@my-project.iam.gserviceaccount.com"}, ws.Spec.ServiceAccountAnnotations)
+			},
+		},
+		{
+			name: "with credential secrets",
+			args: []string{"foo", "--env-secrets", "aws", "--file-secrets", "gcp,ssh=/root/.ssh"},
+			objs: []runtime.Object{testobj.WorkspacePod("default", "foo")},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.Equal(t, []v1alpha1.CredentialSecret{
+					{Name: "aws", Type: v1alpha1.CredentialSecretTypeEnv},
+					{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile},
+					{Name: "ssh", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "/root/.ssh"},
+				}, ws.Spec.CredentialSecrets)
+			},
+		},
+		{
+			name: "with shared plugin cache",
+			args: []string{"foo", "--shared-plugins"},
+			objs: []runtime.Object{testobj.WorkspacePod("default", "foo")},
+			assertions: func(t *testutil.T, o *newOptions) {
+				// Get workspace
+				ws, err := o.WorkspacesClient(o.namespace).Get(context.Background(), o.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+
+				assert.True(t, ws.Spec.Cache.SharedPlugins)
+			},
+		},
 		{
 			name: "with kube context flag",
 			args: []string{"foo", "--context", "oz-cluster"},
@@ -10,7 +10,7 @@ import (
 )
 
 func selectCmd(f *cmdutil.Factory) *cobra.Command {
-	var path string
+	var path, kubeContext string
 	var namespace = defaultNamespace
 
 	cmd := &cobra.Command{
@@ -24,6 +24,15 @@ func selectCmd(f *cmdutil.Factory) *cobra.Command {
 				return err
 			}
 
+			// Record the context and cluster on which the workspace is
+			// selected
+			client, err := f.Create(kubeContext)
+			if err != nil {
+				return err
+			}
+			etokenv.Context = client.Context
+			etokenv.Cluster = client.Config.Host
+
 			if err := etokenv.Write(path); err != nil {
 				return err
 			}
@@ -34,6 +43,7 @@ func selectCmd(f *cmdutil.Factory) *cobra.Command {
 
 	flags.AddPathFlag(cmd, &path)
 	flags.AddNamespaceFlag(cmd, &namespace)
+	flags.AddKubeContextFlag(cmd, &kubeContext)
 
 	return cmd
 }
@@ -32,6 +32,12 @@ func TestWorkspaceSelect(t *testing.T) {
 			wantEnv: &env.Env{Namespace: "dev", Workspace: "networking"},
 			out:     "Current workspace now: dev/networking\n",
 		},
+		{
+			name:    "with explicit context",
+			args:    []string{"networking", "--context", "kind"},
+			wantEnv: &env.Env{Namespace: "default", Workspace: "networking", Context: "kind"},
+			out:     "Current workspace now: default/networking\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -50,7 +56,7 @@ func TestWorkspaceSelect(t *testing.T) {
 
 			assert.Equal(t, tt.out, out.String())
 
-			// Confirm .terraform/environment was written with expected contents
+			// Confirm project file was written with expected contents
 			etokenv, err := env.Read(path)
 			require.NoError(t, err)
 			assert.Equal(t, tt.wantEnv, etokenv)
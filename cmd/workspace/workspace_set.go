@@ -0,0 +1,253 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/k8s"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	defaultReconfigureTimeout = 5 * time.Minute
+)
+
+var (
+	errNoChanges          = errors.New("no changes specified")
+	errReconfigureTimeout = errors.New("timed out waiting for workspace to be reconfigured")
+)
+
+type setOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	workspace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// Desired changes to the workspace's spec. Only those corresponding to
+	// flags that have been passed are applied.
+	spec        v1alpha1.WorkspaceSpec
+	idleTimeout time.Duration
+	envSecrets  []string
+	fileSecrets []string
+
+	// Flags that have been passed
+	changed *pflag.FlagSet
+
+	// Wait for the operator to reconfigure the workspace
+	wait bool
+	// Timeout for the workspace to be reconfigured
+	timeout time.Duration
+}
+
+func setCmd(f *cmdutil.Factory) (*cobra.Command, *setOptions) {
+	o := &setOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+		workspace: defaultWorkspace,
+	}
+	cmd := &cobra.Command{
+		Use:   "set [workspace]",
+		Short: "Change settings of an existing etok workspace",
+		Long: `Change settings of an existing etok workspace. Only the settings for the flags that are passed
+are changed. Defaults to the current workspace.
+
+Changing the terraform version re-installs terraform. Increasing the cache size expands the cache
+if its storage class permits it. Changing the storage class or the cache mode re-creates the cache.
+Disruptive changes are deferred until the workspace's runs have completed.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				o.workspace = args[0]
+			}
+
+			o.changed = cmd.Flags()
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().StringVar(&o.spec.TerraformVersion, "terraform-version", "", "Terraform version")
+	cmd.Flags().StringVar(&o.spec.TerraformMirror, "terraform-mirror", "", "URL of mirror from which to download terraform")
+	cmd.Flags().StringVar(&o.spec.Cache.Size, "size", "", "Size of PersistentVolume for cache")
+	o.spec.Cache.StorageClass = cmd.Flags().String("storage-class", "", "StorageClass of PersistentVolume for cache (resets the cache)")
+	cmd.Flags().StringVar((*string)(&o.spec.Cache.Mode), "cache-mode", "", "Cache mode: pinned, shared, or ephemeral (resets the cache)")
+	cmd.Flags().StringVar((*string)(&o.spec.ReaderPolicy), "reader-policy", "", "Scheduling of read-only commands such as plan: wait, isolate, or share (unsafe)")
+	cmd.Flags().DurationVar(&o.idleTimeout, "idle-timeout", 0, "Delete workspace pod after workspace has had no runs for this duration (0 disables)")
+	cmd.Flags().BoolVar(&o.spec.Cache.SharedPlugins, "shared-plugins", false, "Use provider plugin cache shared with other workspaces in the namespace")
+	cmd.Flags().BoolVar(&o.spec.GitTrackedOnly, "git-tracked-only", false, "Only upload files tracked by git when running commands")
+	cmd.Flags().StringVar(&o.spec.ServiceAccountName, "service-account", "", "Run commands with this service account, which is created if it does not exist (empty reverts to the namespace's etok service account)")
+	cmd.Flags().StringToStringVar(&o.spec.ServiceAccountAnnotations, "sa-annotations", map[string]string{}, "Annotations to add to the workspace's service account")
+	cmd.Flags().StringVar(&o.spec.BackupBucket, "backup-bucket", "", "Backup state to GCS bucket")
+	cmd.Flags().StringVar((*string)(&o.spec.StateBackend), "state-backend", "", "State backend: kubernetes, or http (served by the operator). Switching to http migrates existing state.")
+	cmd.Flags().StringSliceVar(&o.spec.PrivilegedCommands, "privileged-commands", []string{}, "Set privileged commands")
+	cmd.Flags().StringSliceVar(&o.envSecrets, "env-secrets", []string{}, "Provide keys of these secrets to runs as environment variables, replacing existing env secrets")
+	cmd.Flags().StringSliceVar(&o.fileSecrets, "file-secrets", []string{}, "Mount keys of these secrets as files in runs, optionally specifying a mount path, e.g. ssh=/root/.ssh, replacing existing file secrets")
+
+	cmd.Flags().BoolVar(&o.wait, "wait", false, "Wait for the workspace to be reconfigured")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", defaultReconfigureTimeout, "Timeout for the workspace to be reconfigured")
+
+	return cmd, o
+}
+
+func (o *setOptions) run(ctx context.Context) error {
+	var ws *v1alpha1.Workspace
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() (err error) {
+		ws, err = o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if err := o.apply(&ws.Spec); err != nil {
+			return err
+		}
+
+		ws, err = o.WorkspacesClient(o.namespace).Update(ctx, ws, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Updated workspace %s/%s\n", o.namespace, o.workspace)
+
+	if !o.wait {
+		return nil
+	}
+
+	fmt.Fprintln(o.Out, "Waiting for workspace to be reconfigured...")
+	ws, err = o.waitForReconfigure(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	// Summarise each step of the reconfiguration
+	for _, cond := range ws.Status.Conditions {
+		if cond.Type == v1alpha1.WorkspaceReadyCondition {
+			continue
+		}
+		fmt.Fprintf(o.Out, "%s: %s %s\n", cond.Type, cond.Reason, cond.Message)
+	}
+	return nil
+}
+
+// apply applies changes to the spec according to the flags passed
+func (o *setOptions) apply(spec *v1alpha1.WorkspaceSpec) error {
+	var changes int
+	set := func(flag string, fn func()) {
+		if flags.IsFlagPassed(o.changed, flag) {
+			fn()
+			changes++
+		}
+	}
+
+	set("terraform-version", func() { spec.TerraformVersion = o.spec.TerraformVersion })
+	set("terraform-mirror", func() { spec.TerraformMirror = o.spec.TerraformMirror })
+	set("size", func() { spec.Cache.Size = o.spec.Cache.Size })
+	set("storage-class", func() { spec.Cache.StorageClass = o.spec.Cache.StorageClass })
+	set("cache-mode", func() { spec.Cache.Mode = o.spec.Cache.Mode })
+	set("reader-policy", func() { spec.ReaderPolicy = o.spec.ReaderPolicy })
+	set("shared-plugins", func() { spec.Cache.SharedPlugins = o.spec.Cache.SharedPlugins })
+	set("git-tracked-only", func() { spec.GitTrackedOnly = o.spec.GitTrackedOnly })
+	set("service-account", func() { spec.ServiceAccountName = o.spec.ServiceAccountName })
+	set("sa-annotations", func() { spec.ServiceAccountAnnotations = o.spec.ServiceAccountAnnotations })
+	set("backup-bucket", func() { spec.BackupBucket = o.spec.BackupBucket })
+	set("privileged-commands", func() { spec.PrivilegedCommands = o.spec.PrivilegedCommands })
+	set("state-backend", func() { spec.StateBackend = o.spec.StateBackend })
+	set("env-secrets", func() {
+		spec.CredentialSecrets = replaceCredentialSecrets(spec.CredentialSecrets, v1alpha1.CredentialSecretTypeEnv, credentialSecrets(o.envSecrets, nil))
+	})
+	set("file-secrets", func() {
+		spec.CredentialSecrets = replaceCredentialSecrets(spec.CredentialSecrets, v1alpha1.CredentialSecretTypeFile, credentialSecrets(nil, o.fileSecrets))
+	})
+	set("idle-timeout", func() {
+		if o.idleTimeout > 0 {
+			spec.Cache.IdleTimeout = o.idleTimeout.String()
+		} else {
+			spec.Cache.IdleTimeout = ""
+		}
+	})
+
+	if changes == 0 {
+		return errNoChanges
+	}
+
+	switch spec.Cache.Mode {
+	case "", v1alpha1.CacheModePinned, v1alpha1.CacheModeShared, v1alpha1.CacheModeEphemeral:
+	default:
+		return fmt.Errorf("%w: %s", errInvalidCacheMode, spec.Cache.Mode)
+	}
+
+	switch spec.ReaderPolicy {
+	case "", v1alpha1.ReaderPolicyShare, v1alpha1.ReaderPolicyWait, v1alpha1.ReaderPolicyIsolate:
+	default:
+		return fmt.Errorf("%w: %s", errInvalidReaderPolicy, spec.ReaderPolicy)
+	}
+
+	switch spec.StateBackend {
+	case "", v1alpha1.StateBackendKubernetes, v1alpha1.StateBackendHTTP:
+	default:
+		return fmt.Errorf("%w: %s", errInvalidStateBackend, spec.StateBackend)
+	}
+
+	return nil
+}
+
+// waitForReconfigure waits for the operator to reconcile the updated spec and
+// for the workspace to be ready.
+func (o *setOptions) waitForReconfigure(ctx context.Context, ws *v1alpha1.Workspace) (*v1alpha1.Workspace, error) {
+	lw := &k8s.WorkspaceListWatcher{Client: o.EtokClient, Name: ws.Name, Namespace: ws.Namespace}
+	hdlr := handlers.WorkspaceReconfigured(ws.Generation)
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	event, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Workspace{}, nil, hdlr)
+	if err != nil {
+		if errors.Is(err, wait.ErrWaitTimeout) {
+			return nil, errReconfigureTimeout
+		}
+		return nil, err
+	}
+	return event.Object.(*v1alpha1.Workspace), nil
+}
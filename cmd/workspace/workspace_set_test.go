@@ -0,0 +1,213 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestSetWorkspace(t *testing.T) {
+	var standard = "standard"
+
+	tests := []struct {
+		name       string
+		args       []string
+		env        *env.Env
+		objs       []runtime.Object
+		err        error
+		assertions func(*testutil.T, *v1alpha1.Workspace, string)
+	}{
+		{
+			name: "set terraform version",
+			args: []string{"workspace-1", "--terraform-version", "0.13.5"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithTerraformVersion("0.14.3"))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "0.13.5", ws.Spec.TerraformVersion)
+				assert.Equal(t, "Updated workspace default/workspace-1\n", out)
+			},
+		},
+		{
+			name: "only passed flags are applied",
+			args: []string{"workspace-1", "--size", "5Gi"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithTerraformVersion("0.14.3"), testobj.WithStorageClass(&standard))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "5Gi", ws.Spec.Cache.Size)
+				assert.Equal(t, "0.14.3", ws.Spec.TerraformVersion)
+				assert.Equal(t, "standard", *ws.Spec.Cache.StorageClass)
+			},
+		},
+		{
+			name: "set storage class and cache mode",
+			args: []string{"workspace-1", "--storage-class", "nfs", "--cache-mode", "shared"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "nfs", *ws.Spec.Cache.StorageClass)
+				assert.Equal(t, v1alpha1.CacheModeShared, ws.Spec.Cache.Mode)
+			},
+		},
+		{
+			name: "set reader policy",
+			args: []string{"workspace-1", "--reader-policy", "isolate"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, v1alpha1.ReaderPolicyIsolate, ws.Spec.ReaderPolicy)
+			},
+		},
+		{
+			name: "invalid reader policy",
+			args: []string{"workspace-1", "--reader-policy", "ignore"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			err:  errInvalidReaderPolicy,
+		},
+		{
+			name: "disable idle timeout",
+			args: []string{"workspace-1", "--idle-timeout", "0"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithIdleTimeout("30m"))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "", ws.Spec.Cache.IdleTimeout)
+			},
+		},
+		{
+			name: "set service account",
+			args: []string{"workspace-1", "--service-account", "terraform", "--sa-annotations", "iam.gke.io/gcp-service-account=prod@my-project.iam.gserviceaccount.com"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "terraform", ws.Spec.ServiceAccountName)
+				assert.Equal(t, "prod@my-project.iam.gserviceaccount.com", ws.Spec.ServiceAccountAnnotations["iam.gke.io/gcp-service-account"])
+			},
+		},
+		{
+			name: "revert to namespace service account",
+			args: []string{"workspace-1", "--service-account", ""},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithServiceAccount("terraform"))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "", ws.Spec.ServiceAccountName)
+			},
+		},
+		{
+			name: "replace file credential secrets",
+			args: []string{"workspace-1", "--file-secrets", "kubeconfig=/root/.kube"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithCredentialSecrets(
+				v1alpha1.CredentialSecret{Name: "aws"},
+				v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile},
+			))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, []v1alpha1.CredentialSecret{
+					{Name: "aws"},
+					{Name: "kubeconfig", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "/root/.kube"},
+				}, ws.Spec.CredentialSecrets)
+			},
+		},
+		{
+			name: "remove env credential secrets",
+			args: []string{"workspace-1", "--env-secrets", ""},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", testobj.WithCredentialSecrets(
+				v1alpha1.CredentialSecret{Name: "aws", Type: v1alpha1.CredentialSecretTypeEnv},
+				v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile},
+			))},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, []v1alpha1.CredentialSecret{
+					{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile},
+				}, ws.Spec.CredentialSecrets)
+			},
+		},
+		{
+			name: "current workspace",
+			args: []string{"--terraform-version", "0.13.5"},
+			env:  &env.Env{Namespace: "dev", Workspace: "workspace-1"},
+			objs: []runtime.Object{testobj.Workspace("dev", "workspace-1")},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, "0.13.5", ws.Spec.TerraformVersion)
+			},
+		},
+		{
+			name: "no changes",
+			args: []string{"workspace-1"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			err:  errNoChanges,
+		},
+		{
+			name: "invalid cache mode",
+			args: []string{"workspace-1", "--cache-mode", "sticky"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			err:  errInvalidCacheMode,
+		},
+		{
+			name: "migrate to http state backend",
+			args: []string{"workspace-1", "--state-backend", "http"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Equal(t, v1alpha1.StateBackendHTTP, ws.Spec.StateBackend)
+			},
+		},
+		{
+			name: "invalid state backend",
+			args: []string{"workspace-1", "--state-backend", "s3"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			err:  errInvalidStateBackend,
+		},
+		{
+			name: "wait for reconfiguration",
+			args: []string{"workspace-1", "--terraform-version", "0.13.5", "--wait"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", func(ws *v1alpha1.Workspace) {
+				ws.Status.Conditions = append(ws.Status.Conditions, metav1.Condition{
+					Type:    v1alpha1.WorkspaceTerraformInstalledCondition,
+					Status:  metav1.ConditionTrue,
+					Reason:  v1alpha1.InstalledReason,
+					Message: "Installed terraform 0.13.5",
+				})
+			})},
+			assertions: func(t *testutil.T, ws *v1alpha1.Workspace, out string) {
+				assert.Contains(t, out, "TerraformInstalled: Installed Installed terraform 0.13.5")
+			},
+		},
+		{
+			name: "reconfiguration timeout",
+			args: []string{"workspace-1", "--terraform-version", "0.13.5", "--wait", "--timeout", "10ms"},
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", func(ws *v1alpha1.Workspace) {
+				ws.Status.Conditions[0].Status = metav1.ConditionFalse
+				ws.Status.Conditions[0].Reason = v1alpha1.PendingReason
+			})},
+			err: errReconfigureTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			cmd, opts := setCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs(tt.args)
+
+			// Override path
+			opts.path = t.NewTempDir().Chdir().Root()
+			if tt.env != nil {
+				require.NoError(t, tt.env.Write(opts.path))
+			}
+
+			err := cmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.err)) {
+				return
+			}
+
+			if tt.assertions != nil {
+				ws, err := opts.WorkspacesClient(opts.namespace).Get(context.Background(), opts.workspace, metav1.GetOptions{})
+				require.NoError(t, err)
+				tt.assertions(t, ws, out.String())
+			}
+		})
+	}
+}
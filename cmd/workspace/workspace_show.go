@@ -1,38 +1,313 @@
 package workspace
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/cmd/flags"
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
 	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/labels"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 )
 
-func showCmd(f *cmdutil.Factory) *cobra.Command {
-	var path string
+const (
+	defaultShowRuns   = 5
+	defaultShowEvents = 10
 
+	maskedOutput = "(masked)"
+)
+
+type showOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	workspace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// Number of most recent runs to show
+	runs int
+	// Number of most recent events to show
+	events int
+	// Show values of outputs rather than masking them
+	revealOutputs bool
+
+	// Output format. Empty describes the workspace.
+	output string
+}
+
+func showCmd(f *cmdutil.Factory) (*cobra.Command, *showOptions) {
+	o := &showOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+		workspace: defaultWorkspace,
+	}
 	cmd := &cobra.Command{
-		Use:   "show",
-		Short: "Show current workspace",
+		Use:   "show [workspace]",
+		Short: "Show the status of a workspace",
+		Long: `Show the status of a workspace. Defaults to the current workspace.
+
+Shows the workspace's phase and conditions, its terraform version, the status of its cache, its state,
+its active run and queue, its outputs, its most recent runs, and the most recent events for the
+workspace and its pod. Output values are masked, in every output format, unless --reveal-outputs is
+passed. To print only the name of the current workspace, use 'etok workspace current'.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			etokenv, err := env.Read(path)
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				o.workspace = args[0]
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
 			if err != nil {
-				if os.IsNotExist(err) {
-					// no .terraform/environment, so show defaults
-					fmt.Fprintf(f.Out, "%s/%s\n", defaultNamespace, defaultWorkspace)
-					return nil
-				}
-				return fmt.Errorf("failed reading contents of %s: %w", path, err)
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
 			}
 
-			fmt.Fprintln(f.Out, etokenv)
-			return nil
+			return o.run(cmd.Context())
 		},
 	}
 
-	flags.AddPathFlag(cmd, &path)
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().IntVar(&o.runs, "runs", defaultShowRuns, "Number of most recent runs to show")
+	cmd.Flags().IntVar(&o.events, "events", defaultShowEvents, "Number of most recent events to show")
+	cmd.Flags().BoolVar(&o.revealOutputs, "reveal-outputs", false, "Show the values of outputs")
+	cmdutil.AddOutputFlag(cmd, &o.output, "Output format, rather than describing the workspace")
+
+	return cmd, o
+}
+
+func (o *showOptions) run(ctx context.Context) error {
+	ws, err := o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if !o.revealOutputs {
+		ws = maskOutputs(ws)
+	}
+
+	if o.output != "" {
+		printer, err := cmdutil.NewPrinter(o.output, workspaceTable())
+		if err != nil {
+			return err
+		}
+		return printer.PrintObj(ws, o.Out)
+	}
+
+	var pvc *corev1.PersistentVolumeClaim
+	if ws.CacheMode() != v1alpha1.CacheModeEphemeral {
+		pvc, err = o.KubeClient.CoreV1().PersistentVolumeClaims(o.namespace).Get(ctx, ws.PVCName(), metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			pvc = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	runs, err := o.recentRuns(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	events, err := o.recentEvents(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(o.Out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Name:\t%s/%s\n", ws.Namespace, ws.Name)
+	fmt.Fprintf(w, "Phase:\t%s\n", cmdutil.OrNone(string(ws.Status.Phase)))
+	fmt.Fprintf(w, "Terraform Version:\t%s\n", cmdutil.OrNone(ws.Spec.TerraformVersion))
+	fmt.Fprintf(w, "State Backend:\t%s\n", ws.StateBackend())
+	fmt.Fprintf(w, "State Serial:\t%s\n", serial(ws.Status.Serial))
+	if ws.Spec.BackupBucket != "" {
+		fmt.Fprintf(w, "Backup Serial:\t%s (bucket: %s)\n", serial(ws.Status.BackupSerial), ws.Spec.BackupBucket)
+	}
+	fmt.Fprintf(w, "Lock:\t%s\n", lockSummary(ws.Status.Lock))
+	fmt.Fprintf(w, "Active Run:\t%s\n", cmdutil.OrNone(strings.Join(ws.ActiveRuns(), ", ")))
+	fmt.Fprintf(w, "Queue:\t%s\n", cmdutil.OrNone(strings.Join(ws.Status.Queue, ", ")))
+
+	fmt.Fprintf(w, "Cache:\t\n")
+	fmt.Fprintf(w, "  Mode:\t%s\n", ws.CacheMode())
+	if ws.CacheMode() != v1alpha1.CacheModeEphemeral {
+		fmt.Fprintf(w, "  PVC:\t%s\n", pvcSummary(pvc))
+	}
+
+	fmt.Fprintf(w, "Conditions:\t\n")
+	if len(ws.Status.Conditions) > 0 {
+		fmt.Fprintf(w, "  TYPE\tSTATUS\tREASON\tMESSAGE\n")
+		for _, c := range ws.Status.Conditions {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+		}
+	}
+
+	fmt.Fprintf(w, "Outputs:\t\n")
+	for _, out := range ws.Status.Outputs {
+		fmt.Fprintf(w, "  %s\t%s\n", out.Key, out.Value)
+	}
+
+	fmt.Fprintf(w, "Runs:\t\n")
+	if len(runs) > 0 {
+		fmt.Fprintf(w, "  NAME\tCOMMAND\tPHASE\tEXIT CODE\tAGE\n")
+		for _, run := range runs {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", run.Name, run.Command, cmdutil.OrNone(string(run.Phase)), exitCode(run.ExitCode), cmdutil.Age(run.CreationTimestamp.Time))
+		}
+	}
+
+	fmt.Fprintf(w, "Events:\t\n")
+	if len(events) > 0 {
+		fmt.Fprintf(w, "  TYPE\tREASON\tOBJECT\tAGE\tMESSAGE\n")
+		for _, ev := range events {
+			fmt.Fprintf(w, "  %s\t%s\t%s/%s\t%s\t%s\n", ev.Type, ev.Reason, strings.ToLower(ev.InvolvedObject.Kind), ev.InvolvedObject.Name, cmdutil.Age(eventTime(ev)), ev.Message)
+		}
+	}
+
+	return nil
+}
+
+// recentRuns retrieves the workspace's most recent runs, newest first
+func (o *showOptions) recentRuns(ctx context.Context, ws *v1alpha1.Workspace) ([]v1alpha1.Run, error) {
+	selector := metav1.FormatLabelSelector(&metav1.LabelSelector{MatchLabels: labels.MakeLabels(labels.Workspace(ws.Name))})
+	list, err := o.RunsClient(o.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []v1alpha1.Run
+	for _, run := range list.Items {
+		if run.Workspace == ws.Name {
+			runs = append(runs, run)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[j].CreationTimestamp.Before(&runs[i].CreationTimestamp)
+	})
+	if len(runs) > o.runs {
+		runs = runs[:o.runs]
+	}
+	return runs, nil
+}
+
+// recentEvents retrieves the most recent events for the workspace and its pod,
+// newest first
+func (o *showOptions) recentEvents(ctx context.Context, ws *v1alpha1.Workspace) ([]corev1.Event, error) {
+	var events []corev1.Event
+	for _, obj := range []corev1.ObjectReference{{Kind: "Workspace", Name: ws.Name}, {Kind: "Pod", Name: ws.PodName()}} {
+		selector := fields.Set{"involvedObject.kind": obj.Kind, "involvedObject.name": obj.Name}.String()
+		list, err := o.KubeClient.CoreV1().Events(o.namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range list.Items {
+			// Fake clients ignore field selectors
+			if ev.InvolvedObject.Kind == obj.Kind && ev.InvolvedObject.Name == obj.Name {
+				events = append(events, ev)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[j]).Before(eventTime(events[i]))
+	})
+	if len(events) > o.events {
+		events = events[:o.events]
+	}
+	return events, nil
+}
+
+// maskOutputs returns a copy of the workspace with the values of its outputs
+// masked
+func maskOutputs(ws *v1alpha1.Workspace) *v1alpha1.Workspace {
+	ws = ws.DeepCopy()
+	for _, out := range ws.Status.Outputs {
+		out.Value = maskedOutput
+	}
+	return ws
+}
+
+func eventTime(ev corev1.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+	if !ev.EventTime.IsZero() {
+		return ev.EventTime.Time
+	}
+	return ev.CreationTimestamp.Time
+}
+
+func pvcSummary(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc == nil {
+		return "<not found>"
+	}
+	summary := fmt.Sprintf("%s (%s", pvc.Name, pvc.Status.Phase)
+	if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok {
+		summary += ", " + capacity.String()
+	} else if request, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		summary += ", requested " + request.String()
+	}
+	if pvc.Spec.StorageClassName != nil {
+		summary += ", storage class " + *pvc.Spec.StorageClassName
+	}
+	return summary + ")"
+}
+
+func lockSummary(lock *v1alpha1.WorkspaceLock) string {
+	if lock == nil {
+		return "<none>"
+	}
+	summary := lock.ID
+	if lock.Run != "" {
+		summary += " held by run " + lock.Run
+	} else if lock.Who != "" {
+		summary += " held by " + lock.Who
+	}
+	if lock.Since != nil {
+		summary += " for " + cmdutil.Age(lock.Since.Time)
+	}
+	return summary
+}
+
+func serial(s *int) string {
+	if s == nil {
+		return "<none>"
+	}
+	return fmt.Sprintf("%d", *s)
+}
 
-	return cmd
+func exitCode(code *int) string {
+	if code == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *code)
 }
@@ -4,32 +4,166 @@ import (
 	"bytes"
 	"context"
 	"testing"
+	"time"
 
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/testobj"
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestWorkspaceShow(t *testing.T) {
+	withStatus := func(ws *v1alpha1.Workspace) {
+		serial := 5
+		ws.Status.Phase = v1alpha1.WorkspacePhaseError
+		ws.Status.Serial = &serial
+		ws.Status.Active = "run-12345"
+		ws.Status.Queue = []string{"run-67890"}
+		ws.Status.Outputs = []*v1alpha1.Output{{Key: "password", Value: "opensesame"}}
+		ws.Status.Conditions = []metav1.Condition{
+			{
+				Type:    v1alpha1.WorkspaceReadyCondition,
+				Status:  metav1.ConditionFalse,
+				Reason:  v1alpha1.SecretNotFoundReason,
+				Message: "secret creds not found",
+			},
+		}
+	}
+
+	pvc := testobj.PVC("default", "workspace-1")
+	pvc.Status.Phase = corev1.ClaimBound
+	pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}
+
+	run := func(name string, age time.Duration) *v1alpha1.Run {
+		return testobj.Run("default", name, "apply", testobj.WithWorkspace("workspace-1"), func(r *v1alpha1.Run) {
+			r.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+			labels.SetLabel(r, labels.Workspace("workspace-1"))
+		})
+	}
+
+	event := func(kind, name, reason string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name + "." + reason, Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: kind, Name: name},
+			Type:           "Warning",
+			Reason:         reason,
+			Message:        reason + " happened",
+			LastTimestamp:  metav1.NewTime(time.Now().Add(-time.Minute)),
+		}
+	}
+
 	tests := []struct {
-		name string
-		args []string
-		env  *env.Env
-		out  string
-		err  bool
+		name     string
+		args     []string
+		env      *env.Env
+		objs     []runtime.Object
+		err      bool
+		contains []string
+		excludes []string
 	}{
 		{
-			name: "WithEnvironmentFile",
-			args: []string{"show"},
+			name: "current workspace",
 			env:  &env.Env{Namespace: "default", Workspace: "workspace-1"},
-			out:  "default/workspace-1\n",
+			objs: []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus), pvc},
+			contains: []string{
+				"default/workspace-1",
+				"error",
+				"run-12345",
+				"run-67890",
+				"SecretNotFound",
+				"secret creds not found",
+				"workspace-1 (Bound, 1Gi)",
+				"password",
+				maskedOutput,
+			},
+			excludes: []string{"opensesame"},
+		},
+		{
+			name:     "specific workspace",
+			args:     []string{"workspace-2"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-2")},
+			contains: []string{"default/workspace-2", "<not found>"},
+		},
+		{
+			name:     "reveal outputs",
+			args:     []string{"workspace-1", "--reveal-outputs"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus)},
+			contains: []string{"opensesame"},
+			excludes: []string{maskedOutput},
+		},
+		{
+			name: "recent runs",
+			args: []string{"workspace-1", "--runs", "2"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "workspace-1"),
+				run("run-old", 3*time.Hour),
+				run("run-newer", 2*time.Hour),
+				run("run-newest", time.Hour),
+				testobj.Run("default", "run-other", "plan", testobj.WithWorkspace("workspace-2")),
+			},
+			contains: []string{"run-newest", "run-newer"},
+			excludes: []string{"run-old", "run-other"},
 		},
 		{
-			name: "WithoutEnvironmentFile",
-			args: []string{"show"},
-			out:  "default/default\n",
+			name: "events for workspace and pod",
+			args: []string{"workspace-1"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "workspace-1"),
+				event("Workspace", "workspace-1", "StaleLockReleased"),
+				event("Pod", "workspace-workspace-1", "FailedMount"),
+				event("Pod", "unrelated", "BackOff"),
+			},
+			contains: []string{"StaleLockReleased", "FailedMount", "pod/workspace-workspace-1"},
+			excludes: []string{"BackOff"},
+		},
+		{
+			name: "ephemeral cache",
+			args: []string{"workspace-1"},
+			objs: []runtime.Object{
+				testobj.Workspace("default", "workspace-1", testobj.WithCacheMode(v1alpha1.CacheModeEphemeral)),
+			},
+			contains: []string{"ephemeral"},
+			excludes: []string{"PVC:"},
+		},
+		{
+			name:     "json output masks outputs",
+			args:     []string{"workspace-1", "-o", "json"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus)},
+			contains: []string{`"key": "password"`, maskedOutput},
+			excludes: []string{"opensesame"},
+		},
+		{
+			name:     "yaml output masks outputs",
+			args:     []string{"workspace-1", "-o", "yaml"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus)},
+			contains: []string{"key: password", maskedOutput},
+			excludes: []string{"opensesame"},
+		},
+		{
+			name:     "template output masks outputs",
+			args:     []string{"workspace-1", "-o", "go-template={{range .status.outputs}}{{.value}}{{end}}"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus)},
+			contains: []string{maskedOutput},
+			excludes: []string{"opensesame"},
+		},
+		{
+			name:     "json output reveals outputs",
+			args:     []string{"workspace-1", "-o", "json", "--reveal-outputs"},
+			objs:     []runtime.Object{testobj.Workspace("default", "workspace-1", withStatus)},
+			contains: []string{"opensesame"},
+		},
+		{
+			name: "workspace not found",
+			args: []string{"workspace-1"},
+			err:  true,
 		},
 	}
 
@@ -37,22 +171,27 @@ func TestWorkspaceShow(t *testing.T) {
 		testutil.Run(t, tt.name, func(t *testutil.T) {
 			path := t.NewTempDir().Chdir().Root()
 
-			// Write .terraform/environment
+			// Write project file
 			if tt.env != nil {
 				require.NoError(t, tt.env.Write(path))
 			}
 
 			out := new(bytes.Buffer)
 
-			f := cmdutil.NewFakeFactory(out)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
 
-			cmd := showCmd(f)
+			cmd, _ := showCmd(f)
 			cmd.SetOut(f.Out)
 			cmd.SetArgs(tt.args)
 
 			t.CheckError(tt.err, cmd.ExecuteContext(context.Background()))
 
-			assert.Equal(t, tt.out, out.String())
+			for _, s := range tt.contains {
+				assert.Contains(t, out.String(), s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, out.String(), s)
+			}
 		})
 	}
 }
@@ -0,0 +1,441 @@
+package workspace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/k8s"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	defaultStateImportTimeout = time.Minute
+
+	// Key in the kubernetes backend's secret containing the compressed state
+	stateSecretKey = "tfstate"
+)
+
+var (
+	errInvalidStateFile   = errors.New("invalid state file")
+	errLineageMismatch    = errors.New("state lineages do not match")
+	errSerialNotIncreased = errors.New("state serial must be greater than that of the existing state")
+	errStateLocked        = errors.New("state is locked")
+	errNoState            = errors.New("workspace has no state")
+	errHTTPStateBackend   = errors.New("workspace uses the http state backend")
+	errStateImportTimeout = errors.New("timed out waiting for workspace to read imported state")
+)
+
+// tfstate is the subset of a terraform state file used to validate imports and
+// exports
+type tfstate struct {
+	Version int    `json:"version"`
+	Serial  int    `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+func parseStateFile(data []byte) (*tfstate, error) {
+	var s tfstate
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidStateFile, err.Error())
+	}
+	if s.Version == 0 || s.Lineage == "" {
+		return nil, fmt.Errorf("%w: missing version or lineage", errInvalidStateFile)
+	}
+	return &s, nil
+}
+
+func stateCmd(f *cmdutil.Factory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Import and export workspace state",
+		Long: `Import and export workspace state. State is read and written in terraform's own format, and so these
+commands don't support the --output flag of the other read commands.`,
+	}
+
+	ic, _ := stateImportCmd(f)
+	cmd.AddCommand(ic)
+
+	ec, _ := stateExportCmd(f)
+	cmd.AddCommand(ec)
+
+	return cmd
+}
+
+// stateOptions are common to the import and export commands
+type stateOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	workspace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// Permit lineage mismatches
+	force bool
+}
+
+func (o *stateOptions) addFlags(cmd *cobra.Command) {
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddWorkspaceFlag(cmd, &o.workspace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+}
+
+// getWorkspace retrieves the workspace, checking it uses the kubernetes state
+// backend
+func (o *stateOptions) getWorkspace(ctx context.Context, alternative string) (*v1alpha1.Workspace, error) {
+	ws, err := o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if ws.Spec.StateBackend == v1alpha1.StateBackendHTTP || ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		return nil, fmt.Errorf("%w: use '%s' instead", errHTTPStateBackend, alternative)
+	}
+	return ws, nil
+}
+
+// getState retrieves the kubernetes backend's secret and the decompressed state
+// it contains. Nil is returned for both if the secret does not exist.
+func (o *stateOptions) getState(ctx context.Context, ws *v1alpha1.Workspace) (*corev1.Secret, []byte, error) {
+	secret, err := o.SecretsClient(o.namespace).Get(ctx, ws.StateSecretName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	gr, err := gzip.NewReader(bytes.NewBuffer(secret.Data[stateSecretKey]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decompress state: %w", err)
+	}
+	data, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decompress state: %w", err)
+	}
+	return secret, data, nil
+}
+
+type stateImportOptions struct {
+	stateOptions
+
+	// Path to state file to import
+	file string
+
+	// Wait for the operator to read the imported state
+	wait    bool
+	timeout time.Duration
+}
+
+func stateImportCmd(f *cmdutil.Factory) (*cobra.Command, *stateImportOptions) {
+	o := &stateImportOptions{
+		stateOptions: stateOptions{
+			Factory:   f,
+			namespace: defaultNamespace,
+			workspace: defaultWorkspace,
+		},
+	}
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import a local state file into a workspace",
+		Long: `Import a local state file into a workspace, overwriting its existing state. Defaults to the
+current workspace.
+
+The lineage of the state file must match that of the existing state, and its serial must be greater,
+unless --force is passed. The state cannot be imported whilst it is locked.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			o.file = args[0]
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	o.addFlags(cmd)
+
+	cmd.Flags().BoolVar(&o.force, "force", false, "Import state regardless of its lineage and serial")
+	cmd.Flags().BoolVar(&o.wait, "wait", true, "Wait for the workspace to read the imported state")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", defaultStateImportTimeout, "Timeout for the workspace to read the imported state")
+
+	return cmd, o
+}
+
+func (o *stateImportOptions) run(ctx context.Context) error {
+	data, err := ioutil.ReadFile(o.file)
+	if err != nil {
+		return err
+	}
+	imported, err := parseStateFile(data)
+	if err != nil {
+		return err
+	}
+
+	ws, err := o.getWorkspace(ctx, "etok state push")
+	if err != nil {
+		return err
+	}
+
+	if err := o.checkUnlocked(ctx, ws); err != nil {
+		return err
+	}
+
+	secret, existingData, err := o.getState(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	if secret != nil && !o.force {
+		existing, err := parseStateFile(existingData)
+		if err != nil {
+			return fmt.Errorf("unable to parse existing state: %w", err)
+		}
+		if existing.Lineage != imported.Lineage {
+			return fmt.Errorf("%w: state file has lineage %s but existing state has lineage %s", errLineageMismatch, imported.Lineage, existing.Lineage)
+		}
+		if imported.Serial <= existing.Serial {
+			return fmt.Errorf("%w: state file has serial %d but existing state has serial %d", errSerialNotIncreased, imported.Serial, existing.Serial)
+		}
+	}
+
+	compressed, err := compress(data)
+	if err != nil {
+		return err
+	}
+
+	if secret != nil {
+		secret.Data[stateSecretKey] = compressed
+		if _, err := o.SecretsClient(o.namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := o.SecretsClient(o.namespace).Create(ctx, newStateSecret(ws, compressed), metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(o.Out, "Imported state with serial %d into workspace %s/%s\n", imported.Serial, o.namespace, o.workspace)
+
+	if !o.wait {
+		return nil
+	}
+
+	return o.waitForState(ctx, ws, imported.Serial)
+}
+
+// checkUnlocked checks the kubernetes backend's lock is not held. The backend
+// records the lock in a lease named after the state secret.
+func (o *stateImportOptions) checkUnlocked(ctx context.Context, ws *v1alpha1.Workspace) error {
+	lease, err := o.KubeClient.CoordinationV1().Leases(o.namespace).Get(ctx, "lock-"+ws.StateSecretName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		return fmt.Errorf("%w: lock ID: %s", errStateLocked, *lease.Spec.HolderIdentity)
+	}
+	return nil
+}
+
+// waitForState waits for the operator to read the imported state
+func (o *stateImportOptions) waitForState(ctx context.Context, ws *v1alpha1.Workspace, serial int) error {
+	lw := &k8s.WorkspaceListWatcher{Client: o.EtokClient, Name: ws.Name, Namespace: ws.Namespace}
+	hdlr := handlers.WorkspaceStateSerial(serial)
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	if _, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Workspace{}, nil, hdlr); err != nil {
+		if errors.Is(err, wait.ErrWaitTimeout) {
+			return errStateImportTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+// newStateSecret constructs a secret in the manner expected by terraform's
+// kubernetes backend
+func newStateSecret(ws *v1alpha1.Workspace, compressed []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ws.StateSecretName(),
+			Namespace: ws.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "terraform",
+				"tfstate":                      "true",
+				"tfstateSecretSuffix":          ws.Name,
+				"tfstateWorkspace":             "default",
+			},
+			Annotations: map[string]string{
+				"encoding": "gzip",
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			stateSecretKey: compressed,
+		},
+	}
+}
+
+func compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type stateExportOptions struct {
+	stateOptions
+
+	// Path to write state file to. Empty writes to stdout.
+	file string
+}
+
+func stateExportCmd(f *cmdutil.Factory) (*cobra.Command, *stateExportOptions) {
+	o := &stateExportOptions{
+		stateOptions: stateOptions{
+			Factory:   f,
+			namespace: defaultNamespace,
+			workspace: defaultWorkspace,
+		},
+	}
+	cmd := &cobra.Command{
+		Use:   "export [file]",
+		Short: "Export a workspace's state to a local file",
+		Long: `Export a workspace's state to a local file, or to stdout if no file is specified. Defaults to
+the current workspace.
+
+An existing file is only overwritten if its lineage matches that of the workspace's state, unless
+--force is passed.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				o.file = args[0]
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	o.addFlags(cmd)
+
+	cmd.Flags().BoolVar(&o.force, "force", false, "Overwrite an existing file regardless of its lineage")
+
+	return cmd, o
+}
+
+func (o *stateExportOptions) run(ctx context.Context) error {
+	ws, err := o.getWorkspace(ctx, "etok state pull")
+	if err != nil {
+		return err
+	}
+
+	secret, data, err := o.getState(ctx, ws)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("%w: %s/%s", errNoState, o.namespace, o.workspace)
+	}
+
+	if o.file == "" {
+		_, err := o.Out.Write(data)
+		return err
+	}
+
+	if !o.force {
+		if err := checkLineage(o.file, data); err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(o.file, data, 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Exported state of workspace %s/%s to %s\n", o.namespace, o.workspace, o.file)
+	return nil
+}
+
+// checkLineage checks an existing state file has the same lineage as the given
+// state
+func checkLineage(path string, data []byte) error {
+	existingData, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	existing, err := parseStateFile(existingData)
+	if err != nil {
+		return fmt.Errorf("refusing to overwrite %s: %w", path, err)
+	}
+	exported, err := parseStateFile(data)
+	if err != nil {
+		return err
+	}
+	if existing.Lineage != exported.Lineage {
+		return fmt.Errorf("%w: %s has lineage %s but workspace state has lineage %s", errLineageMismatch, path, existing.Lineage, exported.Lineage)
+	}
+	return nil
+}
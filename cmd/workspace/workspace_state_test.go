@@ -0,0 +1,259 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	stateSerial3 = `{"version":4,"serial":3,"lineage":"abc","outputs":{}}`
+	stateSerial5 = `{"version":4,"serial":5,"lineage":"abc","outputs":{}}`
+	otherLineage = `{"version":4,"serial":5,"lineage":"def","outputs":{}}`
+)
+
+func TestStateImport(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		objs       []runtime.Object
+		file       string
+		err        error
+		assertions func(*testutil.T, *stateImportOptions)
+	}{
+		{
+			name: "import into workspace without state",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			file: stateSerial5,
+			assertions: func(t *testutil.T, o *stateImportOptions) {
+				secret, data, err := o.getState(context.Background(), testobj.Workspace("default", "default"))
+				require.NoError(t, err)
+				assert.Equal(t, stateSerial5, string(data))
+				assert.Equal(t, "true", secret.Labels["tfstate"])
+				assert.Equal(t, "default", secret.Labels["tfstateSecretSuffix"])
+				assert.Equal(t, "gzip", secret.Annotations["encoding"])
+			},
+		},
+		{
+			name: "overwrite existing state",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial3)},
+			file: stateSerial5,
+			assertions: func(t *testutil.T, o *stateImportOptions) {
+				_, data, err := o.getState(context.Background(), testobj.Workspace("default", "default"))
+				require.NoError(t, err)
+				assert.Equal(t, stateSerial5, string(data))
+			},
+		},
+		{
+			name: "lineage mismatch",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial3)},
+			file: otherLineage,
+			err:  errLineageMismatch,
+		},
+		{
+			name: "force lineage mismatch",
+			args: []string{"--wait=false", "--force"},
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial3)},
+			file: otherLineage,
+		},
+		{
+			name: "serial not increased",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			file: stateSerial3,
+			err:  errSerialNotIncreased,
+		},
+		{
+			name: "invalid state file",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			file: `{"foo":"bar"}`,
+			err:  errInvalidStateFile,
+		},
+		{
+			name: "state locked",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateLease("lock-tfstate-default-default", "lock-123")},
+			file: stateSerial5,
+			err:  errStateLocked,
+		},
+		{
+			name: "http state backend",
+			args: []string{"--wait=false"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithStateBackend(v1alpha1.StateBackendHTTP))},
+			file: stateSerial5,
+			err:  errHTTPStateBackend,
+		},
+		{
+			name: "wait for workspace to read state",
+			objs: []runtime.Object{testobj.Workspace("default", "default", func(ws *v1alpha1.Workspace) {
+				serial := 5
+				ws.Status.Serial = &serial
+			})},
+			file: stateSerial5,
+		},
+		{
+			name: "timeout waiting for workspace to read state",
+			args: []string{"--timeout", "10ms"},
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			file: stateSerial5,
+			err:  errStateImportTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			path := t.NewTempDir().Write("import.tfstate", []byte(tt.file)).Path("import.tfstate")
+
+			cmd, opts := stateImportCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs(append([]string{path}, tt.args...))
+
+			// Override path
+			opts.path = t.NewTempDir().Root()
+
+			err := cmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.err)) {
+				return
+			}
+
+			if tt.assertions != nil {
+				tt.assertions(t, opts)
+			}
+		})
+	}
+}
+
+func TestStateExport(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		objs []runtime.Object
+		// Existing local state file
+		existing string
+		// Write to stdout rather than a file
+		stdout bool
+		err    error
+		// Wanted output
+		want string
+	}{
+		{
+			name: "export to file",
+			objs: []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			want: stateSerial5,
+		},
+		{
+			name:   "export to stdout",
+			objs:   []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			stdout: true,
+			want:   stateSerial5,
+		},
+		{
+			name:     "overwrite file with same lineage",
+			objs:     []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			existing: stateSerial3,
+			want:     stateSerial5,
+		},
+		{
+			name:     "lineage mismatch",
+			objs:     []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			existing: otherLineage,
+			err:      errLineageMismatch,
+		},
+		{
+			name:     "force lineage mismatch",
+			args:     []string{"--force"},
+			objs:     []runtime.Object{testobj.Workspace("default", "default"), stateSecret(t, stateSerial5)},
+			existing: otherLineage,
+			want:     stateSerial5,
+		},
+		{
+			name: "no state",
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			err:  errNoState,
+		},
+		{
+			name: "http state backend",
+			objs: []runtime.Object{testobj.Workspace("default", "default", testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP))},
+			err:  errHTTPStateBackend,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+
+			dir := t.NewTempDir()
+			if tt.existing != "" {
+				dir.Write("export.tfstate", []byte(tt.existing))
+			}
+
+			args := tt.args
+			if !tt.stdout {
+				args = append(args, dir.Path("export.tfstate"))
+			}
+
+			cmd, opts := stateExportCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs(args)
+
+			// Override path
+			opts.path = t.NewTempDir().Root()
+
+			err := cmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.err)) {
+				return
+			}
+
+			if tt.want != "" {
+				if tt.stdout {
+					assert.Equal(t, tt.want, out.String())
+				} else {
+					got, err := ioutil.ReadFile(dir.Path("export.tfstate"))
+					require.NoError(t, err)
+					assert.Equal(t, tt.want, string(got))
+				}
+			}
+		})
+	}
+}
+
+// stateSecret constructs the kubernetes backend's secret for the default
+// workspace
+func stateSecret(t *testing.T, state string) *corev1.Secret {
+	compressed, err := compress([]byte(state))
+	require.NoError(t, err)
+	return newStateSecret(testobj.Workspace("default", "default"), compressed)
+}
+
+func stateLease(name, holder string) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity: &holder,
+		},
+	}
+}
@@ -36,7 +36,7 @@ func TestWorkspace(t *testing.T) {
 		{
 			name: "list",
 			args: []string{"list", "-h"},
-			out:  "^List all workspaces",
+			out:  "^List workspaces",
 		},
 		{
 			name: "delete",
@@ -46,6 +46,11 @@ func TestWorkspace(t *testing.T) {
 		{
 			name: "show",
 			args: []string{"show", "-h"},
+			out:  "^Show the status of a workspace",
+		},
+		{
+			name: "current",
+			args: []string{"current", "-h"},
 			out:  "^Show current workspace",
 		},
 		{
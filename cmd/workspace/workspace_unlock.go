@@ -0,0 +1,179 @@
+package workspace
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/flags"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/client"
+	"github.com/leg100/etok/pkg/env"
+	"github.com/leg100/etok/pkg/handlers"
+	"github.com/leg100/etok/pkg/k8s"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/apimachinery/pkg/util/wait"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	defaultUnlockTimeout = time.Minute
+)
+
+var (
+	errUnlockTimeout = errors.New("timed out waiting for lock to be released")
+)
+
+type unlockOptions struct {
+	*cmdutil.Factory
+
+	*client.Client
+
+	path        string
+	namespace   string
+	workspace   string
+	kubeContext string
+
+	// Env read from the project file. Nil if there is no project file.
+	etokenv *env.Env
+	// Proceed regardless of whether the cluster matches the recorded cluster
+	ignoreClusterMismatch bool
+
+	// Skip confirmation
+	yes bool
+
+	// Timeout for the lock to be released
+	timeout time.Duration
+}
+
+func unlockCmd(f *cmdutil.Factory) (*cobra.Command, *unlockOptions) {
+	o := &unlockOptions{
+		Factory:   f,
+		namespace: defaultNamespace,
+		workspace: defaultWorkspace,
+	}
+	cmd := &cobra.Command{
+		Use:   "unlock [workspace]",
+		Short: "Release the lock on a workspace's state",
+		Long: `Release the lock on a workspace's state. Defaults to the current workspace.
+
+The lock is shown and confirmation is sought before the lock is released. Only release a lock if you
+are certain the terraform process holding it is no longer running.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			o.etokenv, err = cmdutil.LookupEnv(cmd, o.path, &o.namespace, &o.workspace)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 {
+				o.workspace = args[0]
+			}
+
+			o.Client, err = f.Create(o.kubeContext)
+			if err != nil {
+				return err
+			}
+
+			if err := cmdutil.CheckCluster(cmd, o.etokenv, o.Client, o.ignoreClusterMismatch); err != nil {
+				return err
+			}
+
+			return o.run(cmd.Context())
+		},
+	}
+
+	flags.AddPathFlag(cmd, &o.path)
+	flags.AddNamespaceFlag(cmd, &o.namespace)
+	flags.AddKubeContextFlag(cmd, &o.kubeContext)
+	flags.AddIgnoreClusterMismatchFlag(cmd, &o.ignoreClusterMismatch)
+
+	cmd.Flags().BoolVarP(&o.yes, "yes", "y", false, "Release the lock without seeking confirmation")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", defaultUnlockTimeout, "Timeout for the lock to be released")
+
+	return cmd, o
+}
+
+func (o *unlockOptions) run(ctx context.Context) error {
+	ws, err := o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	lock := ws.Status.Lock
+	if lock == nil {
+		fmt.Fprintf(o.Out, "Workspace %s/%s is not locked\n", o.namespace, o.workspace)
+		return nil
+	}
+
+	printLock(o.Out, lock)
+
+	if !o.yes {
+		fmt.Fprint(o.Out, "Release lock? [y/N]: ")
+		answer, err := bufio.NewReader(o.In).ReadString('\n')
+		if err != nil && answer == "" {
+			return err
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Fprintln(o.Out, "Lock not released")
+			return nil
+		}
+	}
+
+	// Request the operator release the lock
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ws, err = o.WorkspacesClient(o.namespace).Get(ctx, o.workspace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ws.Annotations == nil {
+			ws.Annotations = make(map[string]string)
+		}
+		ws.Annotations[v1alpha1.UnlockAnnotationKey] = lock.ID
+
+		ws, err = o.WorkspacesClient(o.namespace).Update(ctx, ws, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	lw := &k8s.WorkspaceListWatcher{Client: o.EtokClient, Name: ws.Name, Namespace: ws.Namespace}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	if _, err := watchtools.UntilWithSync(ctx, lw, &v1alpha1.Workspace{}, nil, handlers.WorkspaceUnlocked(lock.ID)); err != nil {
+		if errors.Is(err, wait.ErrWaitTimeout) {
+			return errUnlockTimeout
+		}
+		return err
+	}
+
+	fmt.Fprintf(o.Out, "Released lock %s\n", lock.ID)
+	return nil
+}
+
+func printLock(out io.Writer, lock *v1alpha1.WorkspaceLock) {
+	fmt.Fprintf(out, "Lock ID:   %s\n", lock.ID)
+	if lock.Run != "" {
+		fmt.Fprintf(out, "Run:       %s\n", lock.Run)
+	}
+	if lock.Who != "" {
+		fmt.Fprintf(out, "Who:       %s\n", lock.Who)
+	}
+	if lock.Operation != "" {
+		fmt.Fprintf(out, "Operation: %s\n", lock.Operation)
+	}
+	if lock.Since != nil {
+		fmt.Fprintf(out, "Since:     %s (%s ago)\n", lock.Since.UTC().Format(time.RFC3339), duration.HumanDuration(time.Since(lock.Since.Time)))
+	}
+}
@@ -0,0 +1,112 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	cmdutil "github.com/leg100/etok/cmd/util"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestUnlockWorkspace(t *testing.T) {
+	locked := func(ws *v1alpha1.Workspace) {
+		since := metav1.NewTime(time.Now().Add(-time.Hour))
+		ws.Status.Lock = &v1alpha1.WorkspaceLock{
+			ID:        "lock-123",
+			Run:       "run-12345",
+			Who:       "root@run-12345",
+			Operation: "OperationTypeApply",
+			Since:     &since,
+		}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		objs []runtime.Object
+		// Input to confirmation prompt
+		in         string
+		err        error
+		out        string
+		assertions func(*testutil.T, *unlockOptions)
+	}{
+		{
+			name: "not locked",
+			objs: []runtime.Object{testobj.Workspace("default", "default")},
+			out:  "Workspace default/default is not locked\n",
+		},
+		{
+			name: "declined",
+			objs: []runtime.Object{testobj.Workspace("default", "default", locked)},
+			in:   "n\n",
+			out:  "Lock not released\n",
+			assertions: func(t *testutil.T, o *unlockOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.NotContains(t, ws.Annotations, v1alpha1.UnlockAnnotationKey)
+			},
+		},
+		{
+			name: "confirmed but operator does not release lock",
+			args: []string{"--timeout", "10ms"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", locked)},
+			in:   "y\n",
+			err:  errUnlockTimeout,
+			assertions: func(t *testutil.T, o *unlockOptions) {
+				ws, err := o.WorkspacesClient("default").Get(context.Background(), "default", metav1.GetOptions{})
+				require.NoError(t, err)
+				assert.Equal(t, "lock-123", ws.Annotations[v1alpha1.UnlockAnnotationKey])
+			},
+		},
+		{
+			name: "skip confirmation",
+			args: []string{"--yes", "--timeout", "10ms"},
+			objs: []runtime.Object{testobj.Workspace("default", "default", locked)},
+			err:  errUnlockTimeout,
+		},
+		{
+			name: "specific workspace",
+			args: []string{"networking"},
+			objs: []runtime.Object{testobj.Workspace("default", "networking")},
+			out:  "Workspace default/networking is not locked\n",
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			out := new(bytes.Buffer)
+			f := cmdutil.NewFakeFactory(out, tt.objs...)
+			f.In = strings.NewReader(tt.in)
+
+			cmd, opts := unlockCmd(f)
+			cmd.SetOut(out)
+			cmd.SetArgs(tt.args)
+
+			// Override path
+			opts.path = t.NewTempDir().Root()
+
+			err := cmd.ExecuteContext(context.Background())
+			if !assert.True(t, errors.Is(err, tt.err)) {
+				return
+			}
+
+			if tt.out != "" {
+				assert.True(t, strings.HasSuffix(out.String(), tt.out), out.String())
+			}
+
+			if tt.assertions != nil {
+				tt.assertions(t, opts)
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/leg100/etok
 
-go 1.15
+go 1.16
 
 require (
 	cloud.google.com/go/storage v1.12.0
@@ -3,16 +3,25 @@ package archive
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/leg100/etok/pkg/util/path"
 	"k8s.io/klog/v2"
 )
 
+// epoch is the modification time given to every entry in the archive. Zeroing
+// mtimes ensures the same config always produces the same archive, and
+// therefore the same hash.
+var epoch = time.Unix(0, 0)
+
 type archive struct {
 	// Absolute path to root module on client
 	root string
@@ -22,6 +31,8 @@ type archive struct {
 	base string
 	// Maximum permitted size of compressed archive
 	maxSize int64
+	// Only archive files tracked in the git index
+	gitTrackedOnly bool
 }
 
 func NewArchive(root string, opts ...func(*archive)) (*archive, error) {
@@ -49,6 +60,16 @@ func MaxSize(size int64) func(*archive) {
 	}
 }
 
+// GitTrackedOnly, if enabled, restricts the archive to files tracked in the git
+// index, ignoring untracked files. Files forcibly added to the index are
+// archived even if they match .gitignore patterns. Local modules outside of the
+// repository are not permitted.
+func GitTrackedOnly(enabled bool) func(*archive) {
+	return func(a *archive) {
+		a.gitTrackedOnly = enabled
+	}
+}
+
 // Walk returns a list of local modules starting with the root module, including
 // those called from the root module, directly and indirectly.
 func (a *archive) Walk() error {
@@ -88,15 +109,32 @@ func (a *archive) RootPath() (string, error) {
 // subdirectories, which are either added to the tarball, or ignored accordingly
 // to a ruleset. During creation if the size of the tarball exceeds maxSize an
 // error is returned.
+//
+// The tarball is deterministic: entries are written in a stable order and
+// their modification times are zeroed. A hash of the uncompressed tarball is
+// recorded in the returned metadata, permitting identical configs to be
+// detected.
 func (a *archive) Pack(w io.Writer) (*Meta, error) {
-	// tar > gzip > max size watcher > buf
+	// tar > hasher + (gzip > max size watcher > buf)
 	mw := NewMaxWriter(w, a.maxSize)
 	zw := gzip.NewWriter(mw)
-	tw := tar.NewWriter(zw)
+	hasher := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(zw, hasher))
 
 	// Create an ignore rule matcher. Parses .terraformignore if exists.
 	ruleMatcher := newRuleMatcher(a.base)
 
+	if a.gitTrackedOnly {
+		// Additionally ignore files not tracked by git
+		if err := ruleMatcher.restrictToGitIndex(a.root, a.mods); err != nil {
+			return nil, err
+		}
+	} else {
+		// Additionally ignore files ignored by git, unless there is a
+		// .terraformignore
+		ruleMatcher.honourGitIgnore(a.root)
+	}
+
 	// Track the metadata details as we go.
 	meta := &Meta{}
 
@@ -104,6 +142,10 @@ func (a *archive) Pack(w io.Writer) (*Meta, error) {
 	// walking paths more than once)
 	unnested := path.RemoveNestedPaths(a.mods)
 
+	// Module walk is non-deterministic, so sort paths to ensure the tarball
+	// entries are written in a stable order
+	sort.Strings(unnested)
+
 	// Walk directory trees
 	for _, path := range unnested {
 		err := filepath.Walk(path, packWalkFn(a.base, path, path, tw, meta, true, ruleMatcher))
@@ -125,6 +167,9 @@ func (a *archive) Pack(w io.Writer) (*Meta, error) {
 	// Record number of compressed bytes written
 	meta.CompressedSize = mw.tally
 
+	// Record hash of tarball contents
+	meta.Hash = hex.EncodeToString(hasher.Sum(nil))
+
 	return meta, nil
 }
 
@@ -169,7 +214,7 @@ func packWalkFn(base, src, dst string, tarW *tar.Writer, meta *Meta, dereference
 		fm := info.Mode()
 		header := &tar.Header{
 			Name:    filepath.ToSlash(subpath),
-			ModTime: info.ModTime(),
+			ModTime: epoch,
 			Mode:    int64(fm.Perm()),
 		}
 
@@ -225,7 +270,6 @@ func packWalkFn(base, src, dst string, tarW *tar.Writer, meta *Meta, dereference
 			// Dereference this symlink by updating the header with the target file
 			// details and set writeBody to true so the body will be written.
 			header.Typeflag = tar.TypeReg
-			header.ModTime = info.ModTime()
 			header.Mode = int64(info.Mode().Perm())
 			header.Size = info.Size()
 			writeBody = true
@@ -277,6 +321,9 @@ type Meta struct {
 
 	// Total size of the slug in bytes after compression.
 	CompressedSize int64
+
+	// Hex-encoded SHA256 hash of the (uncompressed) slug.
+	Hash string
 }
 
 func Unpack(r io.Reader, dst string) error {
@@ -299,6 +346,12 @@ func Unpack(r io.Reader, dst string) error {
 			return fmt.Errorf("failed to untar archive: %w", err)
 		}
 
+		// Skip global extended headers, e.g. those found at the start of
+		// tarballs produced by git archive.
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
 		// Get rid of absolute paths.
 		path := header.Name
 		if path[0] == '/' {
@@ -306,6 +359,11 @@ func Unpack(r io.Reader, dst string) error {
 		}
 		path = filepath.Join(dst, path)
 
+		// Refuse paths escaping the destination directory.
+		if rel, err := filepath.Rel(dst, path); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("failed to untar archive: illegal path %q", header.Name)
+		}
+
 		klog.V(1).Infof("extracting %s to %s\n", header.Name, path)
 
 		// Make the directories to the path.
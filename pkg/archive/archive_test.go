@@ -7,9 +7,11 @@ import (
 	"errors"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/leg100/etok/pkg/util/path"
@@ -74,6 +76,167 @@ func TestArchive(t *testing.T) {
 	}, files)
 }
 
+func TestArchiveHash(t *testing.T) {
+	tmpdir := testutil.NewTempDir(t).Write("main.tf", []byte("# hello"))
+
+	pack := func() string {
+		arc, err := NewArchive(tmpdir.Root())
+		require.NoError(t, err)
+		require.NoError(t, arc.Walk())
+
+		meta, err := arc.Pack(new(bytes.Buffer))
+		require.NoError(t, err)
+		return meta.Hash
+	}
+
+	original := pack()
+	assert.Len(t, original, 64)
+
+	// Modification times should not affect hash
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(tmpdir.Root(), "main.tf"), future, future))
+	assert.Equal(t, original, pack())
+
+	// Content should affect hash
+	tmpdir.Write("main.tf", []byte("# goodbye"))
+	assert.NotEqual(t, original, pack())
+}
+
+func TestGitTrackedOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := testutil.NewTempDir(t).WriteFiles(map[string][]byte{
+		"main.tf":            []byte("# main"),
+		"modules/vpc/vpc.tf": []byte("# vpc"),
+		"ignored.log":        []byte("forcibly added"),
+		".gitignore":         []byte("*.log\n"),
+		"secret.tfvars":      []byte("password=123"),
+		"untracked/foo.tf":   []byte("# untracked"),
+	})
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "main.tf", "modules/vpc/vpc.tf", ".gitignore"},
+		{"add", "-f", "ignored.log"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", repo.Root()}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	arc, err := NewArchive(repo.Root(), GitTrackedOnly(true))
+	require.NoError(t, err)
+	require.NoError(t, arc.Walk())
+
+	meta, err := arc.Pack(new(bytes.Buffer))
+	require.NoError(t, err)
+
+	// The index is the source of truth, so the forcibly added file is archived
+	// despite matching .gitignore
+	assert.Equal(t, []string{
+		".gitignore",
+		"ignored.log",
+		"main.tf",
+		"modules/",
+		"modules/vpc/",
+		"modules/vpc/vpc.tf",
+	}, meta.Files)
+}
+
+func TestGitIgnore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	files := map[string][]byte{
+		"main.tf":          []byte("# main"),
+		".gitignore":       []byte("*.tfvars\nbuild/\n"),
+		"secret.tfvars":    []byte("password=123"),
+		"forced.tfvars":    []byte("region=eu"),
+		"build/lambda.zip": []byte("zip"),
+		"untracked/foo.tf": []byte("# untracked"),
+	}
+
+	testutil.Run(t, "honoured", func(t *testutil.T) {
+		repo := t.NewTempDir().WriteFiles(files)
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"add", "-f", "forced.tfvars"},
+		} {
+			out, err := exec.Command("git", append([]string{"-C", repo.Root()}, args...)...).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+
+		arc, err := NewArchive(repo.Root())
+		require.NoError(t, err)
+		require.NoError(t, arc.Walk())
+
+		meta, err := arc.Pack(new(bytes.Buffer))
+		require.NoError(t, err)
+
+		// Untracked files are archived unless ignored by git, whereas
+		// tracked files are archived regardless
+		assert.Equal(t, []string{
+			".gitignore",
+			"forced.tfvars",
+			"main.tf",
+			"untracked/",
+			"untracked/foo.tf",
+		}, meta.Files)
+	})
+
+	testutil.Run(t, "overridden by terraformignore", func(t *testutil.T) {
+		repo := t.NewTempDir().WriteFiles(files).Write(".terraformignore", []byte("*.tfvars\n"))
+		out, err := exec.Command("git", "-C", repo.Root(), "init", "-q").CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		arc, err := NewArchive(repo.Root())
+		require.NoError(t, err)
+		require.NoError(t, arc.Walk())
+
+		meta, err := arc.Pack(new(bytes.Buffer))
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			".gitignore",
+			".terraformignore",
+			"build/",
+			"build/lambda.zip",
+			"main.tf",
+			"untracked/",
+			"untracked/foo.tf",
+		}, meta.Files)
+	})
+}
+
+func TestGitTrackedOnlyModuleOutsideRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	tmpdir := testutil.NewTempDir(t).WriteFiles(map[string][]byte{
+		"repo/main.tf":    []byte(`module "outside" { source = "../outside" }`),
+		"outside/main.tf": []byte("# outside"),
+	})
+	repo := filepath.Join(tmpdir.Root(), "repo")
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "main.tf"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	arc, err := NewArchive(repo, GitTrackedOnly(true))
+	require.NoError(t, err)
+	require.NoError(t, arc.Walk())
+
+	_, err = arc.Pack(new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrModuleOutsideRepo), err)
+}
+
 func TestMaxSize(t *testing.T) {
 	tmpdir := testutil.NewTempDir(t).Chdir().WriteRandomFile("toobig", MaxConfigSize+1)
 
@@ -157,3 +320,37 @@ func TestUnpack(t *testing.T) {
 		"m1/globals.tf",
 		"m1/main.tf"}, got)
 }
+
+func TestUnpackGlobalHeader(t *testing.T) {
+	// Tarballs produced by git archive begin with a global extended header
+	tarball := newTarball(t,
+		&tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "abc123"}},
+		&tar.Header{Name: "repo-abc123/main.tf", Typeflag: tar.TypeReg, Mode: 0644})
+
+	dst := testutil.NewTempDir(t)
+
+	require.NoError(t, Unpack(tarball, dst.Root()))
+
+	assert.FileExists(t, filepath.Join(dst.Root(), "repo-abc123", "main.tf"))
+}
+
+func TestUnpackIllegalPath(t *testing.T) {
+	tarball := newTarball(t, &tar.Header{Name: "../evil.tf", Typeflag: tar.TypeReg, Mode: 0644})
+
+	dst := testutil.NewTempDir(t)
+
+	assert.Error(t, Unpack(tarball, dst.Root()))
+}
+
+// newTarball creates a compressed tarball of empty files
+func newTarball(t *testing.T, headers ...*tar.Header) io.Reader {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range headers {
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf
+}
@@ -1,14 +1,23 @@
 package archive
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/leg100/etok/pkg/util/git"
 	"k8s.io/klog/v2"
 )
 
-const ignoreFile = ".terraformignore"
+const (
+	ignoreFile = ".terraformignore"
+)
+
+// ErrModuleOutsideRepo is returned when restricting an archive to files tracked
+// by git and a module lies outside of the git repository
+var ErrModuleOutsideRepo = errors.New("module is outside of git repository")
 
 // ruleMatcher checks whether paths match ignore rules
 type ruleMatcher struct {
@@ -16,6 +25,16 @@ type ruleMatcher struct {
 	rules []rule
 	// base directory that rules are relative to
 	base string
+	// whether rules were read from an ignore file rather than defaulted
+	custom bool
+	// ignored is the set of paths ignored by .gitignore. Nil if .gitignore is
+	// not to be honoured.
+	ignored map[string]bool
+	// root of the git repository in which ignored paths reside
+	repo string
+	// tracked is the set of paths in the git index, along with their parent
+	// directories. Nil if paths are not to be restricted to the git index.
+	tracked map[string]bool
 }
 
 // newRuleMatcher creates a new ruleMatcher, setting the rules and the base
@@ -37,10 +56,93 @@ func newRuleMatcher(path string) *ruleMatcher {
 	}
 	defer file.Close()
 	klog.V(1).Infof("found ignore file: %s", file.Name())
-	return &ruleMatcher{rules: readRules(file), base: filepath.Dir(file.Name())}
+	return &ruleMatcher{rules: readRules(file), base: filepath.Dir(file.Name()), custom: true}
+}
+
+// honourGitIgnore configures the matcher to match (ignore) paths that are
+// ignored by the .gitignore files of the git repository containing path, unless
+// the rules were read from a .terraformignore file, in which case that file is
+// the sole arbiter. Nothing further is ignored if path is not within a git
+// repository.
+func (rm *ruleMatcher) honourGitIgnore(path string) {
+	if rm.custom {
+		return
+	}
+
+	root, err := git.GetRepoRoot(path)
+	if err != nil {
+		klog.V(1).Infof("not honouring .gitignore: %s: %s", err.Error(), path)
+		return
+	}
+
+	files, err := git.IgnoredFiles(root)
+	if err != nil {
+		// Punt, as with an unreadable .terraformignore
+		fmt.Fprintf(os.Stderr, "Error reading .gitignore, default exclusions will apply: %v \n", err)
+		return
+	}
+
+	rm.repo = root
+	rm.ignored = make(map[string]bool, len(files))
+	for _, f := range files {
+		rm.ignored[f] = true
+	}
+	klog.V(1).Infof("honouring .gitignore of git repository: %s", root)
+}
+
+// restrictToGitIndex configures the matcher to match (ignore) all paths that
+// are not tracked in the index of the git repository containing path. The
+// index is the sole arbiter: .gitignore patterns are not consulted, so a file
+// that has been forcibly added to the index is not ignored. Every module must
+// lie within the repository.
+func (rm *ruleMatcher) restrictToGitIndex(path string, mods []string) error {
+	root, err := git.GetRepoRoot(path)
+	if err != nil {
+		return err
+	}
+
+	for _, mod := range mods {
+		if rel, err := filepath.Rel(root, mod); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("%w: %s: %s", ErrModuleOutsideRepo, root, mod)
+		}
+	}
+
+	files, err := git.TrackedFiles(root)
+	if err != nil {
+		return err
+	}
+
+	rm.tracked = make(map[string]bool, len(files))
+	for _, f := range files {
+		// Add file and its parent directories, so that directories containing
+		// tracked files are archived too.
+		for p := f; !rm.tracked[p] && p != root; p = filepath.Dir(p) {
+			rm.tracked[p] = true
+		}
+	}
+	klog.V(1).Infof("restricting archive to %d files tracked in git repository: %s", len(files), root)
+
+	return nil
 }
 
 func (rm *ruleMatcher) match(path string, isDir bool) (matched bool, err error) {
+	if rm.tracked != nil {
+		// Ignore paths not in the git index
+		if !rm.tracked[path] {
+			return true, nil
+		}
+	}
+
+	if rm.ignored != nil {
+		// Ignore paths ignored by git, including the contents of ignored
+		// directories
+		for p := path; p != rm.repo && p != filepath.Dir(p); p = filepath.Dir(p) {
+			if rm.ignored[p] {
+				return true, nil
+			}
+		}
+	}
+
 	if isDir {
 		// Catch directories so we don't end up with empty directories
 		return matchIgnoreRule(path+string(os.PathSeparator), rm.rules), nil
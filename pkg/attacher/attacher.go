@@ -20,7 +20,8 @@ type AttachFunc func(io.Writer, rest.Config, string, string, *os.File, string, s
 // Attach appropriates the behaviour of 'kubectl attach', adding a workaround for
 // https://github.com/kubernetes/kubernetes/issues/27264. A 'handshake string' is sent, to inform the
 // runner on the pod that the client has attached and, only then, will the runner invoke the
-// process.
+// process. An empty handshake string skips the handshake, for re-attaching to a process that is
+// already running.
 func Attach(out io.Writer, cfg rest.Config, namespace, name string, in *os.File, handshake, containerName string) error {
 	cfg.ContentConfig = rest.ContentConfig{
 		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
@@ -33,15 +34,18 @@ func Attach(out io.Writer, cfg rest.Config, namespace, name string, in *os.File,
 
 	var oldState *terminal.State
 	go func() {
-		klog.V(1).Info("handshaking")
-		// Blocks until read from stdinR
-		_, err := stdinW.Write([]byte(handshake))
-		if err != nil {
-			panic(err)
+		if handshake != "" {
+			klog.V(1).Info("handshaking")
+			// Blocks until read from stdinR
+			_, err := stdinW.Write([]byte(handshake))
+			if err != nil {
+				panic(err)
+			}
+			// ...and can now proceed
 		}
-		// ...and can now proceed
 
 		// Set stdin in raw mode.
+		var err error
 		oldState, err = terminal.MakeRaw(int(in.Fd()))
 		if err != nil {
 			panic(err)
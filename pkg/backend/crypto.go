@@ -0,0 +1,11 @@
+package backend
+
+import (
+	"crypto/sha256"
+)
+
+// deriveKey derives an AES-256 key from a secret of arbitrary length
+func deriveKey(secret []byte) []byte {
+	key := sha256.Sum256(secret)
+	return key[:]
+}
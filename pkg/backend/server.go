@@ -0,0 +1,213 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/internal/httpserver"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Port on which the operator's state server listens
+	Port = 9080
+
+	// Name of the service fronting the operator's state server
+	ServiceName = "etok-state"
+
+	// CertsSecretName is the name of the secret in which the operator persists
+	// the state server's certificates
+	CertsSecretName = "etok-state-certs"
+
+	// TokenKey is the key in a workspace's token secret containing the
+	// password with which its runs authenticate to the state server
+	TokenKey = "token"
+
+	// Prefix of the path at which state is served
+	pathPrefix = "/state/"
+)
+
+// TokenSecretName returns the name of the secret containing the password with
+// which the workspace's runs authenticate to the state server
+func TokenSecretName(ws string) string {
+	return ws + "-state-token"
+}
+
+// Address returns the address at which the workspace's state is served, given
+// the base URL of the state server
+func Address(url, namespace, workspace string) string {
+	return fmt.Sprintf("%s%s%s/%s", strings.TrimSuffix(url, "/"), pathPrefix, namespace, workspace)
+}
+
+// Server serves terraform's HTTP backend protocol, storing state in a Store.
+// Each workspace's state is served at /state/<namespace>/<workspace>. Clients
+// authenticate using basic auth, with the workspace name as the username and
+// the token in the workspace's token secret as the password.
+//
+// Every replica of the operator serves state. Replicas write state using
+// optimistic concurrency, and a write that loses a race with another replica
+// is reported to terraform as a conflict.
+type Server struct {
+	*Store
+
+	*httpserver.Runnable
+}
+
+type ServerOption func(*Server) error
+
+// WithTLS serves HTTPS using the PEM-encoded certificate and key, ensuring the
+// credentials sent by runs are not sent in the clear
+func WithTLS(cert, key []byte) ServerOption {
+	return func(s *Server) error {
+		return s.Runnable.WithTLS(cert, key)
+	}
+}
+
+func NewServer(addr string, store *Store, opts ...ServerOption) (*Server, error) {
+	s := &Server{Store: store}
+	s.Runnable = &httpserver.Runnable{Name: "State server", Addr: addr, Handler: s}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, pathPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, pathPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var ws v1alpha1.Workspace
+	if err := s.Client.Get(r.Context(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, &ws); err != nil {
+		if kerrors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		s.error(w, err)
+		return
+	}
+
+	if ok, err := s.authenticate(r, &ws); err != nil {
+		s.error(w, err)
+		return
+	} else if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="etok"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := s.Store.Get(r.Context(), &ws)
+		if err != nil {
+			s.error(w, err)
+			return
+		}
+		if state == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(state)
+	case http.MethodPost:
+		state, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Put(r.Context(), &ws, state, r.URL.Query().Get("ID")); err != nil {
+			if errors.Is(err, ErrLocked) {
+				http.Error(w, err.Error(), http.StatusLocked)
+				return
+			}
+			s.error(w, err)
+			return
+		}
+	case "LOCK":
+		var info LockInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		existing, err := s.Lock(r.Context(), &ws, &info)
+		switch {
+		case errors.Is(err, ErrLocked):
+			// Terraform reports the existing lock to the user
+			writeLock(w, http.StatusLocked, existing)
+		case errors.Is(err, ErrInvalidLockID):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			s.error(w, err)
+		}
+	case "UNLOCK":
+		var info LockInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if info.ID == "" {
+			http.Error(w, ErrInvalidLockID.Error(), http.StatusBadRequest)
+			return
+		}
+		existing, err := s.Unlock(r.Context(), &ws, info.ID)
+		switch {
+		case errors.Is(err, ErrLockMismatch):
+			writeLock(w, http.StatusConflict, existing)
+		case err != nil:
+			s.error(w, err)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authenticate checks the request's credentials against the workspace's token
+func (s *Server) authenticate(r *http.Request, ws *v1alpha1.Workspace) (bool, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != ws.Name {
+		return false, nil
+	}
+
+	var secret corev1.Secret
+	if err := s.Client.Get(r.Context(), types.NamespacedName{Namespace: ws.Namespace, Name: TokenSecretName(ws.Name)}, &secret); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	token := secret.Data[TokenKey]
+	if len(token) == 0 {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare(token, []byte(password)) == 1, nil
+}
+
+func (s *Server) error(w http.ResponseWriter, err error) {
+	if kerrors.IsConflict(err) || kerrors.IsAlreadyExists(err) {
+		// Another replica of the operator modified the state concurrently
+		http.Error(w, "state modified concurrently, please retry: "+err.Error(), http.StatusConflict)
+		return
+	}
+	klog.Errorf("state server error: %s", err.Error())
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeLock(w http.ResponseWriter, code int, lock *LockInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(lock)
+}
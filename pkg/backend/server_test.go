@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leg100/etok/pkg/pki"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		assertions func(*testutil.T, *httptest.Server)
+	}{
+		{
+			name: "unknown path",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodGet, "/foo", "foo", "token", nil)
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			},
+		},
+		{
+			name: "unknown workspace",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodGet, "/state/default/bar", "bar", "token", nil)
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			},
+		},
+		{
+			name: "wrong password",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodGet, "/state/default/foo", "foo", "wrong", nil)
+				assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			},
+		},
+		{
+			name: "wrong username",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodGet, "/state/default/foo", "bar", "token", nil)
+				assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			},
+		},
+		{
+			name: "no state",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodGet, "/state/default/foo", "foo", "token", nil)
+				assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+			},
+		},
+		{
+			name: "lock, write, read and unlock",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, "LOCK", "/state/default/foo", "foo", "token", lockBody(t, "abc"))
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				resp = do(t, ts, http.MethodPost, "/state/default/foo?ID=abc", "foo", "token", testState)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				resp = do(t, ts, http.MethodGet, "/state/default/foo", "foo", "token", nil)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Equal(t, testState, body)
+
+				resp = do(t, ts, "UNLOCK", "/state/default/foo", "foo", "token", lockBody(t, "abc"))
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			},
+		},
+		{
+			name: "already locked",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, "LOCK", "/state/default/foo", "foo", "token", lockBody(t, "abc"))
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				resp = do(t, ts, "LOCK", "/state/default/foo", "foo", "token", lockBody(t, "def"))
+				assert.Equal(t, http.StatusLocked, resp.StatusCode)
+
+				var existing LockInfo
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&existing))
+				assert.Equal(t, "abc", existing.ID)
+
+				resp = do(t, ts, http.MethodPost, "/state/default/foo?ID=def", "foo", "token", testState)
+				assert.Equal(t, http.StatusLocked, resp.StatusCode)
+
+				resp = do(t, ts, "UNLOCK", "/state/default/foo", "foo", "token", lockBody(t, "def"))
+				assert.Equal(t, http.StatusConflict, resp.StatusCode)
+			},
+		},
+		{
+			name: "unsupported method",
+			assertions: func(t *testutil.T, ts *httptest.Server) {
+				resp := do(t, ts, http.MethodPut, "/state/default/foo", "foo", "token", nil)
+				assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+				// Deleting state is not supported
+				resp = do(t, ts, http.MethodDelete, "/state/default/foo", "foo", "token", nil)
+				assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+			},
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			client := fake.NewFakeClientWithScheme(scheme.Scheme,
+				testobj.Workspace("default", "foo"),
+				testobj.Secret("default", TokenSecretName("foo"), testobj.WithData(TokenKey, "token")))
+
+			server, err := NewServer("", NewStore(client))
+			require.NoError(t, err)
+			ts := httptest.NewServer(server)
+			t.Cleanup(ts.Close)
+
+			tt.assertions(t, ts)
+		})
+	}
+}
+
+// conflictingClient simulates another replica of the operator updating state
+// concurrently
+type conflictingClient struct {
+	client.Client
+}
+
+func (c *conflictingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return kerrors.NewConflict(schema.GroupResource{Resource: "secrets"}, obj.GetName(), nil)
+}
+
+func TestServerConflict(t *testing.T) {
+	testutil.Run(t, "concurrent lock", func(t *testutil.T) {
+		client := fake.NewFakeClientWithScheme(scheme.Scheme,
+			testobj.Workspace("default", "foo"),
+			testobj.Secret("default", TokenSecretName("foo"), testobj.WithData(TokenKey, "token")))
+
+		server, err := NewServer("", NewStore(&conflictingClient{Client: client}))
+		require.NoError(t, err)
+		ts := httptest.NewServer(server)
+		t.Cleanup(ts.Close)
+
+		resp := do(t, ts, "LOCK", "/state/default/foo", "foo", "token", lockBody(t, "abc"))
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+}
+
+func TestServerTLS(t *testing.T) {
+	testutil.Run(t, "valid certificate", func(t *testutil.T) {
+		certs, err := pki.Generate(ServiceName, "etok")
+		require.NoError(t, err)
+
+		server, err := NewServer("", nil, WithTLS(certs.Cert, certs.Key))
+		require.NoError(t, err)
+		assert.NotNil(t, server.Cert)
+	})
+
+	testutil.Run(t, "invalid certificate", func(t *testutil.T) {
+		_, err := NewServer("", nil, WithTLS([]byte("garbage"), []byte("garbage")))
+		assert.Error(t, err)
+	})
+}
+
+func do(t *testutil.T, ts *httptest.Server, method, path, username, password string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth(username, password)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func lockBody(t *testutil.T, id string) []byte {
+	body, err := json.Marshal(&LockInfo{ID: id, Who: "alice"})
+	require.NoError(t, err)
+	return body
+}
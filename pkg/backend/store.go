@@ -0,0 +1,476 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/internal/aead"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/scheme"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// DefaultVersions is the default number of versions of state to retain
+	DefaultVersions = 10
+
+	// Secrets are limited to 1MiB, so state is split into chunks no larger
+	// than this
+	defaultChunkSize = 512 * 1024
+
+	// Keys in the head secret
+	versionKey = "version"
+	writeKey   = "write"
+	lockKey    = "lock"
+
+	// Key in a chunk secret
+	chunkKey = "chunk"
+
+	// Annotations on the first chunk of a version of state
+	chunksAnnotation    = "etok.dev/state-chunks"
+	encryptedAnnotation = "etok.dev/state-encrypted"
+	serialAnnotation    = "etok.dev/state-serial"
+
+	// Label identifying chunks belonging to a version of state
+	versionLabel = "state-version"
+)
+
+var (
+	ErrLocked        = errors.New("state is locked")
+	ErrLockMismatch  = errors.New("lock ID does not match existing lock")
+	ErrNoKey         = errors.New("state is encrypted but no encryption key has been provided")
+	ErrInvalidLockID = errors.New("lock ID must be provided")
+)
+
+// LockInfo is terraform's record of a state lock, as sent by its HTTP backend
+type LockInfo struct {
+	ID        string
+	Operation string
+	Info      string
+	Who       string
+	Version   string
+	Created   time.Time
+	Path      string
+}
+
+// Store stores versions of workspaces' state in secrets. Each version of state
+// is compressed, optionally encrypted, and split into chunks, one per secret. A
+// head secret records the current version, and any lock held on the state.
+//
+// Chunks are named after the write that created them, so that concurrent
+// writers of the same version never touch one another's chunks. A version is
+// only committed once the head is updated to reference its write, which
+// optimistic concurrency permits only one writer to do.
+type Store struct {
+	client.Client
+
+	// AES-256 encryption key. Nil disables encryption.
+	key []byte
+
+	// Number of versions of state to retain
+	versions int
+
+	chunkSize int
+
+	// Serialize access to state within the operator. Optimistic concurrency
+	// on the head secret guards against other operator replicas.
+	mu sync.Mutex
+}
+
+type StoreOption func(*Store)
+
+// WithEncryptionKey encrypts state with a key derived from the given secret
+func WithEncryptionKey(secret []byte) StoreOption {
+	return func(s *Store) {
+		s.key = deriveKey(secret)
+	}
+}
+
+// WithVersions sets the number of versions of state to retain
+func WithVersions(versions int) StoreOption {
+	return func(s *Store) {
+		s.versions = versions
+	}
+}
+
+func NewStore(c client.Client, opts ...StoreOption) *Store {
+	s := &Store{
+		Client:    c,
+		versions:  DefaultVersions,
+		chunkSize: defaultChunkSize,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// HeadSecretName returns the name of the secret recording the current version
+// of the workspace's state
+func HeadSecretName(ws string) string {
+	return "etok-state-" + ws
+}
+
+// chunkSecretName returns the name of a secret storing a chunk of a version of
+// state. State written before writes were identified lacks a write ID.
+func chunkSecretName(ws string, version int, write string, chunk int) string {
+	if write == "" {
+		return fmt.Sprintf("%s-v%d-%d", HeadSecretName(ws), version, chunk)
+	}
+	return fmt.Sprintf("%s-v%d-%s-%d", HeadSecretName(ws), version, write, chunk)
+}
+
+// Get retrieves the current version of the workspace's state. Nil is returned
+// if there is no state.
+func (s *Store) Get(ctx context.Context, ws *v1alpha1.Workspace) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, err := s.getHead(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+
+	version := currentVersion(head)
+	if version == 0 {
+		return nil, nil
+	}
+
+	return s.getVersion(ctx, ws, version, string(head.Data[writeKey]))
+}
+
+// Put writes a new version of the workspace's state. If the state is locked
+// then the ID of the lock must be provided.
+func (s *Store) Put(ctx context.Context, ws *v1alpha1.Workspace, state []byte, lockID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, err := s.getOrCreateHead(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	lock, err := currentLock(head)
+	if err != nil {
+		return err
+	}
+	if lock != nil && lock.ID != lockID {
+		return fmt.Errorf("%w: held by %s", ErrLocked, lock.Who)
+	}
+
+	version := currentVersion(head) + 1
+	write := rand.String(8)
+
+	chunks, err := s.putVersion(ctx, ws, version, write, state)
+	if err != nil {
+		s.deleteChunks(ctx, chunks)
+		return err
+	}
+
+	head.Data[versionKey] = []byte(strconv.Itoa(version))
+	head.Data[writeKey] = []byte(write)
+	if err := s.Update(ctx, head); err != nil {
+		// Another writer updated the head in the meantime, so this write is
+		// discarded, leaving the other writer's chunks intact
+		s.deleteChunks(ctx, chunks)
+		return err
+	}
+
+	return s.prune(ctx, ws, version)
+}
+
+// Lock locks the workspace's state. If the state is already locked then
+// ErrLocked is returned along with the existing lock.
+func (s *Store) Lock(ctx context.Context, ws *v1alpha1.Workspace, info *LockInfo) (*LockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info.ID == "" {
+		return nil, ErrInvalidLockID
+	}
+
+	head, err := s.getOrCreateHead(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := currentLock(head)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, ErrLocked
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	head.Data[lockKey] = data
+
+	return nil, s.Update(ctx, head)
+}
+
+// Unlock releases the lock on the workspace's state. The ID must match that of
+// the existing lock, otherwise ErrLockMismatch is returned along with the
+// existing lock. An empty ID forcibly releases the lock regardless.
+func (s *Store) Unlock(ctx context.Context, ws *v1alpha1.Workspace, id string) (*LockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, err := s.getHead(ctx, ws)
+	if err != nil || head == nil {
+		return nil, err
+	}
+
+	existing, err := currentLock(head)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	if id != "" && existing.ID != id {
+		return existing, ErrLockMismatch
+	}
+
+	delete(head.Data, lockKey)
+
+	return nil, s.Update(ctx, head)
+}
+
+// GetLock retrieves the lock on the workspace's state, or nil if it is
+// unlocked.
+func (s *Store) GetLock(ctx context.Context, ws *v1alpha1.Workspace) (*LockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, err := s.getHead(ctx, ws)
+	if err != nil || head == nil {
+		return nil, err
+	}
+	return currentLock(head)
+}
+
+func (s *Store) getHead(ctx context.Context, ws *v1alpha1.Workspace) (*corev1.Secret, error) {
+	var head corev1.Secret
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: HeadSecretName(ws.Name)}, &head); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &head, nil
+}
+
+func (s *Store) getOrCreateHead(ctx context.Context, ws *v1alpha1.Workspace) (*corev1.Secret, error) {
+	head, err := s.getHead(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+	if head != nil {
+		if head.Data == nil {
+			head.Data = make(map[string][]byte)
+		}
+		return head, nil
+	}
+
+	head = s.newSecret(ws, HeadSecretName(ws.Name))
+	if err := controllerutil.SetOwnerReference(ws, head, scheme.Scheme); err != nil {
+		return nil, err
+	}
+	if err := s.Create(ctx, head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+func (s *Store) getVersion(ctx context.Context, ws *v1alpha1.Workspace, version int, write string) ([]byte, error) {
+	var first corev1.Secret
+	if err := s.Client.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: chunkSecretName(ws.Name, version, write, 0)}, &first); err != nil {
+		return nil, fmt.Errorf("unable to retrieve version %d of state: %w", version, err)
+	}
+
+	chunks, err := strconv.Atoi(first.Annotations[chunksAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid number of chunks for version %d of state: %w", version, err)
+	}
+
+	data := append([]byte{}, first.Data[chunkKey]...)
+	for i := 1; i < chunks; i++ {
+		var chunk corev1.Secret
+		if err := s.Client.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: chunkSecretName(ws.Name, version, write, i)}, &chunk); err != nil {
+			return nil, fmt.Errorf("unable to retrieve version %d of state: %w", version, err)
+		}
+		data = append(data, chunk.Data[chunkKey]...)
+	}
+
+	if first.Annotations[encryptedAnnotation] == "true" {
+		if s.key == nil {
+			return nil, ErrNoKey
+		}
+		data, err = aead.Decrypt(s.key, data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt version %d of state: %w", version, err)
+		}
+	}
+
+	gr, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gr)
+}
+
+// putVersion writes the chunks of a version of state, returning the chunks
+// that were created, even upon error.
+func (s *Store) putVersion(ctx context.Context, ws *v1alpha1.Workspace, version int, write string, state []byte) ([]*corev1.Secret, error) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(state); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	if s.key != nil {
+		var err error
+		data, err = aead.Encrypt(s.key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var chunks [][]byte
+	for len(data) > s.chunkSize {
+		chunks = append(chunks, data[:s.chunkSize])
+		data = data[s.chunkSize:]
+	}
+	chunks = append(chunks, data)
+
+	var created []*corev1.Secret
+	for i, chunk := range chunks {
+		secret := s.newSecret(ws, chunkSecretName(ws.Name, version, write, i))
+		secret.Data[chunkKey] = chunk
+		labels.SetLabel(secret, labels.NewLabel(versionLabel, strconv.Itoa(version)))
+
+		if i == 0 {
+			secret.Annotations = map[string]string{
+				chunksAnnotation:    strconv.Itoa(len(chunks)),
+				encryptedAnnotation: strconv.FormatBool(s.key != nil),
+				serialAnnotation:    strconv.Itoa(serial(state)),
+			}
+		}
+
+		if err := controllerutil.SetOwnerReference(ws, secret, scheme.Scheme); err != nil {
+			return created, err
+		}
+
+		// Never overwrite an existing chunk: it belongs to another write
+		if err := s.Create(ctx, secret); err != nil {
+			return created, err
+		}
+		created = append(created, secret)
+	}
+	return created, nil
+}
+
+// deleteChunks deletes the chunks of a discarded write. Failure to do so is
+// harmless: the chunks are pruned along with their version.
+func (s *Store) deleteChunks(ctx context.Context, chunks []*corev1.Secret) {
+	for _, chunk := range chunks {
+		_ = s.Client.Delete(ctx, chunk)
+	}
+}
+
+// prune deletes versions of state older than those to be retained
+func (s *Store) prune(ctx context.Context, ws *v1alpha1.Workspace, current int) error {
+	return s.deleteVersions(ctx, ws, current-s.versions)
+}
+
+// deleteVersions deletes versions of state up to and including the given
+// version
+func (s *Store) deleteVersions(ctx context.Context, ws *v1alpha1.Workspace, upTo int) error {
+	var secrets corev1.SecretList
+	if err := s.List(ctx, &secrets, client.InNamespace(ws.Namespace), client.MatchingLabels(labels.MakeLabels(labels.StateComponent, labels.Workspace(ws.Name)))); err != nil {
+		return err
+	}
+
+	for _, secret := range secrets.Items {
+		version, err := strconv.Atoi(secret.Labels[versionLabel])
+		if err != nil {
+			// Head secret
+			continue
+		}
+		if version > upTo {
+			continue
+		}
+		if err := s.Client.Delete(ctx, &secret); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) newSecret(ws *v1alpha1.Workspace, name string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ws.Namespace,
+		},
+		Data: make(map[string][]byte),
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(secret)
+	// Permit filtering secrets by workspace
+	labels.SetLabel(secret, labels.Workspace(ws.Name))
+	// Permit filtering etok resources by component
+	labels.SetLabel(secret, labels.StateComponent)
+
+	return secret
+}
+
+func currentVersion(head *corev1.Secret) int {
+	if head == nil {
+		return 0
+	}
+	version, _ := strconv.Atoi(string(head.Data[versionKey]))
+	return version
+}
+
+func currentLock(head *corev1.Secret) (*LockInfo, error) {
+	data, ok := head.Data[lockKey]
+	if !ok {
+		return nil, nil
+	}
+	var lock LockInfo
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal state lock: %w", err)
+	}
+	return &lock, nil
+}
+
+// serial parses the serial number from a state file, returning zero if it
+// cannot be parsed
+func serial(state []byte) int {
+	var s struct {
+		Serial int `json:"serial"`
+	}
+	_ = json.Unmarshal(state, &s)
+	return s.Serial
+}
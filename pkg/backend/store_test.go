@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testState = []byte(`{"version":4,"serial":3,"lineage":"abc","outputs":{}}`)
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []StoreOption
+		chunkSize  int
+		assertions func(*testutil.T, *Store)
+	}{
+		{
+			name: "no state",
+			assertions: func(t *testutil.T, s *Store) {
+				state, err := s.Get(context.Background(), testobj.Workspace("default", "foo"))
+				require.NoError(t, err)
+				assert.Nil(t, state)
+			},
+		},
+		{
+			name: "put and get",
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+				require.NoError(t, s.Put(context.Background(), ws, testState, ""))
+
+				state, err := s.Get(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, testState, state)
+
+				first := firstChunk(t, s, ws)
+				assert.Equal(t, "3", first.Annotations[serialAnnotation])
+				assert.Equal(t, "false", first.Annotations[encryptedAnnotation])
+			},
+		},
+		{
+			name:      "chunked state",
+			chunkSize: 8,
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+				require.NoError(t, s.Put(context.Background(), ws, testState, ""))
+
+				state, err := s.Get(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, testState, state)
+
+				first := firstChunk(t, s, ws)
+				assert.NotEqual(t, "1", first.Annotations[chunksAnnotation])
+			},
+		},
+		{
+			name: "encrypted state",
+			opts: []StoreOption{WithEncryptionKey([]byte("secret"))},
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+				require.NoError(t, s.Put(context.Background(), ws, testState, ""))
+
+				state, err := s.Get(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, testState, state)
+
+				first := firstChunk(t, s, ws)
+				assert.Equal(t, "true", first.Annotations[encryptedAnnotation])
+
+				// Without the key the state cannot be read
+				_, err = NewStore(s.Client).Get(context.Background(), ws)
+				assert.True(t, errors.Is(err, ErrNoKey))
+
+				// With the wrong key the state cannot be decrypted
+				_, err = NewStore(s.Client, WithEncryptionKey([]byte("wrong"))).Get(context.Background(), ws)
+				assert.Error(t, err)
+			},
+		},
+		{
+			name: "prune old versions",
+			opts: []StoreOption{WithVersions(2)},
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+				for i := 0; i < 4; i++ {
+					require.NoError(t, s.Put(context.Background(), ws, testState, ""))
+				}
+
+				var secrets corev1.SecretList
+				require.NoError(t, s.List(context.Background(), &secrets))
+				var versions []string
+				for _, s := range secrets.Items {
+					versions = append(versions, s.Labels[versionLabel])
+				}
+				// Head has no version label
+				assert.ElementsMatch(t, []string{"", "3", "4"}, versions)
+			},
+		},
+		{
+			name: "concurrent write",
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+				require.NoError(t, s.Put(context.Background(), ws, testState, ""))
+
+				// Another replica writes the same version first
+				other := []byte(`{"version":4,"serial":4,"lineage":"abc","outputs":{}}`)
+				racing := NewStore(&racingClient{Client: s.Client, store: s, ws: ws, state: other})
+				err := racing.Put(context.Background(), ws, testState, "")
+				assert.True(t, kerrors.IsConflict(err), err)
+
+				// The other replica's state is intact
+				state, err := s.Get(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, other, state)
+
+				// The discarded write's chunks are removed
+				var secrets corev1.SecretList
+				require.NoError(t, s.List(context.Background(), &secrets))
+				assert.Equal(t, 3, len(secrets.Items))
+			},
+		},
+		{
+			name: "lock and unlock",
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+
+				_, err := s.Lock(context.Background(), ws, &LockInfo{ID: "abc", Who: "alice"})
+				require.NoError(t, err)
+
+				lock, err := s.GetLock(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Equal(t, "alice", lock.Who)
+
+				existing, err := s.Lock(context.Background(), ws, &LockInfo{ID: "def", Who: "bob"})
+				assert.True(t, errors.Is(err, ErrLocked))
+				assert.Equal(t, "abc", existing.ID)
+
+				// Writes require the lock ID
+				assert.True(t, errors.Is(s.Put(context.Background(), ws, testState, "def"), ErrLocked))
+				assert.NoError(t, s.Put(context.Background(), ws, testState, "abc"))
+
+				existing, err = s.Unlock(context.Background(), ws, "def")
+				assert.True(t, errors.Is(err, ErrLockMismatch))
+				assert.Equal(t, "abc", existing.ID)
+
+				_, err = s.Unlock(context.Background(), ws, "abc")
+				require.NoError(t, err)
+
+				lock, err = s.GetLock(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Nil(t, lock)
+			},
+		},
+		{
+			name: "force unlock",
+			assertions: func(t *testutil.T, s *Store) {
+				ws := testobj.Workspace("default", "foo")
+
+				_, err := s.Lock(context.Background(), ws, &LockInfo{ID: "abc"})
+				require.NoError(t, err)
+
+				_, err = s.Unlock(context.Background(), ws, "")
+				require.NoError(t, err)
+
+				lock, err := s.GetLock(context.Background(), ws)
+				require.NoError(t, err)
+				assert.Nil(t, lock)
+			},
+		},
+		{
+			name: "lock without ID",
+			assertions: func(t *testutil.T, s *Store) {
+				_, err := s.Lock(context.Background(), testobj.Workspace("default", "foo"), &LockInfo{})
+				assert.True(t, errors.Is(err, ErrInvalidLockID))
+			},
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			s := NewStore(fake.NewFakeClientWithScheme(scheme.Scheme, testobj.Workspace("default", "foo")), tt.opts...)
+			if tt.chunkSize > 0 {
+				s.chunkSize = tt.chunkSize
+			}
+			tt.assertions(t, s)
+		})
+	}
+}
+
+// firstChunk retrieves the first chunk of the current version of state
+func firstChunk(t *testutil.T, s *Store, ws *v1alpha1.Workspace) *corev1.Secret {
+	head, err := s.getHead(context.Background(), ws)
+	require.NoError(t, err)
+
+	var first corev1.Secret
+	name := chunkSecretName(ws.Name, currentVersion(head), string(head.Data[writeKey]), 0)
+	require.NoError(t, s.Client.Get(context.Background(), client.ObjectKey{Namespace: ws.Namespace, Name: name}, &first))
+	return &first
+}
+
+// racingClient simulates another replica writing state in between the writing
+// of chunks and the updating of the head
+type racingClient struct {
+	client.Client
+	store *Store
+	ws    *v1alpha1.Workspace
+	state []byte
+	raced bool
+}
+
+func (c *racingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if !c.raced {
+		c.raced = true
+		if err := c.store.Put(ctx, c.ws, c.state, ""); err != nil {
+			return err
+		}
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
@@ -0,0 +1,233 @@
+// Package bundle reads and writes portable bundles of a workspace: its
+// resource, its state, and optionally the values of its sensitive variables,
+// encrypted with a passphrase.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/internal/aead"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Version of the bundle format
+	Version = 1
+
+	manifestFile  = "manifest.json"
+	workspaceFile = "workspace.yaml"
+	stateFile     = "terraform.tfstate"
+	secretsFile   = "secrets.enc"
+)
+
+// Maximum size of a file within a bundle, guarding against a malicious bundle
+// exhausting memory
+var maxFileSize int64 = 256 << 20
+
+var (
+	ErrInvalidBundle       = errors.New("invalid bundle")
+	ErrPassphraseRequired  = errors.New("bundle contains encrypted secrets: a passphrase is required")
+	ErrIncorrectPassphrase = errors.New("unable to decrypt secrets: incorrect passphrase")
+)
+
+// Manifest describes the contents of a bundle
+type Manifest struct {
+	// Version of the bundle format
+	Version int `json:"version"`
+
+	// When the bundle was created
+	Created time.Time `json:"created"`
+
+	// Serial number and lineage of the bundled state. Nil serial means the
+	// bundle contains no state.
+	Serial  *int   `json:"serial,omitempty"`
+	Lineage string `json:"lineage,omitempty"`
+
+	// Salt with which the passphrase is derived into an encryption key. Only
+	// set if the bundle contains secrets.
+	Salt []byte `json:"salt,omitempty"`
+}
+
+// Bundle is a portable copy of a workspace
+type Bundle struct {
+	Manifest
+
+	// Workspace resource, stripped of server-populated fields
+	Workspace *v1alpha1.Workspace
+
+	// Uncompressed terraform state file. Nil means there is no state.
+	State []byte
+
+	// Data of secrets referenced by the workspace's variables, keyed by secret
+	// name. Encrypted within the bundle.
+	Secrets map[string]map[string][]byte
+}
+
+// Write writes the bundle as a gzipped tarball. The passphrase is required if
+// the bundle contains secrets.
+func Write(w io.Writer, b *Bundle, passphrase []byte) error {
+	b.Version = Version
+	if b.Created.IsZero() {
+		b.Created = time.Now().UTC()
+	}
+
+	files := make(map[string][]byte)
+
+	wsData, err := yaml.Marshal(b.Workspace)
+	if err != nil {
+		return err
+	}
+	files[workspaceFile] = wsData
+
+	if b.State != nil {
+		files[stateFile] = b.State
+	}
+
+	if len(b.Secrets) > 0 {
+		if len(passphrase) == 0 {
+			return ErrPassphraseRequired
+		}
+		plaintext, err := json.Marshal(b.Secrets)
+		if err != nil {
+			return err
+		}
+		b.Salt, err = newSalt()
+		if err != nil {
+			return err
+		}
+		key, err := deriveKey(passphrase, b.Salt)
+		if err != nil {
+			return err
+		}
+		files[secretsFile], err = aead.Encrypt(key, plaintext)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	// Write manifest first, followed by the other files in a fixed order
+	if err := writeFile(tw, manifestFile, manifest, b.Created); err != nil {
+		return err
+	}
+	for _, name := range []string{workspaceFile, stateFile, secretsFile} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := writeFile(tw, name, data, b.Created); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Read reads a bundle written by Write. The passphrase is required if the
+// bundle contains secrets.
+func Read(r io.Reader, passphrase []byte) (*Bundle, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, maxFileSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+		}
+		if int64(len(data)) > maxFileSize {
+			return nil, fmt.Errorf("%w: %s exceeds maximum size of %d bytes", ErrInvalidBundle, hdr.Name, maxFileSize)
+		}
+		files[hdr.Name] = data
+	}
+
+	var b Bundle
+
+	manifest, ok := files[manifestFile]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidBundle, manifestFile)
+	}
+	if err := json.Unmarshal(manifest, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+	}
+	if b.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, b.Version)
+	}
+
+	wsData, ok := files[workspaceFile]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidBundle, workspaceFile)
+	}
+	b.Workspace = &v1alpha1.Workspace{}
+	if err := yaml.Unmarshal(wsData, b.Workspace); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+	}
+
+	if state, ok := files[stateFile]; ok {
+		b.State = state
+	}
+	if (b.State == nil) != (b.Serial == nil) {
+		return nil, fmt.Errorf("%w: manifest does not match state", ErrInvalidBundle)
+	}
+
+	if ciphertext, ok := files[secretsFile]; ok {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		key, err := deriveKey(passphrase, b.Salt)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := aead.Decrypt(key, ciphertext)
+		if err != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+		if err := json.Unmarshal(plaintext, &b.Secrets); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err.Error())
+		}
+	}
+
+	return &b, nil
+}
@@ -0,0 +1,131 @@
+package bundle
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundle(t *testing.T) {
+	serial := 3
+
+	tests := []struct {
+		name           string
+		bundle         *Bundle
+		passphrase     string
+		readPassphrase string
+		writeErr       error
+		readErr        error
+		assertions     func(*testutil.T, *Bundle)
+	}{
+		{
+			name:   "workspace only",
+			bundle: &Bundle{Workspace: testobj.Workspace("default", "networking")},
+			assertions: func(t *testutil.T, b *Bundle) {
+				assert.Equal(t, "networking", b.Workspace.Name)
+				assert.Nil(t, b.State)
+				assert.Nil(t, b.Serial)
+			},
+		},
+		{
+			name: "with state",
+			bundle: &Bundle{
+				Manifest:  Manifest{Serial: &serial, Lineage: "abc"},
+				Workspace: testobj.Workspace("default", "networking"),
+				State:     []byte(`{"version":4,"serial":3,"lineage":"abc"}`),
+			},
+			assertions: func(t *testutil.T, b *Bundle) {
+				assert.Equal(t, `{"version":4,"serial":3,"lineage":"abc"}`, string(b.State))
+				assert.Equal(t, 3, *b.Serial)
+				assert.Equal(t, "abc", b.Lineage)
+			},
+		},
+		{
+			name: "with secrets",
+			bundle: &Bundle{
+				Workspace: testobj.Workspace("default", "networking"),
+				Secrets:   map[string]map[string][]byte{"creds": {"password": []byte("secret")}},
+			},
+			passphrase:     "opensesame",
+			readPassphrase: "opensesame",
+			assertions: func(t *testutil.T, b *Bundle) {
+				assert.Equal(t, "secret", string(b.Secrets["creds"]["password"]))
+			},
+		},
+		{
+			name: "secrets without passphrase",
+			bundle: &Bundle{
+				Workspace: testobj.Workspace("default", "networking"),
+				Secrets:   map[string]map[string][]byte{"creds": {"password": []byte("secret")}},
+			},
+			writeErr: ErrPassphraseRequired,
+		},
+		{
+			name: "read secrets without passphrase",
+			bundle: &Bundle{
+				Workspace: testobj.Workspace("default", "networking"),
+				Secrets:   map[string]map[string][]byte{"creds": {"password": []byte("secret")}},
+			},
+			passphrase: "opensesame",
+			readErr:    ErrPassphraseRequired,
+		},
+		{
+			name: "read secrets with incorrect passphrase",
+			bundle: &Bundle{
+				Workspace: testobj.Workspace("default", "networking"),
+				Secrets:   map[string]map[string][]byte{"creds": {"password": []byte("secret")}},
+			},
+			passphrase:     "opensesame",
+			readPassphrase: "letmein",
+			readErr:        ErrIncorrectPassphrase,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			buf := new(bytes.Buffer)
+
+			err := Write(buf, tt.bundle, []byte(tt.passphrase))
+			if !assert.True(t, errors.Is(err, tt.writeErr)) || err != nil {
+				return
+			}
+
+			b, err := Read(buf, []byte(tt.readPassphrase))
+			if !assert.True(t, errors.Is(err, tt.readErr)) || err != nil {
+				return
+			}
+			require.NotNil(t, b.Workspace)
+			assert.Equal(t, Version, b.Version)
+
+			if tt.assertions != nil {
+				tt.assertions(t, b)
+			}
+		})
+	}
+}
+
+func TestReadInvalidBundle(t *testing.T) {
+	_, err := Read(bytes.NewBufferString("not a bundle"), nil)
+	assert.True(t, errors.Is(err, ErrInvalidBundle))
+}
+
+func TestReadOversizedBundle(t *testing.T) {
+	defer func(size int64) { maxFileSize = size }(maxFileSize)
+	maxFileSize = 16
+
+	serial := 3
+	buf := new(bytes.Buffer)
+	require.NoError(t, Write(buf, &Bundle{
+		Manifest:  Manifest{Serial: &serial, Lineage: "abc"},
+		Workspace: testobj.Workspace("default", "networking"),
+		State:     []byte(`{"version":4,"serial":3,"lineage":"abc"}`),
+	}, nil))
+
+	_, err := Read(buf, nil)
+	assert.True(t, errors.Is(err, ErrInvalidBundle))
+}
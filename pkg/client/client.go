@@ -14,6 +14,10 @@ type Client struct {
 	// Client config
 	Config *rest.Config
 
+	// Name of the kubeconfig context with which the client was configured.
+	// Empty if configured otherwise, e.g. in-cluster.
+	Context string
+
 	// Kubernetes built-in client
 	KubeClient kubernetes.Interface
 
@@ -5,6 +5,7 @@ import (
 
 	"github.com/leg100/etok/pkg/k8s/etokclient"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
@@ -38,7 +39,21 @@ func (cc *clientCreator) Create(kubeCtx string) (*Client, error) {
 
 	return &Client{
 		Config:     cfg,
+		Context:    contextName(kubeCtx),
 		EtokClient: sc,
 		KubeClient: kc,
 	}, nil
 }
+
+// contextName returns the name of the kubeconfig context, resolving the
+// current context if none is specified
+func contextName(kubeCtx string) string {
+	if kubeCtx != "" {
+		return kubeCtx
+	}
+	raw, err := clientcmd.NewDefaultClientConfigLoadingRules().Load()
+	if err != nil {
+		return ""
+	}
+	return raw.CurrentContext
+}
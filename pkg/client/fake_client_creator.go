@@ -32,18 +32,21 @@ func (f *FakeClientCreator) Create(kubeCtx string) (*Client, error) {
 	}
 
 	EtokClient := sfake.NewSimpleClientset(etokObjs...)
+	KubeClient := kfake.NewSimpleClientset(kubeObjs...)
 	for _, r := range f.reactors {
 		EtokClient.PrependReactor(r.Verb, r.Resource, r.Reaction)
+		KubeClient.PrependReactor(r.Verb, r.Resource, r.Reaction)
 	}
 
 	return &Client{
 		Config:     &rest.Config{},
+		Context:    kubeCtx,
 		EtokClient: EtokClient,
-		KubeClient: kfake.NewSimpleClientset(kubeObjs...),
+		KubeClient: KubeClient,
 	}, nil
 }
 
 // Add a reactor to the list of reactors to be prepended.
 func (f *FakeClientCreator) PrependReactor(verb, resource string, reaction testing.ReactionFunc) {
-	f.reactors = append(f.reactors, testing.SimpleReactor{verb, resource, reaction})
+	f.reactors = append(f.reactors, testing.SimpleReactor{Verb: verb, Resource: resource, Reaction: reaction})
 }
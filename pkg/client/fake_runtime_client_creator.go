@@ -0,0 +1,26 @@
+package client
+
+import (
+	"github.com/leg100/etok/pkg/scheme"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Implements RuntimeClientCreator
+type FakeRuntimeClientCreator struct {
+	// Fake objs
+	objs []runtime.Object
+}
+
+func NewFakeRuntimeClientCreator(objs ...runtime.Object) RuntimeClientCreator {
+	return &FakeRuntimeClientCreator{objs: objs}
+}
+
+func (f *FakeRuntimeClientCreator) CreateRuntimeClient(kubeCtx string) (*Client, error) {
+	return &Client{
+		Config:        &rest.Config{},
+		Context:       kubeCtx,
+		RuntimeClient: fake.NewFakeClientWithScheme(scheme.Scheme, f.objs...),
+	}, nil
+}
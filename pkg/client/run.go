@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+var ErrRunDone = errors.New("run has already completed")
+
+// CancelRun requests cancellation of a run. The first request interrupts the
+// run's command, and any subsequent request kills it. If force is true then
+// the command is killed straight away. The mode of cancellation requested is
+// returned.
+func (c *Client) CancelRun(ctx context.Context, namespace, name string, force bool) (mode v1alpha1.RunCancelMode, err error) {
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		run, err := c.RunsClient(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if run.IsDone() {
+			return fmt.Errorf("%w: %s/%s", ErrRunDone, namespace, name)
+		}
+
+		if force || run.IsCancelled() {
+			mode = v1alpha1.RunCancelKill
+		} else {
+			mode = v1alpha1.RunCancelInterrupt
+		}
+		if run.Cancel == mode {
+			// Already requested
+			return nil
+		}
+
+		// Patch rather than update, permitting users to cancel runs without
+		// being permitted to update them. The resource version guards
+		// against a concurrent cancellation.
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": run.ResourceVersion},
+			"spec":     map[string]interface{}{"cancel": mode},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = c.RunsClient(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	return mode, err
+}
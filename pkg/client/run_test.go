@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCancelRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		run   *v1alpha1.Run
+		force bool
+		want  v1alpha1.RunCancelMode
+		err   error
+	}{
+		{
+			name: "interrupt",
+			run:  testobj.Run("default", "run-12345", "apply"),
+			want: v1alpha1.RunCancelInterrupt,
+		},
+		{
+			name: "kill upon second request",
+			run:  testobj.Run("default", "run-12345", "apply", testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			want: v1alpha1.RunCancelKill,
+		},
+		{
+			name:  "force",
+			run:   testobj.Run("default", "run-12345", "apply"),
+			force: true,
+			want:  v1alpha1.RunCancelKill,
+		},
+		{
+			name: "already completed",
+			run:  testobj.Run("default", "run-12345", "apply", testobj.WithCondition(v1alpha1.RunCompleteCondition)),
+			err:  ErrRunDone,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			c, err := NewFakeClientCreator(tt.run).Create("")
+			require.NoError(t, err)
+
+			mode, err := c.CancelRun(context.Background(), "default", "run-12345", tt.force)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mode)
+
+			run, err := c.RunsClient("default").Get(context.Background(), "run-12345", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, run.Cancel)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -32,6 +33,26 @@ func workspaceUnknown(message string) *metav1.Condition {
 	}
 }
 
+// setWorkspaceCondition sets a condition other than the ready condition.
+func setWorkspaceCondition(ws *v1alpha1.Workspace, condType string, status metav1.ConditionStatus, reason, message string) {
+	setObservedCondition(ws, metav1.Condition{
+		Type:    condType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// setObservedCondition sets a condition on the workspace status, recording the
+// generation of the spec upon which it is based.
+func setObservedCondition(ws *v1alpha1.Workspace, condition metav1.Condition) {
+	meta.SetStatusCondition(&ws.Status.Conditions, condition)
+
+	// SetStatusCondition doesn't update the generation of an existing
+	// condition
+	meta.FindStatusCondition(ws.Status.Conditions, condition.Type).ObservedGeneration = ws.Generation
+}
+
 func runFailed(reason, message string) *metav1.Condition {
 	return &metav1.Condition{
 		Type:    v1alpha1.RunFailedCondition,
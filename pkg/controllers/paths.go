@@ -11,11 +11,35 @@ const (
 	// pluginSubPath is path within persistent volume to mount on
 	// pluginMountPath
 	pluginSubPath = "plugin-cache/"
+	// pluginCacheLockPath is container path to the lock file with which runs
+	// serialise provider installs into the shared plugin cache
+	pluginCacheLockPath = pluginMountPath + "/.etok.lock"
+
+	// cliConfigMountPath is container path to terraform's CLI config file
+	cliConfigMountPath = "/etc/etok/terraformrc"
+	// cliConfigPath is the key in the builtins config map containing
+	// terraform's CLI config
+	cliConfigPath = "terraformrc"
+
+	// stateCAMountPath is the container directory containing the CA
+	// certificate of the operator's state server
+	stateCAMountPath = "/etc/etok/state-ca"
+	// stateCAPath is the key in the builtins config map containing the CA
+	// certificate of the operator's state server
+	stateCAPath = "state-ca.crt"
+
+	// credentialsMountPath is the container path beneath which credential
+	// secrets are mounted by default
+	credentialsMountPath = "/credentials"
 
 	// dotTerraformSubPath is path within persistent volume to mount on
 	// <WorkingDir>/.terraform
 	dotTerraformSubPath = ".terraform/"
 
+	// dotTerraformSourceMountPath is container path on which dotTerraformSubPath
+	// is mounted read-only for runs that take their own copy of .terraform
+	dotTerraformSourceMountPath = "/dot-terraform"
+
 	// workspaceDir is the directory in the container where the tarball is
 	// extracted to
 	workspaceDir = "/workspace"
@@ -3,10 +3,11 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
-	"github.com/leg100/etok/cmd/launcher"
+	"github.com/leg100/etok/cmd/installer"
 	"github.com/leg100/etok/pkg/globals"
 	"github.com/leg100/etok/pkg/k8s"
 	"github.com/leg100/etok/pkg/scheme"
@@ -33,9 +34,9 @@ var (
 	runEnqueueTimeout = 10 * time.Second
 	// runQueueTimeout is the maximum time a run can remain waiting in the queue
 	runQueueTimeout = 60 * time.Minute
-	// runPodPendingTimeout is the maximum time a pod can remain in the pending
-	// phase
-	runPodPendingTimeout = 60 * time.Second
+	// runPodPendingTimeout is the maximum time a run's pod can remain pending,
+	// unless overridden by the run's retry policy
+	runPodPendingTimeout = 10 * time.Minute
 )
 
 type runUpdater func(context.Context, *v1alpha1.Run, v1alpha1.Workspace) (*metav1.Condition, error)
@@ -44,18 +45,35 @@ type RunReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 	Image  string
+	// URL of mirror from which terraform is downloaded by runs of workspaces
+	// with an ephemeral cache, unless overridden by the workspace
+	TerraformMirror string
 }
 
-func NewRunReconciler(c client.Client, image string) *RunReconciler {
+type RunReconcilerOption func(r *RunReconciler)
+
+func WithRunTerraformMirror(mirror string) RunReconcilerOption {
+	return func(r *RunReconciler) {
+		r.TerraformMirror = mirror
+	}
+}
+
+func NewRunReconciler(c client.Client, image string, opts ...RunReconcilerOption) *RunReconciler {
 	r := &RunReconciler{
-		Client: c,
-		Scheme: scheme.Scheme,
-		Image:  image,
+		Client:          c,
+		Scheme:          scheme.Scheme,
+		Image:           image,
+		TerraformMirror: installer.DefaultMirror,
+	}
+
+	for _, o := range opts {
+		o(r)
 	}
 
 	// Build chain of status updaters, to be called one after the other in a
 	// reconcile
 	runReconcileStatusChain = []runUpdater{}
+	runReconcileStatusChain = append(runReconcileStatusChain, r.manageCancel)
 	runReconcileStatusChain = append(runReconcileStatusChain, r.manageQueue)
 	runReconcileStatusChain = append(runReconcileStatusChain, r.managePod)
 
@@ -125,14 +143,30 @@ func (r *RunReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 
 	if condition != nil {
 		// Add condition to status
-		meta.SetStatusCondition(&run.RunStatus.Conditions, *condition)
+		setRunCondition(&run, *condition)
 
 		// Summarise conditions to single phase
 		run.Phase = setRunPhase(*condition)
 
+		// A cancelled run is deemed cancelled once it is done, regardless
+		// of how it finished
+		if run.IsCancelled() && run.IsDone() {
+			run.Phase = v1alpha1.RunPhaseCancelled
+		}
+
 		if err := r.updateStatus(ctx, req, run.RunStatus); err != nil {
 			return ctrl.Result{}, err
 		}
+
+		// Check again once the run may have timed out
+		switch condition.Reason {
+		case v1alpha1.RunUnqueuedReason:
+			return ctrl.Result{RequeueAfter: runEnqueueTimeout}, nil
+		case v1alpha1.RunQueuedReason:
+			return ctrl.Result{RequeueAfter: runQueueTimeout}, nil
+		case v1alpha1.PodPendingReason:
+			return ctrl.Result{RequeueAfter: pendingTimeout(&run)}, nil
+		}
 	}
 
 	return ctrl.Result{}, nil
@@ -172,21 +206,19 @@ func processRunReconcileStatusChain(ctx context.Context, run *v1alpha1.Run, ws v
 			if condition.Status == metav1.ConditionFalse {
 				switch condition.Reason {
 				case v1alpha1.RunUnqueuedReason:
-					if condition.LastTransitionTime.Add(runEnqueueTimeout).After(time.Now()) {
+					// A privileged run awaiting approval is not enqueued
+					// until it is approved
+					if !awaitingApproval(run, &ws) && time.Since(reasonSince(run, condition)) > runEnqueueTimeout {
 						return runFailed(v1alpha1.RunEnqueueTimeoutReason, "Timed out waiting to be enqueued"), nil
 					}
 					// Do not proceed to creating pod
 					return condition, nil
 				case v1alpha1.RunQueuedReason:
-					if condition.LastTransitionTime.Add(runQueueTimeout).After(time.Now()) {
+					if time.Since(reasonSince(run, condition)) > runQueueTimeout {
 						return runFailed(v1alpha1.QueueTimeoutReason, "Timed out waiting in the queue"), nil
 					}
 					// Do not proceed to creating pod
 					return condition, nil
-				case v1alpha1.PodPendingReason:
-					if condition.LastTransitionTime.Add(runPodPendingTimeout).After(time.Now()) {
-						return runFailed(v1alpha1.RunPendingTimeoutReason, "Timed out waiting for pod in pending phase"), nil
-					}
 				}
 			}
 		}
@@ -195,6 +227,33 @@ func processRunReconcileStatusChain(ctx context.Context, run *v1alpha1.Run, ws v
 	return condition, nil
 }
 
+// reasonSince returns the time since which the run's condition has had the
+// reason of the given condition, or now if it has yet to have the reason
+func reasonSince(run *v1alpha1.Run, condition *metav1.Condition) time.Time {
+	existing := meta.FindStatusCondition(run.Conditions, condition.Type)
+	if existing == nil || existing.Status != condition.Status || existing.Reason != condition.Reason {
+		return time.Now()
+	}
+	return existing.LastTransitionTime.Time
+}
+
+// setRunCondition sets the condition on the run. Unlike
+// meta.SetStatusCondition, the transition time is updated upon a change of
+// reason as well as status, so that the time a run has spent in its current
+// state can be determined.
+func setRunCondition(run *v1alpha1.Run, condition metav1.Condition) {
+	if existing := meta.FindStatusCondition(run.Conditions, condition.Type); existing != nil && existing.Reason != condition.Reason {
+		meta.RemoveStatusCondition(&run.Conditions, condition.Type)
+	}
+	meta.SetStatusCondition(&run.Conditions, condition)
+}
+
+// awaitingApproval determines whether the run has a privileged command that is
+// yet to be approved
+func awaitingApproval(run *v1alpha1.Run, ws *v1alpha1.Workspace) bool {
+	return slice.ContainsString(ws.Spec.PrivilegedCommands, run.Command) && !ws.IsRunApproved(run)
+}
+
 // setRunPhase maps the Run's conditions to a single phase
 func setRunPhase(condition metav1.Condition) v1alpha1.RunPhase {
 	if condition.Type == v1alpha1.RunFailedCondition && condition.Status == metav1.ConditionTrue {
@@ -211,7 +270,7 @@ func setRunPhase(condition metav1.Condition) v1alpha1.RunPhase {
 				return v1alpha1.RunPhaseWaiting
 			case v1alpha1.RunQueuedReason:
 				return v1alpha1.RunPhaseQueued
-			case v1alpha1.PodCreatedReason, v1alpha1.PodPendingReason:
+			case v1alpha1.PodCreatedReason, v1alpha1.PodPendingReason, v1alpha1.PodRetryingReason:
 				return v1alpha1.RunPhaseProvisioning
 			case v1alpha1.PodRunningReason:
 				return v1alpha1.RunPhaseRunning
@@ -222,12 +281,29 @@ func setRunPhase(condition metav1.Condition) v1alpha1.RunPhase {
 	return v1alpha1.RunPhaseUnknown
 }
 
+// Cancel a run that has been requested to be cancelled, but only if its pod is
+// yet to be created. Otherwise the runner on the pod is responsible for
+// signalling the command, and the run completes as normal.
+func (r *RunReconciler) manageCancel(ctx context.Context, run *v1alpha1.Run, ws v1alpha1.Workspace) (*metav1.Condition, error) {
+	if !run.IsCancelled() {
+		return nil, nil
+	}
+
+	err := r.Get(ctx, requestFromObject(run).NamespacedName, &corev1.Pod{})
+	if kerrors.IsNotFound(err) {
+		return runFailed(v1alpha1.RunCancelledReason, "Run cancelled before its pod was created"), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
 func (r *RunReconciler) manageQueue(ctx context.Context, run *v1alpha1.Run, ws v1alpha1.Workspace) (*metav1.Condition, error) {
-	if !launcher.IsQueueable(run.Command) {
+	if !isQueueable(&ws, run.Command) {
 		return nil, nil
 	}
 
-	if ws.Status.Active == run.Name {
+	if slice.ContainsString(ws.ActiveRuns(), run.Name) {
 		return nil, nil
 	}
 
@@ -242,28 +318,48 @@ func (r *RunReconciler) manageQueue(ctx context.Context, run *v1alpha1.Run, ws v
 func (r *RunReconciler) managePod(ctx context.Context, run *v1alpha1.Run, ws v1alpha1.Workspace) (*metav1.Condition, error) {
 	log := log.FromContext(ctx)
 
-	// Check if optional secret "etok" is available
-	secretFound := true
-	err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: "etok"}, &corev1.Secret{})
-	if kerrors.IsNotFound(err) {
-		secretFound = false
-	} else if err != nil {
-		return nil, err
+	// Unless the workspace specifies credential secrets, check if optional
+	// secret "etok" is available
+	secretFound := false
+	if len(ws.Spec.CredentialSecrets) == 0 {
+		err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: "etok"}, &corev1.Secret{})
+		if err == nil {
+			secretFound = true
+		} else if !kerrors.IsNotFound(err) {
+			return nil, err
+		}
 	}
 
-	// Check if optional service account "etok" is available
-	serviceAccountFound := true
-	err = r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: "etok"}, &corev1.ServiceAccount{})
+	// Check if the workspace's service account is available. Unless the
+	// workspace specifies a service account, it is the optional service
+	// account "etok".
+	serviceAccount := serviceAccountName(&ws)
+	err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: serviceAccount}, &corev1.ServiceAccount{})
 	if kerrors.IsNotFound(err) {
-		serviceAccountFound = false
+		if hasDedicatedServiceAccount(&ws) {
+			// Retry once the workspace reconciler has created it
+			return nil, fmt.Errorf("service account %s not found", serviceAccount)
+		}
+		serviceAccount = ""
 	} else if err != nil {
 		return nil, err
 	}
 
+	// Check if shared plugin cache is available, if workspace uses it
+	pluginCacheFound := false
+	if ws.Spec.Cache.SharedPlugins {
+		err = r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: SharedPluginCacheName}, &corev1.PersistentVolumeClaim{})
+		if err == nil {
+			pluginCacheFound = true
+		} else if !kerrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
 	var pod corev1.Pod
 	err = r.Get(ctx, requestFromObject(run).NamespacedName, &pod)
 	if kerrors.IsNotFound(err) {
-		pod = *runPod(run, &ws, secretFound, serviceAccountFound, r.Image)
+		pod = *runPod(run, &ws, secretFound, serviceAccount, pluginCacheFound, r.Image, r.TerraformMirror)
 
 		// Make run owner of pod
 		if err := controllerutil.SetControllerReference(run, &pod, r.Scheme); err != nil {
@@ -279,6 +375,28 @@ func (r *RunReconciler) managePod(ctx context.Context, run *v1alpha1.Run, ws v1a
 		return nil, err
 	}
 
+	if run.IsRetriedPod(pod.UID) {
+		if pod.DeletionTimestamp == nil {
+			// The retry was recorded but the pod was not deleted
+			if err := r.deletePod(ctx, &pod); err != nil {
+				return nil, err
+			}
+		}
+		// Await deletion of failed attempt before re-creating pod
+		return runIncomplete(v1alpha1.PodRetryingReason, "Waiting for failed pod to be deleted"), nil
+	}
+
+	// A pod that fails before its command has started is retried according to
+	// the run's retry policy. Without a policy, a pending pod is left to
+	// recover by itself until the pending timeout, whereupon the run fails,
+	// reporting why the pod failed to start.
+	timeout := pendingTimeout(run)
+	if reason, message, failed := podInfraFailure(&pod, timeout); failed {
+		if retryLimit(run) > 0 || pod.Status.Phase == corev1.PodFailed || time.Since(pod.CreationTimestamp.Time) > timeout {
+			return r.retryPod(ctx, run, &pod, reason, message)
+		}
+	}
+
 	var isCompleted = metav1.ConditionFalse
 
 	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
@@ -299,6 +417,124 @@ func (r *RunReconciler) managePod(ctx context.Context, run *v1alpha1.Run, ws v1a
 	}, nil
 }
 
+// retryPod deletes a pod that has failed for reasons of infrastructure, so that
+// it is re-created, unless the run's retry limit has been reached, in which
+// case the run fails.
+func (r *RunReconciler) retryPod(ctx context.Context, run *v1alpha1.Run, pod *corev1.Pod, reason, message string) (*metav1.Condition, error) {
+	limit := retryLimit(run)
+	if len(run.Retries) >= limit {
+		if pod.Status.Phase != corev1.PodFailed {
+			// Delete pending pod lest it starts after the run has failed
+			if err := r.deletePod(ctx, pod); err != nil {
+				return nil, err
+			}
+		}
+		if limit > 0 {
+			message = fmt.Sprintf("%s (retry limit of %d reached)", message, limit)
+		}
+		return runFailed(reason, message), nil
+	}
+
+	// Record the retry before deleting the pod, lest the pod is deleted but
+	// the retry goes unrecorded, and the pod is retried without limit
+	run.Retries = append(run.Retries, v1alpha1.RunRetry{
+		PodUID:  pod.UID,
+		Reason:  reason,
+		Message: message,
+		Time:    metav1.Now(),
+	})
+	if err := r.Status().Update(ctx, run); err != nil {
+		return nil, err
+	}
+
+	if err := r.deletePod(ctx, pod); err != nil {
+		return nil, err
+	}
+
+	return runIncomplete(v1alpha1.PodRetryingReason, fmt.Sprintf("Retrying pod after failure: %s (attempt %d of %d)", reason, len(run.Retries)+1, limit+1)), nil
+}
+
+// retryLimit returns the maximum number of times the run's pod is retried. A
+// run with a TTY is never retried: the client attached to the failed pod
+// cannot attach to its replacement.
+func retryLimit(run *v1alpha1.Run) int {
+	if run.Handshake {
+		return 0
+	}
+	return run.RetryPolicy.Limit
+}
+
+func (r *RunReconciler) deletePod(ctx context.Context, pod *corev1.Pod) error {
+	if err := r.Delete(ctx, pod, client.Preconditions{UID: &pod.UID}); err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// podInfraFailure determines whether a pod has failed for reasons of
+// infrastructure before its runner container has started, returning the reason
+// and details of the failure
+func podInfraFailure(pod *corev1.Pod, pendingTimeout time.Duration) (reason, message string, failed bool) {
+	if runnerStarted(pod) {
+		// The command may have altered state
+		return "", "", false
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodFailed:
+		message := pod.Status.Message
+		if message == "" {
+			message = "Pod failed before its command started"
+		}
+		if pod.Status.Reason == "Evicted" {
+			return v1alpha1.PodEvictedReason, message, true
+		}
+		return v1alpha1.PodFailedReason, message, true
+	case corev1.PodPending:
+		var statuses []corev1.ContainerStatus
+		statuses = append(statuses, pod.Status.InitContainerStatuses...)
+		statuses = append(statuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil {
+				switch waiting.Reason {
+				case "ErrImagePull", "ImagePullBackOff":
+					return v1alpha1.ImagePullFailedReason, waiting.Message, true
+				case "CreateContainerConfigError":
+					// e.g. a missing secret or config map
+					return v1alpha1.ContainerConfigFailedReason, waiting.Message, true
+				}
+			}
+		}
+		if time.Since(pod.CreationTimestamp.Time) > pendingTimeout {
+			return v1alpha1.RunPendingTimeoutReason, "Timed out waiting for pod in pending phase", true
+		}
+	}
+
+	return "", "", false
+}
+
+// runnerStarted determines whether the pod's runner container has ever started
+func runnerStarted(pod *corev1.Pod) bool {
+	status := k8s.ContainerStatusByName(pod, globals.RunnerContainerName)
+	if status == nil {
+		return false
+	}
+	return status.State.Running != nil || status.State.Terminated != nil || status.LastTerminationState.Terminated != nil
+}
+
+// pendingTimeout returns the duration after which the run's pending pod is
+// retried, or, if it is not to be retried, the run fails
+func pendingTimeout(run *v1alpha1.Run) time.Duration {
+	if run.RetryPolicy.PendingTimeout == "" {
+		return runPodPendingTimeout
+	}
+	timeout, err := time.ParseDuration(run.RetryPolicy.PendingTimeout)
+	if err != nil || timeout <= 0 {
+		return runPodPendingTimeout
+	}
+	return timeout
+}
+
 // Translate pod phase to a reason string for the run completed condition
 func getReasonFromPodPhase(phase corev1.PodPhase) string {
 	switch phase {
@@ -326,8 +562,11 @@ func getExitCode(pod *corev1.Pod) (int, error) {
 func (r *RunReconciler) setOwnerOfArchive(ctx context.Context, run *v1alpha1.Run) error {
 	log := log.FromContext(ctx)
 
+	// The archive may be shared with other runs, each of which is made an owner
+	// of it, ensuring it is only garbage collected once all of its runs are
+	// deleted.
 	var archive corev1.ConfigMap
-	if err := r.Get(ctx, requestFromObject(run).NamespacedName, &archive); err != nil {
+	if err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: run.ConfigMap}, &archive); err != nil {
 		// Ignore not found errors and keep on reconciling - the client might
 		// not yet have created the config map
 		if !kerrors.IsNotFound(err) {
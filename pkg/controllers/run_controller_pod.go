@@ -1,18 +1,21 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strconv"
 
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/launcher"
+	"github.com/leg100/etok/pkg/backend"
 	"github.com/leg100/etok/pkg/globals"
 	"github.com/leg100/etok/pkg/labels"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func runPod(run *v1alpha1.Run, ws *v1alpha1.Workspace, secretFound, serviceAccountFound bool, image string) *corev1.Pod {
+func runPod(run *v1alpha1.Run, ws *v1alpha1.Workspace, secretFound bool, serviceAccount string, pluginCacheFound bool, image, mirror string) *corev1.Pod {
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      run.PodName(),
@@ -172,8 +175,113 @@ func runPod(run *v1alpha1.Run, ws *v1alpha1.Workspace, secretFound, serviceAccou
 	// Permit filtering pods by the run command
 	labels.SetLabel(pod, labels.Command(run.Command))
 
-	if serviceAccountFound {
-		pod.Spec.ServiceAccountName = "etok"
+	// Empty means the namespace's default service account
+	pod.Spec.ServiceAccountName = serviceAccount
+
+	if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		setHTTPBackendEnv(pod, ws)
+	}
+
+	if ws.CacheMode() == v1alpha1.CacheModeEphemeral {
+		// Provision an empty cache and install terraform onto it
+		pod.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		}
+		pod.Spec.InitContainers = []corev1.Container{
+			installerContainer(ws, image, mirror),
+		}
+		// ...and instruct the runner to install providers and modules onto
+		// it too
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+			Name:  "ETOK_INIT",
+			Value: "true",
+		})
+	}
+
+	if run.Handshake {
+		// The runner container is only ready once it has received the
+		// handshake, informing a client attaching later whether it should
+		// send the handshake itself
+		pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+			Handler: corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"test", "-f", globals.HandshakeMarker},
+				},
+			},
+			PeriodSeconds: 1,
+		}
+	}
+
+	if ws.CacheMode() != v1alpha1.CacheModeEphemeral {
+		if ws.ReaderPolicy() == v1alpha1.ReaderPolicyIsolate && !launcher.IsQueueable(run.Command) {
+			// Isolate read-only run from other runs by mounting the shared
+			// .terraform directory read-only, from which the runner takes a
+			// copy
+			for i, vm := range pod.Spec.Containers[0].VolumeMounts {
+				if vm.SubPath == dotTerraformSubPath {
+					pod.Spec.Containers[0].VolumeMounts[i] = corev1.VolumeMount{
+						Name:      "cache",
+						MountPath: dotTerraformSourceMountPath,
+						SubPath:   dotTerraformSubPath,
+						ReadOnly:  true,
+					}
+				}
+			}
+			pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+				Name:  "ETOK_DOT_TERRAFORM_SOURCE",
+				Value: dotTerraformSourceMountPath,
+			})
+		} else {
+			// Prevent isolated runs copying the shared .terraform directory
+			// whilst this run modifies it
+			pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+				Name:  "ETOK_DOT_TERRAFORM_LOCK",
+				Value: filepath.Join(workspaceDir, run.ConfigMapPath, ".terraform", globals.DotTerraformLockFile),
+			})
+		}
+	}
+
+	if pluginCacheFound {
+		// Swap workspace's own plugin cache for the shared plugin cache
+		for i, vm := range pod.Spec.Containers[0].VolumeMounts {
+			if vm.MountPath == pluginMountPath {
+				pod.Spec.Containers[0].VolumeMounts[i] = corev1.VolumeMount{
+					Name:      "shared-plugin-cache",
+					MountPath: pluginMountPath,
+				}
+			}
+		}
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "builtins",
+			MountPath: cliConfigMountPath,
+			SubPath:   cliConfigPath,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "shared-plugin-cache",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: SharedPluginCacheName,
+				},
+			},
+		})
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+			Name:  "TF_CLI_CONFIG_FILE",
+			Value: cliConfigMountPath,
+		}, corev1.EnvVar{
+			Name:  "ETOK_PLUGIN_CACHE_LOCK",
+			Value: pluginCacheLockPath,
+		})
+	}
+
+	if len(run.Artifacts) > 0 {
+		// Instruct runner to return artifacts to client. Paths are encoded as
+		// JSON because they may contain any character. Marshaling a slice of
+		// strings cannot fail.
+		paths, _ := json.Marshal(run.Artifacts)
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+			Name:  "ETOK_ARTIFACTS",
+			Value: string(paths),
+		})
 	}
 
 	if secretFound {
@@ -186,8 +294,44 @@ func runPod(run *v1alpha1.Run, ws *v1alpha1.Workspace, secretFound, serviceAccou
 		})
 	}
 
+	// Provide workspace's credential secrets. They're deliberately not
+	// optional: the pod remains pending until they exist.
+	for i, cs := range ws.Spec.CredentialSecrets {
+		if cs.Type == v1alpha1.CredentialSecretTypeFile {
+			volume := fmt.Sprintf("credentials-%d", i)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+				Name: volume,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: cs.Name,
+						Items:      cs.Items,
+					},
+				},
+			})
+			pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+				Name:      volume,
+				MountPath: credentialSecretMountPath(cs),
+				ReadOnly:  true,
+			})
+			continue
+		}
+
+		pod.Spec.Containers[0].EnvFrom = append(pod.Spec.Containers[0].EnvFrom, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: cs.Name,
+				},
+			},
+		})
+	}
+
 	// Set workspace variables
 	for _, v := range ws.Spec.Variables {
+		if v == nil {
+			// Only possible if the validating webhook is not installed
+			continue
+		}
+
 		var ev corev1.EnvVar
 
 		if v.EnvironmentVariable {
@@ -207,3 +351,68 @@ func runPod(run *v1alpha1.Run, ws *v1alpha1.Workspace, secretFound, serviceAccou
 
 	return pod
 }
+
+// credentialSecretMountPath returns the container path on which to mount a
+// credential secret's files
+func credentialSecretMountPath(cs v1alpha1.CredentialSecret) string {
+	if cs.MountPath != "" {
+		return cs.MountPath
+	}
+	return filepath.Join(credentialsMountPath, cs.Name)
+}
+
+// setHTTPBackendEnv configures terraform to authenticate to the operator's
+// state server, replacing the kubernetes backend's config. The password is
+// retrieved from the workspace's token secret and passed in the environment,
+// keeping it off the command line. The state server's CA certificate, if any, is
+// added to the directories from which terraform loads trusted certificates.
+func setHTTPBackendEnv(pod *corev1.Pod, ws *v1alpha1.Workspace) {
+	container := &pod.Spec.Containers[0]
+
+	var env []corev1.EnvVar
+	for _, ev := range container.Env {
+		if ev.Name == "TF_CLI_ARGS_init" {
+			// Kubernetes backend config is invalid for the HTTP backend
+			continue
+		}
+		env = append(env, ev)
+	}
+	container.Env = append(env,
+		corev1.EnvVar{
+			Name: "TF_HTTP_PASSWORD",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: backend.TokenSecretName(ws.Name),
+					},
+					Key: backend.TokenKey,
+				},
+			},
+		},
+		corev1.EnvVar{
+			Name:  "SSL_CERT_DIR",
+			Value: "/etc/ssl/certs:" + stateCAMountPath,
+		},
+	)
+
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "state-ca",
+		MountPath: stateCAMountPath,
+		ReadOnly:  true,
+	})
+	// Optional, because the CA certificate is absent if the state server
+	// doesn't serve TLS
+	optional := true
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: "state-ca",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: ws.BuiltinsConfigMapName(),
+				},
+				Items:    []corev1.KeyToPath{{Key: stateCAPath, Path: "ca.crt"}},
+				Optional: &optional,
+			},
+		},
+	})
+}
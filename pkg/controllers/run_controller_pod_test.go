@@ -11,12 +11,13 @@ import (
 
 func TestRunPod(t *testing.T) {
 	tests := []struct {
-		name                string
-		run                 *v1alpha1.Run
-		workspace           *v1alpha1.Workspace
-		secretFound         bool
-		serviceAccountFound bool
-		assertions          func(*corev1.Pod)
+		name             string
+		run              *v1alpha1.Run
+		workspace        *v1alpha1.Workspace
+		secretFound      bool
+		serviceAccount   string
+		pluginCacheFound bool
+		assertions       func(*corev1.Pod)
 	}{
 		{
 			name:      "Non-default working dir",
@@ -49,6 +50,17 @@ func TestRunPod(t *testing.T) {
 				})
 			},
 		},
+		{
+			name:      "Artifacts",
+			run:       testobj.Run("default", "run-12345", "plan", testobj.WithArtifacts("plan.out", "graph.dot")),
+			workspace: testobj.Workspace("default", "foo"),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "ETOK_ARTIFACTS",
+					Value: `["plan.out","graph.dot"]`,
+				})
+			},
+		},
 		{
 			name:      "Terraform binary volume mount",
 			run:       testobj.Run("default", "run-12345", "plan"),
@@ -71,6 +83,10 @@ func TestRunPod(t *testing.T) {
 					MountPath: "/workspace/subdir/.terraform",
 					SubPath:   ".terraform/",
 				})
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "ETOK_DOT_TERRAFORM_LOCK",
+					Value: "/workspace/subdir/.terraform/.etok.lock",
+				})
 			},
 		},
 		{
@@ -112,6 +128,171 @@ func TestRunPod(t *testing.T) {
 				})
 			},
 		},
+		{
+			name: "Credential secrets",
+			run:  testobj.Run("default", "run-12345", "plan"),
+			workspace: testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(
+				v1alpha1.CredentialSecret{Name: "aws"},
+				v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "/etc/gcp", Items: []corev1.KeyToPath{{Key: "key.json", Path: "credentials.json"}}},
+				v1alpha1.CredentialSecret{Name: "ssh", Type: v1alpha1.CredentialSecretTypeFile},
+			)),
+			assertions: func(pod *corev1.Pod) {
+				assert.Equal(t, []corev1.EnvFromSource{
+					{
+						SecretRef: &corev1.SecretEnvSource{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: "aws",
+							},
+						},
+					},
+				}, pod.Spec.Containers[0].EnvFrom)
+				assert.Contains(t, pod.Spec.Volumes, corev1.Volume{
+					Name: "credentials-1",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "gcp",
+							Items:      []corev1.KeyToPath{{Key: "key.json", Path: "credentials.json"}},
+						},
+					},
+				})
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "credentials-1",
+					MountPath: "/etc/gcp",
+					ReadOnly:  true,
+				})
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "credentials-2",
+					MountPath: "/credentials/ssh",
+					ReadOnly:  true,
+				})
+			},
+		},
+		{
+			name:      "HTTP state backend",
+			run:       testobj.Run("default", "run-12345", "plan"),
+			workspace: testobj.Workspace("default", "foo", testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP)),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name: "TF_HTTP_PASSWORD",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: "foo-state-token",
+							},
+							Key: "token",
+						},
+					},
+				})
+				for _, ev := range pod.Spec.Containers[0].Env {
+					assert.NotEqual(t, "TF_CLI_ARGS_init", ev.Name)
+				}
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "SSL_CERT_DIR",
+					Value: "/etc/ssl/certs:/etc/etok/state-ca",
+				})
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "state-ca",
+					MountPath: "/etc/etok/state-ca",
+					ReadOnly:  true,
+				})
+			},
+		},
+		{
+			name:             "Shared plugin cache",
+			run:              testobj.Run("default", "run-12345", "plan"),
+			workspace:        testobj.Workspace("default", "foo", testobj.WithSharedPlugins()),
+			pluginCacheFound: true,
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "shared-plugin-cache",
+					MountPath: "/plugin-cache",
+				})
+				assert.NotContains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "cache",
+					MountPath: "/plugin-cache",
+					SubPath:   "plugin-cache/",
+				})
+				assert.Equal(t, "etok-plugin-cache", pod.Spec.Volumes[len(pod.Spec.Volumes)-1].PersistentVolumeClaim.ClaimName)
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "TF_CLI_CONFIG_FILE",
+					Value: "/etc/etok/terraformrc",
+				})
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "ETOK_PLUGIN_CACHE_LOCK",
+					Value: "/plugin-cache/.etok.lock",
+				})
+			},
+		},
+		{
+			name:      "Shared plugin cache not found",
+			run:       testobj.Run("default", "run-12345", "plan"),
+			workspace: testobj.Workspace("default", "foo", testobj.WithSharedPlugins()),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "cache",
+					MountPath: "/plugin-cache",
+					SubPath:   "plugin-cache/",
+				})
+			},
+		},
+		{
+			name:      "Ephemeral cache",
+			run:       testobj.Run("default", "run-12345", "plan"),
+			workspace: testobj.Workspace("default", "foo", testobj.WithCacheMode(v1alpha1.CacheModeEphemeral), testobj.WithTerraformVersion("0.13.5")),
+			assertions: func(pod *corev1.Pod) {
+				assert.NotNil(t, pod.Spec.Volumes[0].EmptyDir)
+				assert.Nil(t, pod.Spec.Volumes[0].PersistentVolumeClaim)
+				if assert.Equal(t, 1, len(pod.Spec.InitContainers)) {
+					assert.Equal(t, "installer", pod.Spec.InitContainers[0].Name)
+					assert.Contains(t, pod.Spec.InitContainers[0].Args, "0.13.5")
+				}
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "ETOK_INIT",
+					Value: "true",
+				})
+			},
+		},
+		{
+			name:      "Isolated reader",
+			run:       testobj.Run("default", "run-12345", "plan", testobj.WithConfigMapPath("subdir")),
+			workspace: testobj.Workspace("default", "foo", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyIsolate)),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "cache",
+					MountPath: "/dot-terraform",
+					SubPath:   ".terraform/",
+					ReadOnly:  true,
+				})
+				for _, vm := range pod.Spec.Containers[0].VolumeMounts {
+					assert.NotEqual(t, "/workspace/subdir/.terraform", vm.MountPath)
+				}
+				assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "ETOK_DOT_TERRAFORM_SOURCE",
+					Value: "/dot-terraform",
+				})
+			},
+		},
+		{
+			name:      "Isolated writer",
+			run:       testobj.Run("default", "run-12345", "apply", testobj.WithConfigMapPath("subdir")),
+			workspace: testobj.Workspace("default", "foo", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyIsolate)),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "cache",
+					MountPath: "/workspace/subdir/.terraform",
+					SubPath:   ".terraform/",
+				})
+			},
+		},
+		{
+			name:      "Pinned cache",
+			run:       testobj.Run("default", "run-12345", "plan"),
+			workspace: testobj.Workspace("default", "foo"),
+			assertions: func(pod *corev1.Pod) {
+				assert.Equal(t, "foo", pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+				assert.Empty(t, pod.Spec.InitContainers)
+			},
+		},
 		{
 			name:      "Set workspace terraform variables",
 			run:       testobj.Run("default", "run-12345", "plan"),
@@ -137,7 +318,7 @@ func TestRunPod(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.assertions(runPod(tt.run, tt.workspace, tt.secretFound, tt.serviceAccountFound, "etok:latest"))
+			tt.assertions(runPod(tt.run, tt.workspace, tt.secretFound, tt.serviceAccount, tt.pluginCacheFound, "etok:latest", "https://releases.hashicorp.com/terraform"))
 		})
 	}
 }
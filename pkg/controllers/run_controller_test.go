@@ -3,14 +3,17 @@ package controllers
 import (
 	"context"
 	"testing"
+	"time"
 
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/globals"
 	"github.com/leg100/etok/pkg/scheme"
 	"github.com/leg100/etok/pkg/testobj"
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -19,6 +22,19 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// withIncompleteSince sets the run as incomplete for the given reason, since
+// the given duration ago
+func withIncompleteSince(reason string, ago time.Duration) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		run.Conditions = []metav1.Condition{{
+			Type:               v1alpha1.RunCompleteCondition,
+			Status:             metav1.ConditionFalse,
+			Reason:             reason,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-ago)),
+		}}
+	}
+}
+
 func TestRunReconciler(t *testing.T) {
 	tests := []struct {
 		name                string
@@ -27,7 +43,9 @@ func TestRunReconciler(t *testing.T) {
 		runAssertions       func(*testutil.T, *v1alpha1.Run)
 		podAssertions       func(*testutil.T, *corev1.Pod)
 		configMapAssertions func(*testutil.T, *corev1.ConfigMap)
-		reconcileError      bool
+		// Assert the run's pod has been deleted
+		podDeleted     bool
+		reconcileError bool
 	}{
 		{
 			name: "Missing workspace",
@@ -57,7 +75,28 @@ func TestRunReconciler(t *testing.T) {
 			name: "Plan is unqueued and its pod is immediately provisioned",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
 			objs: []runtime.Object{
-				testobj.Workspace("operator-test", "workspace-1"),
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyIsolate)),
+				testobj.Secret("operator-test", "etok"),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+			},
+		},
+		{
+			name: "Plan waits behind active apply",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait), testobj.WithCombinedQueue("apply-0", "plan-1")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseQueued, run.Phase)
+			},
+		},
+		{
+			name: "Active reader is provisioned",
+			run:  testobj.Run("operator-test", "plan-2", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1", "plan-2")),
 				testobj.Secret("operator-test", "etok"),
 			},
 			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
@@ -74,6 +113,58 @@ func TestRunReconciler(t *testing.T) {
 				assert.Equal(t, v1alpha1.RunPhaseQueued, run.Phase)
 			},
 		},
+		{
+			name: "Queue timeout",
+			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1"), withIncompleteSince(v1alpha1.RunQueuedReason, 2*time.Hour)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("apply-0", "apply-1")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.QueueTimeoutReason, failed.Reason)
+				}
+			},
+		},
+		{
+			name: "Queue timeout measured from when queued",
+			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1"), withIncompleteSince(v1alpha1.RunUnqueuedReason, 2*time.Hour)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("apply-0", "apply-1")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseQueued, run.Phase)
+				complete := meta.FindStatusCondition(run.Conditions, v1alpha1.RunCompleteCondition)
+				if assert.NotNil(t, complete) {
+					assert.True(t, time.Since(complete.LastTransitionTime.Time) < time.Minute)
+				}
+			},
+		},
+		{
+			name: "Enqueue timeout",
+			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1"), withIncompleteSince(v1alpha1.RunUnqueuedReason, time.Minute)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1"),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.RunEnqueueTimeoutReason, failed.Reason)
+				}
+			},
+		},
+		{
+			name: "Unapproved privileged run not timed out",
+			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1"), withIncompleteSince(v1alpha1.RunUnqueuedReason, time.Minute)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithPrivilegedCommands("apply")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseWaiting, run.Phase)
+			},
+		},
 		{
 			name: "Provisioning run at front of queue",
 			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
@@ -90,7 +181,7 @@ func TestRunReconciler(t *testing.T) {
 			name: "Running unqueued plan",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
 			objs: []runtime.Object{
-				testobj.Workspace("operator-test", "workspace-1"),
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyIsolate)),
 				testobj.RunPod("operator-test", "plan-1"),
 			},
 			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
@@ -119,6 +210,242 @@ func TestRunReconciler(t *testing.T) {
 				assert.True(t, meta.IsStatusConditionTrue(run.Conditions, v1alpha1.RunCompleteCondition))
 			},
 		},
+		{
+			name: "Cancelled queued run",
+			run:  testobj.Run("operator-test", "apply-1", "apply", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("apply-0", "apply-1")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseCancelled, run.Phase)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.RunCancelledReason, failed.Reason)
+				}
+			},
+		},
+		{
+			name: "Cancelled running run",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1"),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseRunning, run.Phase)
+			},
+		},
+		{
+			name: "Cancelled run completed",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerExitCode(1)),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseCancelled, run.Phase)
+				if assert.NotNil(t, run.ExitCode) {
+					assert.Equal(t, 1, *run.ExitCode)
+				}
+			},
+		},
+		{
+			name: "Evicted pod retried",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, "")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					pod.Status.Reason = "Evicted"
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+				if assert.Equal(t, 1, len(run.Retries)) {
+					assert.Equal(t, types.UID("pod-1"), run.Retries[0].PodUID)
+					assert.Equal(t, v1alpha1.PodEvictedReason, run.Retries[0].Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Evicted pod not retried once command started",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, "")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerExitCode(137), func(pod *corev1.Pod) {
+					pod.Status.Reason = "Evicted"
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseCompleted, run.Phase)
+				assert.Equal(t, 137, *run.ExitCode)
+				assert.Empty(t, run.Retries)
+			},
+		},
+		{
+			name: "Image pull failure retried",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(2, "")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("ImagePullBackOff")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				if assert.Equal(t, 1, len(run.Retries)) {
+					assert.Equal(t, v1alpha1.ImagePullFailedReason, run.Retries[0].Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Pending pod timed out",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, "1m")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Minute))
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				if assert.Equal(t, 1, len(run.Retries)) {
+					assert.Equal(t, v1alpha1.RunPendingTimeoutReason, run.Retries[0].Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Pending pod yet to time out",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, "1m")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					pod.CreationTimestamp = metav1.Now()
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+				assert.Empty(t, run.Retries)
+			},
+		},
+		{
+			name: "Pending pod without retry policy timed out",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-runPodPendingTimeout - time.Minute))
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				assert.Empty(t, run.Retries)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.RunPendingTimeoutReason, failed.Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Pending pod without retry policy yet to time out",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("CreateContainerConfigError"), func(pod *corev1.Pod) {
+					pod.CreationTimestamp = metav1.Now()
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+			},
+		},
+		{
+			name: "Container config error reported once timed out",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("CreateContainerConfigError"), func(pod *corev1.Pod) {
+					pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-runPodPendingTimeout - time.Minute))
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.ContainerConfigFailedReason, failed.Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Retry limit reached",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, ""), testobj.WithRetries("pod-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-2"), testobj.WithPhase(corev1.PodPending), testobj.WithRunnerWaiting("ImagePullBackOff")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition)
+				if assert.NotNil(t, failed) {
+					assert.Equal(t, v1alpha1.ImagePullFailedReason, failed.Reason)
+				}
+			},
+			podDeleted: true,
+		},
+		{
+			name: "TTY run not retried",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, ""), func(run *v1alpha1.Run) { run.Handshake = true }),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					pod.Status.Reason = "Evicted"
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				assert.Empty(t, run.Retries)
+			},
+		},
+		{
+			name: "Retried pod deleted",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, ""), testobj.WithRetries("pod-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerWaiting("ContainerCreating")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+				assert.Equal(t, 1, len(run.Retries))
+			},
+			podDeleted: true,
+		},
+		{
+			name: "Awaiting deletion of retried pod",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(1, ""), testobj.WithRetries("pod-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPodUID("pod-1"), testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerWaiting("ContainerCreating"), func(pod *corev1.Pod) {
+					now := metav1.Now()
+					pod.DeletionTimestamp = &now
+				}),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseProvisioning, run.Phase)
+				assert.Equal(t, 1, len(run.Retries))
+			},
+		},
+		{
+			name: "Pod failed before command started without retry policy",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
+				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodFailed), testobj.WithRunnerWaiting("ContainerCreating")),
+			},
+			runAssertions: func(t *testutil.T, run *v1alpha1.Run) {
+				assert.Equal(t, v1alpha1.RunPhaseFailed, run.Phase)
+				assert.Nil(t, run.ExitCode)
+			},
+		},
 		{
 			name: "Creates pod",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
@@ -129,6 +456,28 @@ func TestRunReconciler(t *testing.T) {
 				assert.NotEqual(t, &corev1.Pod{}, pod)
 			},
 		},
+		{
+			name: "Handshake readiness probe",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), func(run *v1alpha1.Run) { run.Handshake = true }),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1")),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				if assert.NotNil(t, pod.Spec.Containers[0].ReadinessProbe) {
+					assert.Equal(t, []string{"test", "-f", globals.HandshakeMarker}, pod.Spec.Containers[0].ReadinessProbe.Exec.Command)
+				}
+			},
+		},
+		{
+			name: "No readiness probe without handshake",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1")),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Nil(t, pod.Spec.Containers[0].ReadinessProbe)
+			},
+		},
 		{
 			name: "Secret found and environment variables source set",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
@@ -162,6 +511,25 @@ func TestRunReconciler(t *testing.T) {
 				})
 			},
 		},
+		{
+			name: "credential secrets supersede namespace secret",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1"), testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp"})),
+				testobj.Secret("operator-test", "etok"),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Equal(t, []corev1.EnvFromSource{
+					{
+						SecretRef: &corev1.SecretEnvSource{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: "gcp",
+							},
+						},
+					},
+				}, pod.Spec.Containers[0].EnvFrom)
+			},
+		},
 		{
 			name: "service account found and set",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
@@ -183,6 +551,40 @@ func TestRunReconciler(t *testing.T) {
 				assert.Equal(t, "", pod.Spec.ServiceAccountName)
 			},
 		},
+		{
+			name: "dedicated service account set",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1"), testobj.WithServiceAccount("terraform")),
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "operator-test", Name: "etok"}},
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "operator-test", Name: "terraform"}},
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Equal(t, "terraform", pod.Spec.ServiceAccountName)
+			},
+		},
+		{
+			name: "dedicated service account not yet created",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1"), testobj.WithServiceAccount("terraform")),
+			},
+			reconcileError: true,
+		},
+		{
+			name: "shared plugin cache found and mounted",
+			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-1"), testobj.WithSharedPlugins()),
+				&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "operator-test", Name: "etok-plugin-cache"}},
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "shared-plugin-cache",
+					MountPath: "/plugin-cache",
+				})
+			},
+		},
 		{
 			name: "Image name",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
@@ -215,11 +617,27 @@ func TestRunReconciler(t *testing.T) {
 				assert.Equal(t, "plan-1", archive.OwnerReferences[0].Name)
 			},
 		},
+		{
+			name: "Run shares ownership of config map",
+			run:  testobj.Run("operator-test", "plan-2", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithConfigMap("archive-workspace-1-abc")),
+			objs: []runtime.Object{
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithCombinedQueue("plan-2")),
+				testobj.ConfigMap("operator-test", "archive-workspace-1-abc", func(cm *corev1.ConfigMap) {
+					cm.OwnerReferences = []metav1.OwnerReference{{Kind: "Run", Name: "plan-1"}}
+				}),
+			},
+			configMapAssertions: func(t *testutil.T, archive *corev1.ConfigMap) {
+				if assert.Equal(t, 2, len(archive.OwnerReferences)) {
+					assert.Equal(t, "plan-1", archive.OwnerReferences[0].Name)
+					assert.Equal(t, "plan-2", archive.OwnerReferences[1].Name)
+				}
+			},
+		},
 		{
 			name: "Exit code recorded in status",
 			run:  testobj.Run("operator-test", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
 			objs: []runtime.Object{
-				testobj.Workspace("operator-test", "workspace-1"),
+				testobj.Workspace("operator-test", "workspace-1", testobj.WithReaders("plan-1")),
 				testobj.RunPod("operator-test", "plan-1", testobj.WithPhase(corev1.PodSucceeded), testobj.WithRunnerExitCode(5)),
 				testobj.Secret("operator-test", "etok"),
 			},
@@ -257,9 +675,14 @@ func TestRunReconciler(t *testing.T) {
 				tt.podAssertions(t, &pod)
 			}
 
+			if tt.podDeleted {
+				err := cl.Get(context.TODO(), req.NamespacedName, &corev1.Pod{})
+				assert.True(t, kerrors.IsNotFound(err), err)
+			}
+
 			if tt.configMapAssertions != nil {
 				var archive corev1.ConfigMap
-				require.NoError(t, cl.Get(context.TODO(), req.NamespacedName, &archive))
+				require.NoError(t, cl.Get(context.TODO(), types.NamespacedName{Namespace: tt.run.Namespace, Name: tt.run.ConfigMap}, &archive))
 
 				tt.configMapAssertions(t, &archive)
 			}
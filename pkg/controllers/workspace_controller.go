@@ -8,19 +8,27 @@ import (
 	"io"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/installer"
+	"github.com/leg100/etok/pkg/backend"
+	"github.com/leg100/etok/pkg/labels"
 	"google.golang.org/api/googleapi"
 	"sigs.k8s.io/yaml"
 
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/leg100/etok/pkg/scheme"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -38,6 +46,18 @@ const (
 	ServiceAccountName = "etok"
 	RoleName           = "etok"
 	RoleBindingName    = "etok"
+
+	// SharedPluginCacheName is the name of the PVC for the provider plugin
+	// cache shared by workspaces across the cluster. The PVC is created in the
+	// plugin cache namespace, and a PVC of the same name is bound to the same
+	// storage in each namespace with workspaces using the cache.
+	SharedPluginCacheName = "etok-plugin-cache"
+	// DefaultSharedPluginCacheSize is the default size of the shared plugin
+	// cache PVC
+	DefaultSharedPluginCacheSize = "10Gi"
+	// DefaultSharedPluginCacheNamespace is the default namespace in which the
+	// shared plugin cache PVC is created
+	DefaultSharedPluginCacheNamespace = "etok"
 )
 
 var (
@@ -53,6 +73,34 @@ type WorkspaceReconciler struct {
 	Image         string
 	StorageClient *storage.Client
 	recorder      record.EventRecorder
+	// URL of mirror from which terraform is downloaded, unless overridden by
+	// the workspace
+	TerraformMirror string
+	// Storage class for the shared plugin cache PVC. The shared plugin cache
+	// is disabled if nil.
+	PluginCacheStorageClass *string
+	// Size of the shared plugin cache PVC
+	PluginCacheSize resource.Quantity
+	// Namespace in which the shared plugin cache PVC is created
+	PluginCacheNamespace string
+	// Only install providers from the shared plugin cache
+	PluginCacheOffline bool
+	// Store for workspaces using the HTTP state backend. The HTTP state
+	// backend is disabled if nil.
+	StateStore *backend.Store
+	// URL at which runs reach the operator's state server
+	StateServerURL string
+	// PEM-encoded CA certificate with which runs verify the state server's
+	// certificate. Nil if the state server doesn't serve TLS.
+	StateServerCA []byte
+	// Release locks held by runs whose pods are gone
+	ReleaseStaleLocks bool
+
+	// Warnings recorded against workspaces, keyed by workspace UID and reason,
+	// so that a warning is only recorded when a workspace enters the state it
+	// warns of, rather than upon every reconcile
+	warnings   map[string]bool
+	warningsMu sync.Mutex
 }
 
 type WorkspaceReconcilerOption func(r *WorkspaceReconciler)
@@ -69,11 +117,57 @@ func WithEventRecorder(recorder record.EventRecorder) WorkspaceReconcilerOption
 	}
 }
 
+func WithTerraformMirror(mirror string) WorkspaceReconcilerOption {
+	return func(r *WorkspaceReconciler) {
+		r.TerraformMirror = mirror
+	}
+}
+
+// WithSharedPluginCache enables a provider plugin cache shared by workspaces
+// across the cluster, using a PVC with the given storage class and size,
+// created in the given namespace. The storage class must support the
+// ReadWriteMany access mode.
+func WithSharedPluginCache(namespace, storageClass string, size resource.Quantity) WorkspaceReconcilerOption {
+	return func(r *WorkspaceReconciler) {
+		r.PluginCacheNamespace = namespace
+		r.PluginCacheStorageClass = &storageClass
+		r.PluginCacheSize = size
+	}
+}
+
+// WithPluginCacheOffline configures workspaces to only install providers from
+// the shared plugin cache
+func WithPluginCacheOffline() WorkspaceReconcilerOption {
+	return func(r *WorkspaceReconciler) {
+		r.PluginCacheOffline = true
+	}
+}
+
+// WithStateBackend enables the HTTP state backend, storing state in the given
+// store, which is served to runs at the given URL. Runs trust the given CA
+// certificate when connecting to the URL.
+func WithStateBackend(store *backend.Store, url string, ca []byte) WorkspaceReconcilerOption {
+	return func(r *WorkspaceReconciler) {
+		r.StateStore = store
+		r.StateServerURL = url
+		r.StateServerCA = ca
+	}
+}
+
+// WithStaleLockRelease releases locks on state held by runs whose pods are gone
+func WithStaleLockRelease() WorkspaceReconcilerOption {
+	return func(r *WorkspaceReconciler) {
+		r.ReleaseStaleLocks = true
+	}
+}
+
 func NewWorkspaceReconciler(cl client.Client, image string, opts ...WorkspaceReconcilerOption) *WorkspaceReconciler {
 	r := &WorkspaceReconciler{
-		Client: cl,
-		Scheme: scheme.Scheme,
-		Image:  image,
+		Client:          cl,
+		Scheme:          scheme.Scheme,
+		Image:           image,
+		TerraformMirror: installer.DefaultMirror,
+		warnings:        make(map[string]bool),
 	}
 
 	for _, o := range opts {
@@ -85,10 +179,15 @@ func NewWorkspaceReconciler(cl client.Client, image string, opts ...WorkspaceRec
 	workspaceReconcileStatusChain = []workspaceUpdater{}
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.handleDeletion)
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageQueue)
-	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageBuiltins)
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageRBACForNamespace)
+	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageCredentials)
+	// Builtins depend on the state backend in use, which is determined by
+	// managing the state
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageState)
+	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageLock)
+	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageBuiltins)
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.managePVC)
+	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.manageSharedPluginCache)
 	workspaceReconcileStatusChain = append(workspaceReconcileStatusChain, r.managePod)
 
 	return r
@@ -96,10 +195,12 @@ func NewWorkspaceReconciler(cl client.Client, image string, opts ...WorkspaceRec
 
 // +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=persistentvolumes,verbs=get;create;patch
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="rbac.authorization.k8s.io",resources=roles,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="rbac.authorization.k8s.io",resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="storage.k8s.io",resources=storageclasses,verbs=get;list;watch
 
 // Manage configmaps for terraform variables
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
@@ -163,22 +264,45 @@ func (r *WorkspaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		}
 	}
 
+	// Release lock upon request
+	if id, ok := ws.Annotations[v1alpha1.UnlockAnnotationKey]; ok {
+		if err := r.handleUnlockRequest(ctx, &ws, id); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Update status one step in the chain at a time. Returns a ready condition.
 	ready, backoff := processWorkspaceReconcileStatusChain(ctx, &ws)
 	if ready != nil {
 		// Add condition to status
-		meta.SetStatusCondition(&ws.Status.Conditions, *ready)
+		setObservedCondition(&ws, *ready)
 
 		// Ensure phase reflects ready condition
 		ws.Status.Phase = setPhase(ready.Reason)
 
+		if backoff == nil && ready.Status == metav1.ConditionTrue {
+			// Record that the spec has been reconciled. Not recorded whilst
+			// pending, lest clients consider a reconfiguration complete
+			// before it is.
+			ws.Status.ObservedGeneration = ws.Generation
+		}
+
 		if err := r.updateStatus(ctx, req, ws.Status); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
 
 	// Non-nil backoff triggers an exponential backoff
-	return ctrl.Result{}, backoff
+	if backoff != nil {
+		return ctrl.Result{}, backoff
+	}
+
+	// Check again once the workspace is due to become idle
+	if remaining, scaleDown, err := r.idleRemaining(ctx, &ws); err == nil && scaleDown && remaining > 0 {
+		return ctrl.Result{RequeueAfter: remaining}, nil
+	}
+
+	return ctrl.Result{}, nil
 }
 
 // updateStatus actually calls the k8s API to update the workspace resource. To
@@ -256,6 +380,9 @@ func setPhase(reason string) v1alpha1.WorkspacePhase {
 // Determine if workspace is being deleted
 func (r *WorkspaceReconciler) handleDeletion(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
 	if !ws.GetDeletionTimestamp().IsZero() {
+		// Forget warnings recorded against the workspace
+		r.clearWarnings(ws)
+
 		return &metav1.Condition{
 			Type:    v1alpha1.WorkspaceReadyCondition,
 			Status:  metav1.ConditionFalse,
@@ -269,6 +396,14 @@ func (r *WorkspaceReconciler) handleDeletion(ctx context.Context, ws *v1alpha1.W
 func (r *WorkspaceReconciler) manageState(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
 	log := log.FromContext(ctx)
 
+	if ws.Spec.StateBackend == v1alpha1.StateBackendHTTP {
+		return r.manageHTTPState(ctx, ws)
+	}
+
+	if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		return workspaceFailure("Migrating state from the http backend to the kubernetes backend is unsupported"), nil
+	}
+
 	var secret corev1.Secret
 	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.StateSecretName()}, &secret)
 	switch {
@@ -296,22 +431,18 @@ func (r *WorkspaceReconciler) manageState(ctx context.Context, ws *v1alpha1.Work
 			return nil, err
 		}
 
-		// Report state serial number in workspace status
-		ws.Status.Serial = &state.Serial
-
-		// Persist outputs from state file to workspace status
-		var outputs []*v1alpha1.Output
-		for k, v := range state.Outputs {
-			outputs = append(outputs, &v1alpha1.Output{Key: k, Value: v.Value})
-		}
-		if !reflect.DeepEqual(ws.Status.Outputs, outputs) {
-			ws.Status.Outputs = outputs
-		}
+		reportState(ws, state)
 
 		if ws.Spec.BackupBucket != "" {
 			if ws.Status.BackupSerial == nil || state.Serial != *ws.Status.BackupSerial {
+				// Marshal state file first to json then to yaml
+				y, err := yaml.Marshal(&secret)
+				if err != nil {
+					return r.handleStorageError(err, ws, "BackupError")
+				}
+
 				// Backup the state file and update status
-				return r.backup(ctx, ws, &secret, state)
+				return r.backup(ctx, ws, ws.BackupObjectName(), y, state)
 			}
 		}
 	}
@@ -319,6 +450,115 @@ func (r *WorkspaceReconciler) manageState(ctx context.Context, ws *v1alpha1.Work
 	return nil, nil
 }
 
+// manageHTTPState manages the state of a workspace using the HTTP state
+// backend, migrating state from the kubernetes backend if necessary.
+func (r *WorkspaceReconciler) manageHTTPState(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	if r.StateStore == nil {
+		r.warnOnce(ws, "StateBackendDisabled", "HTTP state backend is not enabled on the operator")
+		return workspaceFailure("HTTP state backend is not enabled on the operator"), nil
+	}
+	r.clearWarning(ws, "StateBackendDisabled")
+
+	if err := r.manageStateToken(ctx, ws); err != nil {
+		log.Error(err, "unable to manage state token")
+		return nil, err
+	}
+
+	if ws.StateBackend() != v1alpha1.StateBackendHTTP {
+		if cond, err := r.migrateState(ctx, ws); cond != nil || err != nil {
+			return cond, err
+		}
+		ws.Status.StateBackend = v1alpha1.StateBackendHTTP
+	}
+
+	data, err := r.StateStore.Get(ctx, ws)
+	if err != nil {
+		log.Error(err, "unable to get state")
+		return nil, err
+	}
+	if data == nil {
+		if ws.Spec.BackupBucket != "" {
+			return r.restoreStateFile(ctx, ws)
+		}
+		return nil, nil
+	}
+
+	state, err := parseState(data)
+	if err != nil {
+		return nil, err
+	}
+
+	reportState(ws, state)
+
+	if ws.Spec.BackupBucket != "" {
+		if ws.Status.BackupSerial == nil || state.Serial != *ws.Status.BackupSerial {
+			return r.backup(ctx, ws, ws.StateFileBackupObjectName(), data, state)
+		}
+	}
+
+	return nil, nil
+}
+
+// manageStateToken creates the secret containing the token with which the
+// workspace's runs authenticate to the state server
+func (r *WorkspaceReconciler) manageStateToken(ctx context.Context, ws *v1alpha1.Workspace) error {
+	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: backend.TokenSecretName(ws.Name)}, &corev1.Secret{})
+	if !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	secret, err := newStateTokenForWS(ws)
+	if err != nil {
+		return err
+	}
+	if err := controllerutil.SetControllerReference(ws, secret, r.Scheme); err != nil {
+		return err
+	}
+	return r.Create(ctx, secret)
+}
+
+// migrateState copies state from the kubernetes backend's secret to the HTTP
+// backend's store. Migration is deferred until the workspace's runs have
+// completed, lest they write to the kubernetes backend in the meantime. The
+// kubernetes backend's secret is left in place.
+func (r *WorkspaceReconciler) migrateState(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	var secret corev1.Secret
+	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.StateSecretName()}, &secret)
+	if kerrors.IsNotFound(err) {
+		// Nothing to migrate
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	incomplete, err := r.hasIncompleteRuns(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+	if incomplete {
+		return workspacePending("Waiting for runs to complete before migrating state"), nil
+	}
+
+	data, err := readStateFile(&secret)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := r.StateStore.Get(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		if err := r.StateStore.Put(ctx, ws, data, ""); err != nil {
+			return nil, err
+		}
+		r.recorder.Event(ws, "Normal", "StateMigrated", "Migrated state from the kubernetes backend to the http backend")
+	}
+	return nil, nil
+}
+
 func (r *WorkspaceReconciler) addFinalizers(ctx context.Context, ws v1alpha1.Workspace) (v1alpha1.Workspace, error) {
 	// Set garbage collection to use foreground deletion in the event the
 	// workspace is deleted
@@ -363,7 +603,9 @@ func (r *WorkspaceReconciler) pruneApprovals(ctx context.Context, ws v1alpha1.Wo
 	return annotations, nil
 }
 
-func (r *WorkspaceReconciler) backup(ctx context.Context, ws *v1alpha1.Workspace, secret *corev1.Secret, sfile *state) (*metav1.Condition, error) {
+// backup uploads data to the object in the workspace's backup bucket, recording
+// the serial number of the backed up state file
+func (r *WorkspaceReconciler) backup(ctx context.Context, ws *v1alpha1.Workspace, object string, data []byte, sfile *state) (*metav1.Condition, error) {
 	// Re-use client or create if not yet created
 	if r.StorageClient == nil {
 		var err error
@@ -379,17 +621,11 @@ func (r *WorkspaceReconciler) backup(ctx context.Context, ws *v1alpha1.Workspace
 		return r.handleStorageError(err, ws, "BackupError")
 	}
 
-	oh := bh.Object(ws.BackupObjectName())
-
-	// Marshal state file first to json then to yaml
-	y, err := yaml.Marshal(secret)
-	if err != nil {
-		return r.handleStorageError(err, ws, "BackupError")
-	}
+	oh := bh.Object(object)
 
 	// Copy state file to GCS
 	owriter := oh.NewWriter(ctx)
-	_, err = io.Copy(owriter, bytes.NewBuffer(y))
+	_, err = io.Copy(owriter, bytes.NewBuffer(data))
 	if err != nil {
 		return r.handleStorageError(err, ws, "BackupError")
 	}
@@ -408,72 +644,111 @@ func (r *WorkspaceReconciler) backup(ctx context.Context, ws *v1alpha1.Workspace
 func (r *WorkspaceReconciler) restore(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
 	var secret corev1.Secret
 
+	data, cond, err := r.downloadBackup(ctx, ws, ws.BackupObjectName())
+	if data == nil {
+		return cond, err
+	}
+
+	// Unmarshal state file into secret obj
+	if err := yaml.Unmarshal(data, &secret); err != nil {
+		return r.handleStorageError(err, ws, "RestoreError")
+	}
+
+	// Blank out certain fields to avoid errors upon create
+	secret.ResourceVersion = ""
+	secret.OwnerReferences = nil
+
+	if err := r.Create(ctx, &secret); err != nil {
+		return r.handleStorageError(err, ws, "RestoreError")
+	}
+
+	// Parse state file
+	state, err := readState(ctx, &secret)
+	if err != nil {
+		return r.handleStorageError(err, ws, "RestoreError")
+	}
+
+	// Record in status that a backup with the given serial number exists.
+	ws.Status.BackupSerial = &state.Serial
+
+	r.recorder.Eventf(ws, "Normal", "RestoreSuccessful", "Restored state #%d", state.Serial)
+
+	return nil, nil
+}
+
+// restoreStateFile restores a workspace's state to the HTTP backend's store
+func (r *WorkspaceReconciler) restoreStateFile(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	data, cond, err := r.downloadBackup(ctx, ws, ws.StateFileBackupObjectName())
+	if data == nil {
+		return cond, err
+	}
+
+	state, err := parseState(data)
+	if err != nil {
+		return r.handleStorageError(err, ws, "RestoreError")
+	}
+
+	if err := r.StateStore.Put(ctx, ws, data, ""); err != nil {
+		return r.handleStorageError(err, ws, "RestoreError")
+	}
+
+	// Record in status that a backup with the given serial number exists.
+	ws.Status.BackupSerial = &state.Serial
+
+	r.recorder.Eventf(ws, "Normal", "RestoreSuccessful", "Restored state #%d", state.Serial)
+
+	return nil, nil
+}
+
+// downloadBackup downloads the object from the workspace's backup bucket. Nil
+// data is returned if there is no such object or an error occurs.
+func (r *WorkspaceReconciler) downloadBackup(ctx context.Context, ws *v1alpha1.Workspace, object string) ([]byte, *metav1.Condition, error) {
 	// Re-use client or create if not yet created
 	if r.StorageClient == nil {
 		var err error
 		r.StorageClient, err = storage.NewClient(ctx)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	bh := r.StorageClient.Bucket(ws.Spec.BackupBucket)
 	_, err := bh.Attrs(ctx)
 	if err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
+		cond, err := r.handleStorageError(err, ws, "RestoreError")
+		return nil, cond, err
 	}
 
 	// Try to retrieve existing backup
-	oh := bh.Object(ws.BackupObjectName())
+	oh := bh.Object(object)
 	_, err = oh.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		r.recorder.Eventf(ws, "Normal", "RestoreSkipped", "There is no state to restore")
-		return nil, nil
+		return nil, nil, nil
 	} else if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	oreader, err := oh.NewReader(ctx)
 	if err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
+		cond, err := r.handleStorageError(err, ws, "RestoreError")
+		return nil, cond, err
 	}
 
 	// Copy state file from GCS
 	buf := new(bytes.Buffer)
 	_, err = io.Copy(buf, oreader)
 	if err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
-	}
-
-	// Unmarshal state file into secret obj
-	if err := yaml.Unmarshal(buf.Bytes(), &secret); err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
+		cond, err := r.handleStorageError(err, ws, "RestoreError")
+		return nil, cond, err
 	}
 
 	if err := oreader.Close(); err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
-	}
-
-	// Blank out certain fields to avoid errors upon create
-	secret.ResourceVersion = ""
-	secret.OwnerReferences = nil
-
-	if err := r.Create(ctx, &secret); err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
-	}
-
-	// Parse state file
-	state, err := readState(ctx, &secret)
-	if err != nil {
-		return r.handleStorageError(err, ws, "RestoreError")
+		cond, err := r.handleStorageError(err, ws, "RestoreError")
+		return nil, cond, err
 	}
 
-	// Record in status that a backup with the given serial number exists.
-	ws.Status.BackupSerial = &state.Serial
-
-	r.recorder.Eventf(ws, "Normal", "RestoreSuccessful", "Restored state #%d", state.Serial)
-
-	return nil, nil
+	return buf.Bytes(), nil, nil
 }
 
 // Handle errors from the Google Cloud storage client
@@ -498,10 +773,12 @@ func (r *WorkspaceReconciler) manageBuiltins(ctx context.Context, ws *v1alpha1.W
 	log := log.FromContext(ctx)
 
 	// Manage ConfigMap containing built-in terraform config for workspace
+	desired := newBuiltinsForWS(ws, r.PluginCacheOffline, r.StateServerURL, r.StateServerCA)
+
 	var builtins corev1.ConfigMap
 	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.BuiltinsConfigMapName()}, &builtins)
 	if kerrors.IsNotFound(err) {
-		builtins := *newBuiltinsForWS(ws)
+		builtins := *desired
 
 		if err := controllerutil.SetControllerReference(ws, &builtins, r.Scheme); err != nil {
 			log.Error(err, "unable to set config map ownership")
@@ -517,6 +794,16 @@ func (r *WorkspaceReconciler) manageBuiltins(ctx context.Context, ws *v1alpha1.W
 		log.Error(err, "unable to get configmap for builtins")
 		return nil, err
 	}
+
+	// Builtins depend upon workspace spec and operator config, either of which
+	// may have since changed
+	if !reflect.DeepEqual(builtins.Data, desired.Data) {
+		builtins.Data = desired.Data
+		if err := r.Update(ctx, &builtins); err != nil {
+			log.Error(err, "unable to update configmap for builtins")
+			return nil, err
+		}
+	}
 	return nil, nil
 }
 
@@ -539,15 +826,50 @@ func (r *WorkspaceReconciler) manageQueue(ctx context.Context, ws *v1alpha1.Work
 func (r *WorkspaceReconciler) managePod(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
 	log := log.FromContext(ctx)
 
+	if ws.CacheMode() == v1alpha1.CacheModeEphemeral {
+		// Runs install terraform themselves, so delete any pod left over from
+		// a previous cache mode
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ws.Namespace, Name: ws.PodName()}}
+		return nil, r.deleteObsolete(ctx, ws, pod, "pod")
+	}
+
+	remaining, scaleDown, err := r.idleRemaining(ctx, ws)
+	if err != nil {
+		return workspaceFailure(err.Error()), nil
+	}
+	idle := scaleDown && remaining <= 0
+
 	var pod corev1.Pod
-	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.PodName()}, &pod)
+	err = r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.PodName()}, &pod)
 	if kerrors.IsNotFound(err) {
-		pod, err := workspacePod(ws, r.Image)
-		if err != nil {
-			log.Error(err, "unable to construct pod")
+		if idle {
+			// Pod is re-created upon the next run
+			return nil, nil
+		}
+
+		// Don't create the pod until its cache is available
+		var pvc corev1.PersistentVolumeClaim
+		if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.PVCName()}, &pvc); err != nil {
+			if kerrors.IsNotFound(err) {
+				return workspacePending("Waiting for cache to be created"), nil
+			}
+			return nil, err
+		}
+		if pvc.DeletionTimestamp != nil {
+			return workspacePending("Waiting for old cache to be deleted"), nil
+		}
+
+		// Nor whilst the cache is being migrated
+		var migration corev1.PersistentVolumeClaim
+		err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: cacheMigrationPVCName(ws)}, &migration)
+		if err == nil && migration.DeletionTimestamp == nil {
+			return workspacePending("Waiting for cache to be migrated"), nil
+		} else if client.IgnoreNotFound(err) != nil {
 			return nil, err
 		}
 
+		pod := workspacePod(ws, r.Image, r.TerraformMirror)
+
 		if err := controllerutil.SetControllerReference(ws, pod, r.Scheme); err != nil {
 			log.Error(err, "unable to set pod ownership")
 			return nil, err
@@ -560,21 +882,48 @@ func (r *WorkspaceReconciler) managePod(ctx context.Context, ws *v1alpha1.Worksp
 
 		// TODO: event
 		//podOK(ws, v1alpha1.PendingReason, "Creating pod")
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionFalse, v1alpha1.InstallingReason, "Installing terraform "+ws.Spec.TerraformVersion)
 		return workspacePending("Creating pod"), nil
 	} else if err != nil {
 		log.Error(err, "unable to get pod")
 		return nil, err
 	}
 
+	if idle {
+		if err := r.Delete(ctx, &pod); err != nil {
+			log.Error(err, "unable to delete idle pod")
+			return nil, err
+		}
+		r.recorder.Eventf(ws, "Normal", "ScaledDown", "Deleted pod after workspace was idle for %s", ws.Spec.Cache.IdleTimeout)
+		return nil, nil
+	}
+
+	if pod.DeletionTimestamp != nil {
+		return workspacePending("Waiting for pod to be deleted"), nil
+	}
+
+	// Re-install terraform if the version or mirror has changed
+	if installerChanged(&pod, workspacePod(ws, r.Image, r.TerraformMirror)) {
+		return r.reinstall(ctx, ws, &pod)
+	}
+
+	installed := "Installed terraform " + ws.Spec.TerraformVersion
+
 	switch phase := pod.Status.Phase; phase {
 	case corev1.PodRunning:
 		// TODO: event
-		break
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionTrue, v1alpha1.InstalledReason, installed)
 	case corev1.PodPending:
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionFalse, v1alpha1.InstallingReason, "Installing terraform "+ws.Spec.TerraformVersion)
 		return workspacePending("Pod in pending phase"), nil
 	case corev1.PodFailed:
 		return workspaceFailure("Pod failed"), nil
 	case corev1.PodSucceeded:
+		if ws.CacheMode() == v1alpha1.CacheModeShared {
+			// Pod exits once terraform is installed
+			setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionTrue, v1alpha1.InstalledReason, installed)
+			break
+		}
 		return workspaceFailure("Pod unexpectedly exited"), nil
 	default:
 		return workspaceUnknown("Pod state unknown"), nil
@@ -582,47 +931,182 @@ func (r *WorkspaceReconciler) managePod(ctx context.Context, ws *v1alpha1.Worksp
 	return nil, nil
 }
 
-// manageRBACForNamespace creates RBAC resources in the Workspace's namespace if
-// they don't already exist. They don't belong to the Workspace nor does the
-// Workspace rely on them. But a Run in the namespace does; its Pod relies on
-// the privileges to carry out k8s API calls (e.g. terraform talking to its
-// state residing in a Secret). A user may also add annotations to the
-// ServiceAccount to enable things like Workspace Identity.
-func (r *WorkspaceReconciler) manageRBACForNamespace(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+// deleteObsolete deletes a resource belonging to the workspace that is
+// obsolete in the workspace's current cache mode, if it exists.
+func (r *WorkspaceReconciler) deleteObsolete(ctx context.Context, ws *v1alpha1.Workspace, obj client.Object, kind string) error {
 	log := log.FromContext(ctx)
 
-	var serviceAccount corev1.ServiceAccount
-	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ServiceAccountName}, &serviceAccount); err != nil {
+	if err := r.Delete(ctx, obj); err != nil {
 		if kerrors.IsNotFound(err) {
-			serviceAccount := *newServiceAccountForNamespace(ws)
-
-			if err = r.Create(ctx, &serviceAccount); err != nil {
-				log.Error(err, "unable to create service account")
-				return nil, err
-			}
-		} else if err != nil {
-			log.Error(err, "unable to get service account")
-			return nil, err
+			return nil
 		}
+		log.Error(err, "unable to delete obsolete "+kind)
+		return err
 	}
+	r.recorder.Eventf(ws, "Normal", "DeletedObsolete", "Deleted %s not used in %s cache mode", kind, ws.CacheMode())
+	return nil
+}
 
-	var role rbacv1.Role
-	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: RoleName}, &role); err != nil {
-		if kerrors.IsNotFound(err) {
-			role := *newRoleForNamespace(ws)
-
-			if err = r.Create(ctx, &role); err != nil {
-				log.Error(err, "unable to create role")
-				return nil, err
-			}
-		} else if err != nil {
-			log.Error(err, "unable to get role")
-			return nil, err
-		}
+// installerChanged determines whether the pod's installer differs from that of
+// the desired pod, i.e. the terraform version, the mirror, or the image or
+// environment of the installer has changed.
+func installerChanged(pod, desired *corev1.Pod) bool {
+	if len(pod.Spec.InitContainers) == 0 {
+		return false
+	}
+	have, want := pod.Spec.InitContainers[0], desired.Spec.InitContainers[0]
+	if have.Image != want.Image {
+		return true
+	}
+	if !reflect.DeepEqual(have.Args, want.Args) {
+		return true
 	}
+	// Treat a nil environment as equal to an empty environment
+	if len(have.Env) == 0 && len(want.Env) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(have.Env, want.Env)
+}
 
-	var binding rbacv1.RoleBinding
-	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: RoleBindingName}, &binding); err != nil {
+// reinstall deletes the workspace pod so that it is re-created with the new
+// installer, once the workspace's runs have completed.
+func (r *WorkspaceReconciler) reinstall(ctx context.Context, ws *v1alpha1.Workspace, pod *corev1.Pod) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	busy, err := r.hasIncompleteRuns(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+	if busy {
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionFalse, v1alpha1.ReinstallPendingReason, "Waiting for runs to complete before installing terraform "+ws.Spec.TerraformVersion)
+		return workspacePending("Waiting for runs to complete before installing terraform"), nil
+	}
+
+	if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to delete pod")
+		return nil, err
+	}
+	r.recorder.Eventf(ws, "Normal", "Reinstalling", "Re-creating pod to install terraform %s", ws.Spec.TerraformVersion)
+
+	setWorkspaceCondition(ws, v1alpha1.WorkspaceTerraformInstalledCondition, metav1.ConditionFalse, v1alpha1.InstallingReason, "Installing terraform "+ws.Spec.TerraformVersion)
+	return workspacePending("Re-installing terraform"), nil
+}
+
+// idleRemaining returns the time remaining before a workspace is deemed idle
+// and its pod deleted. The boolean is false if the pod is not to be deleted,
+// either because idle scale-down is not enabled or because the workspace has
+// an incomplete run.
+func (r *WorkspaceReconciler) idleRemaining(ctx context.Context, ws *v1alpha1.Workspace) (time.Duration, bool, error) {
+	if ws.CacheMode() != v1alpha1.CacheModePinned || ws.Spec.Cache.IdleTimeout == "" {
+		return 0, false, nil
+	}
+
+	timeout, err := time.ParseDuration(ws.Spec.Cache.IdleTimeout)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid idle timeout: %w", err)
+	}
+
+	runs, err := r.workspaceRuns(ctx, ws)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Determine when the workspace was last active
+	last := ws.CreationTimestamp.Time
+	for _, run := range runs {
+		if !run.IsDone() {
+			return 0, false, nil
+		}
+		if run.CreationTimestamp.After(last) {
+			last = run.CreationTimestamp.Time
+		}
+		for _, cond := range run.Conditions {
+			if cond.LastTransitionTime.After(last) {
+				last = cond.LastTransitionTime.Time
+			}
+		}
+	}
+
+	return time.Until(last.Add(timeout)), true, nil
+}
+
+// workspaceRuns returns the workspace's runs. Runs are selected using the
+// spec.workspace index set up by the run controller.
+func (r *WorkspaceReconciler) workspaceRuns(ctx context.Context, ws *v1alpha1.Workspace) ([]v1alpha1.Run, error) {
+	runlist := &v1alpha1.RunList{}
+	if err := r.List(ctx, runlist, client.InNamespace(ws.Namespace), client.MatchingFields{
+		"spec.workspace": ws.Name,
+	}); err != nil {
+		return nil, err
+	}
+
+	var runs []v1alpha1.Run
+	for _, run := range runlist.Items {
+		// Clients without the index, such as the fake client, ignore the
+		// field selector
+		if run.Workspace == ws.Name {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// hasIncompleteRuns determines whether the workspace has runs that have yet to
+// complete. Disruptive changes to the workspace are deferred until they have.
+func (r *WorkspaceReconciler) hasIncompleteRuns(ctx context.Context, ws *v1alpha1.Workspace) (bool, error) {
+	runs, err := r.workspaceRuns(ctx, ws)
+	if err != nil {
+		return false, err
+	}
+	for _, run := range runs {
+		if !run.IsDone() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// manageRBACForNamespace creates RBAC resources in the Workspace's namespace if
+// they don't already exist. They don't belong to the Workspace nor does the
+// Workspace rely on them. But a Run in the namespace does; its Pod relies on
+// the privileges to carry out k8s API calls (e.g. terraform talking to its
+// state residing in a Secret). A user may also add annotations to the
+// ServiceAccount to enable things like Workspace Identity.
+func (r *WorkspaceReconciler) manageRBACForNamespace(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	var serviceAccount corev1.ServiceAccount
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ServiceAccountName}, &serviceAccount); err != nil {
+		if kerrors.IsNotFound(err) {
+			serviceAccount := *newServiceAccountForNamespace(ws)
+
+			if err = r.Create(ctx, &serviceAccount); err != nil {
+				log.Error(err, "unable to create service account")
+				return nil, err
+			}
+		} else if err != nil {
+			log.Error(err, "unable to get service account")
+			return nil, err
+		}
+	}
+
+	var role rbacv1.Role
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: RoleName}, &role); err != nil {
+		if kerrors.IsNotFound(err) {
+			role := *newRoleForNamespace(ws)
+
+			if err = r.Create(ctx, &role); err != nil {
+				log.Error(err, "unable to create role")
+				return nil, err
+			}
+		} else if err != nil {
+			log.Error(err, "unable to get role")
+			return nil, err
+		}
+	}
+
+	var binding rbacv1.RoleBinding
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: RoleBindingName}, &binding); err != nil {
 		if kerrors.IsNotFound(err) {
 			binding := *newRoleBindingForNamespace(ws)
 
@@ -636,16 +1120,163 @@ func (r *WorkspaceReconciler) manageRBACForNamespace(ctx context.Context, ws *v1
 		}
 	}
 
+	return r.manageRBACForWorkspace(ctx, ws)
+}
+
+// manageRBACForWorkspace manages the workspace's dedicated service account,
+// creating it if it does not exist, and binding the namespace's role to it.
+func (r *WorkspaceReconciler) manageRBACForWorkspace(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	var binding rbacv1.RoleBinding
+	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: workspaceRoleBindingName(ws)}, &binding)
+	if err != nil && !kerrors.IsNotFound(err) {
+		log.Error(err, "unable to get workspace binding")
+		return nil, err
+	}
+	bindingFound := err == nil
+
+	if !hasDedicatedServiceAccount(ws) {
+		// Revoke permissions from any service account previously used by the
+		// workspace
+		if bindingFound && metav1.IsControlledBy(&binding, ws) {
+			if err := r.Delete(ctx, &binding); err != nil && !kerrors.IsNotFound(err) {
+				log.Error(err, "unable to delete workspace binding")
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	var serviceAccount corev1.ServiceAccount
+	err = r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: serviceAccountName(ws)}, &serviceAccount)
+	if kerrors.IsNotFound(err) {
+		serviceAccount := *newServiceAccountForWS(ws)
+
+		if err := controllerutil.SetControllerReference(ws, &serviceAccount, r.Scheme); err != nil {
+			log.Error(err, "unable to set service account ownership")
+			return nil, err
+		}
+
+		if err = r.Create(ctx, &serviceAccount); err != nil {
+			log.Error(err, "unable to create service account")
+			return nil, err
+		}
+	} else if err != nil {
+		log.Error(err, "unable to get service account")
+		return nil, err
+	} else if !metav1.IsControlledBy(&serviceAccount, ws) && serviceAccount.Labels[labels.Workspace(ws.Name).Name] != ws.Name {
+		// Only grant permissions to a service account created for the
+		// workspace or labelled for the workspace. The validating webhook
+		// rejects other service accounts, but it may not be installed.
+		msg := fmt.Sprintf("Service account %s was neither created for the workspace nor labelled %s=%s", serviceAccount.Name, labels.Workspace(ws.Name).Name, ws.Name)
+		if bindingFound && metav1.IsControlledBy(&binding, ws) {
+			if err := r.Delete(ctx, &binding); err != nil && !kerrors.IsNotFound(err) {
+				log.Error(err, "unable to delete workspace binding")
+				return nil, err
+			}
+		}
+		return workspaceFailure(msg), nil
+	} else if metav1.IsControlledBy(&serviceAccount, ws) && !annotationsApplied(serviceAccount.Annotations, ws.Spec.ServiceAccountAnnotations) {
+		// Keep annotations of a service account created by the operator in
+		// sync with the workspace
+		if serviceAccount.Annotations == nil {
+			serviceAccount.Annotations = make(map[string]string)
+		}
+		for k, v := range ws.Spec.ServiceAccountAnnotations {
+			serviceAccount.Annotations[k] = v
+		}
+		if err := r.Update(ctx, &serviceAccount); err != nil {
+			log.Error(err, "unable to update service account")
+			return nil, err
+		}
+	}
+
+	desired := newRoleBindingForWS(ws)
+	if !bindingFound {
+		if err := controllerutil.SetControllerReference(ws, desired, r.Scheme); err != nil {
+			log.Error(err, "unable to set binding ownership")
+			return nil, err
+		}
+
+		if err := r.Create(ctx, desired); err != nil {
+			log.Error(err, "unable to create workspace binding")
+			return nil, err
+		}
+	} else if !reflect.DeepEqual(binding.Subjects, desired.Subjects) {
+		// Service account has changed
+		binding.Subjects = desired.Subjects
+		if err := r.Update(ctx, &binding); err != nil {
+			log.Error(err, "unable to update workspace binding")
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// annotationsApplied determines whether the wanted annotations are present
+func annotationsApplied(existing, wanted map[string]string) bool {
+	for k, v := range wanted {
+		if existing[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// manageCredentials reports whether the workspace's credential secrets exist.
+// Missing secrets don't prevent the workspace from becoming ready, but runs
+// remain pending until they exist.
+func (r *WorkspaceReconciler) manageCredentials(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	if len(ws.Spec.CredentialSecrets) == 0 {
+		meta.RemoveStatusCondition(&ws.Status.Conditions, v1alpha1.WorkspaceCredentialsReadyCondition)
+		return nil, nil
+	}
+
+	var missing []string
+	for _, cs := range ws.Spec.CredentialSecrets {
+		err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: cs.Name}, &corev1.Secret{})
+		if kerrors.IsNotFound(err) {
+			missing = append(missing, cs.Name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(missing) > 0 {
+		msg := "Credential secrets not found: " + strings.Join(missing, ", ")
+		if existing := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCredentialsReadyCondition); existing == nil || existing.Message != msg {
+			r.recorder.Event(ws, "Warning", v1alpha1.SecretNotFoundReason, msg)
+		}
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCredentialsReadyCondition, metav1.ConditionFalse, v1alpha1.SecretNotFoundReason, msg)
+		return nil, nil
+	}
+
+	setWorkspaceCondition(ws, v1alpha1.WorkspaceCredentialsReadyCondition, metav1.ConditionTrue, v1alpha1.SecretsFoundReason, "")
 	return nil, nil
 }
 
 func (r *WorkspaceReconciler) managePVC(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
 	log := log.FromContext(ctx)
 
+	if ws.CacheMode() == v1alpha1.CacheModeEphemeral {
+		// Each run provisions its own cache, so delete any cache left over
+		// from a previous cache mode
+		pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: ws.Namespace, Name: ws.PVCName()}}
+		return nil, r.deleteObsolete(ctx, ws, pvc, "cache")
+	}
+
+	desired, err := newPVCForWS(ws)
+	if err != nil {
+		// Only possible if the validating webhook is not installed
+		return workspaceFailure(err.Error()), nil
+	}
+
 	var pvc corev1.PersistentVolumeClaim
-	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.PVCName()}, &pvc)
+	err = r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.PVCName()}, &pvc)
 	if kerrors.IsNotFound(err) {
-		pvc := *newPVCForWS(ws)
+		pvc := *desired
 
 		if err := controllerutil.SetControllerReference(ws, &pvc, r.Scheme); err != nil {
 			log.Error(err, "unable to set PVC ownership")
@@ -657,25 +1288,434 @@ func (r *WorkspaceReconciler) managePVC(ctx context.Context, ws *v1alpha1.Worksp
 			return nil, err
 		}
 		//cacheOK(ws, v1alpha1.PendingReason, "PVC is being created")
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheProvisioningReason, "Creating PVC")
 		return workspacePending("Creating PVC"), nil
 	} else if err != nil {
 		log.Error(err, "unable to get PVC")
 		return nil, err
 	}
 
+	if pvc.DeletionTimestamp != nil {
+		// Old cache is being deleted as part of a migration
+		return workspacePending("Waiting for old cache to be deleted"), nil
+	}
+
+	if cacheNeedsMigration(&pvc, desired) {
+		return r.migrateCache(ctx, ws, &pvc, desired)
+	}
+
+	if cond, err := r.restoreCache(ctx, ws, &pvc); cond != nil || err != nil {
+		return cond, err
+	}
+
+	resizing, err := r.resizeCache(ctx, ws, &pvc, desired)
+	if err != nil {
+		return nil, err
+	}
+
 	switch pvc.Status.Phase {
 	case corev1.ClaimLost:
 		r.recorder.Event(ws, "Warning", "CacheLost", "Cache persistent volume has been lost")
 		return nil, errors.New("PVC has lost its persistent volume")
 	case corev1.ClaimPending:
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheProvisioningReason, "Cache's PVC in pending state")
 		return workspacePending("Cache's PVC in pending state"), nil
 	case corev1.ClaimBound:
+		if !resizing {
+			setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionTrue, v1alpha1.CacheBoundReason, "")
+		}
 		return nil, nil
 	default:
 		return workspaceUnknown("Cache PVC status unknown"), nil
 	}
 }
 
+// cacheNeedsMigration determines whether the PVC must be re-created to match
+// the desired PVC, because the storage class or access mode has changed.
+func cacheNeedsMigration(pvc, desired *corev1.PersistentVolumeClaim) bool {
+	if !reflect.DeepEqual(pvc.Spec.AccessModes, desired.Spec.AccessModes) {
+		return true
+	}
+	// A nil storage class leaves the choice of class to the cluster
+	if desired.Spec.StorageClassName == nil {
+		return false
+	}
+	if pvc.Spec.StorageClassName == nil {
+		return true
+	}
+	return *pvc.Spec.StorageClassName != *desired.Spec.StorageClassName
+}
+
+// migrateCache migrates the cache to a PVC with the new spec, once the
+// workspace's runs have completed. PVCs cannot be changed in place, so the
+// workspace pod using the cache is deleted, and the contents of the cache are
+// copied to a temporary PVC with the new spec. The cache's PVC is then deleted,
+// and once it has been re-created with the new spec, restoreCache copies the
+// contents back.
+func (r *WorkspaceReconciler) migrateCache(ctx context.Context, ws *v1alpha1.Workspace, pvc, desired *corev1.PersistentVolumeClaim) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	busy, err := r.hasIncompleteRuns(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+	if busy {
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheMigrationPendingReason, "Waiting for runs to complete before migrating cache")
+		return workspacePending("Waiting for runs to complete before migrating cache"), nil
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: ws.Namespace, Name: ws.PodName()}}
+	if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to delete pod")
+		return nil, err
+	}
+
+	migration := desired.DeepCopy()
+	migration.Name = cacheMigrationPVCName(ws)
+	if err := controllerutil.SetControllerReference(ws, migration, r.Scheme); err != nil {
+		log.Error(err, "unable to set PVC ownership")
+		return nil, err
+	}
+	if err := r.Create(ctx, migration); err != nil && !kerrors.IsAlreadyExists(err) {
+		log.Error(err, "unable to create migration PVC")
+		return nil, err
+	}
+
+	copied, cond, err := r.copyCache(ctx, ws, ws.PVCName()+"-migrate-out", pvc.Name, migration.Name)
+	if !copied {
+		return cond, err
+	}
+
+	if err := r.Delete(ctx, pvc); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to delete PVC")
+		return nil, err
+	}
+	r.recorder.Event(ws, "Normal", "MigratingCache", "Re-creating cache with new storage class or access mode")
+
+	setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheMigratingReason, "Re-creating cache with new storage class or access mode")
+	return workspacePending("Migrating cache"), nil
+}
+
+// restoreCache completes a migration of the cache, copying the contents of the
+// temporary PVC to the re-created cache's PVC, and then deleting the temporary
+// PVC. Nothing is done if no migration is in progress.
+func (r *WorkspaceReconciler) restoreCache(ctx context.Context, ws *v1alpha1.Workspace, pvc *corev1.PersistentVolumeClaim) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	var migration corev1.PersistentVolumeClaim
+	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: cacheMigrationPVCName(ws)}, &migration)
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		log.Error(err, "unable to get migration PVC")
+		return nil, err
+	}
+	if migration.DeletionTimestamp != nil {
+		// Migration has completed
+		return nil, nil
+	}
+
+	copied, cond, err := r.copyCache(ctx, ws, ws.PVCName()+"-migrate-in", migration.Name, pvc.Name)
+	if !copied {
+		return cond, err
+	}
+
+	if err := r.Delete(ctx, &migration); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "unable to delete migration PVC")
+		return nil, err
+	}
+	r.recorder.Event(ws, "Normal", "MigratedCache", "Migrated cache to new storage class or access mode")
+
+	return nil, nil
+}
+
+// copyCache copies the contents of the src PVC to the dst PVC, using a pod
+// with the given name. Returns true once the copy has completed, otherwise a
+// condition reporting its progress.
+func (r *WorkspaceReconciler) copyCache(ctx context.Context, ws *v1alpha1.Workspace, name, src, dst string) (bool, *metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	var pod corev1.Pod
+	err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: name}, &pod)
+	if kerrors.IsNotFound(err) {
+		pod := cacheCopyPod(ws, name, src, dst, r.Image)
+
+		if err := controllerutil.SetControllerReference(ws, pod, r.Scheme); err != nil {
+			log.Error(err, "unable to set pod ownership")
+			return false, nil, err
+		}
+
+		if err := r.Create(ctx, pod); err != nil {
+			log.Error(err, "unable to create cache copy pod")
+			return false, nil, err
+		}
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheMigratingReason, "Copying cache from "+src+" to "+dst)
+		return false, workspacePending("Migrating cache"), nil
+	} else if err != nil {
+		log.Error(err, "unable to get cache copy pod")
+		return false, nil, err
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		if err := r.Delete(ctx, &pod); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to delete cache copy pod")
+			return false, nil, err
+		}
+		return true, nil, nil
+	case corev1.PodFailed:
+		// Delete the pod so that the copy is retried
+		if err := r.Delete(ctx, &pod); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to delete cache copy pod")
+			return false, nil, err
+		}
+		msg := "Failed to copy cache from " + src + " to " + dst
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheMigrationFailedReason, msg)
+		r.recorder.Event(ws, "Warning", v1alpha1.CacheMigrationFailedReason, msg)
+		return false, workspaceFailure(msg), nil
+	default:
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheMigratingReason, "Copying cache from "+src+" to "+dst)
+		return false, workspacePending("Migrating cache"), nil
+	}
+}
+
+// cacheMigrationPVCName returns the name of the temporary PVC holding the
+// contents of the workspace's cache whilst the cache is migrated
+func cacheMigrationPVCName(ws *v1alpha1.Workspace) string {
+	return ws.PVCName() + "-migration"
+}
+
+// resizeCache expands the cache's PVC if the requested size has increased and
+// its storage class permits expansion. Returns true if the cache is being
+// resized or cannot be resized.
+func (r *WorkspaceReconciler) resizeCache(ctx context.Context, ws *v1alpha1.Workspace, pvc, desired *corev1.PersistentVolumeClaim) (bool, error) {
+	log := log.FromContext(ctx)
+
+	want := desired.Spec.Resources.Requests[corev1.ResourceStorage]
+	have := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	switch want.Cmp(have) {
+	case 0:
+		// Expansion may still be in progress
+		if capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]; ok && capacity.Cmp(have) < 0 {
+			setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheResizingReason, "Expanding cache to "+have.String())
+			return true, nil
+		}
+		return false, nil
+	case -1:
+		msg := fmt.Sprintf("Cache cannot be shrunk from %s to %s", have.String(), want.String())
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheResizeUnsupportedReason, msg)
+		r.recorder.Event(ws, "Warning", v1alpha1.CacheResizeUnsupportedReason, msg)
+		return true, nil
+	}
+
+	allowed, err := r.expansionAllowed(ctx, pvc)
+	if err != nil {
+		return false, err
+	}
+	if !allowed {
+		msg := "Storage class of cache does not permit volume expansion"
+		setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheResizeUnsupportedReason, msg)
+		r.recorder.Event(ws, "Warning", v1alpha1.CacheResizeUnsupportedReason, msg)
+		return true, nil
+	}
+
+	pvc.Spec.Resources.Requests[corev1.ResourceStorage] = want
+	if err := r.Update(ctx, pvc); err != nil {
+		log.Error(err, "unable to update PVC")
+		return false, err
+	}
+	r.recorder.Eventf(ws, "Normal", "ExpandingCache", "Expanding cache from %s to %s", have.String(), want.String())
+
+	setWorkspaceCondition(ws, v1alpha1.WorkspaceCacheReadyCondition, metav1.ConditionFalse, v1alpha1.CacheResizingReason, "Expanding cache to "+want.String())
+	return true, nil
+}
+
+// expansionAllowed determines whether the PVC's storage class permits volume
+// expansion
+func (r *WorkspaceReconciler) expansionAllowed(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+
+	var class storagev1.StorageClass
+	if err := r.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, &class); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return class.AllowVolumeExpansion != nil && *class.AllowVolumeExpansion, nil
+}
+
+// manageSharedPluginCache provides the shared plugin cache to the workspace's
+// namespace if the workspace uses it. The cache is created once, in the plugin
+// cache namespace, and its persistent volume is then bound to a PVC in each
+// namespace that uses it, via a persistent volume referencing the same
+// storage. Neither the PVCs nor the persistent volumes belong to the
+// workspace; they persist for the benefit of other workspaces.
+func (r *WorkspaceReconciler) manageSharedPluginCache(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	if !ws.Spec.Cache.SharedPlugins {
+		return nil, nil
+	}
+
+	if r.PluginCacheStorageClass == nil {
+		r.warnOnce(ws, "SharedPluginCacheDisabled", "Shared plugin cache is not enabled on the operator")
+		return nil, nil
+	}
+	r.clearWarning(ws, "SharedPluginCacheDisabled")
+
+	source, cond, err := r.getOrCreateSharedPluginCachePVC(ctx, ws, newSharedPluginCachePVC(r.PluginCacheNamespace, r.PluginCacheSize, r.PluginCacheStorageClass))
+	if cond != nil || err != nil {
+		return cond, err
+	}
+
+	var volume corev1.PersistentVolume
+	if err := r.Get(ctx, types.NamespacedName{Name: source.Spec.VolumeName}, &volume); err != nil {
+		log.Error(err, "unable to get shared plugin cache persistent volume")
+		return nil, err
+	}
+
+	if volume.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		// Retain the storage should the cache's PVC be deleted, lest it be
+		// deleted from under the other namespaces referencing it
+		patch := client.MergeFrom(volume.DeepCopy())
+		volume.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+		if err := r.Patch(ctx, &volume, patch); err != nil {
+			log.Error(err, "unable to retain shared plugin cache persistent volume")
+			return nil, err
+		}
+	}
+
+	if ws.Namespace == r.PluginCacheNamespace {
+		// Workspace can use the cache's PVC directly
+		return nil, nil
+	}
+
+	if !shareableVolume(&volume) {
+		return workspaceFailure(fmt.Sprintf("Shared plugin cache persistent volume %s cannot be shared across namespaces: it must be an NFS, hostPath or ReadWriteMany CSI volume", volume.Name)), nil
+	}
+
+	pv := newSharedPluginCachePV(&volume, ws.Namespace)
+	err = r.Get(ctx, types.NamespacedName{Name: pv.Name}, &corev1.PersistentVolume{})
+	if kerrors.IsNotFound(err) {
+		if err := r.Create(ctx, pv); err != nil {
+			log.Error(err, "unable to create shared plugin cache persistent volume")
+			return nil, err
+		}
+	} else if err != nil {
+		log.Error(err, "unable to get shared plugin cache persistent volume")
+		return nil, err
+	}
+
+	_, cond, err = r.getOrCreateSharedPluginCachePVC(ctx, ws, newSharedPluginCacheClaim(pv, ws.Namespace))
+	return cond, err
+}
+
+// shareableVolume determines whether the persistent volume's storage can be
+// safely referenced by persistent volumes in several namespaces at once
+func shareableVolume(pv *corev1.PersistentVolume) bool {
+	switch {
+	case pv.Spec.NFS != nil, pv.Spec.HostPath != nil:
+		return true
+	case pv.Spec.CSI != nil:
+		for _, mode := range pv.Spec.AccessModes {
+			if mode == corev1.ReadWriteMany {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getOrCreateSharedPluginCachePVC creates the desired shared plugin cache PVC
+// if it doesn't already exist, returning the PVC once it is bound.
+func (r *WorkspaceReconciler) getOrCreateSharedPluginCachePVC(ctx context.Context, ws *v1alpha1.Workspace, desired *corev1.PersistentVolumeClaim) (*corev1.PersistentVolumeClaim, *metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, types.NamespacedName{Namespace: desired.Namespace, Name: desired.Name}, &pvc)
+	if kerrors.IsNotFound(err) {
+		if err = r.Create(ctx, desired); err != nil {
+			log.Error(err, "unable to create shared plugin cache PVC")
+			return nil, nil, err
+		}
+		return nil, workspacePending("Creating shared plugin cache PVC"), nil
+	} else if err != nil {
+		log.Error(err, "unable to get shared plugin cache PVC")
+		return nil, nil, err
+	}
+
+	switch pvc.Status.Phase {
+	case corev1.ClaimLost:
+		r.recorder.Event(ws, "Warning", "SharedPluginCacheLost", "Shared plugin cache persistent volume has been lost")
+		return nil, nil, errors.New("shared plugin cache PVC has lost its persistent volume")
+	case corev1.ClaimPending:
+		return nil, workspacePending("Shared plugin cache PVC in pending state"), nil
+	case corev1.ClaimBound:
+		return &pvc, nil, nil
+	default:
+		return nil, workspaceUnknown("Shared plugin cache PVC status unknown"), nil
+	}
+}
+
+// warnOnce records a warning event for the workspace, unless the warning has
+// already been recorded and not since cleared with clearWarning.
+func (r *WorkspaceReconciler) warnOnce(ws *v1alpha1.Workspace, reason, msg string) {
+	r.warningsMu.Lock()
+	defer r.warningsMu.Unlock()
+
+	key := string(ws.UID) + "/" + reason
+	if r.warnings[key] {
+		return
+	}
+	r.warnings[key] = true
+	r.recorder.Event(ws, "Warning", reason, msg)
+}
+
+// clearWarning permits the warning to be recorded again for the workspace
+func (r *WorkspaceReconciler) clearWarning(ws *v1alpha1.Workspace, reason string) {
+	r.warningsMu.Lock()
+	defer r.warningsMu.Unlock()
+
+	delete(r.warnings, string(ws.UID)+"/"+reason)
+}
+
+// clearWarnings forgets all the warnings recorded for the workspace
+func (r *WorkspaceReconciler) clearWarnings(ws *v1alpha1.Workspace) {
+	r.warningsMu.Lock()
+	defer r.warningsMu.Unlock()
+
+	for key := range r.warnings {
+		if strings.HasPrefix(key, string(ws.UID)+"/") {
+			delete(r.warnings, key)
+		}
+	}
+}
+
+// workspacesWithCredentialSecret returns requests for the workspaces in the
+// secret's namespace that reference the secret as a credential secret
+func (r *WorkspaceReconciler) workspacesWithCredentialSecret(secret client.Object) []ctrl.Request {
+	var workspaces v1alpha1.WorkspaceList
+	if err := r.List(context.Background(), &workspaces, client.InNamespace(secret.GetNamespace())); err != nil {
+		return []ctrl.Request{}
+	}
+
+	requests := []ctrl.Request{}
+	for _, ws := range workspaces.Items {
+		for _, cs := range ws.Spec.CredentialSecrets {
+			if cs.Name == secret.GetName() {
+				requests = append(requests, requestFromObject(&ws))
+				break
+			}
+		}
+	}
+	return requests
+}
+
 func (r *WorkspaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	blder := ctrl.NewControllerManagedBy(mgr)
 
@@ -691,7 +1731,27 @@ func (r *WorkspaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// Watch owned config maps (variables)
 	blder = blder.Owns(&corev1.ConfigMap{})
 
-	// Watch terraform state files
+	// Watch owned service accounts and role bindings
+	blder = blder.Owns(&corev1.ServiceAccount{})
+	blder = blder.Owns(&rbacv1.RoleBinding{})
+
+	// Watch the kubernetes backend's locks
+	blder = blder.Watches(&source.Kind{Type: &coordinationv1.Lease{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []ctrl.Request {
+		prefix := lockLeasePrefix + "tfstate-default-"
+		if !strings.HasPrefix(o.GetName(), prefix) {
+			return nil
+		}
+		return []ctrl.Request{
+			{
+				NamespacedName: types.NamespacedName{
+					Name:      strings.TrimPrefix(o.GetName(), prefix),
+					Namespace: o.GetNamespace(),
+				},
+			},
+		}
+	}))
+
+	// Watch terraform state files and credential secrets
 	blder = blder.Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []ctrl.Request {
 		var isStateFile bool
 		for k, v := range o.GetLabels() {
@@ -699,10 +1759,21 @@ func (r *WorkspaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				isStateFile = true
 			}
 		}
-		if !isStateFile {
-			return []ctrl.Request{}
+		if isStateFile {
+			return []ctrl.Request{requestFromObject(o)}
+		}
+		// The HTTP state backend's head secret records new versions of state
+		if ws, ok := o.GetLabels()["workspace"]; ok && o.GetName() == backend.HeadSecretName(ws) {
+			return []ctrl.Request{
+				{
+					NamespacedName: types.NamespacedName{
+						Name:      ws,
+						Namespace: o.GetNamespace(),
+					},
+				},
+			}
 		}
-		return []ctrl.Request{requestFromObject(o)}
+		return r.workspacesWithCredentialSecret(o)
 	}))
 
 	// Watch for changes to run resources and requeue the associated Workspace.
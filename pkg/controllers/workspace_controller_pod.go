@@ -1,8 +1,6 @@
 package controllers
 
 import (
-	"bytes"
-
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/pkg/labels"
 	corev1 "k8s.io/api/core/v1"
@@ -15,18 +13,17 @@ const (
 )
 
 // workspacePod returns a pod on which to setup a new etok workspace, optionally
-// downloading a custom version of terraform, within an init container, and then
-// it runs a standard container that simply idles - expressly for performance
-// reasons: it keeps a persistent volume attached to the kubernetes node, which
-// means when a run spins up a pod the volume can be mounted more quickly (that
-// does mean however that a run pod can only be scheduled to the same node as
-// the workspace pod...).
-func workspacePod(ws *v1alpha1.Workspace, image string) (*corev1.Pod, error) {
-	script := new(bytes.Buffer)
-	if err := generateScript(script, ws); err != nil {
-		return nil, err
-	}
-
+// downloading a custom version of terraform from the mirror, within an init
+// container (the workspace's mirror takes precedence).
+//
+// With the pinned cache mode, it then runs a standard container that simply
+// idles - expressly for performance reasons: it keeps a persistent volume
+// attached to the kubernetes node, which means when a run spins up a pod the
+// volume can be mounted more quickly (that does mean however that a run pod can
+// only be scheduled to the same node as the workspace pod...). With the shared
+// cache mode, the volume can be mounted on any node, so the pod exits once
+// terraform is installed.
+func workspacePod(ws *v1alpha1.Workspace, image, mirror string) *corev1.Pod {
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ws.PodName(),
@@ -43,28 +40,87 @@ func workspacePod(ws *v1alpha1.Workspace, image string) (*corev1.Pod, error) {
 				},
 			},
 			InitContainers: []corev1.Container{
+				installerContainer(ws, image, mirror),
+			},
+			RestartPolicy: corev1.RestartPolicyAlways,
+			Volumes: []corev1.Volume{
+				{
+					Name: "cache",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+							ClaimName: ws.PVCName(),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if ws.CacheMode() == v1alpha1.CacheModeShared {
+		pod.Spec.Containers[0] = corev1.Container{
+			Name:                     "installed",
+			Image:                    image,
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			Command:                  []string{"true"},
+			TerminationMessagePolicy: "FallbackToLogsOnError",
+		}
+		pod.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(pod)
+	// Permit filtering pods by workspace
+	labels.SetLabel(pod, labels.Workspace(ws.Name))
+	// Permit filtering resources by component
+	labels.SetLabel(pod, labels.WorkspaceComponent)
+
+	return pod
+}
+
+// cacheCopyPod returns a pod that copies the contents of the src PVC to the dst
+// PVC, for migrating a workspace's cache
+func cacheCopyPod(ws *v1alpha1.Workspace, name, src, dst, image string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ws.Namespace,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
 				{
-					Name:                     InstallerContainerName,
+					Name:                     "copy",
 					Image:                    image,
 					ImagePullPolicy:          corev1.PullIfNotPresent,
-					Command:                  []string{"sh", "-c", script.String()},
+					Command:                  []string{"cp", "-a", "/src/.", "/dst/"},
 					TerminationMessagePolicy: "FallbackToLogsOnError",
 					VolumeMounts: []corev1.VolumeMount{
 						{
-							Name:      "cache",
-							MountPath: binMountPath,
-							SubPath:   binSubPath,
+							Name:      "src",
+							MountPath: "/src",
+							ReadOnly:  true,
+						},
+						{
+							Name:      "dst",
+							MountPath: "/dst",
 						},
 					},
 				},
 			},
-			RestartPolicy: corev1.RestartPolicyAlways,
+			RestartPolicy: corev1.RestartPolicyNever,
 			Volumes: []corev1.Volume{
 				{
-					Name: "cache",
+					Name: "src",
 					VolumeSource: corev1.VolumeSource{
 						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-							ClaimName: ws.PVCName(),
+							ClaimName: src,
+						},
+					},
+				},
+				{
+					Name: "dst",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+							ClaimName: dst,
 						},
 					},
 				},
@@ -79,5 +135,34 @@ func workspacePod(ws *v1alpha1.Workspace, image string) (*corev1.Pod, error) {
 	// Permit filtering resources by component
 	labels.SetLabel(pod, labels.WorkspaceComponent)
 
-	return pod, nil
+	return pod
+}
+
+// installerContainer returns a container that installs the workspace's version
+// of terraform onto the cache volume, downloading it from the mirror if
+// necessary (the workspace's mirror takes precedence).
+func installerContainer(ws *v1alpha1.Workspace, image, mirror string) corev1.Container {
+	if ws.Spec.TerraformMirror != "" {
+		mirror = ws.Spec.TerraformMirror
+	}
+
+	return corev1.Container{
+		Name:            InstallerContainerName,
+		Image:           image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"etok", "install-terraform"},
+		Args: []string{
+			"--version", ws.Spec.TerraformVersion,
+			"--mirror", mirror,
+			"--bin-dir", binMountPath,
+		},
+		TerminationMessagePolicy: "FallbackToLogsOnError",
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "cache",
+				MountPath: binMountPath,
+				SubPath:   binSubPath,
+			},
+		},
+	}
 }
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/installer"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestWorkspacePod(t *testing.T) {
+	tests := []struct {
+		name       string
+		workspace  *v1alpha1.Workspace
+		mirror     string
+		assertions func(*corev1.Pod)
+	}{
+		{
+			name:      "Installer",
+			workspace: testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.14.3")),
+			mirror:    installer.DefaultMirror,
+			assertions: func(pod *corev1.Pod) {
+				assert.Equal(t, []string{"etok", "install-terraform"}, pod.Spec.InitContainers[0].Command)
+				assert.Equal(t, []string{
+					"--version", "0.14.3",
+					"--mirror", "https://releases.hashicorp.com/terraform",
+					"--bin-dir", "/terraform-bins",
+				}, pod.Spec.InitContainers[0].Args)
+			},
+		},
+		{
+			name:      "Workspace mirror overrides operator mirror",
+			workspace: testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.14.3"), testobj.WithTerraformMirror("https://mirror.example.com/terraform")),
+			mirror:    installer.DefaultMirror,
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.InitContainers[0].Args, "https://mirror.example.com/terraform")
+			},
+		},
+		{
+			name:      "Terraform binary volume mount",
+			workspace: testobj.Workspace("default", "foo"),
+			assertions: func(pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.InitContainers[0].VolumeMounts, corev1.VolumeMount{
+					Name:      "cache",
+					MountPath: "/terraform-bins",
+					SubPath:   "terraform-bins/",
+				})
+			},
+		},
+		{
+			name:      "Pinned cache",
+			workspace: testobj.Workspace("default", "foo"),
+			assertions: func(pod *corev1.Pod) {
+				assert.Equal(t, "idler", pod.Spec.Containers[0].Name)
+				assert.Equal(t, corev1.RestartPolicyAlways, pod.Spec.RestartPolicy)
+			},
+		},
+		{
+			name:      "Shared cache",
+			workspace: testobj.Workspace("default", "foo", testobj.WithCacheMode(v1alpha1.CacheModeShared)),
+			assertions: func(pod *corev1.Pod) {
+				assert.Equal(t, []string{"true"}, pod.Spec.Containers[0].Command)
+				assert.Equal(t, corev1.RestartPolicyOnFailure, pod.Spec.RestartPolicy)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.assertions(workspacePod(tt.workspace, "etok:latest", tt.mirror))
+		})
+	}
+}
@@ -2,41 +2,73 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	"cloud.google.com/go/storage"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/installer"
+	"github.com/leg100/etok/pkg/backend"
 	"github.com/leg100/etok/pkg/scheme"
 	"github.com/leg100/etok/pkg/testobj"
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestReconcileWorkspace(t *testing.T) {
 	var localPathStorageClass string = "local-path"
+	var allowExpansion = true
 
 	tests := []struct {
-		name                  string
-		workspace             *v1alpha1.Workspace
-		objs                  []runtime.Object
-		bucketObjs            []fakestorage.Object
-		workspaceAssertions   func(*testutil.T, *v1alpha1.Workspace)
-		podAssertions         func(*testutil.T, *corev1.Pod)
-		pvcAssertions         func(*testutil.T, *corev1.PersistentVolumeClaim)
-		configMapAssertions   func(*testutil.T, *corev1.ConfigMap)
-		stateAssertions       func(*testutil.T, *corev1.Secret)
-		storageAssertions     func(*testutil.T, *storage.Client)
+		name                string
+		workspace           *v1alpha1.Workspace
+		opts                []WorkspaceReconcilerOption
+		objs                []runtime.Object
+		bucketObjs          []fakestorage.Object
+		workspaceAssertions func(*testutil.T, *v1alpha1.Workspace)
+		podAssertions       func(*testutil.T, *corev1.Pod)
+		pvcAssertions       func(*testutil.T, *corev1.PersistentVolumeClaim)
+		// Assertions on the shared plugin cache PVC in the plugin cache
+		// namespace (nil if not found)
+		pluginCacheAssertions func(*testutil.T, *corev1.PersistentVolumeClaim)
+		// Assertions on the persistent volume and PVC providing the shared
+		// plugin cache to the workspace's namespace (nil if not found)
+		pluginCacheClaimAssertions func(*testutil.T, *corev1.PersistentVolume, *corev1.PersistentVolumeClaim)
+		// Assertions on the shared plugin cache's own persistent volume, named
+		// pvc-1234
+		pluginCacheVolumeAssertions func(*testutil.T, *corev1.PersistentVolume)
+		// Assertions on any other objects
+		objAssertions func(*testutil.T, client.Client)
+		// Assertions on the workspace's service account and its role binding
+		// (nil if not found)
+		serviceAccountAssertions func(*testutil.T, *corev1.ServiceAccount, *rbacv1.RoleBinding)
+		podAbsent                bool
+		pvcAbsent                bool
+		configMapAssertions      func(*testutil.T, *corev1.ConfigMap)
+		stateAssertions          func(*testutil.T, *corev1.Secret)
+		storageAssertions        func(*testutil.T, *storage.Client)
+		// Enable the HTTP state backend on the reconciler
+		stateStore           bool
+		stateStoreAssertions func(*testutil.T, *backend.Store)
+		// Assertions on the kubernetes backend's lock lease
+		leaseAssertions       func(*testutil.T, *coordinationv1.Lease)
 		disableRBACAssertions bool
 		wantErr               bool
 	}{
@@ -162,6 +194,343 @@ func TestReconcileWorkspace(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:      "Ephemeral cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheMode(v1alpha1.CacheModeEphemeral)),
+			podAbsent: true,
+			pvcAbsent: true,
+		},
+		{
+			name:      "Switched to ephemeral cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheMode(v1alpha1.CacheModeEphemeral)),
+			objs: []runtime.Object{
+				testobj.WorkspacePod("", "workspace-1"),
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound)),
+			},
+			podAbsent: true,
+			pvcAbsent: true,
+		},
+		{
+			name:      "Shared cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheMode(v1alpha1.CacheModeShared)),
+			objs:      []runtime.Object{testobj.WorkspacePod("", "workspace-1", testobj.WithPhase(corev1.PodSucceeded))},
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				assert.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}, pvc.Spec.AccessModes)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.NotEqual(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+		},
+		{
+			name:      "Idle pod deleted",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithIdleTimeout("1m")),
+			objs:      []runtime.Object{testobj.WorkspacePod("", "workspace-1", testobj.WithPhase(corev1.PodRunning))},
+			podAbsent: true,
+		},
+		{
+			name:      "Idle pod not re-created",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithIdleTimeout("1m")),
+			podAbsent: true,
+		},
+		{
+			name:      "Idle pod re-created for incomplete run",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithIdleTimeout("1m")),
+			objs: []runtime.Object{
+				testobj.Run("", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Equal(t, "idler", pod.Spec.Containers[0].Name)
+			},
+		},
+		{
+			name:      "Recently active pod not deleted",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithIdleTimeout("1m")),
+			objs: []runtime.Object{
+				testobj.WorkspacePod("", "workspace-1", testobj.WithPhase(corev1.PodRunning)),
+				testobj.Run("", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCondition(v1alpha1.RunCompleteCondition)),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Nil(t, pod.DeletionTimestamp)
+			},
+		},
+		{
+			name:      "Invalid idle timeout",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithIdleTimeout("1 fortnight")),
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+			wantErr: true,
+		},
+		{
+			name:      "Invalid cache size",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheSize("1Gb")),
+			pvcAbsent: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+			wantErr: true,
+		},
+		{
+			name:      "Terraform version changed",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithTerraformVersion("0.14.3")),
+			objs: []runtime.Object{
+				workspacePod(testobj.Workspace("", "workspace-1", testobj.WithTerraformVersion("0.13.5")), "", installer.DefaultMirror),
+			},
+			podAbsent: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				installed := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceTerraformInstalledCondition)
+				if assert.NotNil(t, installed) {
+					assert.Equal(t, v1alpha1.InstallingReason, installed.Reason)
+				}
+			},
+		},
+		{
+			name:      "Installer image changed",
+			workspace: testobj.Workspace("", "workspace-1"),
+			objs: []runtime.Object{
+				workspacePod(testobj.Workspace("", "workspace-1"), "etok:old", installer.DefaultMirror),
+			},
+			podAbsent: true,
+		},
+		{
+			name:      "Installer environment changed",
+			workspace: testobj.Workspace("", "workspace-1"),
+			objs: []runtime.Object{
+				func() runtime.Object {
+					pod := workspacePod(testobj.Workspace("", "workspace-1"), "", installer.DefaultMirror)
+					pod.Spec.InitContainers[0].Env = []corev1.EnvVar{{Name: "HTTPS_PROXY", Value: "proxy:3128"}}
+					return pod
+				}(),
+			},
+			podAbsent: true,
+		},
+		{
+			name:      "Terraform version changed with incomplete run",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithTerraformVersion("0.14.3")),
+			objs: []runtime.Object{
+				workspacePod(testobj.Workspace("", "workspace-1", testobj.WithTerraformVersion("0.13.5")), "", installer.DefaultMirror),
+				testobj.Run("", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+			},
+			podAssertions: func(t *testutil.T, pod *corev1.Pod) {
+				assert.Contains(t, pod.Spec.InitContainers[0].Args, "0.13.5")
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				installed := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceTerraformInstalledCondition)
+				if assert.NotNil(t, installed) {
+					assert.Equal(t, v1alpha1.ReinstallPendingReason, installed.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache expanded",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheSize("2Gi")),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("expandable")),
+				&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "expandable"}, AllowVolumeExpansion: &allowExpansion},
+			},
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+				assert.Equal(t, "2Gi", size.String())
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheResizingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache expansion in progress",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheSize("2Gi")),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCSize("2Gi"), testobj.WithPVCCapacity("1Gi")),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheResizingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache expansion unsupported",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCacheSize("2Gi")),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+				&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "standard"}},
+			},
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+				assert.Equal(t, "1Gi", size.String())
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheResizeUnsupportedReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration for new storage class",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.WorkspacePod("", "workspace-1", testobj.WithPhase(corev1.PodRunning)),
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+			},
+			podAbsent: true,
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				// Not deleted until its contents are copied
+				assert.Equal(t, "standard", *pvc.Spec.StorageClassName)
+			},
+			objAssertions: func(t *testutil.T, cl client.Client) {
+				var migration corev1.PersistentVolumeClaim
+				require.NoError(t, cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migration"}, &migration))
+				assert.Equal(t, "local-path", *migration.Spec.StorageClassName)
+
+				var copier corev1.Pod
+				require.NoError(t, cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migrate-out"}, &copier))
+				assert.Equal(t, "workspace-1", copier.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+				assert.Equal(t, "workspace-1-migration", copier.Spec.Volumes[1].PersistentVolumeClaim.ClaimName)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheMigratingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration copied cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+				testobj.PVC("", "workspace-1-migration", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("local-path")),
+				cacheCopyPodWithPhase("workspace-1-migrate-out", corev1.PodSucceeded),
+			},
+			// Old cache deleted, and the workspace pod is not re-created
+			// until the cache is migrated
+			pvcAbsent: true,
+			podAbsent: true,
+			objAssertions: func(t *testutil.T, cl client.Client) {
+				err := cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migrate-out"}, &corev1.Pod{})
+				assert.True(t, kerrors.IsNotFound(err))
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheMigratingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration restoring cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCStorageClass("local-path")),
+				testobj.PVC("", "workspace-1-migration", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("local-path")),
+			},
+			podAbsent: true,
+			objAssertions: func(t *testutil.T, cl client.Client) {
+				var copier corev1.Pod
+				require.NoError(t, cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migrate-in"}, &copier))
+				assert.Equal(t, "workspace-1-migration", copier.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+				assert.Equal(t, "workspace-1", copier.Spec.Volumes[1].PersistentVolumeClaim.ClaimName)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheMigratingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration restored cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("local-path")),
+				testobj.PVC("", "workspace-1-migration", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("local-path")),
+				cacheCopyPodWithPhase("workspace-1-migrate-in", corev1.PodSucceeded),
+			},
+			objAssertions: func(t *testutil.T, cl client.Client) {
+				err := cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migration"}, &corev1.PersistentVolumeClaim{})
+				assert.True(t, kerrors.IsNotFound(err))
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheBoundReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration copy failed",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+				cacheCopyPodWithPhase("workspace-1-migrate-out", corev1.PodFailed),
+			},
+			wantErr: true,
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				assert.Equal(t, "standard", *pvc.Spec.StorageClassName)
+			},
+			objAssertions: func(t *testutil.T, cl client.Client) {
+				// Deleted so that the copy is retried
+				err := cl.Get(context.TODO(), types.NamespacedName{Name: "workspace-1-migrate-out"}, &corev1.Pod{})
+				assert.True(t, kerrors.IsNotFound(err))
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheMigrationFailedReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name:      "Cache migration deferred for incomplete run",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+				testobj.Run("", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+			},
+			pvcAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				assert.Equal(t, "standard", *pvc.Spec.StorageClassName)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cache := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCacheReadyCondition)
+				if assert.NotNil(t, cache) {
+					assert.Equal(t, v1alpha1.CacheMigrationPendingReason, cache.Reason)
+				}
+			},
+		},
+		{
+			name: "Observed generation",
+			workspace: testobj.Workspace("", "workspace-1", func(ws *v1alpha1.Workspace) {
+				ws.Generation = 3
+			}),
+			objs: []runtime.Object{
+				testobj.WorkspacePod("", "workspace-1", testobj.WithPhase(corev1.PodRunning)),
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound)),
+				testobj.ConfigMap("", "workspace-1-builtins"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, int64(3), ws.Status.ObservedGeneration)
+				ready := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceReadyCondition)
+				assert.Equal(t, int64(3), ready.ObservedGeneration)
+			},
+		},
+		{
+			name: "Observed generation not recorded whilst pending",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass), func(ws *v1alpha1.Workspace) {
+				ws.Generation = 3
+				ws.Status.ObservedGeneration = 2
+			}),
+			objs: []runtime.Object{
+				testobj.PVC("", "workspace-1", testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCStorageClass("standard")),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, int64(2), ws.Status.ObservedGeneration)
+			},
+		},
 		{
 			name:      "Cache: Default size",
 			workspace: testobj.Workspace("", "workspace-1"),
@@ -177,6 +546,267 @@ func TestReconcileWorkspace(t *testing.T) {
 				assert.Equal(t, "local-path", *pvc.Spec.StorageClassName)
 			},
 		},
+		{
+			name:      "Shared plugin cache",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			opts:      []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "nfs", resource.MustParse("5Gi"))},
+			pluginCacheAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				assert.Equal(t, "nfs", *pvc.Spec.StorageClassName)
+				assert.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}, pvc.Spec.AccessModes)
+				size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+				assert.Equal(t, "5Gi", size.String())
+				assert.Empty(t, pvc.OwnerReferences)
+			},
+			// Not provided to the workspace's namespace until bound
+			pluginCacheClaimAssertions: func(t *testutil.T, pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				assert.Nil(t, pv)
+				assert.Nil(t, pvc)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseInitializing, ws.Status.Phase)
+			},
+			configMapAssertions: func(t *testutil.T, builtins *corev1.ConfigMap) {
+				assert.Contains(t, builtins.Data[cliConfigPath], "filesystem_mirror")
+				assert.Contains(t, builtins.Data[cliConfigPath], "direct")
+			},
+		},
+		{
+			name:      "Shared plugin cache bound",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			objs: []runtime.Object{
+				testobj.PVC("etok", SharedPluginCacheName, testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCVolumeName("pvc-1234")),
+				testobj.PV("pvc-1234"),
+			},
+			opts: []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "nfs", resource.MustParse("5Gi"))},
+			pluginCacheClaimAssertions: func(t *testutil.T, pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				if assert.NotNil(t, pv) {
+					// References the same storage as the cache's volume
+					assert.Equal(t, "/pvc-1234", pv.Spec.NFS.Path)
+					assert.Equal(t, corev1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+					assert.Equal(t, SharedPluginCacheName, pv.Spec.ClaimRef.Name)
+					assert.Equal(t, "", pv.Spec.ClaimRef.Namespace)
+				}
+				if assert.NotNil(t, pvc) {
+					assert.Equal(t, "etok-plugin-cache-", pvc.Spec.VolumeName)
+					assert.Equal(t, "", *pvc.Spec.StorageClassName)
+					assert.Empty(t, pvc.OwnerReferences)
+				}
+			},
+			pluginCacheVolumeAssertions: func(t *testutil.T, pv *corev1.PersistentVolume) {
+				// Deleting the cache's PVC must not delete the storage
+				// referenced by the other namespaces
+				assert.Equal(t, corev1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+			},
+		},
+		{
+			name:      "Shared plugin cache on unshareable volume",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			objs: []runtime.Object{
+				testobj.PVC("etok", SharedPluginCacheName, testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCVolumeName("pvc-1234")),
+				testobj.PV("pvc-1234", func(pv *corev1.PersistentVolume) {
+					pv.Spec.NFS = nil
+					pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-1234"}
+					pv.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+				}),
+			},
+			opts:    []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "ebs", resource.MustParse("5Gi"))},
+			wantErr: true,
+			pluginCacheClaimAssertions: func(t *testutil.T, pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				assert.Nil(t, pv)
+				assert.Nil(t, pvc)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+		},
+		{
+			name:      "Shared plugin cache on ReadWriteMany CSI volume",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			objs: []runtime.Object{
+				testobj.PVC("etok", SharedPluginCacheName, testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCVolumeName("pvc-1234")),
+				testobj.PV("pvc-1234", func(pv *corev1.PersistentVolume) {
+					pv.Spec.NFS = nil
+					pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: "efs.csi.aws.com", VolumeHandle: "fs-1234"}
+				}),
+			},
+			opts: []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "efs", resource.MustParse("5Gi"))},
+			pluginCacheClaimAssertions: func(t *testutil.T, pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				if assert.NotNil(t, pv) {
+					assert.Equal(t, "fs-1234", pv.Spec.CSI.VolumeHandle)
+				}
+				assert.NotNil(t, pvc)
+			},
+		},
+		{
+			name:      "Shared plugin cache in plugin cache namespace",
+			workspace: testobj.Workspace("etok", "workspace-1", testobj.WithSharedPlugins()),
+			objs: []runtime.Object{
+				testobj.PVC("etok", SharedPluginCacheName, testobj.WithPVCPhase(corev1.ClaimBound), testobj.WithPVCVolumeName("pvc-1234")),
+				testobj.PV("pvc-1234"),
+			},
+			opts: []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "nfs", resource.MustParse("5Gi"))},
+			pluginCacheClaimAssertions: func(t *testutil.T, pv *corev1.PersistentVolume, pvc *corev1.PersistentVolumeClaim) {
+				// Workspace uses the cache's PVC directly
+				assert.Nil(t, pv)
+				assert.Equal(t, "pvc-1234", pvc.Spec.VolumeName)
+			},
+		},
+		{
+			name:      "Shared plugin cache offline",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			opts:      []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "nfs", resource.MustParse("5Gi")), WithPluginCacheOffline()},
+			configMapAssertions: func(t *testutil.T, builtins *corev1.ConfigMap) {
+				assert.Contains(t, builtins.Data[cliConfigPath], "filesystem_mirror")
+				assert.NotContains(t, builtins.Data[cliConfigPath], "direct")
+			},
+		},
+		{
+			name:      "Shared plugin cache disabled on operator",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			pluginCacheAssertions: func(t *testutil.T, pvc *corev1.PersistentVolumeClaim) {
+				assert.Nil(t, pvc)
+			},
+		},
+		{
+			name:      "Dedicated service account",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("workspace-1", "iam.gke.io/gcp-service-account", "prod@my-project.iam.gserviceaccount.com")),
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				assert.Equal(t, "prod@my-project.iam.gserviceaccount.com", sa.Annotations["iam.gke.io/gcp-service-account"])
+				assert.Equal(t, "workspace-1", sa.OwnerReferences[0].Name)
+				assert.Equal(t, "workspace-1", sa.Labels["workspace"])
+
+				if assert.NotNil(t, binding) {
+					assert.Equal(t, "workspace-1", binding.Subjects[0].Name)
+					assert.Equal(t, RoleName, binding.RoleRef.Name)
+				}
+			},
+		},
+		{
+			name:      "Dedicated service account annotations updated",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("workspace-1", "iam.gke.io/gcp-service-account", "prod@my-project.iam.gserviceaccount.com")),
+			objs: []runtime.Object{
+				func() runtime.Object {
+					sa := newServiceAccountForWS(testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("workspace-1", "iam.gke.io/gcp-service-account", "dev@my-project.iam.gserviceaccount.com")))
+					sa.OwnerReferences = []metav1.OwnerReference{{APIVersion: "etok.dev/v1alpha1", Kind: "Workspace", Name: "workspace-1", Controller: &[]bool{true}[0]}}
+					return sa
+				}(),
+			},
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				assert.Equal(t, "prod@my-project.iam.gserviceaccount.com", sa.Annotations["iam.gke.io/gcp-service-account"])
+			},
+		},
+		{
+			name:      "Existing service account",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("terraform", "iam.gke.io/gcp-service-account", "prod@my-project.iam.gserviceaccount.com")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "terraform", Labels: map[string]string{"workspace": "workspace-1"}}},
+			},
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				// Service account not created by operator is left untouched
+				assert.Nil(t, sa.Annotations)
+
+				if assert.NotNil(t, binding) {
+					assert.Equal(t, "terraform", binding.Subjects[0].Name)
+				}
+			},
+		},
+		{
+			name:      "Existing service account not for workspace",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "terraform"}},
+			},
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				// No permissions granted
+				assert.Nil(t, binding)
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+			wantErr: true,
+		},
+		{
+			name:      "Dedicated service account changed",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "terraform", Labels: map[string]string{"workspace": "workspace-1"}}},
+				func() runtime.Object {
+					binding := newRoleBindingForWS(testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("workspace-1")))
+					binding.OwnerReferences = []metav1.OwnerReference{{APIVersion: "etok.dev/v1alpha1", Kind: "Workspace", Name: "workspace-1", Controller: &[]bool{true}[0]}}
+					return binding
+				}(),
+			},
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				if assert.NotNil(t, binding) {
+					assert.Equal(t, "terraform", binding.Subjects[0].Name)
+				}
+			},
+		},
+		{
+			name:      "Revert to namespace service account",
+			workspace: testobj.Workspace("", "workspace-1"),
+			objs: []runtime.Object{
+				func() runtime.Object {
+					binding := newRoleBindingForWS(testobj.Workspace("", "workspace-1", testobj.WithServiceAccount("workspace-1")))
+					binding.OwnerReferences = []metav1.OwnerReference{{APIVersion: "etok.dev/v1alpha1", Kind: "Workspace", Name: "workspace-1", Controller: &[]bool{true}[0]}}
+					return binding
+				}(),
+			},
+			serviceAccountAssertions: func(t *testutil.T, sa *corev1.ServiceAccount, binding *rbacv1.RoleBinding) {
+				// Permissions revoked from previous service account
+				assert.Nil(t, binding)
+			},
+		},
+		{
+			name:      "Credential secrets found",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp"})),
+			objs: []runtime.Object{
+				testobj.Secret("", "gcp"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cond := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCredentialsReadyCondition)
+				if assert.NotNil(t, cond) {
+					assert.Equal(t, metav1.ConditionTrue, cond.Status)
+					assert.Equal(t, v1alpha1.SecretsFoundReason, cond.Reason)
+				}
+			},
+		},
+		{
+			name:      "Credential secrets not found",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp"}, v1alpha1.CredentialSecret{Name: "ssh", Type: v1alpha1.CredentialSecretTypeFile}, v1alpha1.CredentialSecret{Name: "kubeconfig", Type: v1alpha1.CredentialSecretTypeFile})),
+			objs: []runtime.Object{
+				testobj.Secret("", "gcp"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				cond := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCredentialsReadyCondition)
+				if assert.NotNil(t, cond) {
+					assert.Equal(t, metav1.ConditionFalse, cond.Status)
+					assert.Equal(t, v1alpha1.SecretNotFoundReason, cond.Reason)
+					assert.Equal(t, "Credential secrets not found: ssh, kubeconfig", cond.Message)
+				}
+				// Missing secrets don't prevent workspace from being ready
+				assert.NotEqual(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+		},
+		{
+			name:      "No credential secrets",
+			workspace: testobj.Workspace("", "workspace-1"),
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Nil(t, meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceCredentialsReadyCondition))
+			},
+		},
+		{
+			name:      "Builtins updated",
+			workspace: testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins()),
+			objs: []runtime.Object{
+				testobj.ConfigMap("", "workspace-1-builtins"),
+			},
+			opts: []WorkspaceReconcilerOption{WithSharedPluginCache("etok", "nfs", resource.MustParse("5Gi"))},
+			configMapAssertions: func(t *testutil.T, builtins *corev1.ConfigMap) {
+				assert.NotEmpty(t, builtins.Data[backendPath])
+				assert.NotEmpty(t, builtins.Data[cliConfigPath])
+			},
+		},
 		{
 			name:      "Ownership of dependents",
 			workspace: testobj.Workspace("", "workspace-1", testobj.WithStorageClass(&localPathStorageClass)),
@@ -267,6 +897,200 @@ func TestReconcileWorkspace(t *testing.T) {
 			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
 				assert.Equal(t, 4, *ws.Status.BackupSerial)
 			}},
+		{
+			name:       "HTTP state backend",
+			workspace:  testobj.Workspace("default", "workspace-1", testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			stateStore: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.StateBackendHTTP, ws.Status.StateBackend)
+			},
+			configMapAssertions: func(t *testutil.T, vars *corev1.ConfigMap) {
+				assert.Contains(t, vars.Data[backendPath], `backend "http"`)
+				assert.Contains(t, vars.Data[backendPath], `address        = "https://etok-state.etok.svc/state/default/workspace-1"`)
+				assert.Contains(t, vars.Data[backendPath], `username       = "workspace-1"`)
+				assert.Equal(t, "ca", vars.Data[stateCAPath])
+			},
+			stateStoreAssertions: func(t *testutil.T, store *backend.Store) {
+				var token corev1.Secret
+				require.NoError(t, store.Client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "workspace-1-state-token"}, &token))
+				assert.NotEmpty(t, token.Data[backend.TokenKey])
+				assert.Equal(t, "workspace-1", token.OwnerReferences[0].Name)
+			},
+		},
+		{
+			name:      "HTTP state backend migration",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			objs: []runtime.Object{
+				testobj.WorkspacePod("default", "workspace-1", testobj.WithPhase(corev1.PodRunning)),
+				testobj.Secret("default", "tfstate-default-workspace-1", testobj.WithCompressedDataFromFile("tfstate", "testdata/tfstate.json")),
+			},
+			stateStore: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.StateBackendHTTP, ws.Status.StateBackend)
+				assert.Equal(t, []*v1alpha1.Output{
+					{
+						Key:   "random_string",
+						Value: "f584-default-foo-foo",
+					},
+				}, ws.Status.Outputs)
+			},
+			stateStoreAssertions: func(t *testutil.T, store *backend.Store) {
+				state, err := store.Get(context.Background(), testobj.Workspace("default", "workspace-1"))
+				require.NoError(t, err)
+				assert.Equal(t, readFile("testdata/tfstate.json"), state)
+			},
+		},
+		{
+			name:      "HTTP state backend migration deferred for incomplete run",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithStateBackend(v1alpha1.StateBackendHTTP), testobj.WithCombinedQueue("plan-1")),
+			objs: []runtime.Object{
+				testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+				testobj.Secret("default", "tfstate-default-workspace-1", testobj.WithCompressedDataFromFile("tfstate", "testdata/tfstate.json")),
+			},
+			stateStore: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.StateBackend(""), ws.Status.StateBackend)
+			},
+			stateStoreAssertions: func(t *testutil.T, store *backend.Store) {
+				state, err := store.Get(context.Background(), testobj.Workspace("default", "workspace-1"))
+				require.NoError(t, err)
+				assert.Nil(t, state)
+			},
+		},
+		{
+			name:      "HTTP state backend disabled on operator",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+			wantErr: true,
+		},
+		{
+			name:       "Migrating from HTTP state backend unsupported",
+			workspace:  testobj.Workspace("default", "workspace-1", testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP)),
+			stateStore: true,
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Equal(t, v1alpha1.WorkspacePhaseError, ws.Status.Phase)
+			},
+			wantErr: true,
+		},
+		{
+			name:      "State lock held by run",
+			workspace: testobj.Workspace("default", "workspace-1"),
+			objs: []runtime.Object{
+				testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				testobj.RunPod("default", "apply-1", testobj.WithPhase(corev1.PodRunning)),
+				lockLease("workspace-1", "lock-123", "root@apply-1"),
+			},
+			opts: []WorkspaceReconcilerOption{WithStaleLockRelease()},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				if assert.NotNil(t, ws.Status.Lock) {
+					assert.Equal(t, "lock-123", ws.Status.Lock.ID)
+					assert.Equal(t, "apply-1", ws.Status.Lock.Run)
+					assert.Equal(t, "root@apply-1", ws.Status.Lock.Who)
+					assert.Equal(t, "OperationTypeApply", ws.Status.Lock.Operation)
+					assert.NotNil(t, ws.Status.Lock.Since)
+				}
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Equal(t, "lock-123", *lease.Spec.HolderIdentity)
+			},
+		},
+		{
+			name:      "Stale state lock released",
+			workspace: testobj.Workspace("default", "workspace-1"),
+			objs: []runtime.Object{
+				testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				lockLease("workspace-1", "lock-123", "root@apply-1"),
+			},
+			opts: []WorkspaceReconcilerOption{WithStaleLockRelease()},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Nil(t, ws.Status.Lock)
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Nil(t, lease.Spec.HolderIdentity)
+				assert.NotContains(t, lease.Annotations, lockInfoAnnotation)
+			},
+		},
+		{
+			name:      "Stale state lock release disabled",
+			workspace: testobj.Workspace("default", "workspace-1"),
+			objs: []runtime.Object{
+				testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				lockLease("workspace-1", "lock-123", "root@apply-1"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				if assert.NotNil(t, ws.Status.Lock) {
+					assert.Equal(t, "apply-1", ws.Status.Lock.Run)
+				}
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Equal(t, "lock-123", *lease.Spec.HolderIdentity)
+			},
+		},
+		{
+			name:      "State lock not held by run",
+			workspace: testobj.Workspace("default", "workspace-1"),
+			objs: []runtime.Object{
+				lockLease("workspace-1", "lock-123", "alice@laptop"),
+			},
+			opts: []WorkspaceReconcilerOption{WithStaleLockRelease()},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				if assert.NotNil(t, ws.Status.Lock) {
+					assert.Equal(t, "", ws.Status.Lock.Run)
+				}
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Equal(t, "lock-123", *lease.Spec.HolderIdentity)
+			},
+		},
+		{
+			name:      "State lock released upon request",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithAnnotations(v1alpha1.UnlockAnnotationKey, "lock-123")),
+			objs: []runtime.Object{
+				lockLease("workspace-1", "lock-123", "alice@laptop"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Nil(t, ws.Status.Lock)
+				assert.NotContains(t, ws.Annotations, v1alpha1.UnlockAnnotationKey)
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Nil(t, lease.Spec.HolderIdentity)
+			},
+		},
+		{
+			name:      "Release of different state lock requested",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithAnnotations(v1alpha1.UnlockAnnotationKey, "lock-456")),
+			objs: []runtime.Object{
+				lockLease("workspace-1", "lock-123", "alice@laptop"),
+			},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.NotNil(t, ws.Status.Lock)
+				assert.NotContains(t, ws.Annotations, v1alpha1.UnlockAnnotationKey)
+			},
+			leaseAssertions: func(t *testutil.T, lease *coordinationv1.Lease) {
+				assert.Equal(t, "lock-123", *lease.Spec.HolderIdentity)
+			},
+		},
+		{
+			name:      "Stale HTTP state backend lock released",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithStateBackend(v1alpha1.StateBackendHTTP), testobj.WithMigratedStateBackend(v1alpha1.StateBackendHTTP)),
+			objs: []runtime.Object{
+				testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				testobj.RunPod("default", "apply-1", testobj.WithPhase(corev1.PodFailed)),
+				testobj.Secret("default", "etok-state-workspace-1", testobj.WithData("lock", `{"ID":"lock-123","Who":"root@apply-1"}`)),
+			},
+			stateStore: true,
+			opts:       []WorkspaceReconcilerOption{WithStaleLockRelease()},
+			workspaceAssertions: func(t *testutil.T, ws *v1alpha1.Workspace) {
+				assert.Nil(t, ws.Status.Lock)
+			},
+			stateStoreAssertions: func(t *testutil.T, store *backend.Store) {
+				lock, err := store.GetLock(context.Background(), testobj.Workspace("default", "workspace-1"))
+				require.NoError(t, err)
+				assert.Nil(t, lock)
+			},
+		},
 		{
 			name:      "Non-existent backup bucket",
 			workspace: testobj.Workspace("", "workspace-1", testobj.WithBackupBucket("does-not-exist")),
@@ -294,7 +1118,11 @@ func TestReconcileWorkspace(t *testing.T) {
 			defer server.Stop()
 
 			// Reconcile
-			r := NewWorkspaceReconciler(cl, "", WithStorageClient(server.Client()), WithEventRecorder(record.NewFakeRecorder(100)))
+			opts := append([]WorkspaceReconcilerOption{WithStorageClient(server.Client()), WithEventRecorder(record.NewFakeRecorder(100))}, tt.opts...)
+			if tt.stateStore {
+				opts = append(opts, WithStateBackend(backend.NewStore(cl), "https://etok-state.etok.svc", []byte("ca")))
+			}
+			r := NewWorkspaceReconciler(cl, "", opts...)
 			req := requestFromObject(tt.workspace)
 			_, err = r.Reconcile(context.Background(), req)
 			if tt.wantErr {
@@ -335,10 +1163,84 @@ func TestReconcileWorkspace(t *testing.T) {
 				tt.pvcAssertions(t, &cache)
 			}
 
+			if tt.podAbsent {
+				err := r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: tt.workspace.PodName()}, &corev1.Pod{})
+				assert.True(t, kerrors.IsNotFound(err))
+			}
+
+			if tt.pvcAbsent {
+				err := r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: tt.workspace.PVCName()}, &corev1.PersistentVolumeClaim{})
+				assert.True(t, kerrors.IsNotFound(err))
+			}
+
+			if tt.pluginCacheAssertions != nil {
+				cache := &corev1.PersistentVolumeClaim{}
+				err := r.Get(context.TODO(), types.NamespacedName{Namespace: r.PluginCacheNamespace, Name: SharedPluginCacheName}, cache)
+				if kerrors.IsNotFound(err) {
+					cache = nil
+				} else {
+					require.NoError(t, err)
+				}
+				tt.pluginCacheAssertions(t, cache)
+			}
+
+			if tt.pluginCacheClaimAssertions != nil {
+				pv := &corev1.PersistentVolume{}
+				err := r.Get(context.TODO(), types.NamespacedName{Name: SharedPluginCacheName + "-" + tt.workspace.Namespace}, pv)
+				if kerrors.IsNotFound(err) {
+					pv = nil
+				} else {
+					require.NoError(t, err)
+				}
+
+				pvc := &corev1.PersistentVolumeClaim{}
+				err = r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: SharedPluginCacheName}, pvc)
+				if kerrors.IsNotFound(err) {
+					pvc = nil
+				} else {
+					require.NoError(t, err)
+				}
+				tt.pluginCacheClaimAssertions(t, pv, pvc)
+			}
+
+			if tt.objAssertions != nil {
+				tt.objAssertions(t, r.Client)
+			}
+
+			if tt.pluginCacheVolumeAssertions != nil {
+				pv := &corev1.PersistentVolume{}
+				require.NoError(t, r.Get(context.TODO(), types.NamespacedName{Name: "pvc-1234"}, pv))
+				tt.pluginCacheVolumeAssertions(t, pv)
+			}
+
+			if tt.serviceAccountAssertions != nil {
+				serviceAccount := &corev1.ServiceAccount{}
+				require.NoError(t, r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: serviceAccountName(tt.workspace)}, serviceAccount))
+
+				binding := &rbacv1.RoleBinding{}
+				err := r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: workspaceRoleBindingName(tt.workspace)}, binding)
+				if kerrors.IsNotFound(err) {
+					binding = nil
+				} else {
+					require.NoError(t, err)
+				}
+				tt.serviceAccountAssertions(t, serviceAccount, binding)
+			}
+
 			if tt.storageAssertions != nil {
 				tt.storageAssertions(t, r.StorageClient)
 			}
 
+			if tt.stateStoreAssertions != nil {
+				tt.stateStoreAssertions(t, r.StateStore)
+			}
+
+			if tt.leaseAssertions != nil {
+				lease := coordinationv1.Lease{}
+				require.NoError(t, r.Get(context.TODO(), types.NamespacedName{Namespace: tt.workspace.Namespace, Name: lockLeaseName(tt.workspace)}, &lease))
+				tt.leaseAssertions(t, &lease)
+			}
+
 			// RBAC resources should always have been created so check them
 			// unless explicitly told not to
 			if !tt.disableRBACAssertions {
@@ -354,3 +1256,62 @@ func TestReconcileWorkspace(t *testing.T) {
 		})
 	}
 }
+
+// cacheCopyPodWithPhase constructs a pod copying the cache of workspace-1,
+// in the given phase
+func cacheCopyPodWithPhase(name string, phase corev1.PodPhase) *corev1.Pod {
+	pod := cacheCopyPod(testobj.Workspace("", "workspace-1"), name, "src", "dst", "")
+	pod.Status.Phase = phase
+	return pod
+}
+
+func TestReconcileWorkspaceWarnsOnce(t *testing.T) {
+	ws := testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins())
+	cl := fake.NewFakeClientWithScheme(scheme.Scheme, ws)
+	recorder := record.NewFakeRecorder(100)
+
+	// Shared plugin cache is not enabled on the operator
+	r := NewWorkspaceReconciler(cl, "", WithEventRecorder(recorder))
+	for i := 0; i < 3; i++ {
+		// Errors are irrelevant, the cache PVC having no status
+		_, _ = r.Reconcile(context.Background(), requestFromObject(ws))
+	}
+	close(recorder.Events)
+
+	var warnings int
+	for event := range recorder.Events {
+		if strings.HasPrefix(event, "Warning SharedPluginCacheDisabled") {
+			warnings++
+		}
+	}
+	assert.Equal(t, 1, warnings)
+}
+
+func TestReconcileWorkspaceForgetsWarningsOnDeletion(t *testing.T) {
+	ws := testobj.Workspace("", "workspace-1", testobj.WithSharedPlugins(), testobj.WithDeleteTimestamp())
+	cl := fake.NewFakeClientWithScheme(scheme.Scheme, ws)
+
+	r := NewWorkspaceReconciler(cl, "", WithEventRecorder(record.NewFakeRecorder(100)))
+	r.warnOnce(ws, "SharedPluginCacheDisabled", "Shared plugin cache is not enabled on the operator")
+
+	_, _ = r.Reconcile(context.Background(), requestFromObject(ws))
+
+	assert.Empty(t, r.warnings)
+}
+
+// lockLease constructs the kubernetes backend's lease, held with the given ID
+// by the given user@host
+func lockLease(workspace, id, who string) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "lock-tfstate-default-" + workspace,
+			Namespace: "default",
+			Annotations: map[string]string{
+				lockInfoAnnotation: fmt.Sprintf(`{"ID":"%s","Operation":"OperationTypeApply","Who":"%s","Created":"2021-01-01T12:00:00Z"}`, id, who),
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity: &id,
+		},
+	}
+}
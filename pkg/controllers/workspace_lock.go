@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/backend"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Annotation on the kubernetes backend's lease recording the lock info
+	lockInfoAnnotation = "app.terraform.io/lock-info"
+
+	// Prefix of the name of the kubernetes backend's lease
+	lockLeasePrefix = "lock-"
+)
+
+// lockLeaseName returns the name of the lease with which the kubernetes backend
+// locks the workspace's state
+func lockLeaseName(ws *v1alpha1.Workspace) string {
+	return lockLeasePrefix + ws.StateSecretName()
+}
+
+// manageLock reports the lock held on the workspace's state, releasing it if
+// it is held by a run whose pod is gone.
+func (r *WorkspaceReconciler) manageLock(ctx context.Context, ws *v1alpha1.Workspace) (*metav1.Condition, error) {
+	log := log.FromContext(ctx)
+
+	lock, err := r.getLock(ctx, ws)
+	if err != nil {
+		log.Error(err, "unable to get state lock")
+		return nil, err
+	}
+	if lock == nil {
+		ws.Status.Lock = nil
+		return nil, nil
+	}
+
+	ws.Status.Lock = &v1alpha1.WorkspaceLock{
+		ID:        lock.ID,
+		Who:       lock.Who,
+		Operation: lock.Operation,
+	}
+	if !lock.Created.IsZero() {
+		since := metav1.NewTime(lock.Created)
+		ws.Status.Lock.Since = &since
+	}
+
+	run, err := r.lockHolder(ctx, ws, lock)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, nil
+	}
+	ws.Status.Lock.Run = run.Name
+
+	if !r.ReleaseStaleLocks {
+		return nil, nil
+	}
+
+	stale, err := r.isPodGone(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	if !stale {
+		return nil, nil
+	}
+
+	released, err := r.releaseLock(ctx, ws, lock.ID)
+	if err != nil {
+		log.Error(err, "unable to release stale state lock")
+		return nil, err
+	}
+	if released {
+		r.recorder.Eventf(ws, "Warning", "StaleLockReleased", "Released lock %s held by run %s whose pod is gone", lock.ID, run.Name)
+		ws.Status.Lock = nil
+	}
+	return nil, nil
+}
+
+// handleUnlockRequest releases the lock with the ID requested via the
+// workspace's unlock annotation, and then removes the annotation.
+func (r *WorkspaceReconciler) handleUnlockRequest(ctx context.Context, ws *v1alpha1.Workspace, id string) error {
+	released, err := r.releaseLock(ctx, ws, id)
+	if err != nil {
+		return err
+	}
+	if released {
+		r.recorder.Eventf(ws, "Normal", "LockReleased", "Released lock %s upon request", id)
+	} else {
+		r.recorder.Eventf(ws, "Warning", "LockNotReleased", "Lock %s is no longer held", id)
+	}
+
+	delete(ws.Annotations, v1alpha1.UnlockAnnotationKey)
+	return r.Update(ctx, ws)
+}
+
+// getLock retrieves the lock held on the workspace's state, or nil if it is
+// unlocked
+func (r *WorkspaceReconciler) getLock(ctx context.Context, ws *v1alpha1.Workspace) (*backend.LockInfo, error) {
+	if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		if r.StateStore == nil {
+			return nil, nil
+		}
+		return r.StateStore.GetLock(ctx, ws)
+	}
+
+	lease, err := r.getLockLease(ctx, ws)
+	if err != nil || lease == nil {
+		return nil, err
+	}
+
+	lock := backend.LockInfo{ID: *lease.Spec.HolderIdentity}
+	if info, ok := lease.Annotations[lockInfoAnnotation]; ok {
+		if err := json.Unmarshal([]byte(info), &lock); err != nil {
+			return nil, err
+		}
+	}
+	return &lock, nil
+}
+
+// releaseLock releases the lock with the given ID on the workspace's state,
+// in the same manner as terraform's force-unlock. False is returned if the lock
+// is no longer held.
+func (r *WorkspaceReconciler) releaseLock(ctx context.Context, ws *v1alpha1.Workspace, id string) (bool, error) {
+	if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		if r.StateStore == nil {
+			return false, nil
+		}
+		existing, err := r.StateStore.Unlock(ctx, ws, id)
+		if errors.Is(err, backend.ErrLockMismatch) {
+			return false, nil
+		}
+		return existing == nil && err == nil, err
+	}
+
+	lease, err := r.getLockLease(ctx, ws)
+	if err != nil || lease == nil {
+		return false, err
+	}
+	if *lease.Spec.HolderIdentity != id {
+		return false, nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	delete(lease.Annotations, lockInfoAnnotation)
+	if err := r.Update(ctx, lease); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getLockLease retrieves the kubernetes backend's lease if it is held, or nil
+// otherwise
+func (r *WorkspaceReconciler) getLockLease(ctx context.Context, ws *v1alpha1.Workspace) (*coordinationv1.Lease, error) {
+	var lease coordinationv1.Lease
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: lockLeaseName(ws)}, &lease); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// lockHolder returns the run holding the lock, or nil if the lock is not held
+// by a run. Terraform records the holder as user@host, and the host of a run is
+// its pod, named after the run.
+func (r *WorkspaceReconciler) lockHolder(ctx context.Context, ws *v1alpha1.Workspace, lock *backend.LockInfo) (*v1alpha1.Run, error) {
+	parts := strings.Split(lock.Who, "@")
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, nil
+	}
+
+	var run v1alpha1.Run
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: parts[1]}, &run); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if run.Workspace != ws.Name {
+		return nil, nil
+	}
+	return &run, nil
+}
+
+// isPodGone determines whether the run's pod no longer exists or has
+// terminated
+func (r *WorkspaceReconciler) isPodGone(ctx context.Context, run *v1alpha1.Run) (bool, error) {
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: run.PodName()}, &pod); err != nil {
+		if kerrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded, corev1.PodFailed:
+		return true, nil
+	}
+	return false, nil
+}
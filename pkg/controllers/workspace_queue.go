@@ -1,18 +1,34 @@
 package controllers
 
 import (
+	"sort"
+
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
 	"github.com/leg100/etok/cmd/launcher"
 	"github.com/leg100/etok/pkg/util/slice"
 )
 
-// updateCombinedQueue updates a workspace's combined queue (the active run +
-// the queue) with the given list of runs.  Runs in the existing queue are
-// expunged if they meet certain criteria.  If they are not expunged they
-// mantain their position.
+// isQueueable determines whether a run with the given command is subject to
+// the workspace queue. Runs with read-only commands are only queued if the
+// workspace's reader policy is to wait.
+func isQueueable(ws *v1alpha1.Workspace, command string) bool {
+	if launcher.IsQueueable(command) {
+		return true
+	}
+	return ws.ReaderPolicy() == v1alpha1.ReaderPolicyWait
+}
+
+// updateCombinedQueue updates a workspace's combined queue (the active run or
+// readers + the queue) with the given list of runs.  Runs in the existing
+// queue are expunged if they meet certain criteria.  If they are not expunged
+// they mantain their position.
 func updateCombinedQueue(ws *v1alpha1.Workspace, runs []v1alpha1.Run) {
 	newQ := []string{}
-	currQ := append([]string{ws.Status.Active}, ws.Status.Queue...)
+	currQ := append(append([]string{}, ws.Status.Readers...), ws.Status.Active)
+	currQ = append(currQ, orderQueue(ws.Status.Queue, ws.QueueOrder())...)
+
+	// Names of runs with read-only commands
+	readers := make(map[string]bool)
 
 	// Filter run resources
 	for _, run := range runs {
@@ -27,7 +43,7 @@ func updateCombinedQueue(ws *v1alpha1.Workspace, runs []v1alpha1.Run) {
 		}
 
 		// Filter out non-queueable runs
-		if !launcher.IsQueueable(run.Command) {
+		if !isQueueable(ws, run.Command) {
 			continue
 		}
 
@@ -39,6 +55,9 @@ func updateCombinedQueue(ws *v1alpha1.Workspace, runs []v1alpha1.Run) {
 		}
 
 		newQ = append(newQ, run.Name)
+		if !launcher.IsQueueable(run.Command) {
+			readers[run.Name] = true
+		}
 	}
 
 	// Re-order new queue to ensure runs maintain their position from the
@@ -58,10 +77,41 @@ func updateCombinedQueue(ws *v1alpha1.Workspace, runs []v1alpha1.Run) {
 		newQ = append([]string{currQ[i]}, newQ...)
 	}
 
+	// Readers at the front of the queue are permitted to run concurrently with
+	// one another
+	var n int
+	for n < len(newQ) && readers[newQ[n]] {
+		n++
+	}
+
 	// Update workspace with new (combined) queue
-	if len(newQ) > 0 {
-		ws.Status.Active, ws.Status.Queue = newQ[0], newQ[1:]
-	} else {
-		ws.Status.Active, ws.Status.Queue = "", []string(nil)
+	switch {
+	case n > 0:
+		ws.Status.Active, ws.Status.Readers, ws.Status.Queue = "", newQ[:n], newQ[n:]
+	case len(newQ) > 0:
+		ws.Status.Active, ws.Status.Readers, ws.Status.Queue = newQ[0], nil, newQ[1:]
+	default:
+		ws.Status.Active, ws.Status.Readers, ws.Status.Queue = "", nil, []string(nil)
+	}
+}
+
+// orderQueue re-orders a queue according to the requested order. Runs missing
+// from the requested order maintain their position behind those present.
+func orderQueue(queue, order []string) []string {
+	if order == nil {
+		return queue
 	}
+
+	pos := func(run string) int {
+		if i := slice.StringIndex(order, run); i != -1 {
+			return i
+		}
+		return len(order)
+	}
+
+	ordered := append([]string{}, queue...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return pos(ordered[i]) < pos(ordered[j])
+	})
+	return ordered
 }
@@ -10,11 +10,12 @@ import (
 
 func TestUpdateCombinedQueue(t *testing.T) {
 	tests := []struct {
-		name       string
-		workspace  *v1alpha1.Workspace
-		runs       []v1alpha1.Run
-		wantActive string
-		wantQueue  []string
+		name        string
+		workspace   *v1alpha1.Workspace
+		runs        []v1alpha1.Run
+		wantActive  string
+		wantReaders []string
+		wantQueue   []string
 	}{
 		{
 			name:      "No runs",
@@ -69,7 +70,7 @@ func TestUpdateCombinedQueue(t *testing.T) {
 		},
 		{
 			name:      "Don't queue unqueueable runs",
-			workspace: testobj.Workspace("default", "workspace-1"),
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyIsolate)),
 			runs: []v1alpha1.Run{
 				*testobj.Run("default", "output-1", "output", testobj.WithWorkspace("workspace-1"), testobj.WithRunPhase(v1alpha1.RunPhaseWaiting)),
 				*testobj.Run("default", "sh-1", "sh", testobj.WithWorkspace("workspace-1"), testobj.WithRunPhase(v1alpha1.RunPhaseWaiting)),
@@ -80,6 +81,111 @@ func TestUpdateCombinedQueue(t *testing.T) {
 			wantActive: "sh-1",
 			wantQueue:  []string{"apply-1"},
 		},
+		{
+			name:      "Readers queued by default",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{"plan-1"},
+		},
+		{
+			name:      "Readers not queued with share policy",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyShare), testobj.WithCombinedQueue("apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{},
+		},
+		{
+			name:      "Readers run concurrently",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait)),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-2", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantReaders: []string{"plan-1", "plan-2"},
+			wantQueue:   []string{},
+		},
+		{
+			name:      "Reader waits for active writer",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait), testobj.WithCombinedQueue("apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{"plan-1"},
+		},
+		{
+			name:      "Writer waits for active readers",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait), testobj.WithReaders("plan-1", "plan-2")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-2", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantReaders: []string{"plan-1", "plan-2"},
+			wantQueue:   []string{"apply-1"},
+		},
+		{
+			name:      "Reader waits behind queued writer",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait), testobj.WithReaders("plan-1"), testobj.WithQueue("apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-2", "plan", testobj.WithWorkspace("workspace-1")),
+			},
+			wantReaders: []string{"plan-1"},
+			wantQueue:   []string{"apply-1", "plan-2"},
+		},
+		{
+			name:      "Writer made active once readers complete",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithReaderPolicy(v1alpha1.ReaderPolicyWait), testobj.WithReaders("plan-1"), testobj.WithQueue("apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "plan-1", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCondition(v1alpha1.RunCompleteCondition)),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{},
+		},
+		{
+			name:      "Re-ordered queue",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("apply-1", "apply-2", "apply-3"), testobj.WithAnnotations(v1alpha1.QueueOrderAnnotationKey, "apply-3,apply-2")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-2", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-3", "apply", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{"apply-3", "apply-2"},
+		},
+		{
+			name:      "Re-ordering doesn't displace active run",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("apply-1", "apply-2"), testobj.WithAnnotations(v1alpha1.QueueOrderAnnotationKey, "apply-2,apply-1")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-2", "apply", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{"apply-2"},
+		},
+		{
+			name:      "New runs queued behind re-ordered runs",
+			workspace: testobj.Workspace("default", "workspace-1", testobj.WithCombinedQueue("apply-1", "apply-2", "apply-3"), testobj.WithAnnotations(v1alpha1.QueueOrderAnnotationKey, "apply-3,apply-2")),
+			runs: []v1alpha1.Run{
+				*testobj.Run("default", "apply-1", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-2", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-3", "apply", testobj.WithWorkspace("workspace-1")),
+				*testobj.Run("default", "apply-4", "apply", testobj.WithWorkspace("workspace-1")),
+			},
+			wantActive: "apply-1",
+			wantQueue:  []string{"apply-3", "apply-2", "apply-4"},
+		},
 		{
 			name:      "Unapproved privileged command",
 			workspace: testobj.Workspace("", "workspace-1", testobj.WithPrivilegedCommands("apply")),
@@ -102,6 +208,7 @@ func TestUpdateCombinedQueue(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			updateCombinedQueue(tt.workspace, tt.runs)
 			require.Equal(t, tt.wantActive, tt.workspace.Status.Active)
+			require.Equal(t, tt.wantReaders, tt.workspace.Status.Readers)
 			require.Equal(t, tt.wantQueue, tt.workspace.Status.Queue)
 		})
 	}
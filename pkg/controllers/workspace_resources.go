@@ -1,7 +1,12 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
 	v1alpha1 "github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/backend"
 	"github.com/leg100/etok/pkg/labels"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
@@ -19,10 +24,47 @@ variable "workspace" {}
 terraform {
   backend "kubernetes" {}
 }
+`
+
+	// The password is passed to terraform by the run pod, lest it be exposed
+	// in the config map.
+	builtinHTTPConfig = `
+terraform {
+  backend "http" {
+    address        = "%[1]s"
+    lock_address   = "%[1]s"
+    unlock_address = "%[1]s"
+    username       = "%[2]s"
+  }
+}
 `
 )
 
-func newBuiltinsForWS(ws *v1alpha1.Workspace) *corev1.ConfigMap {
+// Terraform CLI config for workspaces using the shared plugin cache. The cache
+// doubles as a filesystem mirror, permitting providers to be installed from the
+// cache without consulting the registry.
+const sharedPluginsCLIConfig = `
+provider_installation {
+  filesystem_mirror {
+    path = "%s"
+  }
+%s}
+`
+
+// newCLIConfig returns terraform CLI config for the shared plugin cache. If
+// offline is true then providers are only installed from the cache.
+func newCLIConfig(offline bool) string {
+	var direct string
+	if !offline {
+		direct = "  direct {}\n"
+	}
+	return fmt.Sprintf(sharedPluginsCLIConfig, pluginMountPath, direct)
+}
+
+// newBuiltinsForWS constructs the config map containing the workspace's
+// built-in terraform config. The state server URL and CA certificate are used to
+// configure the HTTP backend.
+func newBuiltinsForWS(ws *v1alpha1.Workspace, offline bool, stateServerURL string, stateServerCA []byte) *corev1.ConfigMap {
 	builtins := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ws.BuiltinsConfigMapName(),
@@ -34,6 +76,17 @@ func newBuiltinsForWS(ws *v1alpha1.Workspace) *corev1.ConfigMap {
 		},
 	}
 
+	if ws.StateBackend() == v1alpha1.StateBackendHTTP {
+		builtins.Data[backendPath] = fmt.Sprintf(builtinHTTPConfig, backend.Address(stateServerURL, ws.Namespace, ws.Name), ws.Name)
+		if len(stateServerCA) > 0 {
+			builtins.Data[stateCAPath] = string(stateServerCA)
+		}
+	}
+
+	if ws.Spec.Cache.SharedPlugins {
+		builtins.Data[cliConfigPath] = newCLIConfig(offline)
+	}
+
 	// Set etok's common labels
 	labels.SetCommonLabels(builtins)
 	// Permit filtering etok resources by component
@@ -42,7 +95,40 @@ func newBuiltinsForWS(ws *v1alpha1.Workspace) *corev1.ConfigMap {
 	return builtins
 }
 
-func newPVCForWS(ws *v1alpha1.Workspace) *corev1.PersistentVolumeClaim {
+// newStateTokenForWS constructs the secret containing a randomly generated
+// token with which the workspace's runs authenticate to the state server
+func newStateTokenForWS(ws *v1alpha1.Workspace) (*corev1.Secret, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backend.TokenSecretName(ws.Name),
+			Namespace: ws.Namespace,
+		},
+		Data: map[string][]byte{
+			backend.TokenKey: []byte(hex.EncodeToString(token)),
+		},
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(secret)
+	// Permit filtering secrets by workspace
+	labels.SetLabel(secret, labels.Workspace(ws.Name))
+	// Permit filtering etok resources by component
+	labels.SetLabel(secret, labels.StateComponent)
+
+	return secret, nil
+}
+
+func newPVCForWS(ws *v1alpha1.Workspace) (*corev1.PersistentVolumeClaim, error) {
+	size, err := resource.ParseQuantity(ws.Spec.Cache.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache size: %w", err)
+	}
+
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ws.Name,
@@ -54,13 +140,48 @@ func newPVCForWS(ws *v1alpha1.Workspace) *corev1.PersistentVolumeClaim {
 			},
 			Resources: corev1.ResourceRequirements{
 				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(ws.Spec.Cache.Size),
+					corev1.ResourceStorage: size,
 				},
 			},
 			StorageClassName: ws.Spec.Cache.StorageClass,
 		},
 	}
 
+	if ws.CacheMode() == v1alpha1.CacheModeShared {
+		// Permit mounting the cache on any node
+		pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(pvc)
+	// Permit filtering etok resources by component
+	labels.SetLabel(pvc, labels.WorkspaceComponent)
+
+	return pvc, nil
+}
+
+// newSharedPluginCachePVC constructs the PVC for the provider plugin cache
+// shared by workspaces across the cluster. It is not owned by any one
+// workspace.
+func newSharedPluginCachePVC(namespace string, size resource.Quantity, storageClass *string) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      SharedPluginCacheName,
+			Namespace: namespace,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteMany,
+			},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+			StorageClassName: storageClass,
+		},
+	}
+
 	// Set etok's common labels
 	labels.SetCommonLabels(pvc)
 	// Permit filtering etok resources by component
@@ -69,6 +190,51 @@ func newPVCForWS(ws *v1alpha1.Workspace) *corev1.PersistentVolumeClaim {
 	return pvc
 }
 
+// newSharedPluginCachePV constructs a persistent volume referencing the same
+// storage as the shared plugin cache's persistent volume, reserved for the
+// shared plugin cache PVC in the given namespace. The volume is retained upon
+// the PVC being deleted, lest the storage be deleted along with it.
+func newSharedPluginCachePV(source *corev1.PersistentVolume, namespace string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%s-%s", SharedPluginCacheName, namespace),
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:               source.Spec.Capacity,
+			PersistentVolumeSource: source.Spec.PersistentVolumeSource,
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteMany,
+			},
+			ClaimRef: &corev1.ObjectReference{
+				Namespace: namespace,
+				Name:      SharedPluginCacheName,
+			},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			MountOptions:                  source.Spec.MountOptions,
+			NodeAffinity:                  source.Spec.NodeAffinity,
+		},
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(pv)
+	// Permit filtering etok resources by component
+	labels.SetLabel(pv, labels.WorkspaceComponent)
+
+	return pv
+}
+
+// newSharedPluginCacheClaim constructs the shared plugin cache PVC for the
+// given namespace, bound to the given persistent volume.
+func newSharedPluginCacheClaim(pv *corev1.PersistentVolume, namespace string) *corev1.PersistentVolumeClaim {
+	// Empty storage class prevents the PVC being dynamically provisioned
+	storageClass := ""
+
+	pvc := newSharedPluginCachePVC(namespace, pv.Spec.Capacity[corev1.ResourceStorage], &storageClass)
+	pvc.Spec.VolumeName = pv.Name
+
+	return pvc
+}
+
 func newRoleForNamespace(ws *v1alpha1.Workspace) *rbacv1.Role {
 	role := &rbacv1.Role{
 		ObjectMeta: metav1.ObjectMeta{
@@ -83,10 +249,11 @@ func newRoleForNamespace(ws *v1alpha1.Workspace) *rbacv1.Role {
 				APIGroups: []string{""},
 			},
 			// ...and the runner specifies the run resource as owner of said
-			// config map, so it needs to retrieve run resource metadata as well
+			// config map, so it needs to retrieve run resource metadata as
+			// well. The runner also watches the run for cancellation requests.
 			{
 				Resources: []string{"runs"},
-				Verbs:     []string{"get"},
+				Verbs:     []string{"get", "list", "watch"},
 				APIGroups: []string{"etok.dev"},
 			},
 			// Terraform state backend mgmt
@@ -155,3 +322,53 @@ func newServiceAccountForNamespace(ws *v1alpha1.Workspace) *corev1.ServiceAccoun
 
 	return serviceAccount
 }
+
+// serviceAccountName returns the name of the service account with which the
+// workspace's runs are run
+func serviceAccountName(ws *v1alpha1.Workspace) string {
+	if ws.Spec.ServiceAccountName != "" {
+		return ws.Spec.ServiceAccountName
+	}
+	return ServiceAccountName
+}
+
+// hasDedicatedServiceAccount determines whether the workspace uses a service
+// account other than the namespace's service account
+func hasDedicatedServiceAccount(ws *v1alpha1.Workspace) bool {
+	return serviceAccountName(ws) != ServiceAccountName
+}
+
+// workspaceRoleBindingName returns the name of the role binding granting the
+// workspace's dedicated service account the permissions necessary for runs
+func workspaceRoleBindingName(ws *v1alpha1.Workspace) string {
+	return fmt.Sprintf("etok-%s", ws.Name)
+}
+
+func newServiceAccountForWS(ws *v1alpha1.Workspace) *corev1.ServiceAccount {
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   ws.Namespace,
+			Name:        serviceAccountName(ws),
+			Annotations: ws.Spec.ServiceAccountAnnotations,
+		},
+	}
+
+	// Set etok's common labels
+	labels.SetCommonLabels(serviceAccount)
+	// Mark service account as being for the workspace
+	labels.SetLabel(serviceAccount, labels.Workspace(ws.Name))
+	// Permit filtering etok resources by component
+	labels.SetLabel(serviceAccount, labels.WorkspaceComponent)
+
+	return serviceAccount
+}
+
+// newRoleBindingForWS binds the namespace's role to the workspace's dedicated
+// service account
+func newRoleBindingForWS(ws *v1alpha1.Workspace) *rbacv1.RoleBinding {
+	binding := newRoleBindingForNamespace(ws)
+	binding.Name = workspaceRoleBindingName(ws)
+	binding.Subjects[0].Name = serviceAccountName(ws)
+
+	return binding
+}
@@ -6,7 +6,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"reflect"
 
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -22,6 +25,15 @@ type output struct {
 
 // Unmarshal state from secret
 func readState(ctx context.Context, secret *corev1.Secret) (*state, error) {
+	data, err := readStateFile(secret)
+	if err != nil {
+		return nil, err
+	}
+	return parseState(data)
+}
+
+// readStateFile decompresses the state file in the kubernetes backend's secret
+func readStateFile(secret *corev1.Secret) ([]byte, error) {
 	data, ok := secret.Data["tfstate"]
 	if !ok {
 		return nil, errors.New("Expected key tfstate not found in state secret")
@@ -33,11 +45,29 @@ func readState(ctx context.Context, secret *corev1.Secret) (*state, error) {
 		return nil, err
 	}
 
-	// Unmarshal state file
+	return ioutil.ReadAll(gr)
+}
+
+// Unmarshal state file
+func parseState(data []byte) (*state, error) {
 	var s state
-	if err := json.NewDecoder(gr).Decode(&s); err != nil {
+	if err := json.Unmarshal(data, &s); err != nil {
 		return nil, err
 	}
 
 	return &s, nil
 }
+
+// reportState reports the state's serial number and outputs in the workspace
+// status
+func reportState(ws *v1alpha1.Workspace, state *state) {
+	ws.Status.Serial = &state.Serial
+
+	var outputs []*v1alpha1.Output
+	for k, v := range state.Outputs {
+		outputs = append(outputs, &v1alpha1.Output{Key: k, Value: v.Value})
+	}
+	if !reflect.DeepEqual(ws.Status.Outputs, outputs) {
+		ws.Status.Outputs = outputs
+	}
+}
@@ -7,26 +7,71 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
 )
 
-// Env package handles the serializing of workspace information to the
-// environment file.  Etok relies on this file to determine both the current
-// workspace and kubernetes namespace in use.
+// Env package handles the serializing of workspace information to the project
+// file. Etok relies on this file to determine the current workspace and
+// kubernetes namespace in use, and the kube context and cluster on which the
+// workspace was selected.
+//
+// The project file is found by searching the path and its parent directories,
+// stopping at the root of a git repository. The project file may override its
+// settings for directories beneath it.
 //
-// The format is <namespace>/<workspace>.
+// Previous versions of etok stored only <namespace>/<workspace> in
+// .terraform/environment, a file terraform also uses for its own workspace
+// name. Such files are read if there is no project file, and are migrated to
+// the project file when it is written.
 
 const (
-	environmentFile = ".terraform/environment"
+	// ProjectFile is the name of the project file
+	ProjectFile = ".etok.yaml"
+
+	// Legacy environment file, superseded by the project file
+	legacyEnvironmentFile = ".terraform/environment"
 )
 
 var (
 	errInvalidFormat = errors.New("invalid format, expecting <namespace>/<workspace>")
+	errInvalidFile   = errors.New("invalid project file")
 )
 
-// A string identifying a workspace, with helper functions to read and write the
-// string to the environment file.
+// Timeouts are defaults for the timeout flags of commands
+type Timeouts struct {
+	// Timeout for run pod to be running and ready
+	Pod *metav1.Duration `json:"pod,omitempty"`
+
+	// Timeout waiting for handshake with run pod
+	Handshake *metav1.Duration `json:"handshake,omitempty"`
+
+	// Timeout for resource to be reconciled
+	Reconcile *metav1.Duration `json:"reconcile,omitempty"`
+}
+
+// Env identifies a workspace, along with the kube context and cluster on which
+// it was selected, and default settings for commands
 type Env struct {
-	Namespace, Workspace string
+	Namespace string `json:"namespace,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+
+	// Kube context with which the workspace was selected
+	Context string `json:"context,omitempty"`
+
+	// URL of the API server of the cluster on which the workspace was selected
+	Cluster string `json:"cluster,omitempty"`
+
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+}
+
+// project is the structure of the project file
+type project struct {
+	Env `json:",inline"`
+
+	// Overrides for directories, keyed by path relative to the project file
+	Overrides map[string]Env `json:"overrides,omitempty"`
 }
 
 func New(namespace, workspace string) (*Env, error) {
@@ -37,28 +82,220 @@ func (e *Env) String() string {
 	return fmt.Sprintf("%s/%s", e.Namespace, e.Workspace)
 }
 
-func Read(path string) (env *Env, err error) {
-	path = filepath.Join(path, environmentFile)
+// merge overrides the env's settings with those set on another env
+func (e *Env) merge(other Env) {
+	if other.Namespace != "" {
+		e.Namespace = other.Namespace
+	}
+	if other.Workspace != "" {
+		e.Workspace = other.Workspace
+	}
+	if other.Context != "" {
+		e.Context = other.Context
+	}
+	if other.Cluster != "" {
+		e.Cluster = other.Cluster
+	}
+	if other.Timeouts == nil {
+		return
+	}
+	if e.Timeouts == nil {
+		e.Timeouts = &Timeouts{}
+	} else {
+		timeouts := *e.Timeouts
+		e.Timeouts = &timeouts
+	}
+	if other.Timeouts.Pod != nil {
+		e.Timeouts.Pod = other.Timeouts.Pod
+	}
+	if other.Timeouts.Handshake != nil {
+		e.Timeouts.Handshake = other.Timeouts.Handshake
+	}
+	if other.Timeouts.Reconcile != nil {
+		e.Timeouts.Reconcile = other.Timeouts.Reconcile
+	}
+}
 
-	bytes, err := ioutil.ReadFile(path)
+// Read reads the env for the given path from the project file, falling back to
+// a legacy environment file if there is no project file. An error satisfying
+// os.IsNotExist is returned if neither exist.
+func Read(path string) (*Env, error) {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
 
-	parts := strings.Split(string(bytes), "/")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("%s: %w", path, errInvalidFormat)
+	root, err := findProjectFile(path)
+	if os.IsNotExist(err) {
+		return readLegacy(path)
+	} else if err != nil {
+		return nil, err
 	}
 
-	return New(parts[0], parts[1])
+	p, err := readProjectFile(root)
+	if err != nil {
+		return nil, err
+	}
+
+	env := p.Env
+	if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+		if override, ok := p.Overrides[filepath.ToSlash(rel)]; ok {
+			env.merge(override)
+		}
+	}
+
+	if env.Namespace == "" || env.Workspace == "" {
+		return nil, fmt.Errorf("%s: %w: missing namespace or workspace", filepath.Join(root, ProjectFile), errInvalidFile)
+	}
+	return &env, nil
 }
 
+// Write writes the env for the given path to the project file. If the project
+// file resides in a parent directory then the env is written as an override
+// for the path. Otherwise the project file is created in the path. The context,
+// cluster and timeouts are left untouched if they are unset. A legacy
+// environment file in the path is removed.
 func (e *Env) Write(path string) error {
-	path = filepath.Join(path, environmentFile)
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+	root, err := findProjectFile(path)
+	if os.IsNotExist(err) {
+		root = path
+	} else if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, []byte(e.String()), 0644)
+	p := &project{}
+	if root != path || fileExists(filepath.Join(root, ProjectFile)) {
+		p, err = readProjectFile(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	update := func(existing Env) Env {
+		existing.Namespace = e.Namespace
+		existing.Workspace = e.Workspace
+		if e.Context != "" {
+			existing.Context = e.Context
+		}
+		if e.Cluster != "" {
+			existing.Cluster = e.Cluster
+		}
+		if e.Timeouts != nil {
+			existing.Timeouts = e.Timeouts
+		}
+		return existing
+	}
+
+	if root == path {
+		p.Env = update(p.Env)
+	} else {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if p.Overrides == nil {
+			p.Overrides = make(map[string]Env)
+		}
+		p.Overrides[filepath.ToSlash(rel)] = update(p.Overrides[filepath.ToSlash(rel)])
+	}
+
+	if err := writeProjectFile(root, p); err != nil {
+		return err
+	}
+	return removeLegacy(path)
+}
+
+// findProjectFile searches the path and its parents for the project file,
+// returning the directory in which it is found. The search stops at the root of
+// a git repository.
+func findProjectFile(path string) (string, error) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if fileExists(filepath.Join(dir, ProjectFile)) {
+			return dir, nil
+		}
+		if fileExists(filepath.Join(dir, ".git")) || filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	// Return an error that satisfies os.IsNotExist
+	_, err := os.Stat(filepath.Join(path, ProjectFile))
+	return "", err
+}
+
+func readProjectFile(dir string) (*project, error) {
+	path := filepath.Join(dir, ProjectFile)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p project
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", path, errInvalidFile, err.Error())
+	}
+	return &p, nil
+}
+
+func writeProjectFile(dir string, p *project) error {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ProjectFile), data, 0644)
+}
+
+// readLegacy reads the legacy environment file in the path. A legacy file not
+// in the etok format belongs to terraform and is ignored.
+func readLegacy(path string) (*Env, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, legacyEnvironmentFile))
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := parseLegacy(string(data))
+	if err != nil {
+		// Return an error that satisfies os.IsNotExist
+		_, err := os.Stat(filepath.Join(path, ProjectFile))
+		return nil, err
+	}
+	return env, nil
+}
+
+// removeLegacy removes the legacy environment file in the path, now that it is
+// superseded by the project file, so that terraform does not mistake its
+// contents for the name of a terraform workspace. A legacy file not in the etok
+// format belongs to terraform and is left alone.
+func removeLegacy(path string) error {
+	legacy := filepath.Join(path, legacyEnvironmentFile)
+
+	data, err := ioutil.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := parseLegacy(string(data)); err != nil {
+		return nil
+	}
+	return os.Remove(legacy)
+}
+
+func parseLegacy(s string) (*Env, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errInvalidFormat
+	}
+	return New(parts[0], parts[1])
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
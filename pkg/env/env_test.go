@@ -2,7 +2,9 @@ package env
 
 import (
 	"errors"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
@@ -23,9 +25,123 @@ func TestEnv(t *testing.T) {
 	assert.Equal(t, "test-env", env.Workspace)
 }
 
-func TestBadEnv(t *testing.T) {
-	path := testutil.NewTempDir(t).Mkdir(".terraform").Write(".terraform/environment", []byte("missing-a-forward-slash")).Root()
+func TestEnvNotFound(t *testing.T) {
+	_, err := Read(testutil.NewTempDir(t).Mkdir(".git").Root())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestEnvContextAndCluster(t *testing.T) {
+	path := testutil.NewTempDir(t).Root()
+
+	require.NoError(t, (&Env{Namespace: "default", Workspace: "dev", Context: "kind", Cluster: "https://127.0.0.1:6443"}).Write(path))
+
+	// Selecting another workspace without a context retains the recorded
+	// context and cluster
+	require.NoError(t, (&Env{Namespace: "default", Workspace: "prod"}).Write(path))
+
+	env, err := Read(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "prod", env.Workspace)
+	assert.Equal(t, "kind", env.Context)
+	assert.Equal(t, "https://127.0.0.1:6443", env.Cluster)
+}
+
+func TestEnvOverrides(t *testing.T) {
+	dir := testutil.NewTempDir(t).Mkdir(".git").Mkdir("modules/networking").Write(ProjectFile, []byte(`
+namespace: default
+workspace: default
+context: kind
+timeouts:
+  pod: 5m
+overrides:
+  modules/networking:
+    workspace: networking
+    timeouts:
+      handshake: 30s
+`))
+
+	t.Run("project root", func(t *testing.T) {
+		env, err := Read(dir.Root())
+		require.NoError(t, err)
+
+		assert.Equal(t, "default", env.Workspace)
+		assert.Equal(t, 5*time.Minute, env.Timeouts.Pod.Duration)
+		assert.Nil(t, env.Timeouts.Handshake)
+	})
+
+	t.Run("overridden directory", func(t *testing.T) {
+		env, err := Read(dir.Path("modules/networking"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "default", env.Namespace)
+		assert.Equal(t, "networking", env.Workspace)
+		assert.Equal(t, "kind", env.Context)
+		assert.Equal(t, 5*time.Minute, env.Timeouts.Pod.Duration)
+		assert.Equal(t, 30*time.Second, env.Timeouts.Handshake.Duration)
+	})
+
+	t.Run("subdirectory without override", func(t *testing.T) {
+		env, err := Read(dir.Path("modules"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "default", env.Workspace)
+	})
+
+	t.Run("write override", func(t *testing.T) {
+		require.NoError(t, (&Env{Namespace: "dev", Workspace: "vpc"}).Write(dir.Path("modules")))
+
+		env, err := Read(dir.Path("modules"))
+		require.NoError(t, err)
+		assert.Equal(t, "dev", env.Namespace)
+		assert.Equal(t, "vpc", env.Workspace)
+
+		// Project root is unaffected
+		env, err = Read(dir.Root())
+		require.NoError(t, err)
+		assert.Equal(t, "default", env.Namespace)
+		assert.Equal(t, "default", env.Workspace)
+	})
+}
+
+func TestEnvInvalidProjectFile(t *testing.T) {
+	path := testutil.NewTempDir(t).Write(ProjectFile, []byte("context: kind\n")).Root()
 
 	_, err := Read(path)
-	require.True(t, errors.Is(err, errInvalidFormat))
+	assert.True(t, errors.Is(err, errInvalidFile))
+}
+
+func TestMigrateLegacyEnv(t *testing.T) {
+	dir := testutil.NewTempDir(t).Mkdir(".terraform").Write(".terraform/environment", []byte("dev/networking"))
+
+	env, err := Read(dir.Root())
+	require.NoError(t, err)
+
+	assert.Equal(t, "dev", env.Namespace)
+	assert.Equal(t, "networking", env.Workspace)
+
+	// Reading leaves the legacy file alone
+	assert.FileExists(t, dir.Path(".terraform/environment"))
+	assert.NoFileExists(t, dir.Path(ProjectFile))
+
+	// Legacy file is replaced by project file upon writing
+	require.NoError(t, env.Write(dir.Root()))
+	assert.NoFileExists(t, dir.Path(".terraform/environment"))
+	assert.FileExists(t, dir.Path(ProjectFile))
+}
+
+func TestIgnoreTerraformEnv(t *testing.T) {
+	// Terraform's own environment file contains the name of a terraform
+	// workspace
+	dir := testutil.NewTempDir(t).Mkdir(".git").Mkdir(".terraform").Write(".terraform/environment", []byte("missing-a-forward-slash"))
+
+	_, err := Read(dir.Root())
+	assert.True(t, os.IsNotExist(err))
+	assert.FileExists(t, dir.Path(".terraform/environment"))
+
+	// Writing the project file leaves terraform's file alone
+	env, err := New("dev", "networking")
+	require.NoError(t, err)
+	require.NoError(t, env.Write(dir.Root()))
+	assert.FileExists(t, dir.Path(".terraform/environment"))
 }
@@ -3,9 +3,12 @@ package executor
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
 
 	cmdutil "github.com/leg100/etok/cmd/util"
+	"golang.org/x/crypto/ssh/terminal"
 	"k8s.io/klog/v2"
 )
 
@@ -17,6 +20,14 @@ type ExecOption func(*exec.Cmd)
 
 type Exec struct {
 	cmdutil.IOStreams
+
+	// Signals received whilst the command is running are forwarded to it
+	Signals <-chan os.Signal
+
+	// Run the command in its own process group, to which forwarded signals
+	// are sent, reaching any processes the command spawns, such as provider
+	// plugins
+	ProcessGroup bool
 }
 
 func (tc *Exec) Execute(ctx context.Context, args []string, opts ...ExecOption) error {
@@ -31,7 +42,41 @@ func (tc *Exec) Execute(ctx context.Context, args []string, opts ...ExecOption)
 		o(exe)
 	}
 
-	if err := exe.Run(); err != nil {
+	if tc.ProcessGroup {
+		exe.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if f, ok := tc.In.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+			// Place the group in the foreground of the terminal, otherwise
+			// the command is stopped upon reading from it
+			exe.SysProcAttr.Foreground = true
+			exe.SysProcAttr.Ctty = int(f.Fd())
+		}
+	}
+
+	if err := exe.Start(); err != nil {
+		return fmt.Errorf("unable to run command %v: %w", args, err)
+	}
+
+	// Forward signals until the command exits
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-tc.Signals:
+				klog.V(1).Infof("forwarding signal %s to command %v\n", sig, args)
+				if s, ok := sig.(syscall.Signal); ok && tc.ProcessGroup {
+					// A negative pid signals the process group
+					_ = syscall.Kill(-exe.Process.Pid, s)
+				} else {
+					_ = exe.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := exe.Wait(); err != nil {
 		return fmt.Errorf("unable to run command %v: %w", args, err)
 	}
 	return nil
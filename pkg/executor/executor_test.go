@@ -1,16 +1,25 @@
 package executor
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
 	osexec "os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	cmdutil "github.com/leg100/etok/cmd/util"
 	"github.com/leg100/etok/pkg/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestExecutor(t *testing.T) {
@@ -49,4 +58,49 @@ func TestExecutor(t *testing.T) {
 			assert.Equal(t, 101, exiterr.ExitCode())
 		}
 	})
+
+	testutil.Run(t, "forward signal", func(t *testutil.T) {
+		signals := make(chan os.Signal, 1)
+		signals <- os.Kill
+
+		err := (&Exec{Signals: signals}).Execute(context.Background(), []string{"sleep", "10"})
+
+		// want command killed
+		var exiterr *osexec.ExitError
+		if assert.True(t, errors.As(err, &exiterr)) {
+			assert.Equal(t, syscall.SIGKILL, exiterr.Sys().(syscall.WaitStatus).Signal())
+		}
+	})
+
+	testutil.Run(t, "signal process group", func(t *testutil.T) {
+		signals := make(chan os.Signal, 1)
+
+		// The command spawns a child, printing its pid
+		pr, pw := io.Pipe()
+		errch := make(chan error, 1)
+		go func() {
+			errch <- (&Exec{IOStreams: cmdutil.IOStreams{Out: pw}, Signals: signals, ProcessGroup: true}).Execute(context.Background(), []string{"sh", "-c", "sleep 30 & echo $!; wait"})
+		}()
+		line, err := bufio.NewReader(pr).ReadString('\n')
+		require.NoError(t, err)
+		pid, err := strconv.Atoi(strings.TrimSpace(line))
+		require.NoError(t, err)
+		go io.Copy(ioutil.Discard, pr)
+
+		signals <- os.Kill
+
+		// The command only returns once the child has closed its output
+		select {
+		case err := <-errch:
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("child process outlived the command")
+		}
+
+		// want child killed too
+		assert.Eventually(t, func() bool {
+			stat, err := osexec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+			return err != nil || strings.HasPrefix(strings.TrimSpace(string(stat)), "Z")
+		}, 5*time.Second, 100*time.Millisecond)
+	})
 }
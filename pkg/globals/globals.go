@@ -3,4 +3,11 @@ package globals
 const (
 	RunnerContainerName = "runner"
 	LockFile            = ".terraform.lock.hcl"
+	// HandshakeMarker is created by the runner once it has received the
+	// handshake, signalling the runner container is ready
+	HandshakeMarker = "/tmp/etok-handshake-completed"
+	// DotTerraformLockFile is the lock file within a workspace's .terraform
+	// directory, held exclusively whilst the directory is modified, and shared
+	// whilst it is copied
+	DotTerraformLockFile = ".etok.lock"
 )
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
@@ -13,7 +14,7 @@ import (
 // Log queue position until run is at front of queue
 func LogQueuePosition(runName string) watchtools.ConditionFunc {
 	return workspaceHandlerWrapper(func(ws *v1alpha1.Workspace) (bool, error) {
-		if ws.Status.Active == runName {
+		if slice.ContainsString(ws.ActiveRuns(), runName) {
 			// We're active, proceed
 			return true, nil
 		}
@@ -28,7 +29,11 @@ func LogQueuePosition(runName string) watchtools.ConditionFunc {
 					printedQueue = append(printedQueue, run)
 				}
 			}
-			fmt.Printf("Queued behind active run %s: %v\n", ws.Status.Active, printedQueue)
+			if len(ws.Status.Readers) > 0 {
+				fmt.Printf("Queued behind active runs %s: %v\n", strings.Join(ws.Status.Readers, ", "), printedQueue)
+			} else {
+				fmt.Printf("Queued behind active run %s: %v\n", ws.Status.Active, printedQueue)
+			}
 		}
 		return false, nil
 	})
@@ -37,7 +42,7 @@ func LogQueuePosition(runName string) watchtools.ConditionFunc {
 // Return true if run is queued
 func IsQueued(runName string) watchtools.ConditionFunc {
 	return workspaceHandlerWrapper(func(ws *v1alpha1.Workspace) (bool, error) {
-		if ws.Status.Active == runName {
+		if slice.ContainsString(ws.ActiveRuns(), runName) {
 			return true, nil
 		}
 		if slice.ContainsString(ws.Status.Queue, runName) {
@@ -19,22 +19,36 @@ var (
 // error is returned if the ready condition is false with a failure reason or it
 // a deletion reason (its undergoing deletion).  Any other reason returns false.
 func WorkspaceReady() watchtools.ConditionFunc {
+	return workspaceHandlerWrapper(isReady)
+}
+
+// WorkspaceReconfigured returns true once the operator has reconciled the given
+// generation of the workspace's spec and the workspace is ready. Errors are
+// returned in the same manner as WorkspaceReady.
+func WorkspaceReconfigured(generation int64) watchtools.ConditionFunc {
 	return workspaceHandlerWrapper(func(ws *v1alpha1.Workspace) (bool, error) {
-		cond := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceReadyCondition)
-		if cond == nil {
+		if ws.Status.ObservedGeneration < generation {
 			return false, nil
 		}
-		switch cond.Status {
-		case metav1.ConditionTrue:
-			return true, nil
-		case metav1.ConditionFalse:
-			switch cond.Reason {
-			case v1alpha1.FailureReason:
-				return false, fmt.Errorf("%w: %s", ErrWorkspaceFailed, cond.Message)
-			case v1alpha1.DeletionReason:
-				return false, ErrWorkspaceDeletion
-			}
-		}
-		return false, nil
+		return isReady(ws)
 	})
 }
+
+func isReady(ws *v1alpha1.Workspace) (bool, error) {
+	cond := meta.FindStatusCondition(ws.Status.Conditions, v1alpha1.WorkspaceReadyCondition)
+	if cond == nil {
+		return false, nil
+	}
+	switch cond.Status {
+	case metav1.ConditionTrue:
+		return true, nil
+	case metav1.ConditionFalse:
+		switch cond.Reason {
+		case v1alpha1.FailureReason:
+			return false, fmt.Errorf("%w: %s", ErrWorkspaceFailed, cond.Message)
+		case v1alpha1.DeletionReason:
+			return false, ErrWorkspaceDeletion
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// WorkspaceStateSerial returns true once the workspace reports its state has
+// the given serial number, i.e. the operator has read the state.
+func WorkspaceStateSerial(serial int) watchtools.ConditionFunc {
+	return workspaceHandlerWrapper(func(ws *v1alpha1.Workspace) (bool, error) {
+		if ws.Status.Serial == nil {
+			return false, nil
+		}
+		return *ws.Status.Serial == serial, nil
+	})
+}
+
+// WorkspaceUnlocked returns true once the operator has handled a request to
+// release the lock with the given ID, i.e. the unlock annotation has been
+// removed and the workspace no longer reports the lock.
+func WorkspaceUnlocked(id string) watchtools.ConditionFunc {
+	return workspaceHandlerWrapper(func(ws *v1alpha1.Workspace) (bool, error) {
+		if _, ok := ws.Annotations[v1alpha1.UnlockAnnotationKey]; ok {
+			return false, nil
+		}
+		return ws.Status.Lock == nil || ws.Status.Lock.ID != id, nil
+	})
+}
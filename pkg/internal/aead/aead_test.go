@@ -0,0 +1,30 @@
+package aead
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	key := sha256.Sum256([]byte("secret"))
+	data := []byte(`{"lineage": "abc"}`)
+
+	ciphertext, err := Encrypt(key[:], data)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(ciphertext, []byte("lineage")))
+
+	plaintext, err := Decrypt(key[:], ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, data, plaintext)
+
+	wrong := sha256.Sum256([]byte("wrong"))
+	_, err = Decrypt(wrong[:], ciphertext)
+	assert.Error(t, err)
+
+	_, err = Decrypt(key[:], []byte("short"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+// Package httpserver runs the operator's HTTP servers: the state server, the
+// web server and the VCS webhook receiver.
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Maximum time to wait for in-flight requests to complete upon shutdown
+const shutdownTimeout = 5 * time.Second
+
+// Runnable serves a handler until the context is cancelled. It implements
+// controller-runtime's Runnable interface, and is served on every replica of
+// the operator rather than only the leader.
+type Runnable struct {
+	// Name of the server, for logging
+	Name string
+
+	// Address on which to listen
+	Addr string
+
+	Handler http.Handler
+
+	// Serving certificate. Nil serves plain HTTP.
+	Cert *tls.Certificate
+}
+
+// WithTLS sets the serving certificate using the PEM-encoded certificate and
+// key
+func (r *Runnable) WithTLS(cert, key []byte) error {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return fmt.Errorf("invalid serving certificate: %w", err)
+	}
+	r.Cert = &pair
+	return nil
+}
+
+// Start serves requests until the context is cancelled
+func (r *Runnable) Start(ctx context.Context) error {
+	srv := &http.Server{Addr: r.Addr, Handler: r.Handler}
+
+	errch := make(chan error, 1)
+	go func() {
+		klog.V(0).Infof("%s listening on %s", r.Name, r.Addr)
+		if r.Cert != nil {
+			srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*r.Cert}}
+			errch <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errch <- srv.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errch:
+		return err
+	}
+}
+
+// NeedLeaderElection permits every replica of the operator to serve requests
+func (r *Runnable) NeedLeaderElection() bool {
+	return false
+}
@@ -18,6 +18,9 @@ var (
 	OperatorComponent  = Component("operator")
 	WorkspaceComponent = Component("workspace")
 	RunComponent       = Component("run")
+	StateComponent     = Component("state")
+	// VCSTrigger marks runs triggered by VCS webhooks
+	VCSTrigger = NewLabel("trigger", "vcs")
 )
 
 // A valid label must be an empty string or consist of alphanumeric characters ,
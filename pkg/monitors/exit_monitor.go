@@ -6,9 +6,12 @@ import (
 
 	"github.com/leg100/etok/api/etok.dev/v1alpha1"
 	etokerrors "github.com/leg100/etok/pkg/errors"
+	"github.com/leg100/etok/pkg/handlers"
 	"github.com/leg100/etok/pkg/k8s"
 	"github.com/leg100/etok/pkg/k8s/etokclient"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	watchtools "k8s.io/client-go/tools/watch"
@@ -58,8 +61,10 @@ func ExitMonitor(ctx context.Context, client kubernetes.Interface, name, namespa
 
 // Wait for the run to complete and propagate its error, if it has one. The
 // error implements errors.ExitError if there is an error, which contains the
-// non-zero exit code of the container.  Non-blocking, the error is reported via
-// the returned error channel.
+// non-zero exit code of the container. A run that fails without its container
+// exiting, e.g. because it timed out in the queue, is reported with
+// handlers.ErrRunFailed. Non-blocking, the error is reported via the returned
+// error channel.
 func RunExitMonitor(ctx context.Context, client etokclient.Interface, namespace, name string) chan error {
 	var code *int
 	exit := make(chan error)
@@ -83,6 +88,10 @@ func RunExitMonitor(ctx context.Context, client etokclient.Interface, namespace,
 				return true, nil
 			}
 
+			if failed := meta.FindStatusCondition(run.Conditions, v1alpha1.RunFailedCondition); failed != nil && failed.Status == metav1.ConditionTrue {
+				return false, fmt.Errorf("%w: %s", handlers.ErrRunFailed, failed.Message)
+			}
+
 			return false, nil
 		})
 
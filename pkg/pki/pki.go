@@ -0,0 +1,225 @@
+// Package pki generates and persists the self-signed certificates with which
+// the operator serves TLS.
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leg100/etok/pkg/labels"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Validity of generated certificates
+	certValidity = 10 * 365 * 24 * time.Hour
+	// Certificates are re-generated when they're due to expire within this
+	// period
+	certRenewBefore = 30 * 24 * time.Hour
+
+	certFile = "tls.crt"
+	keyFile  = "tls.key"
+	caFile   = "ca.crt"
+)
+
+// Certs is a self-signed CA along with a serving certificate and key signed by
+// the CA, all PEM-encoded.
+type Certs struct {
+	CACert []byte
+	Cert   []byte
+	Key    []byte
+}
+
+// Generate generates a CA and a serving certificate for the service in the
+// given namespace.
+func Generate(service, namespace string) (*Certs, error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: service + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", service, namespace)},
+		DNSNames: []string{
+			service,
+			fmt.Sprintf("%s.%s", service, namespace),
+			fmt.Sprintf("%s.%s.svc", service, namespace),
+			fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certs{
+		CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		Cert:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// LoadOrGenerate loads the certificates for the service persisted in the named
+// secret in the given namespace. If the secret doesn't exist, or its
+// certificates are invalid or due to expire, new certificates are generated and
+// persisted to the secret, so that they're reused across restarts and shared
+// between replicas.
+func LoadOrGenerate(ctx context.Context, kc kubernetes.Interface, secretName, service, namespace string) (*Certs, error) {
+	secrets := kc.CoreV1().Secrets(namespace)
+
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	found := err == nil
+	if found {
+		certs := certsFromSecret(secret)
+		if certs.valid(service, namespace) {
+			return certs, nil
+		}
+	} else if !kerrors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to get certificate secret: %w", err)
+	}
+
+	certs, err := Generate(service, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		// Replace invalid certificates. Fails with a conflict if another
+		// replica has replaced them in the meantime.
+		secret.Data = certs.data()
+		if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			if kerrors.IsConflict(err) {
+				return LoadOrGenerate(ctx, kc, secretName, service, namespace)
+			}
+			return nil, fmt.Errorf("unable to update certificate secret: %w", err)
+		}
+		return certs, nil
+	}
+
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: certs.data(),
+	}
+	labels.SetCommonLabels(secret)
+	labels.SetLabel(secret, labels.OperatorComponent)
+
+	if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			// Another replica persisted certificates first; use those
+			return LoadOrGenerate(ctx, kc, secretName, service, namespace)
+		}
+		return nil, fmt.Errorf("unable to create certificate secret: %w", err)
+	}
+	return certs, nil
+}
+
+func certsFromSecret(secret *corev1.Secret) *Certs {
+	return &Certs{
+		CACert: secret.Data[caFile],
+		Cert:   secret.Data[certFile],
+		Key:    secret.Data[keyFile],
+	}
+}
+
+func (c *Certs) data() map[string][]byte {
+	return map[string][]byte{
+		caFile:   c.CACert,
+		certFile: c.Cert,
+		keyFile:  c.Key,
+	}
+}
+
+// valid determines whether the serving certificate is signed by the CA, is
+// valid for the service, and is not due to expire, and whether the key pair is
+// usable
+func (c *Certs) valid(service, namespace string) bool {
+	if _, err := tls.X509KeyPair(c.Cert, c.Key); err != nil {
+		return false
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(c.CACert) {
+		return false
+	}
+
+	block, _ := pem.Decode(c.Cert)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:     fmt.Sprintf("%s.%s.svc", service, namespace),
+		Roots:       pool,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		CurrentTime: time.Now().Add(certRenewBefore),
+	})
+	return err == nil
+}
+
+// Write writes the serving certificate and key to the directory from which a
+// server reads them.
+func (c *Certs) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, certFile), c.Cert, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, keyFile), c.Key, 0600)
+}
@@ -0,0 +1,121 @@
+package pki
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGenerate(t *testing.T) {
+	testutil.Run(t, "serving certificate is signed by CA", func(t *testutil.T) {
+		certs, err := Generate("etok-webhook", "etok")
+		require.NoError(t, err)
+
+		pool := x509.NewCertPool()
+		require.True(t, pool.AppendCertsFromPEM(certs.CACert))
+
+		block, _ := pem.Decode(certs.Cert)
+		require.NotNil(t, block)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName:   "etok-webhook.etok.svc",
+			Roots:     pool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		assert.NoError(t, err)
+
+		// Check key pair is usable by the webhook server
+		_, err = tls.X509KeyPair(certs.Cert, certs.Key)
+		assert.NoError(t, err)
+	})
+
+	testutil.Run(t, "write certificate and key", func(t *testutil.T) {
+		certs, err := Generate("etok-webhook", "etok")
+		require.NoError(t, err)
+
+		dir := filepath.Join(t.NewTempDir().Root(), "serving-certs")
+		require.NoError(t, certs.Write(dir))
+
+		cert, err := ioutil.ReadFile(filepath.Join(dir, "tls.crt"))
+		require.NoError(t, err)
+		assert.Equal(t, certs.Cert, cert)
+
+		key, err := ioutil.ReadFile(filepath.Join(dir, "tls.key"))
+		require.NoError(t, err)
+		assert.Equal(t, certs.Key, key)
+	})
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	existing, err := Generate("etok-webhook", "etok")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		objs   []runtime.Object
+		reused bool
+	}{
+		{
+			name: "generate",
+		},
+		{
+			name: "reuse persisted certs",
+			objs: []runtime.Object{
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "etok", Name: "etok-webhook-certs"},
+					Data:       existing.data(),
+				},
+			},
+			reused: true,
+		},
+		{
+			name: "replace invalid certs",
+			objs: []runtime.Object{
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "etok", Name: "etok-webhook-certs"},
+					Data:       map[string][]byte{"tls.crt": []byte("garbage")},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			kc := kfake.NewSimpleClientset(tt.objs...)
+
+			certs, err := LoadOrGenerate(context.Background(), kc, "etok-webhook-certs", "etok-webhook", "etok")
+			require.NoError(t, err)
+			assert.True(t, certs.valid("etok-webhook", "etok"))
+
+			if tt.reused {
+				assert.Equal(t, existing, certs)
+			} else {
+				assert.NotEqual(t, existing, certs)
+			}
+
+			// Certs are persisted for the next start
+			secret, err := kc.CoreV1().Secrets("etok").Get(context.Background(), "etok-webhook-certs", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, certs, certsFromSecret(secret))
+
+			// ...and reused upon the next start
+			again, err := LoadOrGenerate(context.Background(), kc, "etok-webhook-certs", "etok-webhook", "etok")
+			require.NoError(t, err)
+			assert.Equal(t, certs, again)
+		})
+	}
+}
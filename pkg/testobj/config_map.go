@@ -3,6 +3,7 @@ package testobj
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func ConfigMap(namespace, name string, opts ...func(*corev1.ConfigMap)) *corev1.ConfigMap {
@@ -18,3 +19,22 @@ func ConfigMap(namespace, name string, opts ...func(*corev1.ConfigMap)) *corev1.
 
 	return configMap
 }
+
+func WithBinaryData(data map[string][]byte) func(*corev1.ConfigMap) {
+	return func(configMap *corev1.ConfigMap) {
+		configMap.BinaryData = data
+	}
+}
+
+func WithOwnerRuns(runs ...string) func(*corev1.ConfigMap) {
+	return func(configMap *corev1.ConfigMap) {
+		for _, run := range runs {
+			configMap.OwnerReferences = append(configMap.OwnerReferences, metav1.OwnerReference{
+				APIVersion: "etok.dev/v1alpha1",
+				Kind:       "Run",
+				Name:       run,
+				UID:        types.UID(run),
+			})
+		}
+	}
+}
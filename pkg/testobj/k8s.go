@@ -14,6 +14,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func Workspace(namespace, name string, opts ...func(*v1alpha1.Workspace)) *v1alpha1.Workspace {
@@ -86,18 +87,110 @@ func WithCombinedQueue(run ...string) func(*v1alpha1.Workspace) {
 	}
 }
 
+func WithReaders(run ...string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Status.Readers = run
+	}
+}
+
+func WithLabels(labels map[string]string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.SetLabels(labels)
+	}
+}
+
+func WithQueue(run ...string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Status.Queue = run
+	}
+}
+
+func WithReaderPolicy(policy v1alpha1.ReaderPolicy) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.ReaderPolicy = policy
+	}
+}
+
 func WithStorageClass(class *string) func(*v1alpha1.Workspace) {
 	return func(ws *v1alpha1.Workspace) {
 		ws.Spec.Cache.StorageClass = class
 	}
 }
 
+func WithCacheSize(size string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.Cache.Size = size
+	}
+}
+
+func WithCacheMode(mode v1alpha1.CacheMode) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.Cache.Mode = mode
+	}
+}
+
+func WithIdleTimeout(timeout string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.Cache.IdleTimeout = timeout
+	}
+}
+
+func WithSharedPlugins() func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.Cache.SharedPlugins = true
+	}
+}
+
+func WithServiceAccount(name string, annotations ...string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.ServiceAccountName = name
+		for i := 0; i < len(annotations); i += 2 {
+			if ws.Spec.ServiceAccountAnnotations == nil {
+				ws.Spec.ServiceAccountAnnotations = make(map[string]string)
+			}
+			ws.Spec.ServiceAccountAnnotations[annotations[i]] = annotations[i+1]
+		}
+	}
+}
+
+func WithCredentialSecrets(secrets ...v1alpha1.CredentialSecret) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.CredentialSecrets = append(ws.Spec.CredentialSecrets, secrets...)
+	}
+}
+
+func WithGitTrackedOnly() func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.GitTrackedOnly = true
+	}
+}
+
+func WithTerraformMirror(mirror string) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.TerraformMirror = mirror
+	}
+}
+
 func WithTerraformVersion(version string) func(*v1alpha1.Workspace) {
 	return func(ws *v1alpha1.Workspace) {
 		ws.Spec.TerraformVersion = version
 	}
 }
 
+func WithStateBackend(backend v1alpha1.StateBackend) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.StateBackend = backend
+	}
+}
+
+// WithMigratedStateBackend records the workspace as having migrated to the
+// given state backend
+func WithMigratedStateBackend(backend v1alpha1.StateBackend) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Status.StateBackend = backend
+	}
+}
+
 func WithApprovals(run ...string) func(*v1alpha1.Workspace) {
 	return func(ws *v1alpha1.Workspace) {
 		if ws.Annotations == nil {
@@ -193,6 +286,21 @@ func WithPhase(phase corev1.PodPhase) func(*corev1.Pod) {
 	}
 }
 
+func WithRetryPolicy(limit int, pendingTimeout string) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		run.RetryPolicy = v1alpha1.RetryPolicy{Limit: limit, PendingTimeout: pendingTimeout}
+	}
+}
+
+// Record failed attempts with the given pod UIDs
+func WithRetries(uids ...types.UID) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		for _, uid := range uids {
+			run.Retries = append(run.Retries, v1alpha1.RunRetry{PodUID: uid, Reason: v1alpha1.PodEvictedReason})
+		}
+	}
+}
+
 // Set exit code in run status
 func WithRunExitCode(code int) func(*v1alpha1.Run) {
 	return func(run *v1alpha1.Run) {
@@ -206,6 +314,25 @@ func WithRunnerExitCode(code int32) func(*corev1.Pod) {
 	}
 }
 
+func WithPodUID(uid types.UID) func(*corev1.Pod) {
+	return func(pod *corev1.Pod) {
+		pod.SetUID(uid)
+	}
+}
+
+// Set runner container waiting, never having started
+func WithRunnerWaiting(reason string) func(*corev1.Pod) {
+	return func(pod *corev1.Pod) {
+		for i, status := range pod.Status.ContainerStatuses {
+			if status.Name == globals.RunnerContainerName {
+				pod.Status.ContainerStatuses[i].State = corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: reason},
+				}
+			}
+		}
+	}
+}
+
 func WithInstallerExitCode(code int32) func(*corev1.Pod) {
 	return func(pod *corev1.Pod) {
 		k8s.ContainerStatusByName(pod, "installer").State.Terminated.ExitCode = code
@@ -265,6 +392,18 @@ func WithArgs(args ...string) func(*v1alpha1.Run) {
 	}
 }
 
+func WithArtifacts(paths ...string) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		run.Artifacts = paths
+	}
+}
+
+func WithConfigMap(name string) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		run.ConfigMap = name
+	}
+}
+
 func WithConfigMapPath(path string) func(*v1alpha1.Run) {
 	return func(run *v1alpha1.Run) {
 		run.ConfigMapPath = path
@@ -294,6 +433,15 @@ func WithStringData(k, v string) func(*corev1.Secret) {
 	}
 }
 
+func WithData(k, v string) func(*corev1.Secret) {
+	return func(secret *corev1.Secret) {
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[k] = []byte(v)
+	}
+}
+
 func WithDataFromFile(k, path string) func(*corev1.Secret) {
 	return func(secret *corev1.Secret) {
 		if secret.Data == nil {
@@ -317,3 +465,9 @@ func WithCompressedDataFromFile(k, path string) func(*corev1.Secret) {
 		secret.Data[k] = buf.Bytes()
 	}
 }
+
+func WithCancel(mode v1alpha1.RunCancelMode) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		run.Cancel = mode
+	}
+}
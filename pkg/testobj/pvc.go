@@ -2,6 +2,7 @@ package testobj
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -11,6 +12,17 @@ func PVC(namespace, name string, opts ...func(*corev1.PersistentVolumeClaim)) *c
 			Name:      name,
 			Namespace: namespace,
 		},
+		// Matches the spec of a default workspace cache
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resource.MustParse("1Gi"),
+				},
+			},
+		},
 	}
 
 	for _, option := range opts {
@@ -28,3 +40,59 @@ func WithPVCPhase(phase corev1.PersistentVolumeClaimPhase) func(*corev1.Persiste
 		}
 	}
 }
+
+func WithPVCStorageClass(class string) func(*corev1.PersistentVolumeClaim) {
+	return func(pvc *corev1.PersistentVolumeClaim) {
+		pvc.Spec.StorageClassName = &class
+	}
+}
+
+func WithPVCSize(size string) func(*corev1.PersistentVolumeClaim) {
+	return func(pvc *corev1.PersistentVolumeClaim) {
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = resource.MustParse(size)
+	}
+}
+
+func WithPVCCapacity(size string) func(*corev1.PersistentVolumeClaim) {
+	return func(pvc *corev1.PersistentVolumeClaim) {
+		pvc.Status.Capacity = corev1.ResourceList{
+			corev1.ResourceStorage: resource.MustParse(size),
+		}
+	}
+}
+
+func WithPVCVolumeName(name string) func(*corev1.PersistentVolumeClaim) {
+	return func(pvc *corev1.PersistentVolumeClaim) {
+		pvc.Spec.VolumeName = name
+	}
+}
+
+// PV constructs a persistent volume backed by an NFS share
+func PV(name string, opts ...func(*corev1.PersistentVolume)) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse("1Gi"),
+			},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{
+					Server: "nfs.example.com",
+					Path:   "/" + name,
+				},
+			},
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteMany,
+			},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+	}
+
+	for _, option := range opts {
+		option(pv)
+	}
+
+	return pv
+}
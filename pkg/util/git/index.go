@@ -0,0 +1,82 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs a git command in the given directory, returning its stdout.
+func git(dir string, args ...string) ([]byte, error) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// TrackedFiles returns the absolute paths of all the files in the index of the
+// git repository with the given root.
+func TrackedFiles(root string) ([]string, error) {
+	out, err := git(root, "ls-files", "-z", "--cached")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f == "" {
+			continue
+		}
+		files = append(files, filepath.Join(root, filepath.FromSlash(f)))
+	}
+	return files, nil
+}
+
+// IgnoredFiles returns the absolute paths of the untracked files in the git
+// repository with the given root that are ignored by .gitignore and the other
+// standard exclusion files. Wholly ignored directories are returned as a single
+// path rather than their contents. Tracked files are never returned, even if
+// they match an exclusion pattern.
+func IgnoredFiles(root string) ([]string, error) {
+	out, err := git(root, "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--directory")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f == "" {
+			continue
+		}
+		files = append(files, filepath.Join(root, filepath.FromSlash(strings.TrimSuffix(f, "/"))))
+	}
+	return files, nil
+}
+
+// Head returns the SHA of the commit currently checked out in the git
+// repository in which path is within
+func Head(path string) (string, error) {
+	out, err := git(path, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// IsDirty determines whether the tracked files of the git repository in which
+// path is within have uncommitted changes
+func IsDirty(path string) (bool, error) {
+	out, err := git(path, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
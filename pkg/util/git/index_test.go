@@ -0,0 +1,91 @@
+package git
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	testutil.Run(t, "tracked files", func(t *testutil.T) {
+		repo := newRepo(t)
+		repo.Write("main.tf", []byte("# main")).Write("sub/vars.tf", []byte("# vars"))
+		runGit(t, repo.Root(), "add", "main.tf", "sub/vars.tf")
+		repo.Write("secret.tfvars", []byte("password=123"))
+
+		files, err := TrackedFiles(repo.Root())
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			filepath.Join(repo.Root(), "main.tf"),
+			filepath.Join(repo.Root(), "sub", "vars.tf"),
+		}, files)
+	})
+
+	testutil.Run(t, "ignored files", func(t *testutil.T) {
+		repo := newRepo(t)
+		repo.Write(".gitignore", []byte("*.tfvars\nbuild/\n"))
+		repo.Write("main.tf", []byte("# main"))
+		repo.Write("secret.tfvars", []byte("password=123"))
+		repo.Write("build/lambda.zip", []byte("zip"))
+		repo.Write("forced.tfvars", []byte("region=eu"))
+		runGit(t, repo.Root(), "add", "-f", "forced.tfvars")
+
+		files, err := IgnoredFiles(repo.Root())
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			filepath.Join(repo.Root(), "build"),
+			filepath.Join(repo.Root(), "secret.tfvars"),
+		}, files)
+	})
+
+	testutil.Run(t, "head and dirty flag", func(t *testutil.T) {
+		repo := newRepo(t)
+		repo.Write("main.tf", []byte("# main"))
+		runGit(t, repo.Root(), "add", "main.tf")
+		runGit(t, repo.Root(), "commit", "-m", "initial")
+
+		sha, err := Head(repo.Root())
+		require.NoError(t, err)
+		assert.Regexp(t, "^[0-9a-f]{40}$", sha)
+
+		dirty, err := IsDirty(repo.Root())
+		require.NoError(t, err)
+		assert.False(t, dirty)
+
+		// Untracked files don't make repo dirty
+		repo.Write("untracked.tf", []byte("# untracked"))
+		dirty, err = IsDirty(repo.Root())
+		require.NoError(t, err)
+		assert.False(t, dirty)
+
+		// But changes to tracked files do
+		repo.Write("main.tf", []byte("# modified"))
+		dirty, err = IsDirty(repo.Root())
+		require.NoError(t, err)
+		assert.True(t, dirty)
+	})
+
+	testutil.Run(t, "not a repo", func(t *testutil.T) {
+		_, err := TrackedFiles(t.NewTempDir().Root())
+		assert.Error(t, err)
+	})
+}
+
+func newRepo(t *testutil.T) *testutil.TempDir {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo := t.NewTempDir()
+	runGit(t, repo.Root(), "init", "-q")
+	return repo
+}
+
+func runGit(t *testutil.T, dir string, args ...string) {
+	args = append([]string{"-C", dir, "-c", "user.name=etok", "-c", "user.email=etok@example.com"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
@@ -0,0 +1,164 @@
+package vcs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/leg100/etok/pkg/util/slice"
+)
+
+// github is a GitHub provider. Webhooks are validated using the HMAC-SHA256
+// signature in the X-Hub-Signature-256 header.
+type github struct {
+	api    *apiClient
+	secret []byte
+}
+
+type githubRepository struct {
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+type githubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			SHA  string `json:"sha"`
+			Ref  string `json:"ref"`
+			Repo *struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Repository githubRepository `json:"repository"`
+}
+
+// GitHub lists no more than 20 commits in a push event
+const githubMaxPushCommits = 20
+
+// GitHub lists the files of a pull request in pages of at most 100 files
+const githubFilesPerPage = 100
+
+type githubPushEvent struct {
+	Ref        string           `json:"ref"`
+	Commits    []pushedCommit   `json:"commits"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Repository githubRepository `json:"repository"`
+}
+
+func (g *github) ParseEvent(r *http.Request, body []byte) (*Event, error) {
+	if !g.validSignature(r.Header.Get("X-Hub-Signature-256"), body) {
+		return nil, ErrInvalidSignature
+	}
+
+	switch r.Header.Get("X-GitHub-Event") {
+	case "pull_request":
+		var ev githubPullRequestEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			return nil, err
+		}
+		// Only plan when the pull request's code changes
+		if !slice.ContainsString([]string{"opened", "synchronize", "reopened"}, ev.Action) {
+			return nil, nil
+		}
+		return &Event{
+			Repository:    ev.Repository.FullName,
+			SHA:           ev.PullRequest.Head.SHA,
+			Branch:        ev.PullRequest.Head.Ref,
+			DefaultBranch: ev.Repository.DefaultBranch,
+			PullRequest:   ev.Number,
+			// The head repository is missing if the fork has been deleted
+			Fork:       ev.PullRequest.Head.Repo == nil || ev.PullRequest.Head.Repo.FullName != ev.Repository.FullName,
+			DeliveryID: r.Header.Get("X-GitHub-Delivery"),
+		}, nil
+	case "push":
+		var ev githubPushEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			return nil, err
+		}
+		// Skip deleted branches and tags
+		if ev.Deleted || !strings.HasPrefix(ev.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		return &Event{
+			Repository:    ev.Repository.FullName,
+			SHA:           ev.After,
+			Branch:        strings.TrimPrefix(ev.Ref, "refs/heads/"),
+			DefaultBranch: ev.Repository.DefaultBranch,
+			DeliveryID:    r.Header.Get("X-GitHub-Delivery"),
+			ChangedFiles:  pushedFiles(ev.Commits, len(ev.Commits) >= githubMaxPushCommits),
+		}, nil
+	default:
+		// Ignore other events, such as ping
+		return nil, nil
+	}
+}
+
+// validSignature checks the signature is the HMAC of the body, keyed with the
+// webhook secret
+func (g *github) validSignature(sig string, body []byte) bool {
+	if !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (g *github) GetArchive(ctx context.Context, repo, sha string) (io.ReadCloser, error) {
+	resp, err := g.api.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/tarball/%s", repo, sha), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (g *github) ListChangedFiles(ctx context.Context, repo string, pr int) ([]string, error) {
+	files := []string{}
+	for page := 1; ; page++ {
+		var list []struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename"`
+		}
+		if err := g.api.get(ctx, fmt.Sprintf("/repos/%s/pulls/%d/files?per_page=%d&page=%d", repo, pr, githubFilesPerPage, page), &list); err != nil {
+			return nil, err
+		}
+		for _, f := range list {
+			files = append(files, f.Filename)
+			// A renamed file changes its previous path too
+			if f.PreviousFilename != "" {
+				files = append(files, f.PreviousFilename)
+			}
+		}
+		if len(list) < githubFilesPerPage {
+			return files, nil
+		}
+	}
+}
+
+func (g *github) SetStatus(ctx context.Context, repo, sha string, status Status) error {
+	return g.api.post(ctx, fmt.Sprintf("/repos/%s/statuses/%s", repo, sha), map[string]string{
+		"state":       string(status.State),
+		"context":     status.Context,
+		"description": status.Description,
+	})
+}
+
+func (g *github) Comment(ctx context.Context, repo string, pr int, body string) error {
+	return g.api.post(ctx, fmt.Sprintf("/repos/%s/issues/%d/comments", repo, pr), map[string]string{
+		"body": body,
+	})
+}
@@ -0,0 +1,162 @@
+package vcs
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitlab is a GitLab provider. Webhooks are validated by comparing the secret
+// token in the X-Gitlab-Token header.
+type gitlab struct {
+	api    *apiClient
+	secret []byte
+}
+
+// The SHA GitLab sends for the head of a deleted branch
+const gitlabDeletedSHA = "0000000000000000000000000000000000000000"
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+type gitlabMergeRequestEvent struct {
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Action          string `json:"action"`
+		SourceBranch    string `json:"source_branch"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		// Set on updates that push new commits
+		OldRev     string `json:"oldrev"`
+		LastCommit struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+	Project gitlabProject `json:"project"`
+}
+
+type gitlabPushEvent struct {
+	Ref     string         `json:"ref"`
+	After   string         `json:"after"`
+	Commits []pushedCommit `json:"commits"`
+	// GitLab lists no more than 20 commits in a push event
+	TotalCommitsCount int           `json:"total_commits_count"`
+	Project           gitlabProject `json:"project"`
+}
+
+func (g *gitlab) ParseEvent(r *http.Request, body []byte) (*Event, error) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), g.secret) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Merge Request Hook":
+		var ev gitlabMergeRequestEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			return nil, err
+		}
+		// Only plan when the merge request's code changes
+		switch ev.ObjectAttributes.Action {
+		case "open", "reopen":
+		case "update":
+			if ev.ObjectAttributes.OldRev == "" {
+				return nil, nil
+			}
+		default:
+			return nil, nil
+		}
+		return &Event{
+			Repository:    ev.Project.PathWithNamespace,
+			SHA:           ev.ObjectAttributes.LastCommit.ID,
+			Branch:        ev.ObjectAttributes.SourceBranch,
+			DefaultBranch: ev.Project.DefaultBranch,
+			PullRequest:   ev.ObjectAttributes.IID,
+			Fork:          ev.ObjectAttributes.SourceProjectID != ev.ObjectAttributes.TargetProjectID,
+			DeliveryID:    r.Header.Get("X-Gitlab-Event-UUID"),
+		}, nil
+	case "Push Hook":
+		var ev gitlabPushEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			return nil, err
+		}
+		// Skip deleted branches
+		if ev.After == gitlabDeletedSHA || !strings.HasPrefix(ev.Ref, "refs/heads/") {
+			return nil, nil
+		}
+		return &Event{
+			Repository:    ev.Project.PathWithNamespace,
+			SHA:           ev.After,
+			Branch:        strings.TrimPrefix(ev.Ref, "refs/heads/"),
+			DefaultBranch: ev.Project.DefaultBranch,
+			DeliveryID:    r.Header.Get("X-Gitlab-Event-UUID"),
+			ChangedFiles:  pushedFiles(ev.Commits, len(ev.Commits) < ev.TotalCommitsCount),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// projectPath returns the API path of a project, identified by its escaped
+// path with namespace
+func projectPath(repo string) string {
+	return "/projects/" + url.PathEscape(repo)
+}
+
+func (g *gitlab) GetArchive(ctx context.Context, repo, sha string) (io.ReadCloser, error) {
+	resp, err := g.api.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/archive.tar.gz?sha=%s", projectPath(repo), url.QueryEscape(sha)), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (g *gitlab) ListChangedFiles(ctx context.Context, repo string, pr int) ([]string, error) {
+	var mr struct {
+		Changes []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		} `json:"changes"`
+		// Set if GitLab truncated the changes
+		Overflow bool `json:"overflow"`
+	}
+	if err := g.api.get(ctx, fmt.Sprintf("%s/merge_requests/%d/changes", projectPath(repo), pr), &mr); err != nil {
+		return nil, err
+	}
+	if mr.Overflow {
+		return nil, nil
+	}
+	files := []string{}
+	for _, c := range mr.Changes {
+		files = append(files, c.NewPath)
+		if c.OldPath != c.NewPath {
+			files = append(files, c.OldPath)
+		}
+	}
+	return files, nil
+}
+
+func (g *gitlab) SetStatus(ctx context.Context, repo, sha string, status Status) error {
+	// GitLab names the failure state differently
+	state := string(status.State)
+	if status.State == StateFailure {
+		state = "failed"
+	}
+	return g.api.post(ctx, fmt.Sprintf("%s/statuses/%s", projectPath(repo), sha), map[string]string{
+		"state":       state,
+		"name":        status.Context,
+		"description": status.Description,
+	})
+}
+
+func (g *gitlab) Comment(ctx context.Context, repo string, pr int, body string) error {
+	return g.api.post(ctx, fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(repo), pr), map[string]string{
+		"body": body,
+	})
+}
@@ -0,0 +1,233 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrInvalidSignature is returned when a webhook request fails validation
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+
+	// ErrUnknownProvider is returned when constructing a provider that is not
+	// supported
+	ErrUnknownProvider = errors.New("unknown VCS provider")
+)
+
+const (
+	// GitHub is the name of the GitHub provider
+	GitHub = "github"
+	// GitLab is the name of the GitLab provider
+	GitLab = "gitlab"
+
+	// DefaultGitHubURL is the default base URL of GitHub's API
+	DefaultGitHubURL = "https://api.github.com"
+	// DefaultGitLabURL is the default base URL of GitLab's API
+	DefaultGitLabURL = "https://gitlab.com/api/v4"
+)
+
+// Provider is a version control system. It parses webhooks received from the
+// system, and calls its API to retrieve code and to report back the results
+// of runs.
+type Provider interface {
+	// ParseEvent validates a webhook request and parses its body. A nil event
+	// is returned for events that do not trigger runs.
+	ParseEvent(r *http.Request, body []byte) (*Event, error)
+	// GetArchive retrieves a gzipped tarball of the repository at a commit
+	GetArchive(ctx context.Context, repo, sha string) (io.ReadCloser, error)
+	// ListChangedFiles lists the files changed by a pull request. Nil is
+	// returned if the provider truncates the list.
+	ListChangedFiles(ctx context.Context, repo string, pr int) ([]string, error)
+	// SetStatus sets the status of a commit
+	SetStatus(ctx context.Context, repo, sha string, status Status) error
+	// Comment adds a comment to a pull request
+	Comment(ctx context.Context, repo string, pr int, body string) error
+}
+
+// Event is a change to a repository that triggers runs
+type Event struct {
+	// Repository, in the form owner/name
+	Repository string
+	// SHA of the commit
+	SHA string
+	// Branch of the commit
+	Branch string
+	// Default branch of the repository
+	DefaultBranch string
+	// Number of the pull request. Zero for pushes.
+	PullRequest int
+	// Whether the pull request is from a fork of the repository
+	Fork bool
+	// ID of the webhook delivery, which is the same for redeliveries. Empty if
+	// the provider doesn't send one.
+	DeliveryID string
+	// Files changed by the event, relative to the root of the repository. Nil
+	// if unknown.
+	ChangedFiles []string
+}
+
+// IsMerge determines whether the event is a push to the default branch
+func (e *Event) IsMerge() bool {
+	return e.PullRequest == 0 && e.Branch == e.DefaultBranch
+}
+
+// Changes determines whether the event changes any files beneath the path,
+// which is relative to the root of the repository. If the changed files are
+// unknown then every path is deemed changed.
+func (e *Event) Changes(path string) bool {
+	if e.ChangedFiles == nil {
+		return true
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." {
+		return len(e.ChangedFiles) > 0
+	}
+	for _, f := range e.ChangedFiles {
+		if f == path || strings.HasPrefix(f, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// pushedFiles lists the files changed by the commits of a push, de-duplicated.
+// Nil is returned if the push lists no commits, or if the provider truncated
+// the list of commits.
+func pushedFiles(commits []pushedCommit, truncated bool) []string {
+	if len(commits) == 0 || truncated {
+		return nil
+	}
+	seen := make(map[string]bool)
+	files := []string{}
+	for _, c := range commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range list {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// pushedCommit is a commit listed in a push event, which both GitHub and
+// GitLab describe in the same manner
+type pushedCommit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// State is the state of a commit status
+type State string
+
+const (
+	StatePending State = "pending"
+	StateSuccess State = "success"
+	StateFailure State = "failure"
+)
+
+// Status is the status of a commit
+type Status struct {
+	State State
+	// Context distinguishes the status from those set by other systems, and
+	// from those set for other workspaces
+	Context     string
+	Description string
+}
+
+// NewProvider constructs a provider by name. The token authenticates calls to
+// the provider's API at url, and the secret validates webhooks.
+func NewProvider(name, url, token, secret string) (Provider, error) {
+	switch name {
+	case GitHub:
+		if url == "" {
+			url = DefaultGitHubURL
+		}
+		return &github{
+			api:    &apiClient{url: url, header: "Authorization", token: "token " + token},
+			secret: []byte(secret),
+		}, nil
+	case GitLab:
+		if url == "" {
+			url = DefaultGitLabURL
+		}
+		return &gitlab{
+			api:    &apiClient{url: url, header: "PRIVATE-TOKEN", token: token},
+			secret: []byte(secret),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+}
+
+// apiClient makes authenticated calls to a provider's API
+type apiClient struct {
+	// Base URL of API
+	url string
+	// Header in which the token is sent
+	header string
+	token  string
+}
+
+// do makes a request to the API, with the body encoded as JSON. Responses
+// with a non-2xx status code are returned as errors.
+func (c *apiClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.url, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(c.header, c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// get makes a GET request to the API, decoding the JSON response into v
+func (c *apiClient) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post makes a POST request to the API, discarding the response
+func (c *apiClient) post(ctx context.Context, path string, body interface{}) error {
+	resp, err := c.do(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
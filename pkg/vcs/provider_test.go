@@ -0,0 +1,454 @@
+package vcs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAPI is a mock of a provider's API. It serves a tarball of a repository
+// and the files changed by a pull request, and records the other requests it
+// receives.
+type mockAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []mockRequest
+
+	// Files changed by pull requests. Defaults to every file in the
+	// repository.
+	changed []string
+	// Fail requests for the tarball
+	archiveErr bool
+}
+
+type mockRequest struct {
+	Method string
+	Path   string
+	Body   map[string]string
+}
+
+func newMockAPI(t *testing.T, files map[string]string) *mockAPI {
+	tarball := newRepoTarball(t, files)
+
+	api := &mockAPI{}
+	for name := range files {
+		api.changed = append(api.changed, name)
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret-token" && r.Header.Get("PRIVATE-TOKEN") != "secret-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		api.mu.Lock()
+		changed, archiveErr := api.changed, api.archiveErr
+		api.mu.Unlock()
+
+		path := r.URL.EscapedPath()
+		switch {
+		case strings.Contains(path, "/tarball/") || strings.Contains(path, "/repository/archive.tar.gz"):
+			if archiveErr {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write(tarball)
+			return
+		case strings.HasSuffix(path, "/files"):
+			// GitHub lists a pull request's files
+			var list []map[string]string
+			for _, f := range changed {
+				list = append(list, map[string]string{"filename": f})
+			}
+			json.NewEncoder(w).Encode(list)
+			return
+		case strings.HasSuffix(path, "/changes"):
+			// GitLab lists a merge request's changes
+			var list []map[string]string
+			for _, f := range changed {
+				list = append(list, map[string]string{"old_path": f, "new_path": f})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"changes": list})
+			return
+		}
+
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+
+		api.mu.Lock()
+		api.requests = append(api.requests, mockRequest{Method: r.Method, Path: path, Body: body})
+		api.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(api.Close)
+
+	return api
+}
+
+func (m *mockAPI) received() []mockRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mockRequest(nil), m.requests...)
+}
+
+// newRepoTarball creates a tarball of a repository in the form providers
+// produce: a global header followed by the files within a single top-level
+// directory
+func newRepoTarball(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "abc123"}}))
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "leg100-infra-abc123/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+// githubRequest constructs a signed GitHub webhook request
+func githubRequest(event, secret, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", event)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	return req
+}
+
+// gitlabRequest constructs a GitLab webhook request
+func gitlabRequest(event, secret, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(body))
+	req.Header.Set("X-Gitlab-Event", event)
+	req.Header.Set("X-Gitlab-Token", secret)
+	return req
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		req      func() *http.Request
+		want     *Event
+		err      error
+	}{
+		{
+			name:     "github pull request opened",
+			provider: GitHub,
+			req: func() *http.Request {
+				req := githubRequest("pull_request", "webhook-secret", `{"action":"opened","number":7,"pull_request":{"head":{"sha":"abc123","ref":"feature","repo":{"full_name":"leg100/infra"}}},"repository":{"full_name":"leg100/infra","default_branch":"master"}}`)
+				req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+				return req
+			},
+			want: &Event{Repository: "leg100/infra", SHA: "abc123", Branch: "feature", DefaultBranch: "master", PullRequest: 7, DeliveryID: "72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+		},
+		{
+			name:     "github pull request from fork",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("pull_request", "webhook-secret", `{"action":"opened","number":7,"pull_request":{"head":{"sha":"abc123","ref":"feature","repo":{"full_name":"mallory/infra"}}},"repository":{"full_name":"leg100/infra","default_branch":"master"}}`)
+			},
+			want: &Event{Repository: "leg100/infra", SHA: "abc123", Branch: "feature", DefaultBranch: "master", PullRequest: 7, Fork: true},
+		},
+		{
+			name:     "github pull request from deleted fork",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("pull_request", "webhook-secret", `{"action":"synchronize","number":7,"pull_request":{"head":{"sha":"abc123","ref":"feature","repo":null}},"repository":{"full_name":"leg100/infra","default_branch":"master"}}`)
+			},
+			want: &Event{Repository: "leg100/infra", SHA: "abc123", Branch: "feature", DefaultBranch: "master", PullRequest: 7, Fork: true},
+		},
+		{
+			name:     "github pull request closed",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("pull_request", "webhook-secret", `{"action":"closed","number":7,"repository":{"full_name":"leg100/infra"}}`)
+			},
+		},
+		{
+			name:     "github push",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("push", "webhook-secret", `{"ref":"refs/heads/master","after":"def456","repository":{"full_name":"leg100/infra","default_branch":"master"}}`)
+			},
+			want: &Event{Repository: "leg100/infra", SHA: "def456", Branch: "master", DefaultBranch: "master"},
+		},
+		{
+			name:     "github push with commits",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("push", "webhook-secret", `{"ref":"refs/heads/master","after":"def456","commits":[{"added":["networking/vpc.tf"],"modified":["main.tf"]},{"modified":["main.tf"],"removed":["old.tf"]}],"repository":{"full_name":"leg100/infra","default_branch":"master"}}`)
+			},
+			want: &Event{Repository: "leg100/infra", SHA: "def456", Branch: "master", DefaultBranch: "master", ChangedFiles: []string{"networking/vpc.tf", "main.tf", "old.tf"}},
+		},
+		{
+			name:     "github branch deleted",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("push", "webhook-secret", `{"ref":"refs/heads/feature","deleted":true,"repository":{"full_name":"leg100/infra"}}`)
+			},
+		},
+		{
+			name:     "github tag pushed",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("push", "webhook-secret", `{"ref":"refs/tags/v1","after":"def456","repository":{"full_name":"leg100/infra"}}`)
+			},
+		},
+		{
+			name:     "github ping",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("ping", "webhook-secret", `{}`)
+			},
+		},
+		{
+			name:     "github invalid signature",
+			provider: GitHub,
+			req: func() *http.Request {
+				return githubRequest("push", "wrong-secret", `{}`)
+			},
+			err: ErrInvalidSignature,
+		},
+		{
+			name:     "github missing signature",
+			provider: GitHub,
+			req: func() *http.Request {
+				req := githubRequest("push", "webhook-secret", `{}`)
+				req.Header.Del("X-Hub-Signature-256")
+				return req
+			},
+			err: ErrInvalidSignature,
+		},
+		{
+			name:     "gitlab merge request opened",
+			provider: GitLab,
+			req: func() *http.Request {
+				req := gitlabRequest("Merge Request Hook", "webhook-secret", `{"object_attributes":{"iid":3,"action":"open","source_branch":"feature","source_project_id":12,"target_project_id":12,"last_commit":{"id":"abc123"}},"project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+				req.Header.Set("X-Gitlab-Event-UUID", "4fd7a3e5-6a1c-4d4f-9b0a-2f1f5d0c6e21")
+				return req
+			},
+			want: &Event{Repository: "group/infra", SHA: "abc123", Branch: "feature", DefaultBranch: "main", PullRequest: 3, DeliveryID: "4fd7a3e5-6a1c-4d4f-9b0a-2f1f5d0c6e21"},
+		},
+		{
+			name:     "gitlab merge request from fork",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Merge Request Hook", "webhook-secret", `{"object_attributes":{"iid":3,"action":"open","source_branch":"feature","source_project_id":34,"target_project_id":12,"last_commit":{"id":"abc123"}},"project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+			},
+			want: &Event{Repository: "group/infra", SHA: "abc123", Branch: "feature", DefaultBranch: "main", PullRequest: 3, Fork: true},
+		},
+		{
+			name:     "gitlab merge request updated with new commits",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Merge Request Hook", "webhook-secret", `{"object_attributes":{"iid":3,"action":"update","oldrev":"abc123","source_branch":"feature","last_commit":{"id":"def456"}},"project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+			},
+			want: &Event{Repository: "group/infra", SHA: "def456", Branch: "feature", DefaultBranch: "main", PullRequest: 3},
+		},
+		{
+			name:     "gitlab merge request title updated",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Merge Request Hook", "webhook-secret", `{"object_attributes":{"iid":3,"action":"update"},"project":{"path_with_namespace":"group/infra"}}`)
+			},
+		},
+		{
+			name:     "gitlab push",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Push Hook", "webhook-secret", `{"ref":"refs/heads/main","after":"def456","project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+			},
+			want: &Event{Repository: "group/infra", SHA: "def456", Branch: "main", DefaultBranch: "main"},
+		},
+		{
+			name:     "gitlab push with commits",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Push Hook", "webhook-secret", `{"ref":"refs/heads/main","after":"def456","commits":[{"added":[],"modified":["main.tf"],"removed":[]}],"total_commits_count":1,"project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+			},
+			want: &Event{Repository: "group/infra", SHA: "def456", Branch: "main", DefaultBranch: "main", ChangedFiles: []string{"main.tf"}},
+		},
+		{
+			name:     "gitlab push with truncated commits",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Push Hook", "webhook-secret", `{"ref":"refs/heads/main","after":"def456","commits":[{"modified":["main.tf"]}],"total_commits_count":21,"project":{"path_with_namespace":"group/infra","default_branch":"main"}}`)
+			},
+			want: &Event{Repository: "group/infra", SHA: "def456", Branch: "main", DefaultBranch: "main"},
+		},
+		{
+			name:     "gitlab branch deleted",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Push Hook", "webhook-secret", `{"ref":"refs/heads/feature","after":"0000000000000000000000000000000000000000","project":{"path_with_namespace":"group/infra"}}`)
+			},
+		},
+		{
+			name:     "gitlab invalid token",
+			provider: GitLab,
+			req: func() *http.Request {
+				return gitlabRequest("Push Hook", "wrong-secret", `{}`)
+			},
+			err: ErrInvalidSignature,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			provider, err := NewProvider(tt.provider, "", "secret-token", "webhook-secret")
+			require.NoError(t, err)
+
+			req := tt.req()
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+
+			ev, err := provider.ParseEvent(req, body)
+			assert.True(t, errors.Is(err, tt.err), err)
+			assert.Equal(t, tt.want, ev)
+		})
+	}
+}
+
+func TestEventChanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		path  string
+		want  bool
+	}{
+		{
+			name: "unknown changes",
+			path: "networking",
+			want: true,
+		},
+		{
+			name:  "change beneath path",
+			files: []string{"networking/vpc.tf"},
+			path:  "networking",
+			want:  true,
+		},
+		{
+			name:  "change beneath trailing slash path",
+			files: []string{"networking/vpc.tf"},
+			path:  "networking/",
+			want:  true,
+		},
+		{
+			name:  "change outside path",
+			files: []string{"compute/main.tf", "networking-old/vpc.tf"},
+			path:  "networking",
+			want:  false,
+		},
+		{
+			name:  "root path",
+			files: []string{"compute/main.tf"},
+			path:  "",
+			want:  true,
+		},
+		{
+			name:  "no changes",
+			files: []string{},
+			path:  "",
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			ev := &Event{ChangedFiles: tt.files}
+			assert.Equal(t, tt.want, ev.Changes(tt.path))
+		})
+	}
+}
+
+func TestProviderAPI(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		repo     string
+		want     []mockRequest
+	}{
+		{
+			name:     "github",
+			provider: GitHub,
+			repo:     "leg100/infra",
+			want: []mockRequest{
+				{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "failure", "context": "etok/default/networking", "description": "plan failed"}},
+				{Method: "POST", Path: "/repos/leg100/infra/issues/7/comments", Body: map[string]string{"body": "hello"}},
+			},
+		},
+		{
+			name:     "gitlab",
+			provider: GitLab,
+			repo:     "group/infra",
+			want: []mockRequest{
+				{Method: "POST", Path: "/projects/group%2Finfra/statuses/abc123", Body: map[string]string{"state": "failed", "name": "etok/default/networking", "description": "plan failed"}},
+				{Method: "POST", Path: "/projects/group%2Finfra/merge_requests/7/notes", Body: map[string]string{"body": "hello"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			api := newMockAPI(t.T, map[string]string{"main.tf": ""})
+
+			provider, err := NewProvider(tt.provider, api.URL, "secret-token", "webhook-secret")
+			require.NoError(t, err)
+
+			tarball, err := provider.GetArchive(context.Background(), tt.repo, "abc123")
+			require.NoError(t, err)
+			tarball.Close()
+
+			api.changed = []string{"networking/main.tf"}
+			files, err := provider.ListChangedFiles(context.Background(), tt.repo, 7)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"networking/main.tf"}, files)
+
+			require.NoError(t, provider.SetStatus(context.Background(), tt.repo, "abc123", Status{State: StateFailure, Context: "etok/default/networking", Description: "plan failed"}))
+			require.NoError(t, provider.Comment(context.Background(), tt.repo, 7, "hello"))
+
+			assert.Equal(t, tt.want, api.received())
+		})
+	}
+}
+
+func TestProviderAPIError(t *testing.T) {
+	api := newMockAPI(t, nil)
+
+	provider, err := NewProvider(GitHub, api.URL, "wrong-token", "webhook-secret")
+	require.NoError(t, err)
+
+	err = provider.Comment(context.Background(), "leg100/infra", 7, "hello")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
+
+func TestNewProviderUnknown(t *testing.T) {
+	_, err := NewProvider("bitbucket", "", "", "")
+	assert.True(t, errors.Is(err, ErrUnknownProvider))
+}
@@ -0,0 +1,240 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/globals"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/logstreamer"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Maximum size of the output included in a pull request comment. GitHub
+// rejects comments longer than 65536 characters.
+const maxCommentOutput = 60000
+
+var (
+	// ansiEscape matches terminal colour codes
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+
+	// Prefixes of the lines of terraform's output that summarise a run
+	summaryPrefixes = []string{"Plan: ", "No changes.", "Apply complete!", "Error: "}
+)
+
+// Reporter reports the status of runs triggered by VCS webhooks back to the
+// provider. A commit status is set whenever the run's status changes, and once
+// a run triggered by a pull request is done, a comment summarising its output
+// is added to the pull request.
+//
+// Only runs created by the webhook receiver are reported on, and only to the
+// repository to which their workspace is connected, lest a user's run reports
+// to an arbitrary repository using the operator's credentials.
+type Reporter struct {
+	client.Client
+
+	provider Provider
+
+	// Client for retrieving run logs
+	kubeClient kubernetes.Interface
+
+	// Function to get a pod's logs stream
+	getLogs logstreamer.GetLogsFunc
+}
+
+func NewReporter(c client.Client, kubeClient kubernetes.Interface, provider Provider) *Reporter {
+	return &Reporter{
+		Client:     c,
+		kubeClient: kubeClient,
+		provider:   provider,
+		getLogs:    logstreamer.GetLogs,
+	}
+}
+
+func (r *Reporter) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var run v1alpha1.Run
+	if err := r.Get(ctx, req.NamespacedName, &run); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if run.GetLabels()[labels.VCSTrigger.Name] != labels.VCSTrigger.Value {
+		return ctrl.Result{}, nil
+	}
+
+	annotations := run.GetAnnotations()
+	repo := annotations[v1alpha1.VCSRepositoryAnnotationKey]
+	sha := annotations[v1alpha1.GitCommitAnnotationKey]
+	if repo == "" || sha == "" {
+		return ctrl.Result{}, nil
+	}
+
+	state := runState(&run)
+	if annotations[v1alpha1.VCSStatusAnnotationKey] == string(state) {
+		// Already reported
+		return ctrl.Result{}, nil
+	}
+
+	var ws v1alpha1.Workspace
+	if err := r.Get(ctx, types.NamespacedName{Namespace: run.Namespace, Name: run.Workspace}, &ws); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if ws.Spec.VCS == nil || !strings.EqualFold(ws.Spec.VCS.Repository, repo) {
+		klog.Warningf("not reporting run %s: repository %s is not connected to workspace %s", klog.KObj(&run), repo, klog.KObj(&ws))
+		return ctrl.Result{}, nil
+	}
+
+	var output string
+	if run.IsDone() {
+		output = r.output(ctx, &run)
+	}
+
+	status := Status{
+		State:       state,
+		Context:     statusContext(run.Namespace, run.Workspace),
+		Description: description(&run, state, summarise(output)),
+	}
+	// Setting the status is idempotent, and so it's set before it's recorded
+	if err := r.provider.SetStatus(ctx, repo, sha, status); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to set commit status: %w", err)
+	}
+
+	// Record the reported state before commenting, which isn't idempotent.
+	// The patch fails if the run has since been modified, e.g. by a
+	// concurrent reconcile recording the same state, in which case the run is
+	// reconciled afresh.
+	patch := client.MergeFromWithOptions(run.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	annotations[v1alpha1.VCSStatusAnnotationKey] = string(state)
+	run.SetAnnotations(annotations)
+	if err := r.Patch(ctx, &run, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if pr := annotations[v1alpha1.VCSPullRequestAnnotationKey]; pr != "" && run.IsDone() {
+		number, err := strconv.Atoi(pr)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("invalid pull request annotation: %w", err)
+		}
+		if err := r.provider.Comment(ctx, repo, number, comment(&run, status.Description, output)); err != nil {
+			// Not retried, lest the comment is posted twice
+			klog.Errorf("unable to comment on pull request %d of %s: %s", number, repo, err.Error())
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// output retrieves the logs of the run's runner container, with terminal
+// colour codes removed. Logs are unavailable if the run's pod was never
+// created or has since been deleted, in which case an empty string is
+// returned.
+func (r *Reporter) output(ctx context.Context, run *v1alpha1.Run) string {
+	stream, err := r.getLogs(ctx, logstreamer.Options{
+		PodsClient:    r.kubeClient.CoreV1().Pods(run.Namespace),
+		PodName:       run.PodName(),
+		PodLogOptions: &corev1.PodLogOptions{Container: globals.RunnerContainerName},
+	})
+	if err != nil {
+		klog.V(1).Infof("unable to retrieve logs for run %s: %s", klog.KObj(run), err.Error())
+		return ""
+	}
+	defer stream.Close()
+
+	logs, err := ioutil.ReadAll(stream)
+	if err != nil {
+		klog.V(1).Infof("unable to retrieve logs for run %s: %s", klog.KObj(run), err.Error())
+		return ""
+	}
+	return ansiEscape.ReplaceAllString(string(logs), "")
+}
+
+// statusContext returns the context of the commit status reported for a
+// workspace
+func statusContext(namespace, workspace string) string {
+	return fmt.Sprintf("etok/%s/%s", namespace, workspace)
+}
+
+// runState maps the status of a run to the state of a commit status
+func runState(run *v1alpha1.Run) State {
+	switch {
+	case !run.IsDone():
+		return StatePending
+	case run.ExitCode != nil && *run.ExitCode == 0:
+		return StateSuccess
+	default:
+		return StateFailure
+	}
+}
+
+// summarise returns the last line of the output summarising the run
+func summarise(output string) string {
+	var summary string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for _, prefix := range summaryPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				summary = line
+			}
+		}
+	}
+	return summary
+}
+
+// description describes a run in a commit status
+func description(run *v1alpha1.Run, state State, summary string) string {
+	switch state {
+	case StatePending:
+		phase := string(run.Phase)
+		if phase == "" {
+			phase = "pending"
+		}
+		return fmt.Sprintf("%s %s", run.Command, phase)
+	case StateSuccess:
+		if summary != "" {
+			return summary
+		}
+		return fmt.Sprintf("%s succeeded", run.Command)
+	default:
+		if summary != "" {
+			return fmt.Sprintf("%s failed: %s", run.Command, summary)
+		}
+		return fmt.Sprintf("%s failed", run.Command)
+	}
+}
+
+// comment renders a pull request comment for a completed run
+func comment(run *v1alpha1.Run, description, output string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**etok** `%s` on workspace `%s/%s` (run `%s`): %s\n", run.Command, run.Namespace, run.Workspace, run.Name, description)
+
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return b.String()
+	}
+	if len(output) > maxCommentOutput {
+		output = "...\n" + output[len(output)-maxCommentOutput:]
+	}
+	fmt.Fprintf(&b, "\n<details><summary>Output</summary>\n\n```\n%s\n```\n</details>\n", output)
+	return b.String()
+}
+
+// SetupWithManager registers the reporter with the manager, reconciling only
+// runs triggered by webhooks
+func (r *Reporter) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("vcs-reporter").
+		For(&v1alpha1.Run{}).
+		WithEventFilter(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return o.GetLabels()[labels.VCSTrigger.Name] == labels.VCSTrigger.Value
+		})).
+		Complete(r)
+}
@@ -0,0 +1,176 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/logstreamer"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func withVCSAnnotations(keyValues ...string) func(*v1alpha1.Run) {
+	return func(run *v1alpha1.Run) {
+		labels.SetLabel(run, labels.VCSTrigger)
+
+		annotations := map[string]string{
+			v1alpha1.GitCommitAnnotationKey:     "abc123",
+			v1alpha1.VCSRepositoryAnnotationKey: "leg100/infra",
+		}
+		for i := 0; i < len(keyValues)-1; i += 2 {
+			annotations[keyValues[i]] = keyValues[i+1]
+		}
+		run.SetAnnotations(annotations)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	logs := "Refreshing state...\n\x1b[0m\x1b[1mPlan:\x1b[0m 1 to add, 0 to change, 0 to destroy.\n"
+
+	tests := []struct {
+		name string
+		run  *v1alpha1.Run
+		// Workspace of the run. Defaults to a workspace connected to the
+		// repository.
+		workspace *v1alpha1.Workspace
+		// Expected requests to the provider's API
+		want []mockRequest
+		// Expected comment on the pull request
+		comment string
+		// Expected status recorded on the run
+		status string
+	}{
+		{
+			name:   "queued run",
+			run:    testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseQueued), withVCSAnnotations()),
+			want:   []mockRequest{{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "pending", "context": "etok/default/networking", "description": "plan queued"}}},
+			status: "pending",
+		},
+		{
+			name:   "already reported",
+			run:    testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseRunning), withVCSAnnotations(v1alpha1.VCSStatusAnnotationKey, "pending")),
+			status: "pending",
+		},
+		{
+			name:   "successful apply",
+			run:    testobj.Run("default", "run-1", "apply", testobj.WithWorkspace("networking"), testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0), withVCSAnnotations()),
+			want:   []mockRequest{{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "success", "context": "etok/default/networking", "description": "Plan: 1 to add, 0 to change, 0 to destroy."}}},
+			status: "success",
+		},
+		{
+			name: "pull request plan",
+			run:  testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0), withVCSAnnotations(v1alpha1.VCSPullRequestAnnotationKey, "7")),
+			want: []mockRequest{
+				{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "success", "context": "etok/default/networking", "description": "Plan: 1 to add, 0 to change, 0 to destroy."}},
+				{Method: "POST", Path: "/repos/leg100/infra/issues/7/comments"},
+			},
+			comment: "**etok** `plan` on workspace `default/networking` (run `run-1`): Plan: 1 to add, 0 to change, 0 to destroy.\n\n<details><summary>Output</summary>\n\n```\nRefreshing state...\nPlan: 1 to add, 0 to change, 0 to destroy.\n```\n</details>\n",
+			status:  "success",
+		},
+		{
+			name:   "run not created by webhook receiver",
+			run:    testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseQueued), withVCSAnnotations(), func(run *v1alpha1.Run) { run.SetLabels(nil) }),
+			status: "",
+		},
+		{
+			name:      "repository not connected to workspace",
+			run:       testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseQueued), withVCSAnnotations(v1alpha1.VCSRepositoryAnnotationKey, "mallory/infra")),
+			workspace: testobj.Workspace("default", "networking", withVCS("leg100/infra", "", false)),
+			status:    "",
+		},
+		{
+			name:      "workspace not connected to repository",
+			run:       testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseQueued), withVCSAnnotations()),
+			workspace: testobj.Workspace("default", "networking"),
+			status:    "",
+		},
+		{
+			name:   "failed plan",
+			run:    testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(1), withVCSAnnotations()),
+			want:   []mockRequest{{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "failure", "context": "etok/default/networking", "description": "plan failed: Plan: 1 to add, 0 to change, 0 to destroy."}}},
+			status: "failure",
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			api := newMockAPI(t.T, nil)
+
+			provider, err := NewProvider(GitHub, api.URL, "secret-token", "webhook-secret")
+			require.NoError(t, err)
+
+			ws := tt.workspace
+			if ws == nil {
+				ws = testobj.Workspace("default", "networking", withVCS("leg100/infra", "", false))
+			}
+			// The reporter patches the run using optimistic concurrency
+			tt.run.SetResourceVersion("1")
+			client := fake.NewFakeClientWithScheme(scheme.Scheme, tt.run, ws)
+
+			reporter := NewReporter(client, kfake.NewSimpleClientset(), provider)
+			reporter.getLogs = func(ctx context.Context, opts logstreamer.Options) (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewBufferString(logs)), nil
+			}
+
+			_, err = reporter.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "run-1"}})
+			require.NoError(t, err)
+
+			// Compare comment separately
+			got := api.received()
+			for i := range got {
+				if body, ok := got[i].Body["body"]; ok {
+					assert.Equal(t, tt.comment, body)
+					got[i].Body = nil
+				}
+			}
+			if tt.want == nil {
+				assert.Empty(t, got)
+			} else {
+				assert.Equal(t, tt.want, got)
+			}
+
+			var run v1alpha1.Run
+			require.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "run-1"}, &run))
+			assert.Equal(t, tt.status, run.Annotations[v1alpha1.VCSStatusAnnotationKey])
+		})
+	}
+}
+
+func TestReporterCommentsOnce(t *testing.T) {
+	api := newMockAPI(t, nil)
+
+	provider, err := NewProvider(GitHub, api.URL, "secret-token", "webhook-secret")
+	require.NoError(t, err)
+
+	run := testobj.Run("default", "run-1", "plan", testobj.WithWorkspace("networking"), testobj.WithCondition(v1alpha1.RunCompleteCondition), testobj.WithRunExitCode(0), withVCSAnnotations(v1alpha1.VCSPullRequestAnnotationKey, "7"))
+	run.SetResourceVersion("1")
+	client := fake.NewFakeClientWithScheme(scheme.Scheme, run, testobj.Workspace("default", "networking", withVCS("leg100/infra", "", false)))
+
+	reporter := NewReporter(client, kfake.NewSimpleClientset(), provider)
+	reporter.getLogs = logstreamer.FakeGetLogs
+
+	for i := 0; i < 2; i++ {
+		_, err = reporter.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "run-1"}})
+		require.NoError(t, err)
+	}
+
+	var comments int
+	for _, req := range api.received() {
+		if req.Path == "/repos/leg100/infra/issues/7/comments" {
+			comments++
+		}
+	}
+	assert.Equal(t, 1, comments)
+}
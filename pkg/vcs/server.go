@@ -0,0 +1,447 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/archive"
+	"github.com/leg100/etok/pkg/internal/httpserver"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Port on which the operator's VCS webhook receiver listens
+	Port = 9091
+
+	// Name of the service fronting the operator's VCS webhook receiver
+	ServiceName = "etok-vcs"
+
+	// Path at which webhooks are received
+	webhookPath = "/webhook"
+
+	// Maximum size of a webhook's body
+	maxBodySize = 25 * 1024 * 1024
+
+	// Maximum time to spend retrieving the repository and creating the runs
+	// triggered by a webhook
+	triggerTimeout = 5 * time.Minute
+
+	// Maximum time to spend reporting a failure to trigger a run
+	failureTimeout = 30 * time.Second
+
+	// Maximum length of a commit status' description. GitHub rejects longer
+	// descriptions.
+	maxStatusDescription = 140
+)
+
+// Server receives webhooks from a VCS provider and triggers runs on the
+// workspaces connected to the repository in question:
+//
+//   - A pull request that is opened or updated triggers a plan
+//   - A push to the default branch triggers an apply, on workspaces with
+//     applyOnMerge enabled. The apply is approved on behalf of the user if
+//     it is a privileged command.
+//
+// Pull requests from forks only trigger plans on workspaces that allow forks.
+// Runs are only triggered on workspaces with changes beneath their path.
+//
+// The runs' configuration is the repository at the commit that triggered
+// them. The result of each run is reported back to the provider by the
+// Reporter.
+//
+// The webhook is acknowledged once the runs to be created are determined, and
+// the repository is then retrieved and the runs created in the background, lest
+// the provider times out the webhook. Runs are named after the webhook's
+// delivery ID and commit, so a redelivered webhook doesn't create them again.
+// Failure to create a run is reported as the status of the commit.
+type Server struct {
+	*httpserver.Runnable
+
+	// Client for retrieving workspaces and creating runs
+	client runtimeclient.Client
+
+	provider Provider
+
+	// Tracks runs being created in the background
+	wg sync.WaitGroup
+}
+
+func NewServer(addr string, client runtimeclient.Client, provider Provider) *Server {
+	s := &Server{client: client, provider: provider}
+	s.Runnable = &httpserver.Runnable{Name: "VCS webhook receiver", Addr: addr, Handler: s}
+	return s
+}
+
+// Run is the representation of a run triggered by a webhook
+type Run struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Workspace string `json:"workspace"`
+	Command   string `json:"command"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != webhookPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ev, err := s.provider.ParseEvent(r, body)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSignature) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ev == nil {
+		// Event does not trigger runs
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	triggers, err := s.triggers(r.Context(), ev)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+
+	runs := []Run{}
+	for _, t := range triggers {
+		runs = append(runs, Run{Namespace: t.ws.Namespace, Name: t.name, Workspace: t.ws.Name, Command: t.command})
+	}
+
+	if len(triggers) > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), triggerTimeout)
+			defer cancel()
+
+			s.trigger(ctx, ev, triggers)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(runs)
+}
+
+// runTrigger is a run to be created on a workspace
+type runTrigger struct {
+	ws      *v1alpha1.Workspace
+	name    string
+	command string
+}
+
+// triggers determines the runs to create on the workspaces connected to the
+// event's repository with changes beneath their path. Runs that already exist,
+// because the webhook has been redelivered, are skipped.
+func (s *Server) triggers(ctx context.Context, ev *Event) ([]runTrigger, error) {
+	var command string
+	switch {
+	case ev.PullRequest != 0:
+		command = "plan"
+	case ev.IsMerge():
+		command = "apply"
+	default:
+		// Pushes to other branches don't trigger runs
+		return nil, nil
+	}
+
+	var wsList v1alpha1.WorkspaceList
+	if err := s.client.List(ctx, &wsList); err != nil {
+		return nil, err
+	}
+
+	var triggers []runTrigger
+	// Whether the files changed by a pull request have been retrieved
+	var listed bool
+	for i := range wsList.Items {
+		ws := &wsList.Items[i]
+		if ws.Spec.VCS == nil || !strings.EqualFold(ws.Spec.VCS.Repository, ev.Repository) {
+			continue
+		}
+		if command == "apply" && !ws.Spec.VCS.ApplyOnMerge {
+			continue
+		}
+		if ev.Fork && !ws.Spec.VCS.AllowForks {
+			klog.V(1).Infof("skipping pull request %d from fork on workspace %s", ev.PullRequest, klog.KObj(ws))
+			continue
+		}
+		if path := filepath.Clean(ws.Spec.VCS.Path); filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			return nil, fmt.Errorf("invalid path for workspace %s: %s", klog.KObj(ws), ws.Spec.VCS.Path)
+		}
+
+		if ev.PullRequest != 0 && !listed {
+			// Retrieve the files only once, for all workspaces
+			files, err := s.provider.ListChangedFiles(ctx, ev.Repository, ev.PullRequest)
+			if err != nil {
+				return nil, fmt.Errorf("unable to list files changed by pull request %d: %w", ev.PullRequest, err)
+			}
+			ev.ChangedFiles = files
+			listed = true
+		}
+		if !ev.Changes(ws.Spec.VCS.Path) {
+			klog.V(1).Infof("skipping workspace %s: no changes beneath %s", klog.KObj(ws), ws.Spec.VCS.Path)
+			continue
+		}
+
+		name := runName(ws, command, ev)
+		var existing v1alpha1.Run
+		err := s.client.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: name}, &existing)
+		if err == nil {
+			klog.V(1).Infof("skipping redelivered webhook %s: run %s already exists", ev.DeliveryID, klog.KObj(&existing))
+			continue
+		}
+		if !kerrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		triggers = append(triggers, runTrigger{ws: ws, name: name, command: command})
+	}
+	return triggers, nil
+}
+
+// runName names a run after the webhook delivery and commit that triggered it,
+// along with its workspace and command, so that a redelivery maps to the same
+// run. Runs are named randomly if the provider doesn't identify deliveries.
+func runName(ws *v1alpha1.Workspace, command string, ev *Event) string {
+	if ev.DeliveryID == "" {
+		return fmt.Sprintf("run-%s", util.GenerateRandomString(5))
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{ev.DeliveryID, ev.SHA, ws.Namespace, ws.Name, command}, "/")))
+	return fmt.Sprintf("run-%s", hex.EncodeToString(sum[:])[:10])
+}
+
+// trigger retrieves the repository and creates the runs. Nobody awaits the
+// outcome, so failures are reported to the provider instead.
+func (s *Server) trigger(ctx context.Context, ev *Event, triggers []runTrigger) {
+	// Retrieve the repository only once, for all workspaces
+	root, err := s.checkout(ctx, ev)
+	if err != nil {
+		for _, t := range triggers {
+			s.fail(ev, t, err)
+		}
+		return
+	}
+	defer os.RemoveAll(filepath.Dir(root))
+
+	for _, t := range triggers {
+		if err := s.createRun(ctx, t, root, ev); err != nil {
+			s.fail(ev, t, fmt.Errorf("unable to create run: %w", err))
+		}
+	}
+}
+
+// fail reports the failure to trigger a run as the status of the commit, in
+// the workspace's context, as the reporter would the run's own failure
+func (s *Server) fail(ev *Event, t runTrigger, err error) {
+	klog.Errorf("unable to trigger %s on workspace %s for %s@%s: %s", t.command, klog.KObj(t.ws), ev.Repository, ev.SHA, err.Error())
+
+	// The trigger's context may have expired
+	ctx, cancel := context.WithTimeout(context.Background(), failureTimeout)
+	defer cancel()
+
+	desc := fmt.Sprintf("%s failed to start: %s", t.command, err.Error())
+	if len(desc) > maxStatusDescription {
+		desc = desc[:maxStatusDescription-3] + "..."
+	}
+	status := Status{
+		State:       StateFailure,
+		Context:     statusContext(t.ws.Namespace, t.ws.Name),
+		Description: desc,
+	}
+	if err := s.provider.SetStatus(ctx, ev.Repository, ev.SHA, status); err != nil {
+		klog.Errorf("unable to set commit status: %s", err.Error())
+	}
+}
+
+// checkout unpacks the repository at the event's commit into a temporary
+// directory, returning the path to the root of the repository
+func (s *Server) checkout(ctx context.Context, ev *Event) (string, error) {
+	tarball, err := s.provider.GetArchive(ctx, ev.Repository, ev.SHA)
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve repository: %w", err)
+	}
+	defer tarball.Close()
+
+	dst, err := ioutil.TempDir("", "etok-vcs-")
+	if err != nil {
+		return "", err
+	}
+	if err := archive.Unpack(tarball, dst); err != nil {
+		os.RemoveAll(dst)
+		return "", err
+	}
+
+	// Providers place the repository in a single top-level directory
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		os.RemoveAll(dst)
+		return "", err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		os.RemoveAll(dst)
+		return "", fmt.Errorf("unexpected repository archive layout")
+	}
+	return filepath.Join(dst, entries[0].Name()), nil
+}
+
+// createRun archives the workspace's root module and creates a run with the
+// archive
+func (s *Server) createRun(ctx context.Context, t runTrigger, root string, ev *Event) error {
+	ws, command := t.ws, t.command
+
+	arc, err := archive.NewArchive(filepath.Join(root, ws.Spec.VCS.Path))
+	if err != nil {
+		return err
+	}
+	if err := arc.Walk(); err != nil {
+		return err
+	}
+	relPathToRoot, err := arc.RootPath()
+	if err != nil {
+		return err
+	}
+	tarball := new(bytes.Buffer)
+	meta, err := arc.Pack(tarball)
+	if err != nil {
+		return err
+	}
+
+	configMapName := v1alpha1.ArchiveConfigMapName(ws.Name, meta.Hash)
+	if err := s.ensureConfigMap(ctx, ws, configMapName, tarball.Bytes()); err != nil {
+		return err
+	}
+
+	run := &v1alpha1.Run{}
+	run.SetNamespace(ws.Namespace)
+	run.SetName(t.name)
+
+	labels.SetCommonLabels(run)
+	labels.SetLabel(run, labels.Command(command))
+	labels.SetLabel(run, labels.Workspace(ws.Name))
+	labels.SetLabel(run, labels.RunComponent)
+	// Distinguishes the run from those created by users, for the reporter
+	labels.SetLabel(run, labels.VCSTrigger)
+
+	// Record the commit, and where to report the run's result
+	annotations := map[string]string{
+		v1alpha1.GitCommitAnnotationKey:     ev.SHA,
+		v1alpha1.VCSRepositoryAnnotationKey: ev.Repository,
+	}
+	if ev.PullRequest != 0 {
+		annotations[v1alpha1.VCSPullRequestAnnotationKey] = strconv.Itoa(ev.PullRequest)
+	}
+	run.SetAnnotations(annotations)
+
+	run.Workspace = ws.Name
+	run.Command = command
+	if command == "apply" {
+		// Nobody is attached to confirm the apply
+		run.Args = []string{"-auto-approve"}
+	}
+	run.ConfigMap = configMapName
+	run.ConfigMapKey = v1alpha1.RunDefaultConfigMapKey
+	run.ConfigMapPath = relPathToRoot
+
+	if ws.IsPrivilegedCommand(command) {
+		if err := s.approve(ctx, ws, run); err != nil {
+			return err
+		}
+	}
+
+	if err := s.client.Create(ctx, run); err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			// Created in response to a concurrent redelivery
+			return nil
+		}
+		return err
+	}
+	klog.V(0).Infof("created run %s for %s@%s", klog.KObj(run), ev.Repository, ev.SHA)
+
+	return nil
+}
+
+// ensureConfigMap creates a config map containing the tarball, unless one with
+// the same name, and therefore the same tarball, already exists
+func (s *Server) ensureConfigMap(ctx context.Context, ws *v1alpha1.Workspace, name string, tarball []byte) error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ws.Namespace,
+		},
+		BinaryData: map[string][]byte{
+			v1alpha1.RunDefaultConfigMapKey: tarball,
+		},
+	}
+
+	labels.SetCommonLabels(configMap)
+	labels.SetLabel(configMap, labels.Workspace(ws.Name))
+	labels.SetLabel(configMap, labels.RunComponent)
+
+	if err := s.client.Create(ctx, configMap); err != nil && !kerrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// approve approves the run on the workspace. Enabling applyOnMerge on a
+// workspace is taken as approval of the applies it triggers.
+func (s *Server) approve(ctx context.Context, ws *v1alpha1.Workspace, run *v1alpha1.Run) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var latest v1alpha1.Workspace
+		if err := s.client.Get(ctx, types.NamespacedName{Namespace: ws.Namespace, Name: ws.Name}, &latest); err != nil {
+			return err
+		}
+		annotations := latest.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[run.ApprovedAnnotationKey()] = "approved"
+		latest.SetAnnotations(annotations)
+
+		return s.client.Update(ctx, &latest)
+	})
+}
+
+func (s *Server) error(w http.ResponseWriter, err error) {
+	klog.Errorf("VCS webhook receiver error: %s", err.Error())
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,278 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func withVCS(repo, path string, applyOnMerge bool) func(*v1alpha1.Workspace) {
+	return func(ws *v1alpha1.Workspace) {
+		ws.Spec.VCS = &v1alpha1.VCSSpec{Repository: repo, Path: path, ApplyOnMerge: applyOnMerge}
+	}
+}
+
+func withAllowForks(ws *v1alpha1.Workspace) {
+	ws.Spec.VCS.AllowForks = true
+}
+
+// withDelivery sets the ID of a GitHub webhook delivery
+func withDelivery(req *http.Request, id string) *http.Request {
+	req.Header.Set("X-GitHub-Delivery", id)
+	return req
+}
+
+func TestServer(t *testing.T) {
+	pullRequest := `{"action":"opened","number":7,"pull_request":{"head":{"sha":"abc123","ref":"feature","repo":{"full_name":"leg100/infra"}}},"repository":{"full_name":"leg100/infra","default_branch":"master"}}`
+	forkPullRequest := `{"action":"opened","number":7,"pull_request":{"head":{"sha":"abc123","ref":"feature","repo":{"full_name":"mallory/infra"}}},"repository":{"full_name":"leg100/infra","default_branch":"master"}}`
+	merge := `{"ref":"refs/heads/master","after":"abc123","repository":{"full_name":"leg100/infra","default_branch":"master"}}`
+
+	tests := []struct {
+		name string
+		objs []runtime.Object
+		req  *http.Request
+		// Override the mock API's files changed by a pull request
+		changed []string
+		// Fail requests for the repository's tarball
+		archiveErr bool
+		code       int
+		// Expected runs' workspace and command
+		want []Run
+		// Additional assertions on the created runs
+		assertions func(*testutil.T, runtimeclient.Client, []Run)
+		// Expected requests made to the provider's API
+		wantRequests []mockRequest
+	}{
+		{
+			name: "pull request triggers plans",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+				testobj.Workspace("dev", "compute", withVCS("leg100/infra", "", false)),
+				testobj.Workspace("default", "unconnected"),
+				testobj.Workspace("default", "other", withVCS("leg100/other", "", false)),
+			},
+			req:  githubRequest("pull_request", "webhook-secret", pullRequest),
+			code: http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "networking", Command: "plan"},
+				{Namespace: "dev", Workspace: "compute", Command: "plan"},
+			},
+			assertions: func(t *testutil.T, client runtimeclient.Client, runs []Run) {
+				var run v1alpha1.Run
+				require.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: runs[0].Namespace, Name: runs[0].Name}, &run))
+
+				assert.Equal(t, "abc123", run.Annotations[v1alpha1.GitCommitAnnotationKey])
+				assert.Equal(t, "leg100/infra", run.Annotations[v1alpha1.VCSRepositoryAnnotationKey])
+				assert.Equal(t, "7", run.Annotations[v1alpha1.VCSPullRequestAnnotationKey])
+				assert.Equal(t, ".", run.ConfigMapPath)
+				assert.Empty(t, run.Args)
+				assert.Equal(t, "vcs", run.Labels["trigger"])
+
+				// Archive is deployed
+				var configMap corev1.ConfigMap
+				require.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: run.Namespace, Name: run.ConfigMap}, &configMap))
+				assert.NotEmpty(t, configMap.BinaryData[v1alpha1.RunDefaultConfigMapKey])
+			},
+		},
+		{
+			name: "merge triggers approved apply",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", true), testobj.WithPrivilegedCommands("apply")),
+				testobj.Workspace("default", "compute", withVCS("leg100/infra", "", false)),
+			},
+			req:  githubRequest("push", "webhook-secret", merge),
+			code: http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "networking", Command: "apply"},
+			},
+			assertions: func(t *testutil.T, client runtimeclient.Client, runs []Run) {
+				var run v1alpha1.Run
+				require.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: runs[0].Name}, &run))
+				assert.Equal(t, []string{"-auto-approve"}, run.Args)
+				assert.NotContains(t, run.Annotations, v1alpha1.VCSPullRequestAnnotationKey)
+
+				var ws v1alpha1.Workspace
+				require.NoError(t, client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "networking"}, &ws))
+				assert.True(t, ws.IsRunApproved(&run))
+			},
+		},
+		{
+			name: "pull request only triggers plans on changed paths",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+				testobj.Workspace("default", "compute", withVCS("leg100/infra", "compute", false)),
+			},
+			req:     githubRequest("pull_request", "webhook-secret", pullRequest),
+			changed: []string{"networking/main.tf"},
+			code:    http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "networking", Command: "plan"},
+			},
+		},
+		{
+			name: "merge only triggers applies on changed paths",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", true)),
+				testobj.Workspace("default", "compute", withVCS("leg100/infra", "compute", true)),
+			},
+			req:  githubRequest("push", "webhook-secret", `{"ref":"refs/heads/master","after":"abc123","commits":[{"modified":["compute/main.tf"]}],"repository":{"full_name":"leg100/infra","default_branch":"master"}}`),
+			code: http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "compute", Command: "apply"},
+			},
+		},
+		{
+			name: "failure to retrieve repository is reported",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+			},
+			req:        githubRequest("pull_request", "webhook-secret", pullRequest),
+			archiveErr: true,
+			code:       http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "networking", Command: "plan"},
+			},
+			assertions: func(t *testutil.T, client runtimeclient.Client, runs []Run) {
+				var list v1alpha1.RunList
+				require.NoError(t, client.List(context.Background(), &list))
+				assert.Empty(t, list.Items)
+			},
+			wantRequests: []mockRequest{
+				{Method: "POST", Path: "/repos/leg100/infra/statuses/abc123", Body: map[string]string{"state": "failure", "context": "etok/default/networking", "description": "plan failed to start: unable to retrieve repository: GET /repos/leg100/infra/tarball/abc123: 404 Not Found: not found"}},
+			},
+		},
+		{
+			name: "push to other branch",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", true)),
+			},
+			req:  githubRequest("push", "webhook-secret", `{"ref":"refs/heads/feature","after":"abc123","repository":{"full_name":"leg100/infra","default_branch":"master"}}`),
+			code: http.StatusAccepted,
+			want: []Run{},
+		},
+		{
+			name: "pull request from fork",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+				testobj.Workspace("default", "compute", withVCS("leg100/infra", "", false), withAllowForks),
+			},
+			req:  githubRequest("pull_request", "webhook-secret", forkPullRequest),
+			code: http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "compute", Command: "plan"},
+			},
+		},
+		{
+			name: "runs named after delivery",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+			},
+			req:  withDelivery(githubRequest("pull_request", "webhook-secret", pullRequest), "delivery-1"),
+			code: http.StatusAccepted,
+			want: []Run{
+				{Namespace: "default", Workspace: "networking", Command: "plan"},
+			},
+			assertions: func(t *testutil.T, client runtimeclient.Client, runs []Run) {
+				assert.Equal(t, runName(testobj.Workspace("default", "networking"), "plan", &Event{DeliveryID: "delivery-1", SHA: "abc123"}), runs[0].Name)
+			},
+		},
+		{
+			name: "redelivery",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "networking", false)),
+				testobj.Run("default", runName(testobj.Workspace("default", "networking"), "plan", &Event{DeliveryID: "delivery-1", SHA: "abc123"}), "plan"),
+			},
+			req:  withDelivery(githubRequest("pull_request", "webhook-secret", pullRequest), "delivery-1"),
+			code: http.StatusAccepted,
+			want: []Run{},
+		},
+		{
+			name: "path outside repository",
+			objs: []runtime.Object{
+				testobj.Workspace("default", "networking", withVCS("leg100/infra", "../..", false)),
+			},
+			req:  githubRequest("pull_request", "webhook-secret", pullRequest),
+			code: http.StatusInternalServerError,
+		},
+		{
+			name: "ignored event",
+			req:  githubRequest("ping", "webhook-secret", `{}`),
+			code: http.StatusNoContent,
+		},
+		{
+			name: "invalid signature",
+			req:  githubRequest("pull_request", "wrong-secret", pullRequest),
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong method",
+			req:  httptest.NewRequest(http.MethodGet, webhookPath, nil),
+			code: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "unknown path",
+			req:  httptest.NewRequest(http.MethodPost, "/foo", nil),
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			api := newMockAPI(t.T, map[string]string{
+				"main.tf":            "",
+				"networking/main.tf": "",
+				"compute/main.tf":    "",
+			})
+			if tt.changed != nil {
+				api.changed = tt.changed
+			}
+			api.archiveErr = tt.archiveErr
+
+			provider, err := NewProvider(GitHub, api.URL, "secret-token", "webhook-secret")
+			require.NoError(t, err)
+
+			client := fake.NewFakeClientWithScheme(scheme.Scheme, tt.objs...)
+
+			w := httptest.NewRecorder()
+			server := NewServer("", client, provider)
+			server.ServeHTTP(w, tt.req)
+
+			// Wait for runs to be created in the background
+			server.wg.Wait()
+
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code != http.StatusAccepted {
+				return
+			}
+
+			var runs []Run
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&runs))
+
+			var got []Run
+			for _, r := range runs {
+				assert.NotEmpty(t, r.Name)
+				got = append(got, Run{Namespace: r.Namespace, Workspace: r.Workspace, Command: r.Command})
+			}
+			assert.ElementsMatch(t, tt.want, got)
+
+			if tt.assertions != nil {
+				tt.assertions(t, client, runs)
+			}
+			assert.Equal(t, tt.wantRequests, api.received())
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// Duration for which the results of token and access reviews are cached,
+// sparing the API server a review for every request the web UI makes
+const reviewCacheTTL = 10 * time.Second
+
+// reviewCache caches the results of reviews for a short period
+type reviewCache struct {
+	mu      sync.Mutex
+	entries map[string]reviewCacheEntry
+	ttl     time.Duration
+}
+
+type reviewCacheEntry struct {
+	// Authenticated user, for token reviews
+	user *authenticationv1.UserInfo
+	// Whether access was allowed, for access reviews
+	allowed bool
+
+	expires time.Time
+}
+
+func newReviewCache(ttl time.Duration) *reviewCache {
+	return &reviewCache{entries: make(map[string]reviewCacheEntry), ttl: ttl}
+}
+
+func (c *reviewCache) get(key string) (reviewCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return reviewCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *reviewCache) set(key string, entry reviewCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Evict expired entries to bound the size of the cache
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	entry.expires = now.Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// authenticate authenticates the bearer token in the request using a
+// TokenReview, returning the user if authenticated, or nil if not
+func (s *Server) authenticate(r *http.Request) (*authenticationv1.UserInfo, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if token == "" {
+		return nil, nil
+	}
+
+	// Tokens are hashed rather than retained in memory
+	sum := sha256.Sum256([]byte(token))
+	key := "token/" + hex.EncodeToString(sum[:])
+	if entry, ok := s.reviews.get(key); ok {
+		return entry.user, nil
+	}
+
+	review, err := s.kubeClient.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var user *authenticationv1.UserInfo
+	if review.Status.Authenticated {
+		user = &review.Status.User
+	}
+	s.reviews.set(key, reviewCacheEntry{user: user})
+	return user, nil
+}
+
+// authorize determines whether the user is permitted to perform the action on
+// the resource using a SubjectAccessReview
+func (s *Server) authorize(ctx context.Context, user *authenticationv1.UserInfo, attrs authorizationv1.ResourceAttributes) (bool, error) {
+	key := fmt.Sprintf("access/%s/%s/%s/%s/%s/%s/%s/%s/%s", user.UID, user.Username, strings.Join(user.Groups, ","), attrs.Verb, attrs.Group, attrs.Resource, attrs.Subresource, attrs.Namespace, attrs.Name)
+	if entry, ok := s.reviews.get(key); ok {
+		return entry.allowed, nil
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	review, err := s.kubeClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			Groups:             user.Groups,
+			UID:                user.UID,
+			Extra:              extra,
+			ResourceAttributes: &attrs,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	s.reviews.set(key, reviewCacheEntry{allowed: review.Status.Allowed})
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,585 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/globals"
+	"github.com/leg100/etok/pkg/internal/httpserver"
+	"github.com/leg100/etok/pkg/logstreamer"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Port on which the operator's web server listens
+	Port = 9090
+
+	// Name of the service fronting the operator's web server
+	ServiceName = "etok-web"
+
+	// CertsSecretName is the name of the secret in which the operator persists
+	// the web server's certificates
+	CertsSecretName = "etok-web-certs"
+
+	// Prefix of the path at which the API is served
+	apiPrefix = "/api/namespaces/"
+
+	// maskedOutput replaces the values of outputs unless they are revealed
+	maskedOutput = "(masked)"
+)
+
+var (
+	// ansiEscape matches terminal colour codes
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+
+	// applyChange matches the line terraform prints upon changing a resource
+	applyChange = regexp.MustCompile(`^(\S+): (Creation|Modifications|Destruction) complete`)
+
+	// applyActions maps the verb in terraform's output to the action taken
+	applyActions = map[string]string{
+		"Creation":      "created",
+		"Modifications": "updated",
+		"Destruction":   "destroyed",
+	}
+)
+
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+
+// Server serves a read-only JSON API for workspaces, runs, queues and outputs,
+// along with a web UI rendering them. Run logs are streamed as server-sent
+// events.
+//
+// Clients authenticate with a kubernetes bearer token, and are authorized to
+// retrieve a resource only if kubernetes RBAC permits them to do so. The
+// results of these reviews are cached briefly. Output values are masked unless
+// the reveal parameter is set and the client is permitted to get secrets in the
+// namespace, because outputs are read from the state, which is stored in
+// secrets.
+//
+// The API is served beneath /api/namespaces/<namespace>:
+//
+//	/workspaces                   list workspaces
+//	/workspaces/<name>            get workspace
+//	/workspaces/<name>/queue      get workspace's active run and queue
+//	/workspaces/<name>/outputs    get workspace's outputs
+//	/workspaces/<name>/runs       list workspace's runs, newest first
+//	/workspaces/<name>/last-apply get resources changed by workspace's last apply
+//	/runs/<name>                  get run
+//	/runs/<name>/logs             stream run's logs
+type Server struct {
+	*httpserver.Runnable
+
+	// Client for retrieving workspaces and runs
+	client runtimeclient.Client
+
+	// Client for reviewing tokens and access, and streaming logs
+	kubeClient kubernetes.Interface
+
+	// Function to get a pod's logs stream
+	getLogs logstreamer.GetLogsFunc
+
+	// Cache of token and access reviews
+	reviews *reviewCache
+}
+
+type ServerOption func(*Server) error
+
+// WithTLS serves HTTPS using the PEM-encoded certificate and key, ensuring the
+// bearer tokens sent by clients are not sent in the clear
+func WithTLS(cert, key []byte) ServerOption {
+	return func(s *Server) error {
+		return s.Runnable.WithTLS(cert, key)
+	}
+}
+
+func NewServer(addr string, client runtimeclient.Client, kubeClient kubernetes.Interface, opts ...ServerOption) (*Server, error) {
+	s := &Server{
+		client:     client,
+		kubeClient: kubeClient,
+		getLogs:    logstreamer.GetLogs,
+		reviews:    newReviewCache(reviewCacheTTL),
+	}
+	s.Runnable = &httpserver.Runnable{Name: "Web server", Addr: addr, Handler: s}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Workspace is the representation of a workspace served by the API
+type Workspace struct {
+	Namespace        string    `json:"namespace"`
+	Name             string    `json:"name"`
+	Phase            string    `json:"phase"`
+	TerraformVersion string    `json:"terraformVersion,omitempty"`
+	Serial           *int      `json:"serial,omitempty"`
+	Active           string    `json:"active,omitempty"`
+	Readers          []string  `json:"readers,omitempty"`
+	Queue            []string  `json:"queue"`
+	Created          time.Time `json:"created"`
+}
+
+// Run is the representation of a run served by the API
+type Run struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Workspace string    `json:"workspace"`
+	Command   string    `json:"command"`
+	Args      []string  `json:"args,omitempty"`
+	Phase     string    `json:"phase"`
+	ExitCode  *int      `json:"exitCode,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Apply is the representation of the changes made by a workspace's last apply
+// served by the API
+type Apply struct {
+	// The last apply run to have completed. Nil if there is no such run.
+	Run *Run `json:"run"`
+	// Terraform's summary of the apply
+	Summary string `json:"summary,omitempty"`
+	// Resources changed by the apply. Empty if the run's logs are no longer
+	// available.
+	Changes []Change `json:"changes"`
+}
+
+// Change is a resource changed by an apply
+type Change struct {
+	Address string `json:"address"`
+	// One of created, updated or destroyed
+	Action string `json:"action"`
+}
+
+// Queue is the representation of a workspace queue served by the API
+type Queue struct {
+	Active  *Run  `json:"active"`
+	Readers []Run `json:"readers,omitempty"`
+	Queue   []Run `json:"queue"`
+}
+
+func newWorkspace(ws *v1alpha1.Workspace) Workspace {
+	queue := ws.Status.Queue
+	if queue == nil {
+		queue = []string{}
+	}
+	return Workspace{
+		Namespace:        ws.Namespace,
+		Name:             ws.Name,
+		Phase:            string(ws.Status.Phase),
+		TerraformVersion: ws.Spec.TerraformVersion,
+		Serial:           ws.Status.Serial,
+		Active:           ws.Status.Active,
+		Readers:          ws.Status.Readers,
+		Queue:            queue,
+		Created:          ws.CreationTimestamp.Time,
+	}
+}
+
+func newRun(run *v1alpha1.Run) Run {
+	return Run{
+		Namespace: run.Namespace,
+		Name:      run.Name,
+		Workspace: run.Workspace,
+		Command:   run.Command,
+		Args:      run.Args,
+		Phase:     string(run.Phase),
+		ExitCode:  run.ExitCode,
+		Created:   run.CreationTimestamp.Time,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, indexHTML)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) || len(parts) < 2 || len(parts) > 4 {
+		http.NotFound(w, r)
+		return
+	}
+	for _, p := range parts {
+		if p == "" {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	namespace, resource := parts[0], parts[1]
+
+	var name, sub string
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+	if len(parts) > 3 {
+		sub = parts[3]
+	}
+
+	// Permissions required for each endpoint
+	var attrs []authorizationv1.ResourceAttributes
+	var handler func(http.ResponseWriter, *http.Request, string, string)
+	switch {
+	case resource == "workspaces" && name == "":
+		attrs = append(attrs, etokAttrs("list", "workspaces", namespace, ""))
+		handler = s.listWorkspaces
+	case resource == "workspaces" && sub == "":
+		attrs = append(attrs, etokAttrs("get", "workspaces", namespace, name))
+		handler = s.getWorkspace
+	case resource == "workspaces" && sub == "queue":
+		attrs = append(attrs, etokAttrs("get", "workspaces", namespace, name), etokAttrs("list", "runs", namespace, ""))
+		handler = s.getQueue
+	case resource == "workspaces" && sub == "outputs":
+		attrs = append(attrs, etokAttrs("get", "workspaces", namespace, name))
+		if reveal(r) {
+			attrs = append(attrs, authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  "secrets",
+			})
+		}
+		handler = s.getOutputs
+	case resource == "workspaces" && sub == "last-apply":
+		attrs = append(attrs, etokAttrs("get", "workspaces", namespace, name), etokAttrs("list", "runs", namespace, ""), authorizationv1.ResourceAttributes{
+			Namespace:   namespace,
+			Verb:        "get",
+			Resource:    "pods",
+			Subresource: "log",
+		})
+		handler = s.getLastApply
+	case resource == "workspaces" && sub == "runs":
+		attrs = append(attrs, etokAttrs("get", "workspaces", namespace, name), etokAttrs("list", "runs", namespace, ""))
+		handler = s.listRuns
+	case resource == "runs" && name != "" && sub == "":
+		attrs = append(attrs, etokAttrs("get", "runs", namespace, name))
+		handler = s.getRun
+	case resource == "runs" && sub == "logs":
+		attrs = append(attrs, etokAttrs("get", "runs", namespace, name), authorizationv1.ResourceAttributes{
+			Namespace:   namespace,
+			Verb:        "get",
+			Resource:    "pods",
+			Subresource: "log",
+			Name:        name,
+		})
+		handler = s.streamLogs
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	user, err := s.authenticate(r)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="etok"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	for _, a := range attrs {
+		allowed, err := s.authorize(r.Context(), user, a)
+		if err != nil {
+			s.error(w, err)
+			return
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("forbidden: user %s cannot %s %s in namespace %s", user.Username, a.Verb, a.Resource, a.Namespace), http.StatusForbidden)
+			return
+		}
+	}
+
+	handler(w, r, namespace, name)
+}
+
+func etokAttrs(verb, resource, namespace, name string) authorizationv1.ResourceAttributes {
+	return authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      verb,
+		Group:     v1alpha1.SchemeGroupVersion.Group,
+		Resource:  resource,
+		Name:      name,
+	}
+}
+
+func (s *Server) listWorkspaces(w http.ResponseWriter, r *http.Request, namespace, _ string) {
+	var list v1alpha1.WorkspaceList
+	if err := s.client.List(r.Context(), &list, runtimeclient.InNamespace(namespace)); err != nil {
+		s.error(w, err)
+		return
+	}
+
+	workspaces := []Workspace{}
+	for i := range list.Items {
+		workspaces = append(workspaces, newWorkspace(&list.Items[i]))
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].Name < workspaces[j].Name })
+
+	writeJSON(w, workspaces)
+}
+
+func (s *Server) getWorkspace(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if ws, ok := s.workspace(w, r, namespace, name); ok {
+		writeJSON(w, newWorkspace(ws))
+	}
+}
+
+func (s *Server) getOutputs(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if ws, ok := s.workspace(w, r, namespace, name); ok {
+		outputs := []v1alpha1.Output{}
+		for _, out := range ws.Status.Outputs {
+			if !reveal(r) {
+				out = &v1alpha1.Output{Key: out.Key, Value: maskedOutput}
+			}
+			outputs = append(outputs, *out)
+		}
+		writeJSON(w, outputs)
+	}
+}
+
+func (s *Server) getQueue(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	ws, ok := s.workspace(w, r, namespace, name)
+	if !ok {
+		return
+	}
+	runs, ok := s.runs(w, r, namespace)
+	if !ok {
+		return
+	}
+
+	byName := make(map[string]*v1alpha1.Run, len(runs))
+	for i := range runs {
+		byName[runs[i].Name] = &runs[i]
+	}
+	// Runs in the queue may not yet be in the cache, in which case only
+	// their names are known
+	lookup := func(name string) Run {
+		if run, ok := byName[name]; ok {
+			return newRun(run)
+		}
+		return Run{Namespace: namespace, Name: name, Workspace: ws.Name}
+	}
+
+	queue := Queue{Queue: []Run{}}
+	if ws.Status.Active != "" {
+		active := lookup(ws.Status.Active)
+		queue.Active = &active
+	}
+	for _, name := range ws.Status.Readers {
+		queue.Readers = append(queue.Readers, lookup(name))
+	}
+	for _, name := range ws.Status.Queue {
+		queue.Queue = append(queue.Queue, lookup(name))
+	}
+
+	writeJSON(w, queue)
+}
+
+func (s *Server) listRuns(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if _, ok := s.workspace(w, r, namespace, name); !ok {
+		return
+	}
+	list, ok := s.runs(w, r, namespace)
+	if !ok {
+		return
+	}
+
+	runs := []Run{}
+	for i := range list {
+		if list[i].Workspace == name {
+			runs = append(runs, newRun(&list[i]))
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].Created.Equal(runs[j].Created) {
+			return runs[i].Created.After(runs[j].Created)
+		}
+		return runs[i].Name < runs[j].Name
+	})
+
+	writeJSON(w, runs)
+}
+
+// getLastApply retrieves the resources changed by the workspace's last apply to
+// have completed, parsing them from the apply's logs
+func (s *Server) getLastApply(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if _, ok := s.workspace(w, r, namespace, name); !ok {
+		return
+	}
+	list, ok := s.runs(w, r, namespace)
+	if !ok {
+		return
+	}
+
+	var last *v1alpha1.Run
+	for i := range list {
+		run := &list[i]
+		if run.Workspace != name || run.Command != "apply" || run.Phase != v1alpha1.RunPhaseCompleted {
+			continue
+		}
+		if last == nil || run.CreationTimestamp.After(last.CreationTimestamp.Time) {
+			last = run
+		}
+	}
+
+	apply := Apply{Changes: []Change{}}
+	if last == nil {
+		writeJSON(w, apply)
+		return
+	}
+	run := newRun(last)
+	apply.Run = &run
+
+	stream, err := s.getLogs(r.Context(), logstreamer.Options{
+		PodsClient:    s.kubeClient.CoreV1().Pods(namespace),
+		PodName:       last.PodName(),
+		PodLogOptions: &corev1.PodLogOptions{Container: globals.RunnerContainerName},
+	})
+	if err != nil {
+		// Logs are unavailable once the run's pod is deleted
+		klog.V(1).Infof("unable to retrieve logs for run %s: %s", klog.KObj(last), err.Error())
+		writeJSON(w, apply)
+		return
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := strings.TrimSpace(ansiEscape.ReplaceAllString(scanner.Text(), ""))
+		if m := applyChange.FindStringSubmatch(line); m != nil {
+			apply.Changes = append(apply.Changes, Change{Address: m[1], Action: applyActions[m[2]]})
+		}
+		if strings.HasPrefix(line, "Apply complete!") {
+			apply.Summary = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		s.error(w, err)
+		return
+	}
+
+	writeJSON(w, apply)
+}
+
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if run, ok := s.run(w, r, namespace, name); ok {
+		writeJSON(w, newRun(run))
+	}
+}
+
+// streamLogs streams a run's logs as server-sent events, one event per line.
+// An 'end' event is sent once the logs are exhausted.
+func (s *Server) streamLogs(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	run, ok := s.run(w, r, namespace, name)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.error(w, fmt.Errorf("streaming unsupported"))
+		return
+	}
+
+	stream, err := s.getLogs(r.Context(), logstreamer.Options{
+		PodsClient:    s.kubeClient.CoreV1().Pods(namespace),
+		PodName:       run.PodName(),
+		PodLogOptions: &corev1.PodLogOptions{Follow: true, Container: globals.RunnerContainerName},
+	})
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		fmt.Fprintf(w, "data: %s\n\n", strings.TrimSuffix(scanner.Text(), "\r"))
+		flusher.Flush()
+	}
+	if err := scanner.Err(); err != nil && r.Context().Err() == nil {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+	}
+	fmt.Fprint(w, "event: end\ndata:\n\n")
+	flusher.Flush()
+}
+
+// workspace retrieves a workspace, writing an error response if it cannot be
+// retrieved
+func (s *Server) workspace(w http.ResponseWriter, r *http.Request, namespace, name string) (*v1alpha1.Workspace, bool) {
+	var ws v1alpha1.Workspace
+	if err := s.client.Get(r.Context(), types.NamespacedName{Namespace: namespace, Name: name}, &ws); err != nil {
+		if kerrors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return nil, false
+		}
+		s.error(w, err)
+		return nil, false
+	}
+	return &ws, true
+}
+
+// run retrieves a run, writing an error response if it cannot be retrieved
+func (s *Server) run(w http.ResponseWriter, r *http.Request, namespace, name string) (*v1alpha1.Run, bool) {
+	var run v1alpha1.Run
+	if err := s.client.Get(r.Context(), types.NamespacedName{Namespace: namespace, Name: name}, &run); err != nil {
+		if kerrors.IsNotFound(err) {
+			http.NotFound(w, r)
+			return nil, false
+		}
+		s.error(w, err)
+		return nil, false
+	}
+	return &run, true
+}
+
+// runs lists the runs in a namespace, writing an error response if they cannot
+// be listed
+func (s *Server) runs(w http.ResponseWriter, r *http.Request, namespace string) ([]v1alpha1.Run, bool) {
+	var list v1alpha1.RunList
+	if err := s.client.List(r.Context(), &list, runtimeclient.InNamespace(namespace)); err != nil {
+		s.error(w, err)
+		return nil, false
+	}
+	return list.Items, true
+}
+
+// reveal determines whether the request asks for output values to be revealed
+func reveal(r *http.Request) bool {
+	return r.URL.Query().Get("reveal") == "true"
+}
+
+func (s *Server) error(w http.ResponseWriter, err error) {
+	klog.Errorf("web server error: %s", err.Error())
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,331 @@
+package web
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/logstreamer"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServer(t *testing.T) {
+	serial := 3
+	objs := []runtime.Object{
+		testobj.Workspace("default", "networking", testobj.WithCombinedQueue("run-1", "run-2"), testobj.WithTerraformVersion("0.14.3"), func(ws *v1alpha1.Workspace) {
+			ws.Status.Serial = &serial
+			ws.Status.Outputs = []*v1alpha1.Output{{Key: "vpc_id", Value: "vpc-123"}}
+		}),
+		testobj.Workspace("default", "compute"),
+		testobj.Workspace("dev", "networking"),
+		testobj.Run("default", "run-1", "apply", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseRunning)),
+		testobj.Run("default", "run-2", "apply", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseQueued)),
+		testobj.Run("default", "run-3", "plan", testobj.WithWorkspace("compute")),
+		testobj.Run("default", "run-0", "apply", testobj.WithWorkspace("networking"), testobj.WithRunPhase(v1alpha1.RunPhaseCompleted), testobj.WithRunExitCode(0)),
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		// Resources the user is forbidden from accessing
+		forbidden []string
+		code      int
+		// Expected JSON body
+		want string
+		// Expected substring of body
+		contains string
+	}{
+		{
+			name:     "web ui",
+			path:     "/",
+			code:     http.StatusOK,
+			contains: "<title>etok</title>",
+		},
+		{
+			name:  "missing token",
+			path:  "/api/namespaces/default/workspaces",
+			token: "",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:  "invalid token",
+			path:  "/api/namespaces/default/workspaces",
+			token: "invalid",
+			code:  http.StatusUnauthorized,
+		},
+		{
+			name:      "forbidden",
+			path:      "/api/namespaces/default/workspaces",
+			token:     "valid",
+			forbidden: []string{"workspaces"},
+			code:      http.StatusForbidden,
+		},
+		{
+			name:  "unknown path",
+			path:  "/api/namespaces/default/foo",
+			token: "valid",
+			code:  http.StatusNotFound,
+		},
+		{
+			name:  "list workspaces",
+			path:  "/api/namespaces/default/workspaces",
+			token: "valid",
+			code:  http.StatusOK,
+			want: `[
+				{"namespace":"default","name":"compute","phase":"","queue":[],"created":"0001-01-01T00:00:00Z"},
+				{"namespace":"default","name":"networking","phase":"","terraformVersion":"0.14.3","serial":3,"active":"run-1","queue":["run-2"],"created":"0001-01-01T00:00:00Z"}
+			]`,
+		},
+		{
+			name:  "get workspace",
+			path:  "/api/namespaces/dev/workspaces/networking",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `{"namespace":"dev","name":"networking","phase":"","queue":[],"created":"0001-01-01T00:00:00Z"}`,
+		},
+		{
+			name:  "workspace not found",
+			path:  "/api/namespaces/default/workspaces/storage",
+			token: "valid",
+			code:  http.StatusNotFound,
+		},
+		{
+			name:  "get queue",
+			path:  "/api/namespaces/default/workspaces/networking/queue",
+			token: "valid",
+			code:  http.StatusOK,
+			want: `{
+				"active":{"namespace":"default","name":"run-1","workspace":"networking","command":"apply","phase":"running","created":"0001-01-01T00:00:00Z"},
+				"queue":[{"namespace":"default","name":"run-2","workspace":"networking","command":"apply","phase":"queued","created":"0001-01-01T00:00:00Z"}]
+			}`,
+		},
+		{
+			name:      "get queue without permission to list runs",
+			path:      "/api/namespaces/default/workspaces/networking/queue",
+			token:     "valid",
+			forbidden: []string{"runs"},
+			code:      http.StatusForbidden,
+		},
+		{
+			name:  "get outputs",
+			path:  "/api/namespaces/default/workspaces/networking/outputs",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `[{"key":"vpc_id","value":"(masked)"}]`,
+		},
+		{
+			name:  "reveal outputs",
+			path:  "/api/namespaces/default/workspaces/networking/outputs?reveal=true",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `[{"key":"vpc_id","value":"vpc-123"}]`,
+		},
+		{
+			name:      "reveal outputs without permission to get secrets",
+			path:      "/api/namespaces/default/workspaces/networking/outputs?reveal=true",
+			token:     "valid",
+			forbidden: []string{"secrets"},
+			code:      http.StatusForbidden,
+		},
+		{
+			name:  "get last apply",
+			path:  "/api/namespaces/default/workspaces/networking/last-apply",
+			token: "valid",
+			code:  http.StatusOK,
+			want: `{
+				"run":{"namespace":"default","name":"run-0","workspace":"networking","command":"apply","phase":"completed","exitCode":0,"created":"0001-01-01T00:00:00Z"},
+				"summary":"Apply complete! Resources: 1 added, 1 changed, 1 destroyed.",
+				"changes":[
+					{"address":"aws_vpc.main","action":"created"},
+					{"address":"aws_subnet.a","action":"updated"},
+					{"address":"aws_subnet.b","action":"destroyed"}
+				]
+			}`,
+		},
+		{
+			name:  "get last apply of workspace without apply",
+			path:  "/api/namespaces/default/workspaces/compute/last-apply",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `{"run":null,"changes":[]}`,
+		},
+		{
+			name:  "list workspace runs",
+			path:  "/api/namespaces/default/workspaces/compute/runs",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `[{"namespace":"default","name":"run-3","workspace":"compute","command":"plan","phase":"","created":"0001-01-01T00:00:00Z"}]`,
+		},
+		{
+			name:  "get run",
+			path:  "/api/namespaces/default/runs/run-3",
+			token: "valid",
+			code:  http.StatusOK,
+			want:  `{"namespace":"default","name":"run-3","workspace":"compute","command":"plan","phase":"","created":"0001-01-01T00:00:00Z"}`,
+		},
+		{
+			name:     "stream logs",
+			path:     "/api/namespaces/default/runs/run-1/logs",
+			token:    "valid",
+			code:     http.StatusOK,
+			contains: "data: fake logs\n\nevent: end\n",
+		},
+		{
+			name:      "stream logs without permission to get pod logs",
+			path:      "/api/namespaces/default/runs/run-1/logs",
+			token:     "valid",
+			forbidden: []string{"pods"},
+			code:      http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			kubeClient := kfake.NewSimpleClientset()
+
+			// Only the token 'valid' is authenticated
+			kubeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+				if review.Spec.Token == "valid" {
+					review.Status.Authenticated = true
+					review.Status.User = authenticationv1.UserInfo{Username: "alice"}
+				}
+				return true, review, nil
+			})
+
+			// Access is allowed unless the resource is forbidden
+			kubeClient.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+				review.Status.Allowed = review.Spec.User == "alice"
+				for _, res := range tt.forbidden {
+					if review.Spec.ResourceAttributes.Resource == res {
+						review.Status.Allowed = false
+					}
+				}
+				return true, review, nil
+			})
+
+			server, err := NewServer("", fake.NewFakeClientWithScheme(scheme.Scheme, objs...), kubeClient)
+			require.NoError(t, err)
+			server.getLogs = func(ctx context.Context, opts logstreamer.Options) (io.ReadCloser, error) {
+				if opts.PodName == "run-0" {
+					return ioutil.NopCloser(strings.NewReader(applyLogs)), nil
+				}
+				return logstreamer.FakeGetLogs(ctx, opts)
+			}
+
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.code, resp.StatusCode, string(body))
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, string(body))
+			}
+			if tt.contains != "" {
+				assert.Contains(t, string(body), tt.contains)
+			}
+		})
+	}
+}
+
+// applyLogs is the output of an apply that changes resources
+const applyLogs = "aws_vpc.main: Creating...\n" +
+	"\x1b[0m\x1b[1maws_vpc.main: Creation complete after 2s [id=vpc-123]\x1b[0m\n" +
+	"aws_subnet.a: Modifications complete after 1s [id=subnet-a]\n" +
+	"aws_subnet.b: Destruction complete after 1s\n" +
+	"\n" +
+	"Apply complete! Resources: 1 added, 1 changed, 1 destroyed.\n"
+
+func TestServerReviewCache(t *testing.T) {
+	kubeClient := kfake.NewSimpleClientset()
+
+	var tokenReviews, accessReviews int
+	kubeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tokenReviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status.Authenticated = true
+		review.Status.User = authenticationv1.UserInfo{Username: "alice"}
+		return true, review, nil
+	})
+	kubeClient.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		accessReviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+
+	server, err := NewServer("", fake.NewFakeClientWithScheme(scheme.Scheme), kubeClient)
+	require.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/namespaces/default/workspaces", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer valid")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Equal(t, 1, tokenReviews)
+	assert.Equal(t, 1, accessReviews)
+}
+
+func TestReviewCacheExpiry(t *testing.T) {
+	cache := newReviewCache(time.Millisecond)
+	cache.set("key", reviewCacheEntry{allowed: true})
+
+	entry, ok := cache.get("key")
+	assert.True(t, ok)
+	assert.True(t, entry.allowed)
+
+	time.Sleep(2 * time.Millisecond)
+	_, ok = cache.get("key")
+	assert.False(t, ok)
+}
+
+func TestServerMethodNotAllowed(t *testing.T) {
+	server, err := NewServer("", fake.NewFakeClientWithScheme(scheme.Scheme), kfake.NewSimpleClientset())
+	require.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/namespaces/default/workspaces", "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
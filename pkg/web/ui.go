@@ -0,0 +1,163 @@
+package web
+
+// indexHTML is the web UI. It renders the API's resources, authenticating
+// with a bearer token entered by the user and kept in session storage. Logs
+// are read with fetch rather than EventSource because the latter cannot set
+// the Authorization header.
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>etok</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; }
+th { border-bottom: 1px solid #ccc; }
+a { color: #0366d6; cursor: pointer; }
+pre { background: #f6f8fa; padding: 1em; max-height: 30em; overflow: auto; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>etok</h1>
+<form id="settings">
+<label>Namespace <input id="namespace" value="default"></label>
+<label>Token <input id="token" type="password" size="40"></label>
+<label><input id="reveal" type="checkbox"> Reveal outputs</label>
+<button type="submit">Load</button>
+</form>
+<p id="error"></p>
+<div id="workspaces"></div>
+<div id="workspace"></div>
+<div id="logs"></div>
+<script>
+var ns = document.getElementById("namespace");
+var token = document.getElementById("token");
+var reveal = document.getElementById("reveal");
+token.value = sessionStorage.getItem("etok-token") || "";
+var logsController = null;
+
+function esc(s) {
+  return String(s == null ? "" : s).replace(/[&<>"']/g, function(c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+  });
+}
+
+function api(path, opts) {
+  opts = opts || {};
+  opts.headers = {"Authorization": "Bearer " + token.value};
+  return fetch("/api/namespaces/" + encodeURIComponent(ns.value) + path, opts).then(function(resp) {
+    if (!resp.ok) {
+      return resp.text().then(function(text) { throw new Error(resp.status + ": " + text); });
+    }
+    return resp;
+  });
+}
+
+function json(path) {
+  return api(path).then(function(resp) { return resp.json(); });
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err.message;
+}
+
+function table(headers, rows) {
+  var html = "<table><tr>" + headers.map(function(h) { return "<th>" + esc(h) + "</th>"; }).join("") + "</tr>";
+  rows.forEach(function(row) {
+    html += "<tr>" + row.map(function(cell) { return "<td>" + cell + "</td>"; }).join("") + "</tr>";
+  });
+  return html + "</table>";
+}
+
+function link(fn, arg, text) {
+  return "<a onclick='" + fn + "(" + esc(JSON.stringify(arg)) + ")'>" + esc(text) + "</a>";
+}
+
+function loadWorkspaces() {
+  document.getElementById("error").textContent = "";
+  json("/workspaces").then(function(workspaces) {
+    document.getElementById("workspaces").innerHTML = "<h2>Workspaces</h2>" + table(
+      ["Name", "Phase", "Version", "Serial", "Active", "Queued"],
+      workspaces.map(function(ws) {
+        return [link("loadWorkspace", ws.name, ws.name), esc(ws.phase), esc(ws.terraformVersion), esc(ws.serial), esc(ws.active || (ws.readers || []).join(", ")), esc(ws.queue.length)];
+      }));
+  }).catch(showError);
+}
+
+function runRow(run) {
+  return [link("loadLogs", run.name, run.name), esc(run.command), esc(run.phase), esc(run.exitCode), esc(run.created)];
+}
+
+function loadWorkspace(name) {
+  Promise.all([
+    json("/workspaces/" + encodeURIComponent(name) + "/queue"),
+    json("/workspaces/" + encodeURIComponent(name) + "/outputs" + (reveal.checked ? "?reveal=true" : "")),
+    json("/workspaces/" + encodeURIComponent(name) + "/runs"),
+    json("/workspaces/" + encodeURIComponent(name) + "/last-apply")
+  ]).then(function(results) {
+    var queue = results[0], outputs = results[1], runs = results[2], apply = results[3];
+    var queued = (queue.active ? [queue.active] : []).concat(queue.readers || [], queue.queue);
+    document.getElementById("workspace").innerHTML = "<h2>" + esc(name) + "</h2>" +
+      "<h3>Queue</h3>" + table(["Run", "Command", "Phase", "Exit Code", "Created"], queued.map(runRow)) +
+      "<h3>Outputs</h3>" + table(["Key", "Value"], outputs.map(function(o) { return [esc(o.key), esc(o.value)]; })) +
+      "<h3>Last Apply</h3>" + (apply.run ? "<p>" + link("loadLogs", apply.run.name, apply.run.name) + " " + esc(apply.summary) + "</p>" +
+        table(["Resource", "Action"], apply.changes.map(function(c) { return [esc(c.address), esc(c.action)]; })) : "<p>None</p>") +
+      "<h3>Runs</h3>" + table(["Run", "Command", "Phase", "Exit Code", "Created"], runs.map(runRow));
+  }).catch(showError);
+}
+
+function loadLogs(name) {
+  if (logsController) {
+    logsController.abort();
+  }
+  logsController = new AbortController();
+
+  var el = document.getElementById("logs");
+  el.innerHTML = "<h3>Logs: " + esc(name) + "</h3><pre></pre>";
+  var pre = el.querySelector("pre");
+
+  api("/runs/" + encodeURIComponent(name) + "/logs", {signal: logsController.signal}).then(function(resp) {
+    var reader = resp.body.getReader();
+    var decoder = new TextDecoder();
+    var buf = "";
+    function read() {
+      return reader.read().then(function(result) {
+        if (result.done) {
+          return;
+        }
+        buf += decoder.decode(result.value, {stream: true});
+        var events = buf.split("\n\n");
+        buf = events.pop();
+        events.forEach(function(ev) {
+          if (ev.indexOf("data: ") === 0) {
+            pre.textContent += ev.substring(6) + "\n";
+          }
+        });
+        return read();
+      });
+    }
+    return read();
+  }).catch(function(err) {
+    if (err.name !== "AbortError") {
+      showError(err);
+    }
+  });
+}
+
+document.getElementById("settings").addEventListener("submit", function(ev) {
+  ev.preventDefault();
+  sessionStorage.setItem("etok-token", token.value);
+  document.getElementById("workspace").innerHTML = "";
+  document.getElementById("logs").innerHTML = "";
+  loadWorkspaces();
+});
+
+if (token.value) {
+  loadWorkspaces();
+}
+</script>
+</body>
+</html>
+`
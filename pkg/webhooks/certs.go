@@ -0,0 +1,53 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// CertsSecretName is the name of the secret in which the operator persists the
+// webhook certificates
+const CertsSecretName = "etok-webhook-certs"
+
+// InjectCABundle sets the CA bundle on the webhooks of both the mutating and
+// validating webhook configurations, so that the API server trusts the webhook
+// server.
+func InjectCABundle(ctx context.Context, kc kubernetes.Interface, caBundle []byte) error {
+	mutating := kc.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg, err := mutating.Get(ctx, ConfigurationName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range cfg.Webhooks {
+			cfg.Webhooks[i].ClientConfig.CABundle = caBundle
+		}
+		_, err = mutating.Update(ctx, cfg, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to inject CA bundle into mutating webhook configuration: %w", err)
+	}
+
+	validating := kc.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cfg, err := validating.Get(ctx, ConfigurationName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range cfg.Webhooks {
+			cfg.Webhooks[i].ClientConfig.CABundle = caBundle
+		}
+		_, err = validating.Update(ctx, cfg, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to inject CA bundle into validating webhook configuration: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestInjectCABundle(t *testing.T) {
+	testutil.Run(t, "inject", func(t *testutil.T) {
+		kc := kfake.NewSimpleClientset(MutatingWebhookConfiguration("etok"), ValidatingWebhookConfiguration("etok"))
+
+		require.NoError(t, InjectCABundle(context.Background(), kc, []byte("ca")))
+
+		mutating, err := kc.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), ConfigurationName, metav1.GetOptions{})
+		require.NoError(t, err)
+		for _, wh := range mutating.Webhooks {
+			assert.Equal(t, []byte("ca"), wh.ClientConfig.CABundle)
+		}
+
+		validating, err := kc.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), ConfigurationName, metav1.GetOptions{})
+		require.NoError(t, err)
+		for _, wh := range validating.Webhooks {
+			assert.Equal(t, []byte("ca"), wh.ClientConfig.CABundle)
+		}
+	})
+
+	testutil.Run(t, "configurations not installed", func(t *testutil.T) {
+		kc := kfake.NewSimpleClientset()
+
+		assert.Error(t, InjectCABundle(context.Background(), kc, []byte("ca")))
+	})
+}
@@ -0,0 +1,162 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/launcher"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// runDefaulter sets defaults on runs
+type runDefaulter struct {
+	decoder *admission.Decoder
+}
+
+func (d *runDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	run := &v1alpha1.Run{}
+	if err := d.decoder.Decode(req, run); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	defaultRun(run)
+
+	marshaled, err := json.Marshal(run)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (d *runDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func defaultRun(run *v1alpha1.Run) {
+	if run.ConfigMapKey == "" {
+		run.ConfigMapKey = v1alpha1.RunDefaultConfigMapKey
+	}
+	if run.HandshakeTimeout == "" {
+		run.HandshakeTimeout = v1alpha1.DefaultHandshakeTimeout.String()
+	}
+}
+
+// runValidator rejects invalid runs, including those that reference a
+// workspace that does not exist. Once created, only a run's cancellation can be
+// requested: any other change to its spec is rejected.
+type runValidator struct {
+	client.Client
+
+	decoder *admission.Decoder
+}
+
+func (v *runValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	run := &v1alpha1.Run{}
+	if err := v.decoder.Decode(req, run); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if req.Operation == admissionv1.Update {
+		old := &v1alpha1.Run{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if errs := validateRunUpdate(old, run); len(errs) > 0 {
+			return admission.Denied(errs.ToAggregate().Error())
+		}
+		return admission.Allowed("")
+	}
+
+	errs := validateRun(run)
+
+	// Check workspace exists
+	if run.Workspace != "" {
+		var ws v1alpha1.Workspace
+		if err := v.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: run.Workspace}, &ws); err != nil {
+			if !kerrors.IsNotFound(err) {
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			errs = append(errs, field.NotFound(field.NewPath("spec", "workspace"), fmt.Sprintf("%s/%s", req.Namespace, run.Workspace)))
+		}
+	}
+
+	if len(errs) > 0 {
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+	return admission.Allowed("")
+}
+
+func (v *runValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+func validateRun(run *v1alpha1.Run) (errs field.ErrorList) {
+	spec := field.NewPath("spec")
+
+	if !launcher.IsCommand(run.Command) {
+		errs = append(errs, field.NotSupported(spec.Child("command"), run.Command, nil))
+	}
+
+	if run.Workspace == "" {
+		errs = append(errs, field.Required(spec.Child("workspace"), ""))
+	}
+
+	if run.HandshakeTimeout != "" {
+		timeout, err := time.ParseDuration(run.HandshakeTimeout)
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(spec.Child("handshakeTimeout"), run.HandshakeTimeout, err.Error()))
+		case timeout <= 0:
+			errs = append(errs, field.Invalid(spec.Child("handshakeTimeout"), run.HandshakeTimeout, "must be greater than zero"))
+		}
+	}
+
+	retryPolicy := spec.Child("retryPolicy")
+	if run.RetryPolicy.PendingTimeout != "" {
+		timeout, err := time.ParseDuration(run.RetryPolicy.PendingTimeout)
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(retryPolicy.Child("pendingTimeout"), run.RetryPolicy.PendingTimeout, err.Error()))
+		case timeout <= 0:
+			errs = append(errs, field.Invalid(retryPolicy.Child("pendingTimeout"), run.RetryPolicy.PendingTimeout, "must be greater than zero"))
+		}
+	}
+	if run.Handshake && run.RetryPolicy.Limit > 0 {
+		// The client attached to the pod cannot attach to a replacement
+		errs = append(errs, field.Forbidden(retryPolicy.Child("limit"), "runs with a TTY cannot be retried"))
+	}
+
+	return errs
+}
+
+// validateRunUpdate permits only a request for cancellation, or its escalation
+// from interrupt to kill
+func validateRunUpdate(old, run *v1alpha1.Run) (errs field.ErrorList) {
+	spec := field.NewPath("spec")
+
+	oldSpec, newSpec := old.RunSpec.DeepCopy(), run.RunSpec.DeepCopy()
+	oldSpec.Cancel, newSpec.Cancel = "", ""
+	if !equality.Semantic.DeepEqual(oldSpec, newSpec) {
+		errs = append(errs, field.Forbidden(spec, "only spec.cancel may be updated"))
+	}
+
+	switch {
+	case old.Cancel == run.Cancel:
+	case old.Cancel == v1alpha1.RunCancelKill, old.Cancel == v1alpha1.RunCancelInterrupt && run.Cancel != v1alpha1.RunCancelKill:
+		errs = append(errs, field.Forbidden(spec.Child("cancel"), "cancellation cannot be withdrawn"))
+	}
+
+	return errs
+}
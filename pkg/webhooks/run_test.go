@@ -0,0 +1,215 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRunDefaulter(t *testing.T) {
+	tests := []struct {
+		name string
+		run  *v1alpha1.Run
+		// Wanted patches: path to value
+		patches map[string]interface{}
+	}{
+		{
+			name: "defaults",
+			run: testobj.Run("default", "run-12345", "plan", func(run *v1alpha1.Run) {
+				run.ConfigMapKey = ""
+				run.HandshakeTimeout = ""
+			}),
+			patches: map[string]interface{}{
+				"/spec/configMapKey":     v1alpha1.RunDefaultConfigMapKey,
+				"/spec/handshakeTimeout": "10s",
+			},
+		},
+		{
+			name: "preserve settings",
+			run: testobj.Run("default", "run-12345", "plan", func(run *v1alpha1.Run) {
+				run.HandshakeTimeout = "1m"
+			}),
+			patches: map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			resp := handle(t, &runDefaulter{}, tt.run)
+			require.True(t, resp.Allowed)
+
+			patches := make(map[string]interface{})
+			for _, p := range resp.Patches {
+				patches[p.Path] = p.Value
+			}
+			assert.Equal(t, tt.patches, patches)
+		})
+	}
+}
+
+func TestRunValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     *v1alpha1.Run
+		objs    []runtime.Object
+		allowed bool
+		reason  string
+	}{
+		{
+			name:    "valid",
+			run:     testobj.Run("default", "run-12345", "state rm", testobj.WithWorkspace("workspace-1")),
+			objs:    []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			allowed: true,
+		},
+		{
+			name:   "missing workspace",
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			reason: "spec.workspace: Not found: \"default/workspace-1\"",
+		},
+		{
+			name:   "workspace in different namespace",
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			objs:   []runtime.Object{testobj.Workspace("dev", "workspace-1")},
+			reason: "spec.workspace: Not found",
+		},
+		{
+			name:   "no workspace",
+			run:    testobj.Run("default", "run-12345", "plan"),
+			reason: "spec.workspace: Required value",
+		},
+		{
+			name:   "unknown command",
+			run:    testobj.Run("default", "run-12345", "plna", testobj.WithWorkspace("workspace-1")),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "spec.command",
+		},
+		{
+			name: "invalid handshake timeout",
+			run: testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), func(run *v1alpha1.Run) {
+				run.HandshakeTimeout = "10"
+			}),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "spec.handshakeTimeout",
+		},
+		{
+			name: "negative handshake timeout",
+			run: testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), func(run *v1alpha1.Run) {
+				run.HandshakeTimeout = "-10s"
+			}),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "must be greater than zero",
+		},
+		{
+			name:    "valid retry policy",
+			run:     testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(2, "5m")),
+			objs:    []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			allowed: true,
+		},
+		{
+			name:   "invalid pending timeout",
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(2, "5")),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "spec.retryPolicy.pendingTimeout",
+		},
+		{
+			name:   "negative pending timeout",
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(2, "-5m")),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "spec.retryPolicy.pendingTimeout",
+		},
+		{
+			name: "retries with tty",
+			run: testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithRetryPolicy(2, ""), func(run *v1alpha1.Run) {
+				run.Handshake = true
+			}),
+			objs:   []runtime.Object{testobj.Workspace("default", "workspace-1")},
+			reason: "spec.retryPolicy.limit",
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			validator := &runValidator{Client: fake.NewFakeClientWithScheme(scheme.Scheme, tt.objs...)}
+
+			resp := handle(t, validator, tt.run)
+			assert.Equal(t, tt.allowed, resp.Allowed)
+			if tt.reason != "" {
+				assert.Contains(t, string(resp.Result.Reason), tt.reason)
+			}
+		})
+	}
+}
+
+func TestRunValidatorUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     *v1alpha1.Run
+		run     *v1alpha1.Run
+		allowed bool
+		reason  string
+	}{
+		{
+			name:    "cancel",
+			old:     testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			run:     testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			allowed: true,
+		},
+		{
+			name:    "escalate cancellation",
+			old:     testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			run:     testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelKill)),
+			allowed: true,
+		},
+		{
+			name: "metadata",
+			old:  testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			run: testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), func(run *v1alpha1.Run) {
+				run.SetLabels(map[string]string{"app": "etok"})
+			}),
+			allowed: true,
+		},
+		{
+			name:   "withdraw cancellation",
+			old:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			reason: "spec.cancel: Forbidden",
+		},
+		{
+			name:   "downgrade cancellation",
+			old:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelKill)),
+			run:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt)),
+			reason: "spec.cancel: Forbidden",
+		},
+		{
+			name:   "change command",
+			old:    testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			run:    testobj.Run("default", "run-12345", "apply", testobj.WithWorkspace("workspace-1")),
+			reason: "only spec.cancel may be updated",
+		},
+		{
+			name: "change args alongside cancellation",
+			old:  testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1")),
+			run: testobj.Run("default", "run-12345", "plan", testobj.WithWorkspace("workspace-1"), testobj.WithCancel(v1alpha1.RunCancelInterrupt), func(run *v1alpha1.Run) {
+				run.Args = []string{"-destroy"}
+			}),
+			reason: "only spec.cancel may be updated",
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// The workspace need not exist for an update to be permitted
+			validator := &runValidator{Client: fake.NewFakeClientWithScheme(scheme.Scheme)}
+
+			resp := handleUpdate(t, validator, tt.old, tt.run)
+			assert.Equal(t, tt.allowed, resp.Allowed)
+			if tt.reason != "" {
+				assert.Contains(t, string(resp.Result.Reason), tt.reason)
+			}
+		})
+	}
+}
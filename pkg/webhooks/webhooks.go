@@ -0,0 +1,139 @@
+package webhooks
+
+import (
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+const (
+	// Name of both the mutating and validating webhook configurations
+	ConfigurationName = "etok"
+
+	// Name of the service fronting the operator's webhook server
+	ServiceName = "etok-webhook"
+
+	// Port on which the operator's webhook server listens
+	Port = 9443
+
+	DefaultWorkspacePath  = "/mutate-etok-dev-v1alpha1-workspace"
+	ValidateWorkspacePath = "/validate-etok-dev-v1alpha1-workspace"
+	DefaultRunPath        = "/mutate-etok-dev-v1alpha1-run"
+	ValidateRunPath       = "/validate-etok-dev-v1alpha1-run"
+)
+
+// Inject CA bundle into webhook configurations
+// +kubebuilder:rbac:groups="admissionregistration.k8s.io",resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;update
+
+// Register registers the admission webhooks with the webhook server. The
+// client is used to look up the workspaces referenced by runs.
+func Register(srv *webhook.Server, c client.Client) {
+	srv.Register(DefaultWorkspacePath, &webhook.Admission{Handler: &workspaceDefaulter{}})
+	srv.Register(ValidateWorkspacePath, &webhook.Admission{Handler: &workspaceValidator{Client: c}})
+	srv.Register(DefaultRunPath, &webhook.Admission{Handler: &runDefaulter{}})
+	srv.Register(ValidateRunPath, &webhook.Admission{Handler: &runValidator{Client: c}})
+}
+
+// MutatingWebhookConfiguration constructs the configuration registering the
+// defaulting webhooks with the API server. The CA bundle is injected by the
+// operator upon startup.
+func MutatingWebhookConfiguration(namespace string) *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "MutatingWebhookConfiguration",
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:                    "default.workspaces.etok.dev",
+				ClientConfig:            clientConfig(namespace, DefaultWorkspacePath),
+				Rules:                   rules("workspaces", admissionregistrationv1.Create, admissionregistrationv1.Update),
+				FailurePolicy:           failurePolicy(),
+				SideEffects:             sideEffects(),
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+			{
+				Name:                    "default.runs.etok.dev",
+				ClientConfig:            clientConfig(namespace, DefaultRunPath),
+				Rules:                   rules("runs", admissionregistrationv1.Create),
+				FailurePolicy:           failurePolicy(),
+				SideEffects:             sideEffects(),
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+}
+
+// ValidatingWebhookConfiguration constructs the configuration registering the
+// validating webhooks with the API server. The CA bundle is injected by the
+// operator upon startup.
+func ValidatingWebhookConfiguration(namespace string) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ValidatingWebhookConfiguration",
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ConfigurationName,
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name:                    "validate.workspaces.etok.dev",
+				ClientConfig:            clientConfig(namespace, ValidateWorkspacePath),
+				Rules:                   rules("workspaces", admissionregistrationv1.Create, admissionregistrationv1.Update),
+				FailurePolicy:           failurePolicy(),
+				SideEffects:             sideEffects(),
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+			{
+				Name:                    "validate.runs.etok.dev",
+				ClientConfig:            clientConfig(namespace, ValidateRunPath),
+				Rules:                   rules("runs", admissionregistrationv1.Create, admissionregistrationv1.Update),
+				FailurePolicy:           failurePolicy(),
+				SideEffects:             sideEffects(),
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+}
+
+func clientConfig(namespace, path string) admissionregistrationv1.WebhookClientConfig {
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Namespace: namespace,
+			Name:      ServiceName,
+			Path:      &path,
+		},
+	}
+}
+
+func rules(resource string, ops ...admissionregistrationv1.OperationType) []admissionregistrationv1.RuleWithOperations {
+	return []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: ops,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{v1alpha1.SchemeGroupVersion.Group},
+				APIVersions: []string{v1alpha1.SchemeGroupVersion.Version},
+				Resources:   []string{resource},
+			},
+		},
+	}
+}
+
+// failurePolicy returns the policy for when the operator's webhook server is
+// unavailable. Requests are permitted rather than rejected, lest an unavailable
+// operator prevent the updates needed to recover, such as removing finalizers.
+func failurePolicy() *admissionregistrationv1.FailurePolicyType {
+	policy := admissionregistrationv1.Ignore
+	return &policy
+}
+
+func sideEffects() *admissionregistrationv1.SideEffectClass {
+	class := admissionregistrationv1.SideEffectClassNone
+	return &class
+}
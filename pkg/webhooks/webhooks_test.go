@@ -0,0 +1,19 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	// An unavailable operator must not prevent workspaces and runs from being
+	// updated, e.g. to remove finalizers
+	for _, wh := range MutatingWebhookConfiguration("etok").Webhooks {
+		assert.Equal(t, admissionregistrationv1.Ignore, *wh.FailurePolicy, wh.Name)
+	}
+	for _, wh := range ValidatingWebhookConfiguration("etok").Webhooks {
+		assert.Equal(t, admissionregistrationv1.Ignore, *wh.FailurePolicy, wh.Name)
+	}
+}
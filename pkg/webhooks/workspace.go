@@ -0,0 +1,344 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/cmd/launcher"
+	"github.com/leg100/etok/pkg/labels"
+	"github.com/leg100/etok/pkg/util/slice"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Name of the service account shared by the workspaces in a namespace, which
+// the operator creates in each namespace
+const defaultServiceAccountName = "etok"
+
+var (
+	// Terraform versions are semantic versions without a 'v' prefix, optionally
+	// with a pre-release and build metadata, e.g. 1.0.0-rc1
+	semverRegex = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+		`(-(0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*)(\.(0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*))*)?` +
+		`(\+[0-9a-zA-Z-]+(\.[0-9a-zA-Z-]+)*)?$`)
+
+	// Valid terraform variable names
+	variableNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+)
+
+// workspaceDefaulter sets defaults on workspaces
+type workspaceDefaulter struct {
+	decoder *admission.Decoder
+}
+
+func (d *workspaceDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ws := &v1alpha1.Workspace{}
+	if err := d.decoder.Decode(req, ws); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if req.Operation == admissionv1.Update {
+		old := &v1alpha1.Workspace{}
+		if err := d.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// Retain existing settings rather than defaulting them, lest a
+		// default trigger a disruptive change such as re-installing terraform
+		retainWorkspaceSettings(ws, old)
+	}
+
+	defaultWorkspace(ws)
+
+	marshaled, err := json.Marshal(ws)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (d *workspaceDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func defaultWorkspace(ws *v1alpha1.Workspace) {
+	// Permit versions to be specified with a 'v' prefix
+	ws.Spec.TerraformVersion = strings.TrimPrefix(ws.Spec.TerraformVersion, "v")
+
+	if ws.Spec.TerraformVersion == "" {
+		ws.Spec.TerraformVersion = v1alpha1.DefaultTerraformVersion
+	}
+	if ws.Spec.Cache.Size == "" {
+		ws.Spec.Cache.Size = v1alpha1.DefaultCacheSize
+	}
+	if ws.Spec.Cache.Mode == "" {
+		ws.Spec.Cache.Mode = v1alpha1.CacheModePinned
+	}
+	if ws.Spec.StateBackend == "" {
+		ws.Spec.StateBackend = v1alpha1.StateBackendKubernetes
+	}
+	for i := range ws.Spec.CredentialSecrets {
+		if ws.Spec.CredentialSecrets[i].Type == "" {
+			ws.Spec.CredentialSecrets[i].Type = v1alpha1.CredentialSecretTypeEnv
+		}
+	}
+}
+
+// retainWorkspaceSettings sets unset settings of an updated workspace to their
+// existing values
+func retainWorkspaceSettings(ws, old *v1alpha1.Workspace) {
+	if ws.Spec.TerraformVersion == "" {
+		ws.Spec.TerraformVersion = old.Spec.TerraformVersion
+	}
+	if ws.Spec.Cache.Size == "" {
+		ws.Spec.Cache.Size = old.Spec.Cache.Size
+	}
+	if ws.Spec.Cache.Mode == "" {
+		ws.Spec.Cache.Mode = old.Spec.Cache.Mode
+	}
+	if ws.Spec.StateBackend == "" {
+		ws.Spec.StateBackend = old.Spec.StateBackend
+	}
+}
+
+// workspaceValidator rejects invalid workspaces
+type workspaceValidator struct {
+	client.Client
+
+	decoder *admission.Decoder
+}
+
+func (v *workspaceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ws := &v1alpha1.Workspace{}
+	if err := v.decoder.Decode(req, ws); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Retrieve the workspace's dedicated service account, if it exists
+	var sa *corev1.ServiceAccount
+	if ws.Spec.ServiceAccountName != "" && ws.Spec.ServiceAccountName != defaultServiceAccountName {
+		sa = &corev1.ServiceAccount{}
+		if err := v.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: ws.Spec.ServiceAccountName}, sa); err != nil {
+			if !kerrors.IsNotFound(err) {
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			sa = nil
+		}
+	}
+
+	if errs := validateWorkspace(ws, sa); len(errs) > 0 {
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+	return admission.Allowed("")
+}
+
+func (v *workspaceValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+// validateWorkspace validates the workspace. The workspace's dedicated service
+// account is nil if it doesn't exist.
+func validateWorkspace(ws *v1alpha1.Workspace, sa *corev1.ServiceAccount) (errs field.ErrorList) {
+	spec := field.NewPath("spec")
+
+	if !semverRegex.MatchString(ws.Spec.TerraformVersion) {
+		errs = append(errs, field.Invalid(spec.Child("terraformVersion"), ws.Spec.TerraformVersion, "must be a semantic version, e.g. 0.14.3"))
+	}
+
+	errs = append(errs, validateCache(spec.Child("cache"), &ws.Spec.Cache)...)
+
+	for i, cmd := range ws.Spec.PrivilegedCommands {
+		if !launcher.IsCommand(cmd) {
+			errs = append(errs, field.NotSupported(spec.Child("privilegedCommands").Index(i), cmd, nil))
+		}
+	}
+
+	errs = append(errs, validateVariables(spec.Child("variables"), ws.Spec.Variables)...)
+
+	errs = append(errs, validateServiceAccount(spec, ws, sa)...)
+
+	errs = append(errs, validateCredentialSecrets(spec.Child("credentialSecrets"), ws.Spec.CredentialSecrets)...)
+
+	switch ws.Spec.StateBackend {
+	case v1alpha1.StateBackendKubernetes, v1alpha1.StateBackendHTTP:
+	default:
+		errs = append(errs, field.NotSupported(spec.Child("stateBackend"), ws.Spec.StateBackend, []string{string(v1alpha1.StateBackendKubernetes), string(v1alpha1.StateBackendHTTP)}))
+	}
+
+	return errs
+}
+
+func validateCache(path *field.Path, cache *v1alpha1.WorkspaceCacheSpec) (errs field.ErrorList) {
+	size, err := resource.ParseQuantity(cache.Size)
+	switch {
+	case err != nil:
+		errs = append(errs, field.Invalid(path.Child("size"), cache.Size, err.Error()))
+	case size.Sign() <= 0:
+		errs = append(errs, field.Invalid(path.Child("size"), cache.Size, "must be greater than zero"))
+	}
+
+	if cache.IdleTimeout != "" {
+		timeout, err := time.ParseDuration(cache.IdleTimeout)
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(path.Child("idleTimeout"), cache.IdleTimeout, err.Error()))
+		case timeout <= 0:
+			errs = append(errs, field.Invalid(path.Child("idleTimeout"), cache.IdleTimeout, "must be greater than zero"))
+		}
+	}
+
+	return errs
+}
+
+func validateServiceAccount(path *field.Path, ws *v1alpha1.Workspace, sa *corev1.ServiceAccount) (errs field.ErrorList) {
+	spec := &ws.Spec
+
+	if spec.ServiceAccountName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(spec.ServiceAccountName) {
+			errs = append(errs, field.Invalid(path.Child("serviceAccountName"), spec.ServiceAccountName, msg))
+		}
+	}
+
+	// An existing service account is only granted permissions for runs if it
+	// was created by the operator for the workspace, or labelled for the
+	// workspace, lest the workspace take on the identity of any service
+	// account in the namespace
+	if sa != nil && !serviceAccountForWorkspace(sa, ws) {
+		errs = append(errs, field.Forbidden(path.Child("serviceAccountName"), fmt.Sprintf("service account %s exists but was neither created for the workspace nor labelled %s=%s", sa.Name, labels.Workspace(ws.Name).Name, ws.Name)))
+	}
+
+	if len(spec.ServiceAccountAnnotations) > 0 {
+		if spec.ServiceAccountName == "" {
+			errs = append(errs, field.Forbidden(path.Child("serviceAccountAnnotations"), "requires serviceAccountName to be set"))
+		}
+		errs = append(errs, apivalidation.ValidateAnnotations(spec.ServiceAccountAnnotations, path.Child("serviceAccountAnnotations"))...)
+	}
+
+	return errs
+}
+
+// serviceAccountForWorkspace determines whether the service account was
+// created by the operator for the workspace or is labelled for the workspace
+func serviceAccountForWorkspace(sa *corev1.ServiceAccount, ws *v1alpha1.Workspace) bool {
+	if sa.Labels[labels.Workspace(ws.Name).Name] == ws.Name {
+		return true
+	}
+	// The workspace has no UID upon creation, so match owner by name
+	for _, ref := range sa.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller && ref.Kind == "Workspace" && ref.Name == ws.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateCredentialSecrets(path *field.Path, secrets []v1alpha1.CredentialSecret) (errs field.ErrorList) {
+	// Keep track of names and mount paths to detect duplicates
+	names := make(map[string]bool)
+	mountPaths := make(map[string]bool)
+
+	for i, cs := range secrets {
+		namePath := path.Index(i).Child("name")
+		if cs.Name == "" {
+			errs = append(errs, field.Required(namePath, ""))
+		}
+		for _, msg := range validation.IsDNS1123Subdomain(cs.Name) {
+			errs = append(errs, field.Invalid(namePath, cs.Name, msg))
+		}
+		if names[cs.Name] {
+			errs = append(errs, field.Duplicate(namePath, cs.Name))
+		}
+		names[cs.Name] = true
+
+		switch cs.Type {
+		case v1alpha1.CredentialSecretTypeEnv:
+			if cs.MountPath != "" {
+				errs = append(errs, field.Forbidden(path.Index(i).Child("mountPath"), "only applies to the file type"))
+			}
+			if len(cs.Items) > 0 {
+				errs = append(errs, field.Forbidden(path.Index(i).Child("items"), "only applies to the file type"))
+			}
+		case v1alpha1.CredentialSecretTypeFile:
+			mountPath := cs.MountPath
+			if mountPath == "" {
+				mountPath = filepath.Join("/credentials", cs.Name)
+			} else if !filepath.IsAbs(mountPath) {
+				errs = append(errs, field.Invalid(path.Index(i).Child("mountPath"), cs.MountPath, "must be an absolute path"))
+			}
+			if mountPaths[mountPath] {
+				errs = append(errs, field.Duplicate(path.Index(i).Child("mountPath"), mountPath))
+			}
+			mountPaths[mountPath] = true
+
+			for j, item := range cs.Items {
+				itemPath := path.Index(i).Child("items").Index(j)
+				for _, msg := range validation.IsConfigMapKey(item.Key) {
+					errs = append(errs, field.Invalid(itemPath.Child("key"), item.Key, msg))
+				}
+				if item.Path == "" || filepath.IsAbs(item.Path) || slice.ContainsString(strings.Split(item.Path, "/"), "..") {
+					errs = append(errs, field.Invalid(itemPath.Child("path"), item.Path, "must be a relative path that does not contain '..'"))
+				}
+			}
+		default:
+			errs = append(errs, field.NotSupported(path.Index(i).Child("type"), cs.Type, []string{string(v1alpha1.CredentialSecretTypeEnv), string(v1alpha1.CredentialSecretTypeFile)}))
+		}
+	}
+
+	return errs
+}
+
+func validateVariables(path *field.Path, variables []*v1alpha1.Variable) (errs field.ErrorList) {
+	// Keep track of names of both terraform and environment variables to
+	// detect duplicates
+	terraformVars := make(map[string]bool)
+	environmentVars := make(map[string]bool)
+
+	for i, v := range variables {
+		if v == nil {
+			errs = append(errs, field.Required(path.Index(i), "must not be null"))
+			continue
+		}
+
+		keyPath := path.Index(i).Child("key")
+
+		if v.EnvironmentVariable {
+			for _, msg := range validation.IsEnvVarName(v.Key) {
+				errs = append(errs, field.Invalid(keyPath, v.Key, msg))
+			}
+			if environmentVars[v.Key] {
+				errs = append(errs, field.Duplicate(keyPath, v.Key))
+			}
+			environmentVars[v.Key] = true
+		} else {
+			if !variableNameRegex.MatchString(v.Key) {
+				errs = append(errs, field.Invalid(keyPath, v.Key, "must start with a letter or underscore and only contain letters, digits, underscores and dashes"))
+			}
+			if terraformVars[v.Key] {
+				errs = append(errs, field.Duplicate(keyPath, v.Key))
+			}
+			terraformVars[v.Key] = true
+		}
+
+		if v.Value != "" && v.ValueFrom != nil {
+			errs = append(errs, field.Invalid(path.Index(i).Child("valueFrom"), "", "cannot be specified along with a value"))
+		}
+	}
+
+	return errs
+}
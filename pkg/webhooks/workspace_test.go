@@ -0,0 +1,346 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/leg100/etok/api/etok.dev/v1alpha1"
+	"github.com/leg100/etok/pkg/scheme"
+	"github.com/leg100/etok/pkg/testobj"
+	"github.com/leg100/etok/pkg/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestWorkspaceDefaulter(t *testing.T) {
+	tests := []struct {
+		name string
+		ws   *v1alpha1.Workspace
+		// Existing workspace, if the workspace is being updated
+		old *v1alpha1.Workspace
+		// Wanted patches: path to value
+		patches map[string]interface{}
+	}{
+		{
+			name: "defaults",
+			ws: testobj.Workspace("default", "foo", func(ws *v1alpha1.Workspace) {
+				ws.Spec = v1alpha1.WorkspaceSpec{}
+			}),
+			patches: map[string]interface{}{
+				"/spec/terraformVersion": v1alpha1.DefaultTerraformVersion,
+				"/spec/cache/size":       v1alpha1.DefaultCacheSize,
+				"/spec/cache/mode":       string(v1alpha1.CacheModePinned),
+				"/spec/stateBackend":     string(v1alpha1.StateBackendKubernetes),
+			},
+		},
+		{
+			name: "strip version prefix",
+			ws:   testobj.Workspace("default", "foo", testobj.WithTerraformVersion("v0.13.5"), testobj.WithCacheMode(v1alpha1.CacheModePinned), testobj.WithStateBackend(v1alpha1.StateBackendKubernetes)),
+			patches: map[string]interface{}{
+				"/spec/terraformVersion": "0.13.5",
+			},
+		},
+		{
+			name: "default credential secret type",
+			ws:   testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.13.5"), testobj.WithCacheMode(v1alpha1.CacheModePinned), testobj.WithStateBackend(v1alpha1.StateBackendKubernetes), testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp"})),
+			patches: map[string]interface{}{
+				"/spec/credentialSecrets/0/type": string(v1alpha1.CredentialSecretTypeEnv),
+			},
+		},
+		{
+			name: "retain existing settings upon update",
+			ws: testobj.Workspace("default", "foo", func(ws *v1alpha1.Workspace) {
+				ws.Spec = v1alpha1.WorkspaceSpec{}
+			}),
+			old: testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.13.5"), testobj.WithCacheMode(v1alpha1.CacheModeShared), testobj.WithCacheSize("5Gi"), testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			patches: map[string]interface{}{
+				"/spec/terraformVersion": "0.13.5",
+				"/spec/cache/size":       "5Gi",
+				"/spec/cache/mode":       string(v1alpha1.CacheModeShared),
+				"/spec/stateBackend":     string(v1alpha1.StateBackendHTTP),
+			},
+		},
+		{
+			name:    "preserve settings",
+			ws:      testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.13.5"), testobj.WithCacheMode(v1alpha1.CacheModeShared), testobj.WithCacheSize("5Gi"), testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			patches: map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			var resp admission.Response
+			if tt.old != nil {
+				resp = handleUpdate(t, &workspaceDefaulter{}, tt.old, tt.ws)
+			} else {
+				resp = handle(t, &workspaceDefaulter{}, tt.ws)
+			}
+			require.True(t, resp.Allowed)
+
+			patches := make(map[string]interface{})
+			for _, p := range resp.Patches {
+				patches[p.Path] = p.Value
+			}
+			assert.Equal(t, tt.patches, patches)
+		})
+	}
+}
+
+func TestWorkspaceValidator(t *testing.T) {
+	controller := true
+
+	tests := []struct {
+		name    string
+		ws      *v1alpha1.Workspace
+		objs    []runtime.Object
+		allowed bool
+		reason  string
+	}{
+		{
+			name:    "valid",
+			ws:      testobj.Workspace("default", "foo", testobj.WithPrivilegedCommands("apply", "state rm"), testobj.WithIdleTimeout("30m")),
+			allowed: true,
+		},
+		{
+			name:   "invalid size",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCacheSize("1Gb")),
+			reason: "spec.cache.size",
+		},
+		{
+			name:   "zero size",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCacheSize("0")),
+			reason: "must be greater than zero",
+		},
+		{
+			name:   "invalid version",
+			ws:     testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.14")),
+			reason: "spec.terraformVersion",
+		},
+		{
+			name:    "pre-release version",
+			ws:      testobj.Workspace("default", "foo", testobj.WithTerraformVersion("1.0.0-rc1")),
+			allowed: true,
+		},
+		{
+			name:    "pre-release version with build metadata",
+			ws:      testobj.Workspace("default", "foo", testobj.WithTerraformVersion("0.15.0-beta2+build.1")),
+			allowed: true,
+		},
+		{
+			name:   "invalid pre-release version",
+			ws:     testobj.Workspace("default", "foo", testobj.WithTerraformVersion("1.0.0-")),
+			reason: "spec.terraformVersion",
+		},
+		{
+			name:   "unknown privileged command",
+			ws:     testobj.Workspace("default", "foo", testobj.WithPrivilegedCommands("apply", "aply")),
+			reason: "spec.privilegedCommands[1]",
+		},
+		{
+			name:   "invalid idle timeout",
+			ws:     testobj.Workspace("default", "foo", testobj.WithIdleTimeout("30")),
+			reason: "spec.cache.idleTimeout",
+		},
+		{
+			name:    "valid variables",
+			ws:      testobj.Workspace("default", "foo", testobj.WithVariables("foo", "bar"), testobj.WithEnvironmentVariables("TF_LOG", "DEBUG")),
+			allowed: true,
+		},
+		{
+			name:   "invalid variable name",
+			ws:     testobj.Workspace("default", "foo", testobj.WithVariables("1foo", "bar")),
+			reason: "spec.variables[0].key",
+		},
+		{
+			name: "null variable",
+			ws: testobj.Workspace("default", "foo", testobj.WithVariables("foo", "bar"), func(ws *v1alpha1.Workspace) {
+				ws.Spec.Variables = append(ws.Spec.Variables, nil)
+			}),
+			reason: "spec.variables[1]",
+		},
+		{
+			name:   "invalid environment variable name",
+			ws:     testobj.Workspace("default", "foo", testobj.WithEnvironmentVariables("TF=LOG", "DEBUG")),
+			reason: "spec.variables[0].key",
+		},
+		{
+			name:    "valid service account",
+			ws:      testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform", "iam.gke.io/gcp-service-account", "prod@my-project.iam.gserviceaccount.com")),
+			allowed: true,
+		},
+		{
+			name: "existing service account not for workspace",
+			ws:   testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "terraform"}},
+			},
+			reason: "service account terraform exists but was neither created for the workspace nor labelled workspace=foo",
+		},
+		{
+			name: "existing service account labelled for another workspace",
+			ws:   testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "terraform", Labels: map[string]string{"workspace": "bar"}}},
+			},
+			reason: "neither created for the workspace",
+		},
+		{
+			name: "existing service account labelled for workspace",
+			ws:   testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "terraform", Labels: map[string]string{"workspace": "foo"}}},
+			},
+			allowed: true,
+		},
+		{
+			name: "existing service account created for workspace",
+			ws:   testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "terraform", OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "etok.dev/v1alpha1", Kind: "Workspace", Name: "foo", Controller: &controller},
+				}}},
+			},
+			allowed: true,
+		},
+		{
+			name: "namespace service account",
+			ws:   testobj.Workspace("default", "foo", testobj.WithServiceAccount("etok")),
+			objs: []runtime.Object{
+				&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "etok"}},
+			},
+			allowed: true,
+		},
+		{
+			name:   "invalid service account name",
+			ws:     testobj.Workspace("default", "foo", testobj.WithServiceAccount("Terraform")),
+			reason: "spec.serviceAccountName",
+		},
+		{
+			name: "service account annotations without name",
+			ws: testobj.Workspace("default", "foo", func(ws *v1alpha1.Workspace) {
+				ws.Spec.ServiceAccountAnnotations = map[string]string{"foo": "bar"}
+			}),
+			reason: "spec.serviceAccountAnnotations: Forbidden",
+		},
+		{
+			name:   "invalid service account annotation",
+			ws:     testobj.Workspace("default", "foo", testobj.WithServiceAccount("terraform", "foo/bar/baz", "qux")),
+			reason: "spec.serviceAccountAnnotations",
+		},
+		{
+			name: "valid credential secrets",
+			ws: testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(
+				v1alpha1.CredentialSecret{Name: "aws"},
+				v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "/etc/gcp", Items: []corev1.KeyToPath{{Key: "key.json", Path: "credentials.json"}}},
+				v1alpha1.CredentialSecret{Name: "ssh", Type: v1alpha1.CredentialSecretTypeFile},
+			)),
+			allowed: true,
+		},
+		{
+			name:   "duplicate credential secret",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp"}, v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile})),
+			reason: "spec.credentialSecrets[1].name: Duplicate value",
+		},
+		{
+			name:   "mount path for env credential secret",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp", MountPath: "/etc/gcp"})),
+			reason: "spec.credentialSecrets[0].mountPath: Forbidden",
+		},
+		{
+			name:   "relative credential secret mount path",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "etc/gcp"})),
+			reason: "spec.credentialSecrets[0].mountPath",
+		},
+		{
+			name: "duplicate credential secret mount path",
+			ws: testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(
+				v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile, MountPath: "/credentials/ssh"},
+				v1alpha1.CredentialSecret{Name: "ssh", Type: v1alpha1.CredentialSecretTypeFile},
+			)),
+			reason: "spec.credentialSecrets[1].mountPath: Duplicate value",
+		},
+		{
+			name:   "credential secret item path escapes mount path",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp", Type: v1alpha1.CredentialSecretTypeFile, Items: []corev1.KeyToPath{{Key: "key.json", Path: "../key.json"}}})),
+			reason: "spec.credentialSecrets[0].items[0].path",
+		},
+		{
+			name:   "unsupported credential secret type",
+			ws:     testobj.Workspace("default", "foo", testobj.WithCredentialSecrets(v1alpha1.CredentialSecret{Name: "gcp", Type: "volume"})),
+			reason: "spec.credentialSecrets[0].type: Unsupported value",
+		},
+		{
+			name:    "http state backend",
+			ws:      testobj.Workspace("default", "foo", testobj.WithStateBackend(v1alpha1.StateBackendHTTP)),
+			allowed: true,
+		},
+		{
+			name:   "unsupported state backend",
+			ws:     testobj.Workspace("default", "foo", testobj.WithStateBackend("s3")),
+			reason: "spec.stateBackend: Unsupported value",
+		},
+		{
+			name:   "duplicate variable",
+			ws:     testobj.Workspace("default", "foo", testobj.WithVariables("foo", "bar", "foo", "baz")),
+			reason: "Duplicate value",
+		},
+	}
+	for _, tt := range tests {
+		testutil.Run(t, tt.name, func(t *testutil.T) {
+			// Mutating webhooks are invoked before validating webhooks
+			defaultWorkspace(tt.ws)
+
+			validator := &workspaceValidator{Client: fake.NewFakeClientWithScheme(scheme.Scheme, tt.objs...)}
+
+			resp := handle(t, validator, tt.ws)
+			assert.Equal(t, tt.allowed, resp.Allowed)
+			if tt.reason != "" {
+				assert.Contains(t, string(resp.Result.Reason), tt.reason)
+			}
+		})
+	}
+}
+
+// handle invokes an admission handler with a request for the creation of the
+// given object
+func handle(t *testutil.T, handler admission.Handler, obj runtime.Object) admission.Response {
+	return handleRequest(t, handler, admissionv1.Create, nil, obj)
+}
+
+// handleUpdate invokes an admission handler with a request for the update of
+// the old object to the given object
+func handleUpdate(t *testutil.T, handler admission.Handler, old, obj runtime.Object) admission.Response {
+	return handleRequest(t, handler, admissionv1.Update, old, obj)
+}
+
+func handleRequest(t *testutil.T, handler admission.Handler, op admissionv1.Operation, old, obj runtime.Object) admission.Response {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	require.NoError(t, err)
+	_, err = admission.InjectDecoderInto(decoder, handler)
+	require.NoError(t, err)
+
+	raw, err := json.Marshal(obj)
+	require.NoError(t, err)
+
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+
+	if old != nil {
+		oldRaw, err := json.Marshal(old)
+		require.NoError(t, err)
+		req.OldObject = runtime.RawExtension{Raw: oldRaw}
+	}
+
+	return handler.Handle(context.Background(), req)
+}